@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"os"
+	"strings"
+	"testing"
+)
+
+// writeAnimatedGIF writes a GIF whose first frame is red and second blue
+func writeAnimatedGIF(t *testing.T, s *Server, name string) string {
+	t.Helper()
+	anim := &gif.GIF{}
+	for _, c := range []color.Color{color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}} {
+		frame := image.NewPaletted(image.Rect(0, 0, 16, 16), palette.Plan9)
+		for i := range frame.Pix {
+			frame.Pix[i] = uint8(color.Palette(palette.Plan9).Index(c))
+		}
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+	return writeTestFile(t, s, name, buf.Bytes())
+}
+
+func TestVipsThumbnailsFirstFrameOfAnimations(t *testing.T) {
+	s := newTestServer(t)
+	s.nativeThumbnails = false
+	argsLog := fakeVips(t)
+
+	for _, name := range []string{"anim.gif", "anim.webp", "ANIM.WEBP", "still.png"} {
+		// The fake doesn't read the input, any bytes will do
+		imagePath := writeTestFile(t, s, name, []byte("image"))
+		if err := s.generateThumbnail(t.Context(), imagePath, defaultThumbnailVariant()); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+
+	data, err := os.ReadFile(argsLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var inputs []string
+	for _, run := range strings.Split(strings.TrimSuffix(string(data), "--\n"), "--\n") {
+		inputs = append(inputs, strings.SplitN(run, "\n", 2)[0])
+	}
+	want := []string{"stdin[page=0,n=1]", "stdin[page=0,n=1]", "stdin[page=0,n=1]", "stdin"}
+	if strings.Join(inputs, " ") != strings.Join(want, " ") {
+		t.Errorf("vipsthumbnail inputs %q, want %q", inputs, want)
+	}
+}
+
+func TestNativeThumbnailsFirstFrameOfAnimations(t *testing.T) {
+	s := newTestServer(t)
+	imagePath := writeAnimatedGIF(t, s, "anim.gif")
+	if err := s.generateThumbnail(t.Context(), imagePath, defaultThumbnailVariant()); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(s.thumbnailPathFor(imagePath, defaultThumbnailVariant()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	thumb, err := jpeg.Decode(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := thumb.Bounds()
+	r, g, bl, _ := thumb.At(b.Min.X+b.Dx()/2, b.Min.Y+b.Dy()/2).RGBA()
+	if r>>8 < 200 || g>>8 > 60 || bl>>8 > 60 {
+		t.Errorf("thumbnail is %d,%d,%d, want the red first frame", r>>8, g>>8, bl>>8)
+	}
+}
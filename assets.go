@@ -0,0 +1,22 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// uiFiles are the page template and the assets it loads, built into the
+// binary so it runs from any directory. -templates-dir overrides the
+// template without a rebuild.
+//
+//go:embed templates/index.html static
+var uiFiles embed.FS
+
+// assetsFS is what /assets/ serves: the static directory of uiFiles
+var assetsFS = func() fs.FS {
+	sub, err := fs.Sub(uiFiles, "static")
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}()
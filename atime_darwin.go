@@ -0,0 +1,16 @@
+package main
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// fileAccessTime returns when a file was last read, as far as the
+// filesystem records it
+func fileAccessTime(info fs.FileInfo) time.Time {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(stat.Atimespec.Unix())
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"io/fs"
+	"time"
+)
+
+// fileAccessTime falls back to the modification time where the access time
+// isn't read, so eviction removes the oldest files first
+func fileAccessTime(info fs.FileInfo) time.Time {
+	return info.ModTime()
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// authCookieName remembers a valid token, so images and movies loaded
+	// by the page authenticate without ?token= in every URL
+	authCookieName = "gallery_token"
+	authCookieAge  = 30 * 24 * time.Hour
+	authRealm      = "gallery"
+)
+
+// authConfig is the access control set up with -auth-user, -auth-pass,
+// -htpasswd and -auth-token. Any kind of credential is accepted when
+// several are set.
+type authConfig struct {
+	user         string
+	pass         string
+	htpasswd     *htpasswdFile
+	token        string
+	exemptAssets bool // serve /assets/ without credentials, for a login page
+}
+
+// maxVerifiedLogins bounds the logins an htpasswdFile remembers as checked
+const maxVerifiedLogins = 1000
+
+// htpasswdFile holds the users of -htpasswd and their bcrypt hashes. bcrypt
+// is slow by design, so a login that matched is remembered, by a hash of
+// it, and the thumbnails a page loads aren't each checked again.
+type htpasswdFile struct {
+	users map[string][]byte // user name -> bcrypt hash
+	decoy []byte            // checked for unknown users, so they take as long
+
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]bool
+}
+
+// loadHtpasswd reads an htpasswd file of user:hash lines. Only bcrypt
+// hashes, as written by htpasswd -B, are taken; the older formats are
+// unsalted or weak.
+func loadHtpasswd(path string) (*htpasswdFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	file := &htpasswdFile{users: make(map[string][]byte), verified: make(map[[sha256.Size]byte]bool)}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", path, i+1)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s:%d: password of %q isn't a bcrypt hash, set it with htpasswd -B", path, i+1, user)
+		}
+		file.users[user] = []byte(hash)
+		file.decoy = []byte(hash)
+	}
+	if len(file.users) == 0 {
+		return nil, fmt.Errorf("%s: no users", path)
+	}
+	return file, nil
+}
+
+// check reports whether user and pass are one of the logins of the file
+func (f *htpasswdFile) check(user, pass string) bool {
+	login := sha256.Sum256([]byte(user + "\x00" + pass))
+	f.mu.Lock()
+	verified := f.verified[login]
+	f.mu.Unlock()
+	if verified {
+		return true
+	}
+
+	hash, known := f.users[user]
+	if !known {
+		hash = f.decoy
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(pass)) != nil || !known {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.verified) >= maxVerifiedLogins {
+		clear(f.verified)
+	}
+	f.verified[login] = true
+	return true
+}
+
+// authExempt are paths served without credentials, so health checks and
+// metrics scrapers work
+var authExempt = map[string]bool{
+	"/healthz": true,
+	"/metrics": true,
+}
+
+// secretEqual compares a credential in constant time. Both sides are hashed
+// first, so not even the length of the secret leaks.
+func secretEqual(given, want string) bool {
+	a, b := sha256.Sum256([]byte(given)), sha256.Sum256([]byte(want))
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
+
+// tokenCookieValue is what the auth cookie holds: a hash of the token rather
+// than the token itself, so a leaked cookie doesn't reveal the sharing link
+func tokenCookieValue(token string) string {
+	sum := sha256.Sum256([]byte("gallery-token:" + token))
+	return hex.EncodeToString(sum[:])
+}
+
+// requireAuth wraps a handler so that only requests with valid credentials
+// reach it. The token is taken from an "Authorization: Bearer" header, a
+// ?token= parameter or the cookie set after the first request that carried
+// it; others get 401 Unauthorized.
+func (s *Server) requireAuth(next http.Handler, auth authConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authExempt[r.URL.Path] || (auth.exemptAssets && strings.HasPrefix(r.URL.Path, "/assets/")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if auth.user != "" {
+			if user, pass, ok := r.BasicAuth(); ok && secretEqual(user, auth.user) && secretEqual(pass, auth.pass) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		if auth.htpasswd != nil {
+			if user, pass, ok := r.BasicAuth(); ok && auth.htpasswd.check(user, pass) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		if auth.token != "" {
+			if cookie, err := r.Cookie(authCookieName); err == nil && secretEqual(cookie.Value, tokenCookieValue(auth.token)) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			token := r.URL.Query().Get("token")
+			if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+				token = bearer
+			}
+			if token != "" && secretEqual(token, auth.token) {
+				http.SetCookie(w, &http.Cookie{
+					Name:     authCookieName,
+					Value:    tokenCookieValue(auth.token),
+					Path:     s.urlWithBasePath("/"),
+					MaxAge:   int(authCookieAge.Seconds()),
+					HttpOnly: true,
+					Secure:   r.TLS != nil,
+					SameSite: http.SameSiteLaxMode,
+				})
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		if auth.user != "" || auth.htpasswd != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+authRealm+`", charset="UTF-8"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+authRealm+`"`)
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// readOnlyExempt are paths whose POST only reads, taking its parameters
+// from the body
+var readOnlyExempt = map[string]bool{
+	"/api/zip": true,
+}
+
+// readOnly wraps a handler so that only requests that read are served.
+// Prunes, rebuilds, cache purges, album orders and favorites are refused.
+func readOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if readOnlyExempt[r.URL.Path] && r.Method == http.MethodPost {
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+		default:
+			http.Error(w, "Server is read-only", http.StatusForbidden)
+		}
+	})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeHtpasswd writes an htpasswd file of the given lines and returns its path
+func writeHtpasswd(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "users.htpasswd")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestHtpasswdLogins(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("open sesame"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := loadHtpasswd(writeHtpasswd(t, "# family\nalice:"+string(hash)+"\n\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t)
+	writeTestJPEG(t, s, "a.jpg", 40, 20)
+	handler := s.newHandler(handlerOptions{auth: &authConfig{htpasswd: users}})
+
+	for _, test := range []struct {
+		user, pass string
+		want       int
+	}{
+		{"alice", "open sesame", http.StatusOK},
+		{"alice", "open sesame", http.StatusOK}, // remembered this time
+		{"alice", "wrong", http.StatusUnauthorized},
+		{"bob", "open sesame", http.StatusUnauthorized},
+		{"", "", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/download/a.jpg", nil)
+		if test.user != "" {
+			req.SetBasicAuth(test.user, test.pass)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != test.want {
+			t.Errorf("%q/%q: status %d, want %d", test.user, test.pass, rec.Code, test.want)
+		}
+		if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%q/%q: 401 without a Basic challenge", test.user, test.pass)
+		}
+	}
+	if len(users.verified) != 1 {
+		t.Errorf("%d logins remembered, want 1", len(users.verified))
+	}
+}
+
+func TestHtpasswdOnlyTakesBcrypt(t *testing.T) {
+	for _, content := range []string{
+		"alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n",
+		"alice:$apr1$abc$def\n",
+		"alice\n",
+		"# nobody\n",
+	} {
+		if _, err := loadHtpasswd(writeHtpasswd(t, content)); err == nil {
+			t.Errorf("%q was taken", content)
+		}
+	}
+}
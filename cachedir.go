@@ -0,0 +1,232 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// cacheEvictInterval is how often the cache is checked against -cache-max-bytes
+const cacheEvictInterval = 10 * time.Minute
+
+var (
+	// cacheDir is where -cache-dir keeps the caches, mirroring the tree under
+	// cacheSourceRoot with a .small directory per source directory, e.g.
+	// <cache-dir>/2024/.small/photo.jpg.jpg. "" keeps each .small directory
+	// next to its files.
+	cacheDir        string
+	cacheSourceRoot string
+)
+
+// thumbnailDirFor returns the .small directory holding the caches of the
+// files in dir
+func thumbnailDirFor(dir string) string {
+	dir = foldedDir(dir)
+	if cacheDir == "" {
+		return filepath.Join(dir, ".small")
+	}
+	relPath, err := filepath.Rel(cacheSourceRoot, dir)
+	if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return filepath.Join(dir, ".small")
+	}
+	return filepath.Join(cacheDir, relPath, ".small")
+}
+
+// sourceDirFor is the inverse of thumbnailDirFor
+func sourceDirFor(thumbnailDir string) string {
+	dir := filepath.Dir(thumbnailDir)
+	if cacheDir == "" {
+		return dir
+	}
+	relPath, err := filepath.Rel(cacheDir, dir)
+	if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return dir
+	}
+	return filepath.Join(cacheSourceRoot, relPath)
+}
+
+// cacheTreeFor returns the directory whose .small directories hold the
+// caches of the subtree under root
+func cacheTreeFor(root string) string {
+	return filepath.Dir(thumbnailDirFor(root))
+}
+
+// cacheURLPath names a cache file by where it would be kept without
+// -cache-dir, e.g. /2024/.small/photo.jpg.jpg, for reports
+func (s *Server) cacheURLPath(path string) string {
+	thumbnailDir := filepath.Dir(path)
+	for filepath.Base(thumbnailDir) != ".small" && thumbnailDir != filepath.Dir(thumbnailDir) {
+		thumbnailDir = filepath.Dir(thumbnailDir)
+	}
+	relPath, err := filepath.Rel(thumbnailDir, path)
+	if err != nil {
+		return s.urlPathFor(path)
+	}
+	return s.urlPathFor(filepath.Join(sourceDirFor(thumbnailDir), ".small", relPath))
+}
+
+// isCacheFile reports whether a file in a .small directory was generated
+// from a source file and can be regenerated, unlike favorites or the
+// session key
+func isCacheFile(name string) bool {
+	name = strings.TrimSuffix(name, ".tmp")
+	for _, suffix := range cacheFileSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// walkCache calls fn for every cache file of the subtree under root,
+// including those in subdirectories of .small such as contact sheets
+func (s *Server) walkCache(ctx context.Context, root string, fn func(path string, info fs.FileInfo)) error {
+	start := cacheTreeFor(root)
+	err := filepath.WalkDir(start, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		inCache := isInCache(start, path)
+		if d.IsDir() {
+			// Other hidden directories are never listed, leave them alone
+			if strings.HasPrefix(d.Name(), ".") && !isCacheDirName(d.Name()) && !inCache && path != start {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !inCache || !isCacheFile(d.Name()) {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			fn(path, info)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// cacheStats is the JSON body of GET /api/cache
+type cacheStats struct {
+	Path     string `json:"path"`
+	Files    int    `json:"files"`
+	Bytes    int64  `json:"bytes"`
+	MaxBytes int64  `json:"maxBytes,omitempty"` // -cache-max-bytes, 0 = unlimited
+}
+
+// handleCache reports the size of the cache of a subtree with GET and
+// deletes it with DELETE. Both take an optional path, the whole tree by
+// default. Deleted files are regenerated on the next request.
+func (s *Server) handleCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		path = "/"
+	}
+	fullPath, ok := s.resolvePath(path)
+	if !ok {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		result := pruneResult{}
+		err := s.walkCache(r.Context(), fullPath, func(path string, info fs.FileInfo) {
+			if os.Remove(path) == nil {
+				result.Removed++
+				result.Bytes += info.Size()
+			}
+		})
+		if err != nil {
+			respondJSON(w, map[string]interface{}{
+				"error": err.Error(),
+			}, http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Purged %d cache files (%d bytes) under %s", result.Removed, result.Bytes, s.urlPathFor(fullPath))
+		respondJSON(w, result, http.StatusOK)
+		return
+	}
+
+	stats := cacheStats{Path: s.urlPathFor(fullPath), MaxBytes: s.settings().cacheMaxBytes}
+	err := s.walkCache(r.Context(), fullPath, func(path string, info fs.FileInfo) {
+		stats.Files++
+		stats.Bytes += info.Size()
+	})
+	if err != nil {
+		respondJSON(w, map[string]interface{}{
+			"error": err.Error(),
+		}, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	respondJSON(w, stats, http.StatusOK)
+}
+
+// evictCachePeriodically keeps the cache within -cache-max-bytes
+func (s *Server) evictCachePeriodically() {
+	ticker := time.NewTicker(cacheEvictInterval)
+	defer ticker.Stop()
+	for {
+		s.evictCache(s.baseCtx)
+		select {
+		case <-ticker.C:
+		case <-s.baseCtx.Done():
+			return
+		}
+	}
+}
+
+// evictCache deletes the least recently read cache files until the cache
+// fits in -cache-max-bytes. Access times are only as fresh as the
+// filesystem keeps them; with noatime the oldest files go first. Without a
+// limit nothing is evicted.
+func (s *Server) evictCache(ctx context.Context) {
+	type cacheFile struct {
+		path     string
+		size     int64
+		accessed time.Time
+	}
+	limit := s.settings().cacheMaxBytes
+	if limit == 0 {
+		return
+	}
+	var files []cacheFile
+	var total int64
+	if err := s.walkCache(ctx, s.rootDir, func(path string, info fs.FileInfo) {
+		files = append(files, cacheFile{path, info.Size(), fileAccessTime(info)})
+		total += info.Size()
+	}); err != nil || total <= limit {
+		return
+	}
+
+	slices.SortFunc(files, func(a, b cacheFile) int {
+		return cmp.Compare(a.accessed.UnixNano(), b.accessed.UnixNano())
+	})
+	removed, freed := 0, int64(0)
+	for _, file := range files {
+		if total-freed <= limit {
+			break
+		}
+		if os.Remove(file.path) == nil {
+			removed++
+			freed += file.size
+		}
+	}
+	log.Printf("Cache over %d bytes: evicted %d files (%d bytes)", limit, removed, freed)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// caseInsensitiveFS is set when the root lives on a case-insensitive
+// filesystem (macOS APFS and HFS+, Windows NTFS by default), where
+// Photo.JPG and photo.jpg name the same file
+var caseInsensitiveFS bool
+
+// caseFoldRoot is the root directory, below which foldedDir lowercases
+var caseFoldRoot string
+
+// detectCaseInsensitive creates a lowercase probe file in dir and checks
+// whether it can be found under its uppercase name. A directory that can't
+// be written to is assumed to be case-sensitive.
+func detectCaseInsensitive(dir string) bool {
+	probe, err := os.CreateTemp(dir, ".case-probe-*")
+	if err != nil {
+		return false
+	}
+	probe.Close()
+	defer os.Remove(probe.Name())
+
+	upper := filepath.Join(dir, strings.ToUpper(filepath.Base(probe.Name())))
+	_, err = os.Stat(upper)
+	return err == nil
+}
+
+// cacheName returns the name a cache file of the given source file is
+// stored under. On a case-insensitive filesystem it is lowercased, so
+// requests that spell a file differently share one thumbnail, one pending
+// generation and one cache key. Caches written before keep working there,
+// as the filesystem finds them under either spelling.
+func cacheName(name string) string {
+	if caseInsensitiveFS {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+// foldedDir returns the directory the caches of the files in dir are kept
+// for. On a case-insensitive filesystem the part of dir below the root is
+// lowercased like cacheName, so /Trip/Photo.JPG and /trip/photo.jpg share
+// one thumbnail path, as a key for pending generations and under a
+// -cache-dir that may itself be case-sensitive.
+func foldedDir(dir string) string {
+	if !caseInsensitiveFS || caseFoldRoot == "" {
+		return dir
+	}
+	relPath, err := filepath.Rel(caseFoldRoot, dir)
+	if err != nil || relPath == "." || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return dir
+	}
+	return filepath.Join(caseFoldRoot, strings.ToLower(relPath))
+}
+
+// isCacheDirName reports whether a path component names a .small directory,
+// however it is spelled where that reaches the same directory
+func isCacheDirName(name string) bool {
+	return name == ".small" || (caseInsensitiveFS && strings.EqualFold(name, ".small"))
+}
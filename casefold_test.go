@@ -0,0 +1,59 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// foldCase treats the test server's root as case-insensitive, as -case-insensitive on does
+func foldCase(t *testing.T, s *Server) {
+	t.Helper()
+	caseInsensitiveFS, caseFoldRoot = true, s.rootDir
+	t.Cleanup(func() { caseInsensitiveFS, caseFoldRoot = false, "" })
+}
+
+func TestMismatchedCaseSharesThumbnail(t *testing.T) {
+	s := newTestServer(t)
+	foldCase(t, s)
+
+	want := s.thumbnailPathFor(filepath.Join(s.rootDir, "trip", "photo.jpg"), defaultThumbnailVariant())
+	for _, name := range []string{"Trip/Photo.JPG", "TRIP/photo.jpg", "trip/PHOTO.jpg"} {
+		if got := s.thumbnailPathFor(filepath.Join(s.rootDir, filepath.FromSlash(name)), defaultThumbnailVariant()); got != want {
+			t.Errorf("thumbnail of %s = %s, want %s", name, got, want)
+		}
+	}
+	// The root is spelled as it was given, only what is below it is folded
+	if got, want := filepath.Dir(filepath.Dir(want)), filepath.Join(s.rootDir, "trip"); got != want {
+		t.Errorf("thumbnail directory under %s, want %s", got, want)
+	}
+}
+
+func TestMismatchedCaseSharesThumbnailUnderCacheDir(t *testing.T) {
+	s := newTestServer(t)
+	foldCase(t, s)
+	cacheDir, cacheSourceRoot = t.TempDir(), s.rootDir
+	t.Cleanup(func() { cacheDir, cacheSourceRoot = "", "" })
+
+	upper := s.thumbnailPathFor(filepath.Join(s.rootDir, "Trip", "Day 1", "Photo.JPG"), defaultThumbnailVariant())
+	lower := s.thumbnailPathFor(filepath.Join(s.rootDir, "trip", "day 1", "photo.jpg"), defaultThumbnailVariant())
+	if upper != lower {
+		t.Errorf("thumbnails differ by case: %s and %s", upper, lower)
+	}
+	if want := filepath.Join(cacheDir, "trip", "day 1", ".small", "photo.jpg.v2.jpg"); lower != want {
+		t.Errorf("thumbnail = %s, want %s", lower, want)
+	}
+}
+
+func TestMismatchedCaseSharesPendingGeneration(t *testing.T) {
+	s := newTestServer(t)
+	foldCase(t, s)
+
+	first, created := s.pendingFor(s.thumbnailPathFor(filepath.Join(s.rootDir, "Trip", "Photo.JPG"), defaultThumbnailVariant()), true)
+	if !created {
+		t.Fatal("first request didn't start a generation")
+	}
+	second, created := s.pendingFor(s.thumbnailPathFor(filepath.Join(s.rootDir, "trip", "photo.jpg"), defaultThumbnailVariant()), true)
+	if created || second != first {
+		t.Error("request in another case started a second generation")
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestMediaClassification(t *testing.T) {
+	tests := []struct {
+		path         string
+		copiesHidden bool
+		image, movie bool
+	}{
+		{path: "/album/photo.jpg", image: true},
+		{path: "/album/photo.JPG", image: true},
+		{path: "/album/clip.MOV", movie: true},
+		{path: "/album/.small/photo.jpg.jpg"},
+		{path: "/album/.small/clip.MOV.jpg"},
+
+		// Names like thumbnails are source media unless copies are hidden
+		{path: "/album/photo.jpg.jpg", image: true},
+		{path: "/album/clip.MOV.jpg", image: true},
+		{path: "/album/foo.png.jpg", image: true},
+		{path: "/album/photo.jpg.jpg", copiesHidden: true},
+		{path: "/album/clip.MOV.jpg", copiesHidden: true},
+		{path: "/album/photo.jpg.600.jpg", copiesHidden: true},
+		{path: "/album/foo.png.jpg", copiesHidden: true},
+
+		// Only the last extension says what a file is
+		{path: "/album/photo.jpg.mov", movie: true, copiesHidden: true},
+		{path: "/album/clip.mov.png", image: true, copiesHidden: true},
+		{path: "/album/v1.2.jpg", image: true, copiesHidden: true},
+	}
+	defer func(hidden bool) { hideThumbnailCopies = hidden }(hideThumbnailCopies)
+	for _, tt := range tests {
+		hideThumbnailCopies = tt.copiesHidden
+		if got := isImageFile(tt.path); got != tt.image {
+			t.Errorf("isImageFile(%q) with hidden copies %v = %v, want %v", tt.path, tt.copiesHidden, got, tt.image)
+		}
+		if got := isMovieFile(tt.path); got != tt.movie {
+			t.Errorf("isMovieFile(%q) with hidden copies %v = %v, want %v", tt.path, tt.copiesHidden, got, tt.movie)
+		}
+	}
+}
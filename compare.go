@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+// compareGap is the space, in pixels, between the two images of a stacked
+// comparison
+const compareGap = 16
+
+// compareImage is one side of a comparison
+type compareImage struct {
+	Path    string `json:"path"`
+	Preview string `json:"preview"` // the image at the comparison height
+	Width   int    `json:"width"`   // width of the preview, 0 if unknown
+	Height  int    `json:"height"`
+}
+
+// compareResponse describes two images rendered at the same height
+type compareResponse struct {
+	A       compareImage `json:"a"`
+	B       compareImage `json:"b"`
+	Stacked string       `json:"stacked"` // both side by side in one image
+}
+
+// handleCompare renders two images at the same height for side by side
+// review. By default it returns JSON with a preview URL for each side;
+// ?side=a or ?side=b returns that preview and ?stack=true both in one JPEG.
+// ?size= picks the height from the preview sizes.
+func (s *Server) handleCompare(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("a") == "" || query.Get("b") == "" {
+		http.Error(w, "Query parameters a and b required", http.StatusBadRequest)
+		return
+	}
+
+	height := defaultPreviewSize
+	if sizeParam := query.Get("size"); sizeParam != "" {
+		requested, err := strconv.Atoi(sizeParam)
+		if err != nil || !previewSizes[requested] {
+			http.Error(w, "Invalid preview size", http.StatusBadRequest)
+			return
+		}
+		height = requested
+	}
+
+	var paths [2]string
+	for i, param := range []string{"a", "b"} {
+		fullPath, ok := s.resolvePath(query.Get(param))
+		if !ok {
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+		if s.isExcludedPath(s.urlPathFor(fullPath)) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		if info, err := s.store.Stat(r.Context(), fullPath); err != nil || info.IsDir() {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		if !isImageFile(fullPath) {
+			http.Error(w, "Not an image file", http.StatusBadRequest)
+			return
+		}
+		paths[i] = fullPath
+	}
+
+	switch {
+	case query.Get("side") == "a":
+		s.serveComparison(w, r, height, paths[0])
+	case query.Get("side") == "b":
+		s.serveComparison(w, r, height, paths[1])
+	case query.Get("side") != "":
+		http.Error(w, "Invalid side", http.StatusBadRequest)
+	case query.Get("stack") == "true":
+		s.serveComparison(w, r, height, paths[0], paths[1])
+	default:
+		base := s.urlWithBasePath("/api/compare") + "?a=" + url.QueryEscape(s.urlPathFor(paths[0])) +
+			"&b=" + url.QueryEscape(s.urlPathFor(paths[1])) + "&size=" + strconv.Itoa(height)
+		respondJSON(w, compareResponse{
+			A:       s.compareSide(r.Context(), paths[0], height, base+"&side=a"),
+			B:       s.compareSide(r.Context(), paths[1], height, base+"&side=b"),
+			Stacked: base + "&stack=true",
+		}, http.StatusOK)
+	}
+}
+
+// compareSide describes one image of a comparison, scaling its recorded
+// dimensions to the comparison height
+func (s *Server) compareSide(ctx context.Context, fullPath string, height int, preview string) compareImage {
+	side := compareImage{Path: s.urlPathFor(fullPath), Preview: preview, Height: height}
+	if dims, err := s.imageDimensionsFor(ctx, fullPath); err == nil && dims.Height > 0 {
+		side.Width = max(1, dims.Width*height/dims.Height)
+	}
+	return side
+}
+
+// serveComparison renders the images at the given height and writes them
+// side by side, separated by compareGap, as one JPEG
+func (s *Server) serveComparison(w http.ResponseWriter, r *http.Request, height int, fullPaths ...string) {
+	ctx, cancel := s.previewContext(r)
+	defer cancel()
+	release, err := s.acquirePreviewSlot(ctx)
+	if err != nil {
+		http.Error(w, "Preview generation timed out", http.StatusGatewayTimeout)
+		return
+	}
+	defer release()
+
+	var images []image.Image
+	width := 0
+	for _, fullPath := range fullPaths {
+		img, err := s.renderAtHeight(ctx, fullPath, height)
+		if err != nil {
+			if ctx.Err() != nil {
+				http.Error(w, "Preview generation timed out", http.StatusGatewayTimeout)
+				return
+			}
+			http.Error(w, "Failed to render "+s.urlPathFor(fullPath), http.StatusInternalServerError)
+			return
+		}
+		images = append(images, img)
+		width += img.Bounds().Dx()
+	}
+	width += compareGap * (len(images) - 1)
+
+	canvas := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(s.backgroundColor()), image.Point{}, draw.Src)
+	x := 0
+	for _, img := range images {
+		b := img.Bounds()
+		draw.Draw(canvas, image.Rect(x, 0, x+b.Dx(), b.Dy()), img, b.Min, draw.Src)
+		x += b.Dx() + compareGap
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	jpeg.Encode(w, canvas, &jpeg.Options{Quality: nativeDefaultQuality})
+}
+
+// renderAtHeight scales an image to exactly height pixels high, enlarging
+// it if needed so both sides of a comparison match. vips does the work
+// unless thumbnails are generated in-process.
+func (s *Server) renderAtHeight(ctx context.Context, fullPath string, height int) (image.Image, error) {
+	if s.nativeThumbnails || (s.vipsMissing && isFallbackImage(fullPath)) {
+		img, err := s.decodeNativeImage(ctx, fullPath)
+		if err != nil {
+			return nil, err
+		}
+		b := img.Bounds()
+		width := max(1, b.Dx()*height/b.Dy())
+		return scaleRect(img, b, width, height, s.backgroundColor()), nil
+	}
+
+	file, err := s.store.Open(ctx, fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// "x<height>" sizes by height alone
+	var out bytes.Buffer
+	args := []string{vipsStdinInput(fullPath), vipsAutoRotate, "-s", fmt.Sprintf("x%d", height), "-o", ".jpg[background=" + s.thumbnailBackground + "]"}
+	cmd := s.runner.command(ctx, vipsExecutable(), append(args, s.colorProfileArgs()...)...)
+	cmd.Stdin = file
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed to resize %s: %w", fullPath, err)
+	}
+	return jpeg.Decode(&out)
+}
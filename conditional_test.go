@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"sync/atomic"
+	"testing"
+)
+
+// recordingRunner counts the processes requests start. They run in dir, so
+// fakeVips writing to a relative output such as ".jpg" stays out of the tree.
+type recordingRunner struct {
+	dir   string
+	calls atomic.Int32
+}
+
+func (r *recordingRunner) command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	r.calls.Add(1)
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = r.dir
+	return cmd
+}
+
+func TestConditionalRequestsStartNoProcess(t *testing.T) {
+	s := newTestServer(t)
+	s.nativeThumbnails = false
+	fakeVips(t)
+	runner := &recordingRunner{dir: t.TempDir()}
+	s.runner = runner
+	s.resizeWorkers(1, 1)
+	t.Cleanup(func() { s.resizeWorkers(0, 0) })
+	writeTestJPEG(t, s, "trip/photo.jpg", 40, 20)
+	handler := s.newHandler(handlerOptions{})
+
+	for _, target := range []string{"/api/thumbnail/trip/photo.jpg", "/api/preview/trip/photo.jpg"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		etag := rec.Header().Get("ETag")
+		if rec.Code != http.StatusOK || etag == "" {
+			t.Fatalf("%s: status %d, ETag %q", target, rec.Code, etag)
+		}
+		started := runner.calls.Load()
+		if started == 0 {
+			t.Fatalf("%s: no process started to render it", target)
+		}
+
+		rec = httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("If-None-Match", etag)
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusNotModified {
+			t.Errorf("%s revalidated: status %d, want 304", target, rec.Code)
+		}
+		if n := runner.calls.Load() - started; n != 0 {
+			t.Errorf("%s revalidated: %d processes started, want none", target, n)
+		}
+		runner.calls.Store(0)
+	}
+}
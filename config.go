@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"net/http"
+	"os/exec"
+	"time"
+)
+
+// toolVersionTimeout bounds each version probe of vips and ffmpeg
+const toolVersionTimeout = 5 * time.Second
+
+// serverConfig is the effective configuration reported by /api/config
+type serverConfig struct {
+	Root                string            `json:"root"`
+	Store               string            `json:"store"`
+	BasePath            string            `json:"basePath"`
+	HomePath            string            `json:"homePath"`
+	ImageWorkers        int               `json:"imageWorkers"`
+	MovieWorkers        int               `json:"movieWorkers"`
+	QueueSize           int               `json:"queueSize"`
+	MaxGenerations      int               `json:"maxGenerations"` // 0 = unlimited
+	PreviewReserve      int               `json:"previewReserve"`
+	ThumbnailSize       int               `json:"thumbnailSize"`
+	ThumbnailFormat     string            `json:"thumbnailFormat"`
+	ThumbnailQuality    int               `json:"thumbnailQuality"` // 0 = encoder default
+	ThumbnailMode       string            `json:"thumbnailMode"`
+	ThumbnailPad        string            `json:"thumbnailPad"` // aspect ratio, "" = unpadded
+	VideoThumbStyle     string            `json:"videoThumbStyle"`
+	VideoEncoder        string            `json:"videoEncoder"` // ffmpeg encoder, e.g. h264_qsv
+	ThumbnailSubsample  string            `json:"thumbnailSubsample"`
+	ThumbnailBackground string            `json:"thumbnailBackground"`
+	ColorProfile        string            `json:"colorProfile"` // "" = the source's profile is kept
+	ThumbnailMinBytes   int64             `json:"thumbnailMinBytes"`
+	ThumbnailTimeout    string            `json:"thumbnailTimeout"`
+	PreviewTimeout      string            `json:"previewTimeout"`
+	MaxFileTime         string            `json:"maxFileTime"`
+	ListCacheTTL        string            `json:"listCacheTTL"` // 0s = off
+	Favorites           string            `json:"favorites"`
+	Features            map[string]bool   `json:"features"`
+	Binaries            map[string]string `json:"binaries"`
+}
+
+// handleConfig reports the configuration the running server uses
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	store := "local"
+	if s3, ok := s.store.(*s3Store); ok {
+		store = "s3://" + s3.bucket + "/" + s3.prefix
+	}
+
+	// Thumbnails get what the reserve leaves of the shared limit
+	reserve := 0
+	if s.capacitySem != nil {
+		reserve = cap(s.capacitySem) - cap(s.generationSem)
+	}
+
+	respondJSON(w, serverConfig{
+		Root:                s.rootDir,
+		Store:               store,
+		BasePath:            s.basePath,
+		HomePath:            s.homePath,
+		ImageWorkers:        s.settings().imageWorkers,
+		MovieWorkers:        s.settings().movieWorkers,
+		QueueSize:           cap(s.imageThumbnailQueue),
+		MaxGenerations:      max(cap(s.generationSem), cap(s.capacitySem)),
+		PreviewReserve:      reserve,
+		ThumbnailSize:       defaultThumbnailVariant().size,
+		ThumbnailFormat:     "jpeg",
+		ThumbnailQuality:    defaultThumbnailVariant().quality,
+		ThumbnailMode:       s.thumbnailMode,
+		ThumbnailPad:        defaultThumbnailVariant().pad,
+		VideoThumbStyle:     s.videoThumbStyle,
+		VideoEncoder:        s.videoEncoder.encoder,
+		ThumbnailSubsample:  s.settings().thumbnailSubsample,
+		ThumbnailBackground: s.thumbnailBackground,
+		ColorProfile:        s.colorProfile,
+		ThumbnailMinBytes:   s.settings().thumbnailMinBytes,
+		ThumbnailTimeout:    s.settings().thumbnailTimeout.String(),
+		PreviewTimeout:      s.settings().previewTimeout.String(),
+		MaxFileTime:         s.settings().maxFileTime.String(),
+		ListCacheTTL:        s.listCacheTTL().String(),
+		Favorites:           cmp.Or(s.favoritesMode, favoritesOff),
+		Features: map[string]bool{
+			"hashedThumbnails":     s.hashedThumbnails,
+			"prefetchThumbnails":   s.settings().prefetchThumbnails,
+			"exposureStats":        s.settings().exposureStats,
+			"listIndex":            s.listIndex != nil,
+			"caseInsensitiveFS":    caseInsensitiveFS,
+			"progressiveJPEG":      s.settings().progressiveJPEG,
+			"nativeThumbnails":     s.nativeThumbnails,
+			"nativeFallback":       s.vipsMissing,
+			"svgThumbnails":        !s.svgUnsupported,
+			"watermark":            s.watermark != nil,
+			"requirePretranscoded": s.requireTranscoded,
+		},
+		Binaries: s.toolVersions(r.Context()),
+	}, http.StatusOK)
+}
+
+// listCacheTTL returns the listing cache TTL, 0 when it is disabled
+func (s *Server) listCacheTTL() time.Duration {
+	if s.listCache == nil {
+		return 0
+	}
+	return s.listCache.ttl
+}
+
+// toolVersions reports the versions of vips and ffmpeg, probed once and
+// remembered. A tool that can't be run is reported as "unavailable".
+func (s *Server) toolVersions(ctx context.Context) map[string]string {
+	s.toolVersionsOnce.Do(func() {
+		s.toolVersionsCache = map[string]string{
+			"vipsthumbnail": probeToolVersion(ctx, vipsExecutable(), "--version"),
+			"ffmpeg":        probeToolVersion(ctx, ffmpegExecutable(), "-version"),
+		}
+	})
+	return s.toolVersionsCache
+}
+
+// probeToolVersion returns the first line a tool prints for its version flag
+func probeToolVersion(ctx context.Context, tool, flag string) string {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), toolVersionTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, tool, flag).Output()
+	if err != nil {
+		return "unavailable"
+	}
+	line, _, _ := bufio.NewReader(bytes.NewReader(out)).ReadLine()
+	return string(line)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// loadConfigFile sets flags from the JSON object in path, keyed by flag name
+// without the dash, e.g. {"root": "/srv/photos", "thumbnail-size": 300}. Flags
+// given on the command line are left as they are, so one setting can be
+// changed for a single run. Values go through the flag's own parsing:
+// durations are strings like "30s", and lists such as "exclude" may be
+// arrays. Unknown names are an error rather than ignored, so a typo doesn't
+// silently fall back to the default.
+func loadConfigFile(flags *flag.FlagSet, path string) error {
+	settings, err := readConfigFile(flags, path)
+	if err != nil {
+		return err
+	}
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if given[name] {
+			continue
+		}
+		if err := flags.Set(name, settings[name]); err != nil {
+			return fmt.Errorf("%s: %s: %w", path, name, err)
+		}
+	}
+	return nil
+}
+
+// readConfigFile returns the settings in path as the strings their flags
+// parse, keyed by flag name
+func readConfigFile(flags *flag.FlagSet, path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var settings map[string]any
+	if err := decoder.Decode(&settings); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	values := make(map[string]string, len(settings))
+	for _, name := range names {
+		if name == "config" || flags.Lookup(name) == nil {
+			return nil, fmt.Errorf("%s: unknown setting %q", path, name)
+		}
+		value, err := configValue(settings[name])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", path, name, err)
+		}
+		values[name] = value
+	}
+	return values, nil
+}
+
+// configValue turns a JSON value into the string a flag parses
+func configValue(value any) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return "", fmt.Errorf("list items must be strings")
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("must be a string, number, boolean or list of strings")
+}
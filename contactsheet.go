@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Contact sheet defaults and bounds for ?columns= and ?cell=
+const (
+	defaultSheetColumns = 6
+	maxSheetColumns     = 20
+	defaultSheetCell    = 200
+	minSheetCell        = 64
+	maxSheetCell        = 600
+)
+
+// maxSheetImages bounds the photos on one contact sheet, which has to be
+// held in memory while it is assembled
+const maxSheetImages = 1000
+
+// sheetCaptionHeight is the strip below each cell that holds its file name
+const sheetCaptionHeight = 18
+
+// handleContactSheet serves one JPEG with the photos of a directory in a
+// grid, for printing or quick reference. ?columns= and ?cell= (the size of
+// each square cell in pixels) shape the grid and ?captions=true writes each
+// file name below its photo. Photos follow the directory's order; movies
+// and subdirectories are left out. The sheet is built from the thumbnails,
+// generating missing ones first, and cached until the directory changes.
+func (s *Server) handleContactSheet(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	path := query.Get("path")
+	if path == "" {
+		path = "/"
+	}
+	fullPath, ok := s.resolvePath(path)
+	if !ok {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+	relPath, _ := filepath.Rel(s.rootDir, fullPath)
+	if s.isExcludedPath(relPath) {
+		http.Error(w, "Directory not found", http.StatusNotFound)
+		return
+	}
+
+	columns, err := sheetParam(query.Get("columns"), defaultSheetColumns, 1, maxSheetColumns)
+	if err != nil {
+		http.Error(w, "Invalid columns", http.StatusBadRequest)
+		return
+	}
+	cell, err := sheetParam(query.Get("cell"), defaultSheetCell, minSheetCell, maxSheetCell)
+	if err != nil {
+		http.Error(w, "Invalid cell size", http.StatusBadRequest)
+		return
+	}
+	captions := query.Get("captions") == "true"
+
+	entries, err := s.store.ReadDir(r.Context(), fullPath)
+	if err != nil {
+		http.Error(w, "Directory not found", http.StatusNotFound)
+		return
+	}
+	var photos []FileInfo
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || s.isExcluded(name) || !isImageFile(name) {
+			continue
+		}
+		photos = append(photos, FileInfo{Name: name})
+	}
+	if len(photos) == 0 {
+		http.Error(w, "No photos in directory", http.StatusNotFound)
+		return
+	}
+	if len(photos) > maxSheetImages {
+		http.Error(w, fmt.Sprintf("Too many photos for a contact sheet (more than %d)", maxSheetImages), http.StatusBadRequest)
+		return
+	}
+	if s.dirConfigFor(fullPath).Sort == "manual" {
+		sortManual(photos, readManualOrder(fullPath))
+	}
+
+	ctx, cancel := s.previewContext(r)
+	defer cancel()
+	thumbnails := s.sheetThumbnails(ctx, fullPath, photos)
+	if ctx.Err() != nil {
+		http.Error(w, "Contact sheet generation timed out", http.StatusGatewayTimeout)
+		return
+	}
+
+	// Thumbnails are in place now, so the first one creating .small doesn't
+	// date the sheet
+	version := s.directoryVersion(r.Context(), fullPath, entries)
+	sheetPath := getContactSheetPath(fullPath, columns, cell, captions)
+	if info, err := os.Stat(sheetPath); err != nil || !info.ModTime().Equal(version) {
+		// Requests for the same sheet share one generation
+		pending, created := s.pendingFor(sheetPath, true)
+		if created {
+			pending.err = s.renderContactSheet(ctx, sheetPath, version, photos, thumbnails, columns, cell, captions)
+			s.leave(sheetPath, pending, false)
+			s.finish(sheetPath, pending)
+		} else {
+			select {
+			case <-pending.done:
+				s.leave(sheetPath, pending, false)
+			case <-ctx.Done():
+				s.leave(sheetPath, pending, true)
+				http.Error(w, "Contact sheet generation timed out", http.StatusGatewayTimeout)
+				return
+			}
+		}
+		if err := pending.err; errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+			http.Error(w, "Contact sheet generation timed out", http.StatusGatewayTimeout)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to generate contact sheet: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeFile(w, r, sheetPath)
+}
+
+// renderContactSheet generates a sheet once a preview slot is free and dates
+// it with the directory version it shows
+func (s *Server) renderContactSheet(ctx context.Context, sheetPath string, version time.Time, photos []FileInfo, thumbnails []string, columns, cell int, captions bool) error {
+	release, err := s.acquirePreviewSlot(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := s.generateContactSheet(ctx, sheetPath, photos, thumbnails, columns, cell, captions); err != nil {
+		return err
+	}
+	return os.Chtimes(sheetPath, version, version)
+}
+
+// sheetParam parses an optional integer query parameter within bounds
+func sheetParam(value string, fallback, lo, hi int) (int, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < lo || n > hi {
+		return 0, fmt.Errorf("%q is not between %d and %d", value, lo, hi)
+	}
+	return n, nil
+}
+
+// getContactSheetPath returns where a directory's contact sheet is cached.
+// Sheets live in a subdirectory of .small, which pruning leaves alone.
+// e.g., 6 columns of 200px with captions -> .small/contact-sheets/6x200-captions.jpg
+func getContactSheetPath(dir string, columns, cell int, captions bool) string {
+	name := fmt.Sprintf("%dx%d", columns, cell)
+	if captions {
+		name += "-captions"
+	}
+	return filepath.Join(thumbnailDirFor(dir), "contact-sheets", name+".jpg")
+}
+
+// sheetThumbnails returns the default thumbnail of each photo, generating
+// the missing ones. All of them are queued before waiting on any, so the
+// workers share the work. Photos whose thumbnail fails get an empty path
+// and an empty cell.
+func (s *Server) sheetThumbnails(ctx context.Context, dir string, photos []FileInfo) []string {
+	thumbnails := make([]string, len(photos))
+	var missing []int
+	for i, photo := range photos {
+		thumbnails[i] = s.thumbnailPathFor(filepath.Join(dir, photo.Name), defaultThumbnailVariant())
+		if _, err := os.Stat(thumbnails[i]); err != nil {
+			s.enqueueThumbnail(filepath.Join(dir, photo.Name), defaultThumbnailVariant())
+			missing = append(missing, i)
+		}
+	}
+	for _, i := range missing {
+		if _, err := os.Stat(thumbnails[i]); err == nil {
+			continue
+		}
+		if err := s.queueAndWaitForThumbnail(ctx, filepath.Join(dir, photos[i].Name), defaultThumbnailVariant()); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			thumbnails[i] = ""
+		}
+	}
+	return thumbnails
+}
+
+// generateContactSheet renders one cell per photo and tiles them into the
+// sheet: vips arrayjoin does the tiling, which keeps big sheets out of
+// memory, unless thumbnails are generated in-process. The sheet is written
+// to a temporary file of its own next to its final path and renamed over it.
+func (s *Server) generateContactSheet(ctx context.Context, sheetPath string, photos []FileInfo, thumbnails []string, columns, cell int, captions bool) error {
+	if err := os.MkdirAll(filepath.Dir(sheetPath), 0755); err != nil {
+		return err
+	}
+	cellHeight := cell
+	if captions {
+		cellHeight += sheetCaptionHeight
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(sheetPath), ".sheet-*.jpg")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	tmpPath := tmp.Name()
+	if s.nativeThumbnails || s.vipsMissing {
+		err = s.tileContactSheet(tmpPath, photos, thumbnails, columns, cell, cellHeight, captions)
+	} else {
+		err = s.joinContactSheet(ctx, tmpPath, photos, thumbnails, columns, cell, cellHeight, captions)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, sheetPath)
+}
+
+// joinContactSheet writes each cell to a scratch directory and has vips
+// arrayjoin tile them, filling a short last row with the background
+func (s *Server) joinContactSheet(ctx context.Context, outPath string, photos []FileInfo, thumbnails []string, columns, cell, cellHeight int, captions bool) error {
+	scratch, err := os.MkdirTemp(filepath.Dir(outPath), "cells")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(scratch)
+
+	// Short numbered names keep the argument list small for big sheets
+	cells := make([]string, len(photos))
+	for i, photo := range photos {
+		cells[i] = fmt.Sprintf("%04d.jpg", i)
+		img := s.renderSheetCell(photo.Name, thumbnails[i], cell, cellHeight, captions)
+		if err := writeNativeJPEG(filepath.Join(scratch, cells[i]), img, nativeDefaultQuality); err != nil {
+			return err
+		}
+	}
+
+	absOut, err := filepath.Abs(outPath)
+	if err != nil {
+		return err
+	}
+	bg := s.backgroundColor()
+	cmd := s.runner.command(ctx, vipsCLIExecutable(), "arrayjoin", strings.Join(cells, " "), absOut,
+		"--across", strconv.Itoa(columns), "--background", fmt.Sprintf("%d %d %d", bg.R, bg.G, bg.B))
+	cmd.Dir = scratch
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("vips arrayjoin failed: %w", err)
+	}
+	return nil
+}
+
+// tileContactSheet assembles the sheet in-process, for -native-thumbnails
+func (s *Server) tileContactSheet(outPath string, photos []FileInfo, thumbnails []string, columns, cell, cellHeight int, captions bool) error {
+	columns = min(columns, len(photos))
+	rows := (len(photos) + columns - 1) / columns
+	canvas := image.NewRGBA(image.Rect(0, 0, columns*cell, rows*cellHeight))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(s.backgroundColor()), image.Point{}, draw.Src)
+	for i, photo := range photos {
+		img := s.renderSheetCell(photo.Name, thumbnails[i], cell, cellHeight, captions)
+		at := image.Pt(i%columns*cell, i/columns*cellHeight)
+		draw.Draw(canvas, image.Rectangle{Min: at, Max: at.Add(img.Bounds().Size())}, img, image.Point{}, draw.Src)
+	}
+	return writeNativeJPEG(outPath, canvas, nativeDefaultQuality)
+}
+
+// renderSheetCell draws a thumbnail centred in a cell, never enlarged,
+// with its file name below when captions are on. A missing or unreadable
+// thumbnail leaves the cell empty.
+func (s *Server) renderSheetCell(name, thumbnailPath string, cell, cellHeight int, captions bool) *image.RGBA {
+	bg := s.backgroundColor()
+	img := image.NewRGBA(image.Rect(0, 0, cell, cellHeight))
+	draw.Draw(img, img.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+
+	// A small margin keeps neighbouring photos apart
+	inner := cell - cell/20*2
+	if thumb, err := decodeJPEGFile(thumbnailPath); err == nil {
+		scaled := scaleToFit(thumb, inner, bg)
+		b := scaled.Bounds()
+		at := image.Pt((cell-b.Dx())/2, (cell-b.Dy())/2)
+		draw.Draw(img, image.Rectangle{Min: at, Max: at.Add(b.Size())}, scaled, b.Min, draw.Src)
+	}
+
+	if captions {
+		face := basicfont.Face7x13
+		label := fitCaption(name, face, cell-4)
+		drawer := font.Drawer{Dst: img, Src: image.NewUniform(captionColor(bg)), Face: face}
+		x := (cell - drawer.MeasureString(label).Round()) / 2
+		drawer.Dot = fixed.P(x, cell+(sheetCaptionHeight+face.Ascent-face.Descent)/2)
+		drawer.DrawString(label)
+	}
+	return img
+}
+
+// decodeJPEGFile decodes a JPEG from disk
+func decodeJPEGFile(path string) (image.Image, error) {
+	if path == "" {
+		return nil, errors.New("no thumbnail")
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return jpeg.Decode(file)
+}
+
+// fitCaption shortens a file name to fit width pixels, keeping its end,
+// which usually tells similar names apart
+func fitCaption(name string, face font.Face, width int) string {
+	if font.MeasureString(face, name).Round() <= width {
+		return name
+	}
+	runes := []rune(name)
+	for len(runes) > 0 {
+		runes = runes[1:]
+		if label := "..." + string(runes); font.MeasureString(face, label).Round() <= width {
+			return label
+		}
+	}
+	return ""
+}
+
+// captionColor picks black or white text, whichever reads better on bg
+func captionColor(bg color.RGBA) color.Color {
+	if 299*int(bg.R)+587*int(bg.G)+114*int(bg.B) > 128*1000 {
+		return color.Black
+	}
+	return color.White
+}
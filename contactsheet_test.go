@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentContactSheetRequests(t *testing.T) {
+	s := newTestServer(t)
+	for _, name := range []string{"a.jpg", "b.jpg", "c.jpg"} {
+		photo := writeTestJPEG(t, s, "trip/"+name, 60, 40)
+		if err := s.generateThumbnail(t.Context(), photo, defaultThumbnailVariant()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mux := s.newMux()
+
+	var wg sync.WaitGroup
+	codes := make([]int, 8)
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/contact-sheet?path=/trip&columns=2&cell=100", nil))
+			codes[i] = rec.Code
+		}()
+	}
+	wg.Wait()
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("request %d: status %d", i, code)
+		}
+	}
+
+	sheetPath := getContactSheetPath(filepath.Join(s.rootDir, "trip"), 2, 100, false)
+	if w, h := thumbnailSize(t, sheetPath); w != 200 || h != 200 {
+		t.Errorf("sheet is %dx%d, want 200x200", w, h)
+	}
+	entries, err := os.ReadDir(filepath.Dir(sheetPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("contact sheet directory holds %d files, want only the sheet", len(entries))
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// coverScanDepth is how deep below a directory a cover is looked for:
+	// its own files and those of its subdirectories
+	coverScanDepth = 2
+	// coverScanEntries caps the entries read per directory while scanning
+	coverScanEntries = 200
+	// coverListBudget bounds the time one listing spends picking covers.
+	// Directories past it get none, and are scanned again next time.
+	coverListBudget = 500 * time.Millisecond
+)
+
+// cachedCover is a picked cover, valid while the directory is unchanged
+type cachedCover struct {
+	modTime time.Time
+	cover   string // full path of the media file, "" when there is none
+}
+
+// coverFor picks a representative file for a directory tile, for
+// /api/list?covers=1. A file whose thumbnail is cached already is preferred,
+// then the first image, then the first movie. Picks are cached by directory
+// mtime, which changes when files are added or removed directly in it.
+func (s *Server) coverFor(ctx context.Context, dir string, deadline time.Time) (string, bool) {
+	info, err := s.store.Stat(ctx, dir)
+	if err != nil {
+		return "", false
+	}
+	if cached, ok := s.dirCovers.Load(dir); ok && cached.(cachedCover).modTime.Equal(info.ModTime()) {
+		cover := cached.(cachedCover).cover
+		return cover, cover != ""
+	}
+	if time.Now().After(deadline) {
+		return "", false
+	}
+
+	var scan coverScan
+	if !s.scanForCover(ctx, dir, coverScanDepth, deadline, &scan) {
+		// Cut short, so an empty result doesn't mean there's no media
+		cover := scan.pick()
+		return cover, cover != ""
+	}
+	cover := scan.pick()
+	s.dirCovers.Store(dir, cachedCover{modTime: info.ModTime(), cover: cover})
+	return cover, cover != ""
+}
+
+// coverScan collects the candidates found while scanning for a cover
+type coverScan struct {
+	cached string // first file with a cached thumbnail
+	image  string
+	movie  string
+}
+
+// pick returns the best candidate found
+func (c *coverScan) pick() string {
+	switch {
+	case c.cached != "":
+		return c.cached
+	case c.image != "":
+		return c.image
+	default:
+		return c.movie
+	}
+}
+
+// scanForCover looks for candidates in dir and, depth permitting, its
+// subdirectories, stopping at the first file with a cached thumbnail. It
+// reports false when the deadline or ctx cut the scan short.
+func (s *Server) scanForCover(ctx context.Context, dir string, depth int, deadline time.Time, scan *coverScan) bool {
+	entries, err := s.store.ReadDir(ctx, dir)
+	if err != nil {
+		return ctx.Err() == nil
+	}
+	var subdirs []string
+	for i, entry := range entries {
+		if i == coverScanEntries {
+			break
+		}
+		if ctx.Err() != nil || time.Now().After(deadline) {
+			return false
+		}
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || s.isExcluded(name) {
+			continue
+		}
+		fullPath := filepath.Join(dir, name)
+		if entry.IsDir() {
+			subdirs = append(subdirs, fullPath)
+			continue
+		}
+		isImage := isImageFile(name) && !(isSVGFile(name) && s.svgUnsupported)
+		if !isImage && !isMovieFile(name) {
+			continue
+		}
+		if _, err := os.Stat(s.thumbnailPathFor(fullPath, defaultThumbnailVariant())); err == nil {
+			scan.cached = fullPath
+			return true
+		}
+		if isImage && scan.image == "" {
+			scan.image = fullPath
+		} else if !isImage && scan.movie == "" {
+			scan.movie = fullPath
+		}
+	}
+	if depth <= 1 {
+		return true
+	}
+	for _, subdir := range subdirs {
+		if s.ownDirConfig(subdir).Hidden {
+			continue
+		}
+		if !s.scanForCover(ctx, subdir, depth-1, deadline, scan) {
+			return false
+		}
+		if scan.cached != "" {
+			return true
+		}
+	}
+	return true
+}
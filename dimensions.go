@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dimensionsVersion is bumped when the meaning of the recorded dimensions
+// changes, so older sidecars are recomputed. Version 1 applies EXIF orientation.
+const dimensionsVersion = 1
+
+// imageDimensions is the sidecar record stored next to a thumbnail. Width
+// and height are as displayed, i.e. after applying EXIF orientation.
+type imageDimensions struct {
+	Width   int   `json:"width"`
+	Height  int   `json:"height"`
+	ModTime int64 `json:"modTime"` // source mtime (UnixNano), used for invalidation
+	Version int   `json:"version"`
+}
+
+// vipsheader prints e.g. "photo.heic: 4032x3024 uchar, 3 bands, srgb, heifload"
+var vipsHeaderSizeRe = regexp.MustCompile(`: (\d+)x(\d+) `)
+
+// vipsHeaderExecutable returns the path to the vipsheader executable
+// On Windows, it looks for vipsheader.exe, otherwise just "vipsheader"
+func vipsHeaderExecutable() string {
+	return vipsTool("vipsheader")
+}
+
+// getDimensionsPath returns the sidecar path holding the dimensions of an image
+// e.g., photo.heic -> .small/photo.heic.dim.json
+func getDimensionsPath(imagePath string) string {
+	dir := filepath.Dir(imagePath)
+	baseName := cacheName(filepath.Base(imagePath))
+	return filepath.Join(thumbnailDirFor(dir), baseName+".dim.json")
+}
+
+// loadDimensions reads cached dimensions, rejecting them if the source has
+// been modified since they were recorded
+func loadDimensions(imagePath string, modTime time.Time) (imageDimensions, bool) {
+	var dims imageDimensions
+	data, err := os.ReadFile(getDimensionsPath(imagePath))
+	if err != nil {
+		return dims, false
+	}
+	if err := json.Unmarshal(data, &dims); err != nil {
+		return dims, false
+	}
+	if dims.ModTime != modTime.UnixNano() || dims.Version != dimensionsVersion {
+		return dims, false
+	}
+	return dims, true
+}
+
+// saveDimensions writes the dimensions sidecar for an image
+func saveDimensions(imagePath string, dims imageDimensions) error {
+	dimensionsPath := getDimensionsPath(imagePath)
+	if err := os.MkdirAll(filepath.Dir(dimensionsPath), 0755); err != nil {
+		return fmt.Errorf("failed to create thumbnail directory: %w", err)
+	}
+	data, err := json.Marshal(dims)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dimensionsPath, data, 0644)
+}
+
+// readImageDimensions reads the pixel dimensions of an image. Formats the Go
+// standard library understands are decoded in-process from the header only,
+// everything else (HEIC, RAW, ...) is handed to vipsheader.
+func readImageDimensions(ctx context.Context, runner commandRunner, imagePath string) (int, int, error) {
+	if file, err := os.Open(imagePath); err == nil {
+		config, _, err := image.DecodeConfig(file)
+		file.Close()
+		if err == nil {
+			return config.Width, config.Height, nil
+		}
+	}
+
+	out, err := runner.command(ctx, vipsHeaderExecutable(), imagePath).Output()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read image header: %w", err)
+	}
+	match := vipsHeaderSizeRe.FindSubmatch(out)
+	if match == nil {
+		return 0, 0, fmt.Errorf("unexpected vipsheader output: %q", out)
+	}
+	width, _ := strconv.Atoi(string(match[1]))
+	height, _ := strconv.Atoi(string(match[2]))
+	return width, height, nil
+}
+
+// sourceImageDimensions returns the displayed dimensions of a source image.
+// Orientations 5-8 rotate by 90 or 270 degrees, so width and height of the
+// stored pixels are swapped, just like in the autorotated thumbnail.
+func (s *Server) sourceImageDimensions(ctx context.Context, imagePath string) (int, int, error) {
+	width, height, err := s.storedImageDimensions(ctx, imagePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	if s.imageOrientation(ctx, imagePath) >= 5 {
+		width, height = height, width
+	}
+	return width, height, nil
+}
+
+// imageOrientation returns the EXIF orientation of a source image, 1 when it
+// has none. JPEG is parsed in-process, PNG and GIF never carry one, and
+// everything else is asked of vipsheader.
+func (s *Server) imageOrientation(ctx context.Context, imagePath string) int {
+	switch strings.ToLower(filepath.Ext(imagePath)) {
+	case ".jpg", ".jpeg":
+		file, err := s.store.Open(ctx, imagePath)
+		if err != nil {
+			return 1
+		}
+		defer file.Close()
+		return readExifOrientation(file)
+	case ".png", ".gif":
+		return 1
+	}
+
+	input, err := s.store.Locate(ctx, imagePath)
+	if err != nil {
+		return 1
+	}
+	out, err := s.runner.command(ctx, vipsHeaderExecutable(), "-f", "orientation", input).Output()
+	if err != nil {
+		return 1
+	}
+	orientation, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil || orientation < 1 || orientation > 8 {
+		return 1
+	}
+	return orientation
+}
+
+// storedImageDimensions reads the pixel dimensions of a source image from the
+// media store. Formats the Go standard library understands are decoded from
+// the header only, everything else is handed to vipsheader.
+func (s *Server) storedImageDimensions(ctx context.Context, imagePath string) (int, int, error) {
+	if file, err := s.store.Open(ctx, imagePath); err == nil {
+		config, _, err := image.DecodeConfig(file)
+		file.Close()
+		if err == nil {
+			return config.Width, config.Height, nil
+		}
+	}
+
+	input, err := s.store.Locate(ctx, imagePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	return readImageDimensions(ctx, s.runner, input)
+}
+
+// imageDimensionsFor returns the dimensions of a source image, reading them
+// from the sidecar when it is fresh and recording them otherwise
+func (s *Server) imageDimensionsFor(ctx context.Context, imagePath string) (imageDimensions, error) {
+	info, err := s.store.Stat(ctx, imagePath)
+	if err != nil {
+		return imageDimensions{}, err
+	}
+	if dims, ok := loadDimensions(imagePath, info.ModTime()); ok {
+		return dims, nil
+	}
+
+	width, height, err := s.sourceImageDimensions(ctx, imagePath)
+	if err != nil {
+		return imageDimensions{}, err
+	}
+	dims := imageDimensions{Width: width, Height: height, ModTime: info.ModTime().UnixNano(), Version: dimensionsVersion}
+	if err := saveDimensions(imagePath, dims); err != nil {
+		return dims, err
+	}
+	return dims, nil
+}
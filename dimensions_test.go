@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDimensionsFollowOrientation(t *testing.T) {
+	s := newTestServer(t)
+	for orientation := 1; orientation <= 8; orientation++ {
+		imagePath := writeOrientedJPEG(t, s, fmt.Sprintf("o%d.jpg", orientation), 40, 20, orientation)
+		if got := s.imageOrientation(t.Context(), imagePath); got != orientation {
+			t.Fatalf("orientation %d read as %d", orientation, got)
+		}
+
+		// 5-8 turn the picture by 90 or 270 degrees
+		wantWidth, wantHeight := 40, 20
+		if orientation >= 5 {
+			wantWidth, wantHeight = 20, 40
+		}
+		dims, err := s.imageDimensionsFor(t.Context(), imagePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dims.Width != wantWidth || dims.Height != wantHeight {
+			t.Errorf("orientation %d: %dx%d, want %dx%d", orientation, dims.Width, dims.Height, wantWidth, wantHeight)
+		}
+	}
+}
+
+func TestRotatedJPEGThumbnail(t *testing.T) {
+	s := newTestServer(t)
+	for orientation, want := range map[int][2]int{1: {300, 150}, 3: {300, 150}, 6: {150, 300}, 8: {150, 300}} {
+		imagePath := writeOrientedJPEG(t, s, fmt.Sprintf("o%d.jpg", orientation), 400, 200, orientation)
+		if err := s.generateThumbnail(t.Context(), imagePath, defaultThumbnailVariant()); err != nil {
+			t.Fatal(err)
+		}
+		if w, h := thumbnailSize(t, s.thumbnailPathFor(imagePath, defaultThumbnailVariant())); w != want[0] || h != want[1] {
+			t.Errorf("orientation %d: thumbnail %dx%d, want %dx%d", orientation, w, h, want[0], want[1])
+		}
+	}
+}
+
+func TestRotatedJPEGSkipsEmbeddedThumbnail(t *testing.T) {
+	s := newTestServer(t)
+	s.resizeWorkers(1, 1)
+	t.Cleanup(func() { s.resizeWorkers(0, 0) })
+	// A portrait photo stored landscape, its EXIF thumbnail as well
+	embedded := writeJPEGWithThumbnail(t, s, "portrait.jpg", 400, 300, 160, 120, 6)
+
+	rec := httptest.NewRecorder()
+	s.newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/thumbnail/portrait.jpg?size=160", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if bytes.Equal(rec.Body.Bytes(), embedded) {
+		t.Fatal("the sideways EXIF thumbnail was served")
+	}
+	config, err := jpeg.DecodeConfig(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Width > config.Height {
+		t.Errorf("thumbnail %dx%d, want it upright", config.Width, config.Height)
+	}
+}
+
+func TestVipsThumbnailAutoRotates(t *testing.T) {
+	s := newTestServer(t)
+	s.nativeThumbnails = false
+	argsLog := fakeVips(t)
+	imagePath := writeOrientedJPEG(t, s, "portrait.jpg", 400, 200, 6)
+	if err := s.generateThumbnail(t.Context(), imagePath, defaultThumbnailVariant()); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(argsLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(strings.Split(string(data), "\n"), vipsAutoRotate) {
+		t.Errorf("vipsthumbnail ran without %s: %q", vipsAutoRotate, data)
+	}
+}
+
+func TestEmbeddedThumbnailOnlyWhenItFits(t *testing.T) {
+	s := newTestServer(t)
+	s.resizeWorkers(1, 1)
+	t.Cleanup(func() { s.resizeWorkers(0, 0) })
+	embedded := writeJPEGWithThumbnail(t, s, "photo.jpg", 400, 300, 160, 120, 1)
+	mux := s.newMux()
+	get := func(size string) []byte {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/thumbnail/photo.jpg?size="+size, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("size %s: status %d: %s", size, rec.Code, rec.Body)
+		}
+		return rec.Body.Bytes()
+	}
+
+	if !bytes.Equal(get("160"), embedded) {
+		t.Error("size 160 wasn't served from the embedded thumbnail")
+	}
+	if bytes.Equal(get("150"), embedded) {
+		t.Error("size 150 was served from a 160 pixel embedded thumbnail")
+	}
+	s.thumbnailMode = "center-crop"
+	if bytes.Equal(get("160"), embedded) {
+		t.Error("a cropped thumbnail was served from the embedded thumbnail")
+	}
+}
+
+func TestEmbeddedThumbnailNotServedWithWatermark(t *testing.T) {
+	s := newTestServer(t)
+	runner := &recordingRunner{dir: t.TempDir()}
+	s.watermark = &watermark{path: filepath.Join(t.TempDir(), "mark.png"), width: 10, height: 10, position: "center", scale: 0.2, runner: runner}
+	s.resizeWorkers(1, 1)
+	t.Cleanup(func() { s.resizeWorkers(0, 0) })
+	embedded := writeJPEGWithThumbnail(t, s, "photo.jpg", 400, 300, 160, 120, 1)
+
+	rec := httptest.NewRecorder()
+	s.newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/thumbnail/photo.jpg?size=160", nil))
+	if bytes.Equal(rec.Body.Bytes(), embedded) {
+		t.Error("the embedded thumbnail was served without the watermark")
+	}
+	if runner.calls.Load() == 0 {
+		t.Error("no watermark was put on the thumbnail")
+	}
+}
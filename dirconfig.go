@@ -0,0 +1,124 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// dirConfigName is the optional per-directory settings file
+const dirConfigName = ".gallery.json"
+
+// dirConfig overrides server settings for a directory. Thumbnail mode and
+// sort order apply to its subdirectories too unless they override them
+// again; hidden and cover concern the directory itself.
+type dirConfig struct {
+	ThumbnailMode string `json:"thumbnailMode,omitempty"` // fit, center-crop or smart-crop
+	Sort          string `json:"sort,omitempty"`          // manual, the default order when ?sort= is not given
+	Hidden        bool   `json:"hidden,omitempty"`        // left out of the parent's listing, still reachable by path
+	Cover         string `json:"cover,omitempty"`         // name of the image shown on the directory's tile
+}
+
+// cachedDirConfig is a parsed .gallery.json, valid while the file is unchanged
+type cachedDirConfig struct {
+	modTime time.Time
+	size    int64
+	config  dirConfig
+}
+
+// ownDirConfig returns the settings in a directory's own .gallery.json, the
+// zero config when it has none. Parsed files are cached until they change;
+// invalid ones are logged and ignored.
+func (s *Server) ownDirConfig(dir string) dirConfig {
+	configPath := filepath.Join(dir, dirConfigName)
+	info, err := os.Stat(configPath)
+	if err != nil {
+		s.dirConfigs.Delete(configPath)
+		return dirConfig{}
+	}
+	if cached, ok := s.dirConfigs.Load(configPath); ok {
+		if c := cached.(cachedDirConfig); c.modTime.Equal(info.ModTime()) && c.size == info.Size() {
+			return c.config
+		}
+	}
+
+	var config dirConfig
+	data, err := os.ReadFile(configPath)
+	if err == nil {
+		err = json.Unmarshal(data, &config)
+	}
+	if err == nil {
+		err = config.validate()
+	}
+	if err != nil {
+		log.Printf("Ignoring %s: %v", configPath, err)
+		config = dirConfig{}
+	}
+	s.dirConfigs.Store(configPath, cachedDirConfig{modTime: info.ModTime(), size: info.Size(), config: config})
+	return config
+}
+
+// validate rejects settings the server doesn't know
+func (c dirConfig) validate() error {
+	switch c.ThumbnailMode {
+	case "", "fit", "center-crop", "smart-crop":
+	default:
+		return errors.New("thumbnailMode must be fit, center-crop or smart-crop")
+	}
+	if c.Sort != "" && c.Sort != "manual" {
+		return errors.New("sort must be manual")
+	}
+	if strings.ContainsAny(c.Cover, "/\\") || (c.Cover != "" && !isImageFile(c.Cover) && !isMovieFile(c.Cover)) {
+		return errors.New("cover must be the name of an image or movie in the directory")
+	}
+	return nil
+}
+
+// dirConfigFor returns the settings in effect for a directory: its own
+// .gallery.json on top of those of its parents up to the root
+func (s *Server) dirConfigFor(dir string) dirConfig {
+	relPath, err := filepath.Rel(s.rootDir, dir)
+	if err != nil || strings.HasPrefix(relPath, "..") {
+		return dirConfig{}
+	}
+	config := s.ownDirConfig(s.rootDir)
+	current := s.rootDir
+	if relPath != "." {
+		for _, part := range strings.Split(relPath, string(filepath.Separator)) {
+			current = filepath.Join(current, part)
+			own := s.ownDirConfig(current)
+			config.ThumbnailMode = cmp.Or(own.ThumbnailMode, config.ThumbnailMode)
+			config.Sort = cmp.Or(own.Sort, config.Sort)
+			config.Hidden, config.Cover = own.Hidden, own.Cover
+		}
+	}
+	return config
+}
+
+// hiddenByDirConfig reports whether fullPath is, or lies below, a directory
+// hidden by its .gallery.json
+func (s *Server) hiddenByDirConfig(fullPath string) bool {
+	relPath, err := filepath.Rel(s.rootDir, fullPath)
+	if err != nil || relPath == "." || strings.HasPrefix(relPath, "..") {
+		return false
+	}
+	current := s.rootDir
+	for _, part := range strings.Split(relPath, string(filepath.Separator)) {
+		current = filepath.Join(current, part)
+		if s.ownDirConfig(current).Hidden {
+			return true
+		}
+	}
+	return false
+}
+
+// thumbnailModeFor returns the thumbnail mode for a file, from the nearest
+// .gallery.json that sets one or else -thumbnail-mode
+func (s *Server) thumbnailModeFor(path string) string {
+	return cmp.Or(s.dirConfigFor(filepath.Dir(path)).ThumbnailMode, s.thumbnailMode)
+}
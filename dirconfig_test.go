@@ -0,0 +1,64 @@
+package main
+
+import (
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// thumbnailSize decodes a generated thumbnail and returns its size
+func thumbnailSize(t *testing.T, path string) (int, int) {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	config, err := jpeg.DecodeConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config.Width, config.Height
+}
+
+func TestDirConfigModeGetsOwnThumbnails(t *testing.T) {
+	s := newTestServer(t)
+	// The mode is read from the source directory, not the cache's
+	cacheDir, cacheSourceRoot = t.TempDir(), s.rootDir
+	t.Cleanup(func() { cacheDir, cacheSourceRoot = "", "" })
+	s.placeholderVariant = thumbnailVariant{size: 100}
+	photo := writeTestJPEG(t, s, "trip/photo.jpg", 400, 200)
+
+	fitPath := s.thumbnailPathFor(photo, defaultThumbnailVariant())
+	if err := s.generateThumbnail(t.Context(), photo, defaultThumbnailVariant()); err != nil {
+		t.Fatal(err)
+	}
+	if w, h := thumbnailSize(t, fitPath); w != 300 || h != 150 {
+		t.Fatalf("fit thumbnail is %dx%d, want 300x150", w, h)
+	}
+
+	writeTestFile(t, s, "trip/"+dirConfigName, []byte(`{"thumbnailMode": "center-crop"}`))
+	cropPath := s.thumbnailPathFor(photo, defaultThumbnailVariant())
+	if cropPath == fitPath {
+		t.Fatalf("center-crop thumbnail shares the fit thumbnail's path %s", fitPath)
+	}
+	if err := s.generateThumbnail(t.Context(), photo, defaultThumbnailVariant()); err != nil {
+		t.Fatal(err)
+	}
+	if w, h := thumbnailSize(t, cropPath); w != 300 || h != 300 {
+		t.Errorf("center-crop thumbnail is %dx%d, want 300x300", w, h)
+	}
+	if w, h := thumbnailSize(t, s.thumbnailPathFor(photo, s.placeholderVariant)); w != 100 || h != 100 {
+		t.Errorf("center-crop placeholder is %dx%d, want 100x100", w, h)
+	}
+	if filepath.Base(cropPath) != "photo.jpg.center-crop.v2.jpg" {
+		t.Errorf("thumbnail name %s doesn't say its mode", filepath.Base(cropPath))
+	}
+	// Pruning and rebuilds find the source of every rendition by its name
+	for _, base := range []string{"photo.jpg.center-crop.v2", "photo.jpg.600.pad4x3.smart-crop.v2", "photo.jpg.pad4x3.center-crop", "photo.jpg.v2"} {
+		if got := thumbnailVariantSuffix.ReplaceAllString(base, ""); got != "photo.jpg" {
+			t.Errorf("source of %s = %s, want photo.jpg", base, got)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxDirIndexes bounds the directories kept by -list-index. A 50k file
+// directory is tens of megabytes, so only a few large ones fit comfortably.
+const maxDirIndexes = 64
+
+// dirIndex is the complete, sorted listing of one directory, valid
+// while the directory's own mtime is unchanged
+type dirIndex struct {
+	key     string
+	modTime time.Time
+	version time.Time // directoryVersion and entry count, for the ETag
+	entries int
+	files   []FileInfo
+	stats   DirectoryStats
+}
+
+// dirIndexes is an in-memory LRU of sorted directory listings, keyed by
+// path and query options, that serves windowed ?offset=&limit= requests
+// without reading and sorting the directory again. Adding, removing or
+// renaming a file changes the directory's mtime and so invalidates it.
+type dirIndexes struct {
+	mu      sync.Mutex
+	order   *list.List // front = most recently used
+	entries map[string]*list.Element
+}
+
+func newDirIndexes() *dirIndexes {
+	return &dirIndexes{
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns the index for key if the directory hasn't changed since
+func (c *dirIndexes) get(key string, modTime time.Time) (*dirIndex, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	index := elem.Value.(*dirIndex)
+	if !index.modTime.Equal(modTime) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return index, true
+}
+
+// put stores an index, evicting the least recently used one when full
+func (c *dirIndexes) put(index *dirIndex) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[index.key]; ok {
+		elem.Value = index
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[index.key] = c.order.PushFront(index)
+	if c.order.Len() > maxDirIndexes {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*dirIndex).key)
+	}
+}
+
+// listWindow parses the optional ?offset=&limit= of a listing request. A
+// limit of 0 means everything from offset on.
+func listWindow(r *http.Request) (offset, limit int, windowed, ok bool) {
+	query := r.URL.Query()
+	if !query.Has("offset") && !query.Has("limit") {
+		return 0, 0, false, true
+	}
+	var err error
+	if value := query.Get("offset"); value != "" {
+		if offset, err = strconv.Atoi(value); err != nil || offset < 0 {
+			return 0, 0, false, false
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			return 0, 0, false, false
+		}
+	}
+	return offset, limit, true, true
+}
+
+// windowOf returns the items from offset, at most limit of them, or all of
+// them with a limit of 0. It never returns nil, so JSON gets an empty array.
+func windowOf[T any](items []T, offset, limit int) []T {
+	if offset >= len(items) {
+		return []T{}
+	}
+	items = items[offset:]
+	if limit > 0 && limit < len(items) {
+		items = items[:limit]
+	}
+	return items
+}
+
+// pageLinks returns the URLs of the windows before and after the current
+// one, with every other query parameter of the request kept. Either is empty
+// at the start or end of the listing; without a limit there are no pages.
+func (s *Server) pageLinks(r *http.Request, offset, limit, total int) (prev, next string) {
+	if limit <= 0 {
+		return "", ""
+	}
+	link := func(offset int) string {
+		query := r.URL.Query()
+		query.Set("offset", strconv.Itoa(offset))
+		return s.requestURL(r, "/api/list") + "?" + query.Encode()
+	}
+	if offset > 0 {
+		prev = link(max(0, offset-limit))
+	}
+	// Compared this way round, a huge offset can't overflow
+	if limit < total-offset {
+		next = link(offset + limit)
+	}
+	return prev, next
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// handleDownload serves the original bytes of a file as an attachment under
+// its own name. Unlike /static it always sets a Content-Disposition and an
+// ETag, and never renders directories or SVGs inline. Ranges are honoured,
+// so large RAW files and movies can be resumed.
+func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/api/download")
+	if strings.Trim(path, "/") == "" {
+		http.Error(w, "Path required", http.StatusBadRequest)
+		return
+	}
+
+	fullPath, ok := s.resolvePath(path)
+	if !ok {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+	if s.isExcludedPath(s.urlPathFor(fullPath)) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	info, err := s.store.Stat(r.Context(), fullPath)
+	if err != nil || info.IsDir() {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	// ServeFile checks If-None-Match and If-Range against this ETag and adds
+	// Last-Modified from the file itself
+	w.Header().Set("ETag", fileETag(info, ""))
+	w.Header().Set("Content-Type", mimeTypeFor(fullPath))
+	setAttachmentHeaders(w, fullPath)
+	w.Header().Set("Cache-Control", "no-cache")
+	s.store.ServeFile(w, r, fullPath)
+}
+
+// setAttachmentHeaders has browsers save a file rather than render it on
+// the gallery's origin, where scripts in an uploaded HTML page or SVG
+// drawing would run with the visitor's session. Embedding it, e.g. an SVG
+// in an <img>, still works.
+func setAttachmentHeaders(w http.ResponseWriter, fullPath string) {
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(fullPath)}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+}
+
+// rendersInline reports whether /static serves a file for the browser to
+// show: the images and movies of the gallery and their thumbnails, but not
+// SVG drawings, which can carry scripts, nor any other file
+func rendersInline(fullPath string) bool {
+	ext := strings.ToLower(filepath.Ext(fullPath))
+	return (imageExtensions[ext] || movieExtensions[ext]) && !isSVGFile(fullPath)
+}
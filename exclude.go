@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// defaultExcludePatterns cover the files operating systems and NAS software
+// leave in photo folders
+const defaultExcludePatterns = "._*,.DS_Store,Thumbs.db,ehthumbs.db,desktop.ini,@eaDir,#recycle,$RECYCLE.BIN,System Volume Information"
+
+// parseExcludePatterns splits a comma-separated list of glob patterns and
+// checks their syntax. Patterns are matched case-insensitively.
+func parseExcludePatterns(spec string) ([]string, error) {
+	var patterns []string
+	for _, pattern := range strings.Split(spec, ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern %q: %w", pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// isExcluded reports whether a file or directory name matches an exclude pattern
+func (s *Server) isExcluded(name string) bool {
+	name = strings.ToLower(name)
+	for _, pattern := range s.exclude {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isExcludedPath reports whether any component of a path relative to the
+// root is excluded, so files inside an excluded directory are excluded too
+func (s *Server) isExcludedPath(relPath string) bool {
+	for _, part := range strings.Split(filepath.ToSlash(relPath), "/") {
+		if part != "" && s.isExcluded(part) {
+			return true
+		}
+	}
+	return false
+}
+
+// isHiddenPath reports whether any component of a path relative to the root
+// is hidden, like .small, .trash or a dotfile. Hidden files are never
+// listed, so they aren't served either.
+func isHiddenPath(relPath string) bool {
+	for _, part := range strings.Split(filepath.ToSlash(relPath), "/") {
+		if strings.HasPrefix(part, ".") && part != "." {
+			return true
+		}
+	}
+	return false
+}
+
+// isServedThumbnailPath reports whether a path relative to the root is a
+// thumbnail right inside a .small directory, the one kind of hidden file
+// /static/ serves. The session key, favorites and the trash are not.
+func isServedThumbnailPath(relPath string) bool {
+	parts := strings.Split(filepath.ToSlash(relPath), "/")
+	n := len(parts)
+	if n < 2 || !isCacheDirName(parts[n-2]) || isHiddenPath(strings.Join(parts[:n-2], "/")) || strings.HasPrefix(parts[n-1], ".") {
+		return false
+	}
+	switch strings.ToLower(filepath.Ext(parts[n-1])) {
+	case ".jpg", ".webp", ".avif":
+		return true
+	}
+	return false
+}
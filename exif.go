@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Maximum edge length of an EXIF embedded thumbnail. The EXIF spec
+// recommends 160x120, so anything larger must be generated by vips.
+const maxEmbeddedThumbSize = 160
+
+// EXIF/TIFF tags used by the gallery
+const (
+	tagThumbnailOffset  = 0x0201 // JPEGInterchangeFormat
+	tagThumbnailLength  = 0x0202 // JPEGInterchangeFormatLength
+	tagMake             = 0x010f
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769 // pointer to the Exif sub-IFD
+	tagGPSIFD           = 0x8825 // pointer to the GPS sub-IFD
+	tagDateTimeOriginal = 0x9003
+	tagExposureTime     = 0x829a
+	tagFNumber          = 0x829d
+	tagISO              = 0x8827 // ISOSpeedRatings, PhotographicSensitivity in EXIF 2.3
+	tagFocalLength      = 0x920a
+	tagLensModel        = 0xa434
+	tagGPSLatitudeRef   = 0x0001
+	tagGPSLatitude      = 0x0002
+	tagGPSLongitudeRef  = 0x0003
+	tagGPSLongitude     = 0x0004
+)
+
+// exifDateLayout is the format of EXIF date/time values. They carry no time
+// zone, so they are interpreted as local time of wherever the photo was taken.
+const exifDateLayout = "2006:01:02 15:04:05"
+
+var errNoExif = errors.New("no EXIF data found")
+
+// tiffData is a parsed TIFF structure as found inside an EXIF APP1 segment
+type tiffData struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// ifdEntry is a single raw entry from an image file directory
+type ifdEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte // raw 4-byte value/offset field
+}
+
+// readJPEGExif scans the JPEG markers at the start of a file and returns the
+// TIFF payload of the EXIF APP1 segment. It stops at the start of scan so
+// only the header of the file is ever read.
+func readJPEGExif(r io.Reader) ([]byte, error) {
+	br := bufio.NewReader(r)
+
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil {
+		return nil, err
+	}
+	if soi[0] != 0xFF || soi[1] != 0xD8 {
+		return nil, fmt.Errorf("not a JPEG file")
+	}
+
+	for {
+		// Markers may be padded with any number of 0xFF bytes
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b != 0xFF {
+			return nil, fmt.Errorf("invalid JPEG marker")
+		}
+		marker, err := br.ReadByte()
+		for err == nil && marker == 0xFF {
+			marker, err = br.ReadByte()
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Start of scan or end of image: no more metadata segments
+		if marker == 0xDA || marker == 0xD9 {
+			return nil, errNoExif
+		}
+		// Standalone markers carry no length
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			continue
+		}
+
+		var lenBuf [2]byte
+		if _, err := io.ReadFull(br, lenBuf[:]); err != nil {
+			return nil, err
+		}
+		segLen := int(binary.BigEndian.Uint16(lenBuf[:])) - 2
+		if segLen < 0 {
+			return nil, fmt.Errorf("invalid JPEG segment length")
+		}
+
+		if marker != 0xE1 {
+			if _, err := br.Discard(segLen); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		segment := make([]byte, segLen)
+		if _, err := io.ReadFull(br, segment); err != nil {
+			return nil, err
+		}
+		// APP1 is also used for XMP, only accept the EXIF variant
+		if bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:], nil
+		}
+	}
+}
+
+// parseTIFF validates the TIFF header and determines the byte order
+func parseTIFF(data []byte) (*tiffData, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("TIFF header too short")
+	}
+	var order binary.ByteOrder
+	switch string(data[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("invalid TIFF byte order")
+	}
+	if order.Uint16(data[2:4]) != 42 {
+		return nil, fmt.Errorf("invalid TIFF magic")
+	}
+	return &tiffData{data: data, order: order}, nil
+}
+
+// firstIFD returns the offset of IFD0
+func (t *tiffData) firstIFD() uint32 {
+	return t.order.Uint32(t.data[4:8])
+}
+
+// readIFD reads the directory at the given offset and returns its entries
+// keyed by tag, plus the offset of the next IFD in the chain (0 if none)
+func (t *tiffData) readIFD(offset uint32) (map[uint16]ifdEntry, uint32, error) {
+	if offset == 0 || int(offset)+2 > len(t.data) {
+		return nil, 0, fmt.Errorf("IFD offset out of range")
+	}
+	count := int(t.order.Uint16(t.data[offset:]))
+	start := int(offset) + 2
+	end := start + count*12
+	if end+4 > len(t.data) {
+		return nil, 0, fmt.Errorf("IFD extends past end of data")
+	}
+
+	entries := make(map[uint16]ifdEntry, count)
+	for i := start; i < end; i += 12 {
+		e := ifdEntry{
+			tag:   t.order.Uint16(t.data[i:]),
+			typ:   t.order.Uint16(t.data[i+2:]),
+			count: t.order.Uint32(t.data[i+4:]),
+			value: t.data[i+8 : i+12],
+		}
+		entries[e.tag] = e
+	}
+	next := t.order.Uint32(t.data[end:])
+	return entries, next, nil
+}
+
+// uint returns the first value of a SHORT or LONG entry
+func (t *tiffData) uint(e ifdEntry) (uint32, bool) {
+	switch e.typ {
+	case 3: // SHORT
+		return uint32(t.order.Uint16(e.value)), true
+	case 4: // LONG
+		return t.order.Uint32(e.value), true
+	}
+	return 0, false
+}
+
+// ascii returns the value of an ASCII entry without its NUL terminator
+func (t *tiffData) ascii(e ifdEntry) (string, bool) {
+	if e.typ != 2 {
+		return "", false
+	}
+	raw := e.value
+	if e.count > 4 {
+		off := t.order.Uint32(e.value)
+		if uint64(off)+uint64(e.count) > uint64(len(t.data)) {
+			return "", false
+		}
+		raw = t.data[off : off+e.count]
+	} else {
+		raw = raw[:e.count]
+	}
+	return strings.TrimRight(string(raw), "\x00 "), true
+}
+
+// rationals returns the values of an unsigned RATIONAL entry
+func (t *tiffData) rationals(e ifdEntry) ([]float64, bool) {
+	if e.typ != 5 {
+		return nil, false
+	}
+	off := t.order.Uint32(e.value)
+	if uint64(off)+uint64(e.count)*8 > uint64(len(t.data)) {
+		return nil, false
+	}
+	values := make([]float64, e.count)
+	for i := range values {
+		p := off + uint32(i)*8
+		num, den := t.order.Uint32(t.data[p:]), t.order.Uint32(t.data[p+4:])
+		if den == 0 {
+			return nil, false
+		}
+		values[i] = float64(num) / float64(den)
+	}
+	return values, true
+}
+
+// subIFD reads the directory an IFD0 pointer tag refers to
+func (t *tiffData) subIFD(ifd0 map[uint16]ifdEntry, tag uint16) (map[uint16]ifdEntry, bool) {
+	e, ok := ifd0[tag]
+	if !ok {
+		return nil, false
+	}
+	offset, ok := t.uint(e)
+	if !ok {
+		return nil, false
+	}
+	ifd, _, err := t.readIFD(offset)
+	return ifd, err == nil
+}
+
+// orientation returns the EXIF orientation (1-8) from IFD0, 1 if absent
+func (t *tiffData) orientation() int {
+	ifd0, _, err := t.readIFD(t.firstIFD())
+	if err != nil {
+		return 1
+	}
+	e, ok := ifd0[tagOrientation]
+	if !ok {
+		return 1
+	}
+	v, ok := t.uint(e)
+	if !ok || v < 1 || v > 8 {
+		return 1
+	}
+	return int(v)
+}
+
+// exifMetadata is the subset of EXIF metadata the gallery reports
+type exifMetadata struct {
+	taken     time.Time // zero if unknown
+	camera    string    // make and model, "" if not recorded
+	hasGPS    bool
+	latitude  float64 // degrees, negative south of the equator
+	longitude float64 // degrees, negative west of Greenwich
+
+	// Exposure settings, zero when not recorded
+	maker       string
+	model       string
+	lens        string
+	iso         int
+	exposure    float64 // seconds
+	fNumber     float64
+	focalLength float64 // millimetres
+	orientation int     // 1-8, 0 if not recorded
+}
+
+// metadata extracts the capture time, camera, exposure and GPS position
+func (t *tiffData) metadata() exifMetadata {
+	var meta exifMetadata
+	ifd0, _, err := t.readIFD(t.firstIFD())
+	if err != nil {
+		return meta
+	}
+
+	// Prefer the capture time over the last modification time
+	if exifIFD, ok := t.subIFD(ifd0, tagExifIFD); ok {
+		if v, ok := t.ascii(exifIFD[tagDateTimeOriginal]); ok {
+			meta.taken, _ = time.Parse(exifDateLayout, v)
+		}
+		if v, ok := t.uint(exifIFD[tagISO]); ok {
+			meta.iso = int(v)
+		}
+		if v, ok := t.rationals(exifIFD[tagExposureTime]); ok && len(v) > 0 {
+			meta.exposure = v[0]
+		}
+		if v, ok := t.rationals(exifIFD[tagFNumber]); ok && len(v) > 0 {
+			meta.fNumber = v[0]
+		}
+		if v, ok := t.rationals(exifIFD[tagFocalLength]); ok && len(v) > 0 {
+			meta.focalLength = v[0]
+		}
+		meta.lens, _ = t.ascii(exifIFD[tagLensModel])
+	}
+	if meta.taken.IsZero() {
+		if v, ok := t.ascii(ifd0[tagDateTime]); ok {
+			meta.taken, _ = time.Parse(exifDateLayout, v)
+		}
+	}
+
+	meta.maker, _ = t.ascii(ifd0[tagMake])
+	meta.model, _ = t.ascii(ifd0[tagModel])
+	meta.camera = strings.TrimSpace(meta.maker + " " + meta.model)
+	if v, ok := t.uint(ifd0[tagOrientation]); ok && v >= 1 && v <= 8 {
+		meta.orientation = int(v)
+	}
+
+	if gps, ok := t.subIFD(ifd0, tagGPSIFD); ok {
+		lat, okLat := t.gpsCoordinate(gps[tagGPSLatitude], gps[tagGPSLatitudeRef], "S")
+		lon, okLon := t.gpsCoordinate(gps[tagGPSLongitude], gps[tagGPSLongitudeRef], "W")
+		if okLat && okLon {
+			meta.hasGPS, meta.latitude, meta.longitude = true, lat, lon
+		}
+	}
+	return meta
+}
+
+// gpsCoordinate converts a degrees/minutes/seconds entry to decimal degrees,
+// negated when the reference matches the given hemisphere
+func (t *tiffData) gpsCoordinate(value, ref ifdEntry, negative string) (float64, bool) {
+	dms, ok := t.rationals(value)
+	if !ok || len(dms) != 3 {
+		return 0, false
+	}
+	degrees := dms[0] + dms[1]/60 + dms[2]/3600
+	if r, _ := t.ascii(ref); r == negative {
+		degrees = -degrees
+	}
+	return degrees, true
+}
+
+// embeddedThumbnail returns the JPEG thumbnail stored in IFD1, if any
+func (t *tiffData) embeddedThumbnail() ([]byte, bool) {
+	_, next, err := t.readIFD(t.firstIFD())
+	if err != nil || next == 0 {
+		return nil, false
+	}
+	ifd1, _, err := t.readIFD(next)
+	if err != nil {
+		return nil, false
+	}
+
+	offEntry, ok1 := ifd1[tagThumbnailOffset]
+	lenEntry, ok2 := ifd1[tagThumbnailLength]
+	if !ok1 || !ok2 {
+		return nil, false
+	}
+	off, ok1 := t.uint(offEntry)
+	length, ok2 := t.uint(lenEntry)
+	if !ok1 || !ok2 || length == 0 || uint64(off)+uint64(length) > uint64(len(t.data)) {
+		return nil, false
+	}
+
+	thumb := t.data[off : off+length]
+	// Sanity check that this really is a JPEG stream
+	if len(thumb) < 2 || thumb[0] != 0xFF || thumb[1] != 0xD8 {
+		return nil, false
+	}
+	return thumb, true
+}
+
+// readEmbeddedThumbnail extracts the EXIF thumbnail from a JPEG stream. The
+// thumbnail is stored the way the sensor saw the picture, so there is none
+// to serve of a photo with an EXIF orientation that turns or mirrors it.
+func readEmbeddedThumbnail(r io.Reader) ([]byte, bool) {
+	exifData, err := readJPEGExif(r)
+	if err != nil {
+		return nil, false
+	}
+	tiff, err := parseTIFF(exifData)
+	if err != nil || tiff.orientation() != 1 {
+		return nil, false
+	}
+	return tiff.embeddedThumbnail()
+}
+
+// readExifMetadata extracts the capture time, camera and GPS position from a
+// JPEG stream
+func readExifMetadata(r io.Reader) (exifMetadata, bool) {
+	exifData, err := readJPEGExif(r)
+	if err != nil {
+		return exifMetadata{}, false
+	}
+	tiff, err := parseTIFF(exifData)
+	if err != nil {
+		return exifMetadata{}, false
+	}
+	return tiff.metadata(), true
+}
+
+// maxTIFFHeader bounds how much of a TIFF-based RAW file is read for its
+// metadata. The IFDs sit near the start, ahead of the image data.
+const maxTIFFHeader = 1 << 20
+
+// readTIFFExifMetadata extracts the same metadata as readExifMetadata from
+// a TIFF-based file such as DNG, ARW or NEF, whose header is itself the
+// TIFF structure EXIF uses
+func readTIFFExifMetadata(r io.Reader) (exifMetadata, bool) {
+	data, err := io.ReadAll(io.LimitReader(r, maxTIFFHeader))
+	if err != nil {
+		return exifMetadata{}, false
+	}
+	tiff, err := parseTIFF(data)
+	if err != nil {
+		return exifMetadata{}, false
+	}
+	return tiff.metadata(), true
+}
+
+// readExifOrientation returns the EXIF orientation of a JPEG stream, 1 (no
+// transformation) when there is none
+func readExifOrientation(r io.Reader) int {
+	exifData, err := readJPEGExif(r)
+	if err != nil {
+		return 1
+	}
+	tiff, err := parseTIFF(exifData)
+	if err != nil {
+		return 1
+	}
+	return tiff.orientation()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// exportColumns is the header row of /api/export.csv
+var exportColumns = []string{"name", "size", "date_taken", "width", "height", "latitude", "longitude"}
+
+// handleExportCSV streams a CSV with the metadata of every file in a directory.
+// Rows are flushed as they are produced so large directories start
+// downloading immediately.
+func (s *Server) handleExportCSV(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		path = "/"
+	}
+	fullPath, ok := s.resolvePath(path)
+	if !ok {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	entries, err := s.store.ReadDir(r.Context(), fullPath)
+	if err != nil {
+		http.Error(w, "Directory not found", http.StatusNotFound)
+		return
+	}
+
+	name := filepath.Base(fullPath)
+	if fullPath == s.rootDir {
+		name = "gallery"
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+strings.ReplaceAll(name, `"`, "")+`.csv"`)
+
+	flusher, _ := w.(http.Flusher)
+	cw := csv.NewWriter(w)
+	cw.Write(exportColumns)
+
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || s.isExcluded(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		row := make([]string, len(exportColumns))
+		row[0] = entry.Name()
+		row[1] = strconv.FormatInt(info.Size(), 10)
+		s.exportImageMetadata(r.Context(), filepath.Join(fullPath, entry.Name()), row)
+
+		if err := cw.Write(row); err != nil {
+			log.Printf("Failed to write CSV export of %s: %v", fullPath, err)
+			return
+		}
+		cw.Flush()
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if r.Context().Err() != nil {
+			return
+		}
+	}
+	cw.Flush()
+}
+
+// exportImageMetadata fills the date, dimension and GPS columns of a row.
+// Non-images leave them empty, as do images without the metadata.
+func (s *Server) exportImageMetadata(ctx context.Context, fullPath string, row []string) {
+	if !isImageFile(fullPath) {
+		return
+	}
+	if dims, err := s.imageDimensionsFor(ctx, fullPath); err == nil {
+		row[3] = strconv.Itoa(dims.Width)
+		row[4] = strconv.Itoa(dims.Height)
+	}
+
+	// EXIF is only parsed from JPEG files
+	ext := strings.ToLower(filepath.Ext(fullPath))
+	if ext != ".jpg" && ext != ".jpeg" {
+		return
+	}
+	file, err := s.store.Open(ctx, fullPath)
+	if err != nil {
+		return
+	}
+	meta, ok := readExifMetadata(file)
+	file.Close()
+	if !ok {
+		return
+	}
+	if !meta.taken.IsZero() {
+		row[2] = meta.taken.Format("2006-01-02 15:04:05")
+	}
+	if meta.hasGPS {
+		row[5] = strconv.FormatFloat(meta.latitude, 'f', 6, 64)
+		row[6] = strconv.FormatFloat(meta.longitude, 'f', 6, 64)
+	}
+}
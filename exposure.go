@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// exposureBins is the number of luminance bins in an exposure histogram
+const exposureBins = 16
+
+// Luminance levels (0-255) at or beyond which a pixel counts as clipped
+const (
+	shadowClipLevel    = 8
+	highlightClipLevel = 247
+)
+
+// exposureStats summarizes the exposure of an image, measured on its
+// thumbnail, which is plenty for spotting badly exposed shots
+type exposureStats struct {
+	Brightness float64 `json:"brightness"` // mean luminance, 0 (black) to 1 (white)
+	Shadows    float64 `json:"shadows"`    // fraction of nearly black pixels
+	Highlights float64 `json:"highlights"` // fraction of nearly white pixels
+	Histogram  []int   `json:"histogram"`  // percent of pixels per luminance bin, dark to light
+}
+
+// exposureRecord is the sidecar stored next to a thumbnail
+type exposureRecord struct {
+	exposureStats
+	ModTime int64 `json:"modTime"` // source mtime (UnixNano), used for invalidation
+}
+
+// getExposurePath returns the sidecar path holding the exposure of an image
+// e.g., photo.heic -> .small/photo.heic.exp.json
+func getExposurePath(imagePath string) string {
+	dir := filepath.Dir(imagePath)
+	baseName := cacheName(filepath.Base(imagePath))
+	return filepath.Join(thumbnailDirFor(dir), baseName+".exp.json")
+}
+
+// measureExposure computes the exposure of a JPEG thumbnail from the
+// luminance of its pixels
+func measureExposure(thumbnailPath string) (exposureStats, error) {
+	file, err := os.Open(thumbnailPath)
+	if err != nil {
+		return exposureStats{}, err
+	}
+	defer file.Close()
+	img, err := jpeg.Decode(file)
+	if err != nil {
+		return exposureStats{}, fmt.Errorf("failed to decode thumbnail: %w", err)
+	}
+
+	var bins [exposureBins]int
+	var sum, shadows, highlights, pixels int
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			var luma int
+			if ycc, ok := img.(*image.YCbCr); ok {
+				luma = int(ycc.Y[ycc.YOffset(x, y)])
+			} else {
+				r, g, b, _ := img.At(x, y).RGBA()
+				luma = int((299*r + 587*g + 114*b) / 1000 >> 8) // 16-bit RGBA to 8-bit luma
+			}
+			sum += luma
+			bins[luma*exposureBins/256]++
+			if luma <= shadowClipLevel {
+				shadows++
+			} else if luma >= highlightClipLevel {
+				highlights++
+			}
+			pixels++
+		}
+	}
+	if pixels == 0 {
+		return exposureStats{}, fmt.Errorf("empty thumbnail")
+	}
+
+	stats := exposureStats{
+		Brightness: round3(float64(sum) / float64(pixels) / 255),
+		Shadows:    round3(float64(shadows) / float64(pixels)),
+		Highlights: round3(float64(highlights) / float64(pixels)),
+		Histogram:  make([]int, exposureBins),
+	}
+	for i, count := range bins {
+		stats.Histogram[i] = int(math.Round(float64(count) * 100 / float64(pixels)))
+	}
+	return stats, nil
+}
+
+// round3 rounds to three decimals, which keeps listings short
+func round3(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
+
+// recordExposure measures a thumbnail and stores the result for the listing
+func recordExposure(imagePath, thumbnailPath string, modTime time.Time) (exposureStats, error) {
+	stats, err := measureExposure(thumbnailPath)
+	if err != nil {
+		return stats, err
+	}
+	data, err := json.Marshal(exposureRecord{exposureStats: stats, ModTime: modTime.UnixNano()})
+	if err != nil {
+		return stats, err
+	}
+	return stats, os.WriteFile(getExposurePath(imagePath), data, 0644)
+}
+
+// exposureFor returns the exposure of an image from its sidecar, measuring
+// the cached thumbnail if the sidecar is missing or stale. Images without
+// a thumbnail yet have none; listing them doesn't generate one.
+func (s *Server) exposureFor(imagePath string, modTime time.Time) (*exposureStats, bool) {
+	var record exposureRecord
+	if data, err := os.ReadFile(getExposurePath(imagePath)); err == nil && json.Unmarshal(data, &record) == nil && record.ModTime == modTime.UnixNano() {
+		return &record.exposureStats, true
+	}
+	thumbnailPath := s.thumbnailPathFor(imagePath, defaultThumbnailVariant())
+	if _, err := os.Stat(thumbnailPath); err != nil {
+		return nil, false
+	}
+	stats, err := recordExposure(imagePath, thumbnailPath, modTime)
+	if err != nil {
+		return nil, false
+	}
+	return &stats, true
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Favorites modes. Session favorites are kept per visitor, identified by a
+// signed cookie, global favorites are shared by everyone with the link.
+const (
+	favoritesOff     = "off"
+	favoritesGlobal  = "global"
+	favoritesSession = "session"
+)
+
+// globalFavoritesOwner is the owner key of the shared list in global mode
+const globalFavoritesOwner = ""
+
+const (
+	// maxFavoritesPerOwner bounds the favorites of one session, or of
+	// everyone in global mode
+	maxFavoritesPerOwner = 1000
+
+	// maxFavorites bounds the favorites of all owners together, and with it
+	// the favorites file rewritten on every change. Reaching it drops the
+	// sessions used least recently.
+	maxFavorites = 20000
+
+	// favoritesIdleTTL is how long the favorites of a session are kept after
+	// it last listed or changed them
+	favoritesIdleTTL = 90 * 24 * time.Hour
+)
+
+// errTooManyFavorites refuses a favorite beyond maxFavoritesPerOwner
+var errTooManyFavorites = errors.New("too many favorites")
+
+// favoritesStore holds the favorite media paths of every owner (a session
+// ID, or globalFavoritesOwner) and persists them to a JSON file
+type favoritesStore struct {
+	mu     sync.Mutex
+	path   string
+	owners map[string][]string
+	used   map[string]time.Time // when each owner last listed or changed its favorites, since startup
+	total  int                  // favorites of all owners
+}
+
+// favoritesRequest adds or removes one favorite
+type favoritesRequest struct {
+	Path     string `json:"path"`
+	Favorite bool   `json:"favorite"`
+}
+
+// favoritesResponse is the favorites list of the caller
+type favoritesResponse struct {
+	Mode      string   `json:"mode"`
+	Favorites []string `json:"favorites"`
+}
+
+// loadFavorites reads the favorites file, starting empty if there is none
+func loadFavorites(path string) (*favoritesStore, error) {
+	store := &favoritesStore{path: path, owners: make(map[string][]string), used: make(map[string]time.Time)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store.owners); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	// Sessions idle before startup get a full favoritesIdleTTL from now
+	now := time.Now()
+	for owner, paths := range store.owners {
+		store.used[owner] = now
+		store.total += len(paths)
+	}
+	return store, nil
+}
+
+// list returns a copy of an owner's favorites, sorted by path
+func (fav *favoritesStore) list(owner string) []string {
+	fav.mu.Lock()
+	defer fav.mu.Unlock()
+	if _, ok := fav.owners[owner]; ok {
+		fav.used[owner] = time.Now()
+	}
+	return append([]string{}, fav.owners[owner]...)
+}
+
+// set adds or removes a favorite of an owner and saves the store. An owner
+// already holding maxFavoritesPerOwner can't add more.
+func (fav *favoritesStore) set(owner, path string, favorite bool) ([]string, error) {
+	fav.mu.Lock()
+	defer fav.mu.Unlock()
+
+	paths := fav.owners[owner]
+	i, found := slices.BinarySearch(paths, path)
+	switch {
+	case favorite && !found:
+		if len(paths) >= maxFavoritesPerOwner {
+			return nil, errTooManyFavorites
+		}
+		fav.makeRoom(owner, time.Now())
+		paths = slices.Insert(paths, i, path)
+		fav.total++
+	case !favorite && found:
+		paths = slices.Delete(paths, i, i+1)
+		fav.total--
+	default:
+		return append([]string{}, paths...), nil
+	}
+	if len(paths) == 0 {
+		delete(fav.owners, owner)
+		delete(fav.used, owner)
+	} else {
+		fav.owners[owner] = paths
+		fav.used[owner] = time.Now()
+	}
+
+	if err := fav.save(); err != nil {
+		return nil, err
+	}
+	return append([]string{}, paths...), nil
+}
+
+// makeRoom drops the sessions idle for favoritesIdleTTL, then the ones
+// used least recently until one more favorite fits under maxFavorites.
+// Neither keep's favorites nor the global ones are dropped.
+func (fav *favoritesStore) makeRoom(keep string, now time.Time) {
+	for owner := range fav.owners {
+		if owner != keep && owner != globalFavoritesOwner && now.Sub(fav.used[owner]) > favoritesIdleTTL {
+			fav.drop(owner)
+		}
+	}
+	for fav.total >= maxFavorites {
+		oldest := ""
+		for owner := range fav.owners {
+			if owner != keep && owner != globalFavoritesOwner && (oldest == "" || fav.used[owner].Before(fav.used[oldest])) {
+				oldest = owner
+			}
+		}
+		if oldest == "" {
+			return
+		}
+		fav.drop(oldest)
+	}
+}
+
+// drop forgets all favorites of an owner
+func (fav *favoritesStore) drop(owner string) {
+	fav.total -= len(fav.owners[owner])
+	delete(fav.owners, owner)
+	delete(fav.used, owner)
+}
+
+// save writes the store next to its final path and renames it into place
+func (fav *favoritesStore) save() error {
+	data, err := json.Marshal(fav.owners)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fav.path), 0755); err != nil {
+		return err
+	}
+	tmpPath := fav.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, fav.path)
+}
+
+// favoritesOwner returns whose favorites a request reads and writes
+func (s *Server) favoritesOwner(w http.ResponseWriter, r *http.Request) (string, error) {
+	if s.favoritesMode == favoritesGlobal {
+		return globalFavoritesOwner, nil
+	}
+	return s.sessionID(w, r)
+}
+
+// handleFavorites lists (GET) or updates (POST) the caller's favorites.
+// In session mode the list belongs to the visitor's session cookie.
+func (s *Server) handleFavorites(w http.ResponseWriter, r *http.Request) {
+	if s.favorites == nil {
+		http.Error(w, "Favorites are disabled", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	owner, err := s.favoritesOwner(w, r)
+	if err != nil {
+		http.Error(w, "Failed to start session", http.StatusInternalServerError)
+		return
+	}
+	// The response depends on the cookie, never share it between visitors
+	w.Header().Set("Cache-Control", "private, no-store")
+
+	if r.Method != http.MethodPost {
+		respondJSON(w, favoritesResponse{Mode: s.favoritesMode, Favorites: s.favorites.list(owner)}, http.StatusOK)
+		return
+	}
+
+	var req favoritesRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil || req.Path == "" {
+		respondJSON(w, map[string]interface{}{
+			"error": "expected {\"path\": ..., \"favorite\": true|false}",
+		}, http.StatusBadRequest)
+		return
+	}
+	fullPath, ok := s.resolvePath(req.Path)
+	if !ok || fullPath == s.rootDir {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+	// Removing a favorite whose file is gone must still work
+	if req.Favorite {
+		if info, err := s.store.Stat(r.Context(), fullPath); err != nil || info.IsDir() {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+	}
+	favorites, err := s.favorites.set(owner, s.urlPathFor(fullPath), req.Favorite)
+	if errors.Is(err, errTooManyFavorites) {
+		respondJSON(w, map[string]interface{}{
+			"error": fmt.Sprintf("at most %d favorites", maxFavoritesPerOwner),
+		}, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to save favorites: %v", err)
+		respondJSON(w, map[string]interface{}{
+			"error": "failed to save favorites",
+		}, http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, favoritesResponse{Mode: s.favoritesMode, Favorites: favorites}, http.StatusOK)
+}
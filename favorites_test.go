@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFavoritesPerOwnerLimit(t *testing.T) {
+	fav, err := loadFavorites(filepath.Join(t.TempDir(), "favorites.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxFavoritesPerOwner; i++ {
+		if _, err := fav.set("visitor", fmt.Sprintf("/photo%d.jpg", i), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fav.set("visitor", "/one-more.jpg", true); !errors.Is(err, errTooManyFavorites) {
+		t.Errorf("favorite beyond the limit: err = %v, want %v", err, errTooManyFavorites)
+	}
+	if _, err := fav.set("visitor", "/photo0.jpg", false); err != nil {
+		t.Errorf("removing a favorite at the limit: %v", err)
+	}
+}
+
+func TestFavoritesDropIdleAndLeastRecentSessions(t *testing.T) {
+	fav, err := loadFavorites(filepath.Join(t.TempDir(), "favorites.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Fill the store, the global list and the sessions each holding an
+	// equal share, used one after the other
+	now := time.Now()
+	owners := maxFavorites / maxFavoritesPerOwner
+	for i := 0; i < owners; i++ {
+		owner := fmt.Sprintf("session%d", i)
+		if i == 0 {
+			owner = globalFavoritesOwner
+		}
+		paths := make([]string, maxFavoritesPerOwner)
+		for j := range paths {
+			paths[j] = fmt.Sprintf("/photo%04d.jpg", j)
+		}
+		fav.owners[owner] = paths
+		fav.used[owner] = now.Add(time.Duration(i-owners) * time.Minute)
+		fav.total += len(paths)
+	}
+	fav.used["session5"] = now.Add(-favoritesIdleTTL - time.Hour)
+
+	if _, err := fav.set("newcomer", "/beach.jpg", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fav.owners["session5"]; ok {
+		t.Error("an idle session was kept")
+	}
+	if _, ok := fav.owners[globalFavoritesOwner]; !ok {
+		t.Error("the global favorites were dropped")
+	}
+	if _, ok := fav.owners["session1"]; !ok {
+		t.Error("a session was dropped though the idle one made room")
+	}
+
+	// Full again: the session used least recently makes room
+	fav.owners["session5"] = fav.owners["session2"]
+	fav.used["session5"] = now
+	fav.total += maxFavoritesPerOwner
+	if _, err := fav.set("newcomer", "/hill.jpg", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fav.owners["session1"]; ok {
+		t.Error("the least recently used session was kept")
+	}
+	if _, ok := fav.owners["session2"]; !ok {
+		t.Error("more sessions were dropped than needed")
+	}
+	if fav.total > maxFavorites {
+		t.Errorf("%d favorites kept, want at most %d", fav.total, maxFavorites)
+	}
+}
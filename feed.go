@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultFeedItems = 50
+	maxFeedItems     = 200
+)
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	MediaNS string     `xml:"xmlns:media,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string         `xml:"title"`
+	Link        string         `xml:"link"`
+	GUID        rssGUID        `xml:"guid"`
+	PubDate     string         `xml:"pubDate"`
+	Description string         `xml:"description"`
+	Enclosure   rssEnclosure   `xml:"enclosure"`
+	Thumbnail   mediaThumbnail `xml:"media:thumbnail"`
+}
+
+type rssGUID struct {
+	Value       string `xml:",chardata"`
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+type mediaThumbnail struct {
+	URL string `xml:"url,attr"`
+}
+
+// feedEntry is a media file considered for inclusion in a feed
+type feedEntry struct {
+	name    string
+	urlPath string
+	isMovie bool
+	size    int64
+	modTime time.Time
+}
+
+// handleFeed returns an RSS feed of the most recently modified media in a directory
+func (s *Server) handleFeed(w http.ResponseWriter, r *http.Request) {
+	dirPath := r.URL.Query().Get("path")
+	if dirPath == "" {
+		dirPath = "/"
+	}
+	dirPath = path.Clean("/" + filepath.ToSlash(dirPath))
+
+	limit := defaultFeedItems
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 {
+		limit = min(v, maxFeedItems)
+	}
+
+	fullPath, ok := s.resolvePath(dirPath)
+	if !ok {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	dirEntries, err := s.store.ReadDir(r.Context(), fullPath)
+	if err != nil {
+		http.Error(w, "Directory not found", http.StatusNotFound)
+		return
+	}
+
+	var entries []feedEntry
+	for _, entry := range dirEntries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || s.isExcluded(entry.Name()) {
+			continue
+		}
+		isMovie := isMovieFile(entry.Name())
+		if !isImageFile(entry.Name()) && !isMovie {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, feedEntry{
+			name:    entry.Name(),
+			urlPath: path.Join(dirPath, entry.Name()),
+			isMovie: isMovie,
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+	}
+
+	// Newest first, capped to the requested item count
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].modTime.After(entries[j].modTime)
+	})
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+
+	origin := requestOrigin(r)
+	title := "Image Gallery"
+	if dirPath != "/" {
+		title = path.Base(dirPath)
+	}
+
+	feed := rssFeed{
+		Version: "2.0",
+		MediaNS: "http://search.yahoo.com/mrss/",
+		Channel: rssChannel{
+			Title:       title,
+			Link:        origin + s.urlWithBasePath("/") + "?path=" + url.QueryEscape(dirPath),
+			Description: "Recently added media in " + dirPath,
+		},
+	}
+	if len(entries) > 0 {
+		feed.Channel.LastBuildDate = entries[0].modTime.UTC().Format(time.RFC1123Z)
+	}
+
+	for _, e := range entries {
+		escaped := escapeURLPath(e.urlPath)
+		original := origin + s.urlWithBasePath("/static"+escaped)
+		thumbnail := origin + s.urlWithBasePath("/api/thumbnail"+escaped)
+
+		// Images are enclosed as browser-friendly previews, movies as originals
+		enclosure := rssEnclosure{URL: original, Length: e.size, Type: mimeTypeFor(e.name)}
+		if !e.isMovie {
+			enclosure = rssEnclosure{URL: origin + s.urlWithBasePath("/api/preview"+escaped), Type: "image/jpeg"}
+		}
+
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       e.name,
+			Link:        original,
+			GUID:        rssGUID{Value: e.urlPath},
+			PubDate:     e.modTime.UTC().Format(time.RFC1123Z),
+			Description: fmt.Sprintf(`<a href="%s"><img src="%s" alt="%s"></a>`, html.EscapeString(original), html.EscapeString(thumbnail), html.EscapeString(e.name)),
+			Enclosure:   enclosure,
+			Thumbnail:   mediaThumbnail{URL: thumbnail},
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(feed); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// requestOrigin returns the scheme and host the client used to reach the server
+func requestOrigin(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// escapeURLPath percent-encodes a slash-separated path for use in a URL
+func escapeURLPath(p string) string {
+	return (&url.URL{Path: p}).EscapedPath()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// errSkippedFile is returned for a file that exceeded -max-file-time before
+// and hasn't changed since
+var errSkippedFile = errors.New("skipped, exceeded -max-file-time before")
+
+// fileTimeContext bounds the work on one file by -max-file-time
+func (s *Server) fileTimeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if limit := s.settings().maxFileTime; limit > 0 {
+		return context.WithTimeout(ctx, limit)
+	}
+	return context.WithCancel(ctx)
+}
+
+// isSkippedFile reports whether a file exceeded -max-file-time before. A
+// file that changed since is given another chance.
+func (s *Server) isSkippedFile(ctx context.Context, path string) bool {
+	skipped, ok := s.skippedFiles.Load(path)
+	if !ok {
+		return false
+	}
+	if info, err := s.store.Stat(ctx, path); err == nil && info.ModTime().Equal(skipped.(time.Time)) {
+		return true
+	}
+	s.skippedFiles.Delete(path)
+	return false
+}
+
+// noteFileTime records a file whose work failed because fileCtx, derived
+// from ctx with fileTimeContext, ran out, so later attempts skip it instead
+// of tying up a worker for -max-file-time again
+func (s *Server) noteFileTime(ctx, fileCtx context.Context, path, work string, err error) {
+	if err == nil || ctx.Err() != nil || !errors.Is(fileCtx.Err(), context.DeadlineExceeded) {
+		return
+	}
+	info, statErr := s.store.Stat(context.Background(), path)
+	if statErr != nil {
+		return
+	}
+	s.skippedFiles.Store(path, info.ModTime())
+	log.Printf("Skipping %s until it changes: %s ran out of time", path, work)
+}
+
+// skippedFileError is the failure reported for a skipped file
+func skippedFileError(path string) error {
+	return thumbnailFailure(failureTimeout, fmt.Errorf("%s: %w", path, errSkippedFile))
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// filmstripFrames is how many frames a filmstrip thumbnail shows side by side
+const filmstripFrames = 5
+
+// filmstripFilter returns the ffmpeg filter that samples filmstripFrames
+// frames evenly across a movie and tiles them into one horizontal strip,
+// size pixels wide. select keeps a frame whenever the interval has passed
+// since the last kept one, so no frame count is needed up front.
+func (s *Server) filmstripFilter(ctx context.Context, moviePath string, size int) (string, error) {
+	seconds, err := s.movieDurationFor(ctx, moviePath)
+	if err != nil {
+		return "", err
+	}
+	interval := seconds / filmstripFrames
+	frameSize := size / filmstripFrames
+
+	scale := fmt.Sprintf("scale=%d:-2", frameSize)
+	if s.thumbnailModeFor(moviePath) != "fit" {
+		scale = fmt.Sprintf("scale=%[1]d:%[1]d:force_original_aspect_ratio=increase,crop=%[1]d:%[1]d", frameSize)
+	}
+	return fmt.Sprintf(`select='isnan(prev_selected_t)+gte(t-prev_selected_t\,%.3f)',%s,tile=%dx1`,
+		interval, scale, filmstripFrames), nil
+}
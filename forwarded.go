@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// forwardedPrefixHeader carries the path prefix a reverse proxy stripped
+const forwardedPrefixHeader = "X-Forwarded-Prefix"
+
+// validForwardedPrefix keeps prefixes to plain path characters, since they
+// end up in URLs, ETags and the page
+var validForwardedPrefix = regexp.MustCompile(`^(/[A-Za-z0-9._~%-]+)*$`)
+
+// requestBasePath returns the base path the client sees. With
+// -trust-forwarded-prefix a valid X-Forwarded-Prefix from the proxy wins
+// over -base-path; otherwise, or when it is malformed, -base-path is used.
+func (s *Server) requestBasePath(r *http.Request) string {
+	if !s.trustPrefixHeader {
+		return s.basePath
+	}
+	prefix, forwarded := r.Header[forwardedPrefixHeader]
+	if !forwarded || len(prefix) == 0 {
+		return s.basePath
+	}
+	// Chained proxies may append theirs; the first one faces the client
+	first, _, _ := strings.Cut(prefix[0], ",")
+	first = strings.TrimSpace(first)
+	if first == "" || first == "/" {
+		return ""
+	}
+	cleaned := strings.TrimSuffix(path.Clean("/"+first), "/")
+	if !validForwardedPrefix.MatchString(cleaned) {
+		return s.basePath
+	}
+	return cleaned
+}
+
+// requestURL prepends the base path the client sees to a URL path, the
+// per-request counterpart of urlWithBasePath
+func (s *Server) requestURL(r *http.Request, path string) string {
+	return s.rebaseURL(s.urlWithBasePath(path), s.requestBasePath(r))
+}
+
+// rebaseURL moves a URL built by urlWithBasePath under another base path
+func (s *Server) rebaseURL(u, basePath string) string {
+	if u == "" || basePath == s.basePath || !strings.HasPrefix(u, s.basePath+"/") {
+		return u
+	}
+	return basePath + strings.TrimPrefix(u, s.basePath)
+}
+
+// rebaseFiles returns listing entries with their URLs under another base
+// path. The entries are copied, since they may be shared with a cache.
+func (s *Server) rebaseFiles(files []FileInfo, basePath string) []FileInfo {
+	if basePath == s.basePath {
+		return files
+	}
+	rebased := make([]FileInfo, len(files))
+	for i, file := range files {
+		file.Thumbnail = s.rebaseURL(file.Thumbnail, basePath)
+		file.CanonicalMovie = s.rebaseURL(file.CanonicalMovie, basePath)
+		file.Placeholder = s.rebaseURL(file.Placeholder, basePath)
+		file.Cover = s.rebaseURL(file.Cover, basePath)
+		file.Download = s.rebaseURL(file.Download, basePath)
+		rebased[i] = file
+	}
+	return rebased
+}
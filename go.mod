@@ -1,3 +1,8 @@
 module directory-server
 
 go 1.24.2
+
+require (
+	golang.org/x/crypto v0.48.0
+	golang.org/x/image v0.36.0
+)
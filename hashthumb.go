@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// validThumbnailHash matches the hashes produced by thumbnailHash, so a
+// request can never name anything outside the hashed thumbnail store
+var validThumbnailHash = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// maxThumbHashes bounds the hashes remembered from listings, about the
+// thumbnails of a large library
+const maxThumbHashes = 100000
+
+// thumbHashIndex maps the hashes of listed thumbnails to their sources. It
+// forgets the oldest beyond maxThumbHashes; a hash it doesn't know, also
+// after a restart, is looked up in the hashes of the media index instead,
+// see findSource.
+type thumbHashIndex struct {
+	mu    sync.Mutex
+	paths map[string]string // content hash -> source path
+	order []string          // hashes, oldest first
+
+	indexMu      sync.Mutex
+	indexPaths   map[string]string // content hash -> source path of every media index entry
+	indexBuilt   time.Time         // build of the media index indexPaths was made from
+	indexVariant thumbnailVariant  // default rendition indexPaths was made for
+}
+
+func (idx *thumbHashIndex) store(hash, fullPath string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.paths == nil {
+		idx.paths = make(map[string]string)
+	}
+	if _, ok := idx.paths[hash]; !ok {
+		idx.order = append(idx.order, hash)
+		if len(idx.order) > maxThumbHashes {
+			delete(idx.paths, idx.order[0])
+			idx.order = idx.order[1:]
+		}
+	}
+	idx.paths[hash] = fullPath
+}
+
+func (idx *thumbHashIndex) load(hash string) (string, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	fullPath, ok := idx.paths[hash]
+	return fullPath, ok
+}
+
+// len counts the remembered hashes
+func (idx *thumbHashIndex) len() int {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return len(idx.paths)
+}
+
+// thumbnailHash derives the content address of a thumbnail from the source
+// path, mtime, size and the thumbnail settings. Changing any of them yields
+// a new hash, so hashed URLs can be cached forever.
+func (s *Server) thumbnailHash(fullPath string, info os.FileInfo) string {
+	return s.thumbnailFingerprint(fullPath, info, defaultThumbnailVariant())
+}
+
+// thumbnailFingerprint identifies the content of one thumbnail rendition of
+// a file without generating it, see thumbnailHash
+func (s *Server) thumbnailFingerprint(fullPath string, info os.FileInfo, variant thumbnailVariant) string {
+	return s.stampFingerprint(fullPath, info.ModTime(), info.Size(), variant)
+}
+
+// stampFingerprint is thumbnailFingerprint from a file's mtime and size
+func (s *Server) stampFingerprint(fullPath string, modTime time.Time, size int64, variant thumbnailVariant) string {
+	relPath, _ := filepath.Rel(s.rootDir, fullPath)
+	h := sha256.New()
+	fmt.Fprintf(h, "v%d\x00%s\x00%d\x00%d\x00%d%s\x00%s", thumbnailCacheVersion,
+		filepath.ToSlash(relPath), modTime.UnixNano(), size,
+		variant.size, s.thumbnailSaveOptions(fullPath, variant), s.thumbnailModeFor(fullPath))
+	if variant.pad != "" {
+		fmt.Fprintf(h, "\x00pad%s", variant.pad)
+	}
+	if variant.format != "" {
+		fmt.Fprintf(h, "\x00format%s", variant.format)
+	}
+	if s.watermark != nil {
+		fmt.Fprintf(h, "\x00%s\x00%g\x00%s\x00%g", s.watermark.source, s.watermark.opacity, s.watermark.position, s.watermark.scale)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:20])
+}
+
+// hashedThumbnailURL returns the content-addressable thumbnail URL for a file
+// and remembers which source it belongs to so it can be generated on request
+func (s *Server) hashedThumbnailURL(fullPath string, info os.FileInfo) string {
+	hash := s.thumbnailHash(fullPath, info)
+	s.thumbHashes.store(hash, fullPath)
+	return s.urlWithBasePath("/api/t/" + hash + ".jpg")
+}
+
+// findSource returns the source of a hashed thumbnail URL. Hashes that
+// aren't remembered are looked up in the hashes of the media index, so URLs
+// handed out before a restart or forgotten since keep working.
+func (s *Server) findSource(ctx context.Context, hash string) (string, bool) {
+	if fullPath, ok := s.thumbHashes.load(hash); ok {
+		return fullPath, true
+	}
+	fullPath, ok := s.indexedThumbHashes(ctx)[hash]
+	if ok {
+		s.thumbHashes.store(hash, fullPath)
+	}
+	return fullPath, ok
+}
+
+// indexedThumbHashes returns the thumbnail hashes of every file in the media
+// index. They are computed once per build of the index and default
+// rendition, so a hash that isn't among them is answered without hashing
+// the library again. It returns nil if ctx ends first.
+func (s *Server) indexedThumbHashes(ctx context.Context) map[string]string {
+	entries, built, err := s.mediaIndexEntries(ctx)
+	if err != nil {
+		return nil
+	}
+	variant := defaultThumbnailVariant()
+
+	idx := &s.thumbHashes
+	idx.indexMu.Lock()
+	defer idx.indexMu.Unlock()
+	if idx.indexPaths != nil && idx.indexBuilt.Equal(built) && idx.indexVariant == variant {
+		return idx.indexPaths
+	}
+	paths := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if fullPath, ok := s.resolvePath(entry.Path); ok {
+			paths[s.stampFingerprint(fullPath, entry.ModTime, entry.Size, variant)] = fullPath
+		}
+	}
+	idx.indexPaths, idx.indexBuilt, idx.indexVariant = paths, built, variant
+	return paths
+}
+
+// getHashedThumbnailPath returns where the thumbnail with the given hash is stored
+// e.g., <root>/.small/hashed/ab/abcdef....jpg
+func (s *Server) getHashedThumbnailPath(hash string) string {
+	return filepath.Join(thumbnailDirFor(s.rootDir), "hashed", hash[:2], hash+".jpg")
+}
+
+// handleHashedThumbnail serves thumbnails by content hash. Known hashes are
+// served straight from the store; otherwise the source recorded by the
+// listing is thumbnailed and the result is linked into the store.
+func (s *Server) handleHashedThumbnail(w http.ResponseWriter, r *http.Request) {
+	hash := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/t/"), ".jpg")
+	if !validThumbnailHash.MatchString(hash) {
+		http.Error(w, "Invalid thumbnail hash", http.StatusBadRequest)
+		return
+	}
+
+	hashedPath := s.getHashedThumbnailPath(hash)
+	if _, err := os.Stat(hashedPath); err != nil {
+		fullPath, ok := s.findSource(r.Context(), hash)
+		if !ok {
+			http.Error(w, "Thumbnail not found", http.StatusNotFound)
+			return
+		}
+
+		// The source must still match the hash, otherwise the URL is stale
+		info, err := s.store.Stat(r.Context(), fullPath)
+		if err != nil || s.thumbnailHash(fullPath, info) != hash {
+			http.Error(w, "Thumbnail not found", http.StatusNotFound)
+			return
+		}
+
+		thumbnailPath, ok := s.ensureThumbnail(w, r, fullPath, defaultThumbnailVariant())
+		if !ok {
+			return
+		}
+		if err := storeHashedThumbnail(thumbnailPath, hashedPath); err != nil {
+			http.Error(w, "Failed to store thumbnail: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// The URL changes whenever the content does. It is always the default
+	// rendition whatever the client hints say, so there is no Vary either.
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeFile(w, r, hashedPath)
+}
+
+// storeHashedThumbnail places a generated thumbnail into the hashed store,
+// hard-linking when possible and copying otherwise
+func storeHashedThumbnail(thumbnailPath, hashedPath string) error {
+	if err := os.MkdirAll(filepath.Dir(hashedPath), 0755); err != nil {
+		return err
+	}
+	if err := os.Link(thumbnailPath, hashedPath); err == nil || os.IsExist(err) {
+		return nil
+	}
+
+	src, err := os.Open(thumbnailPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmpPath := hashedPath + ".tmp"
+	dst, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, hashedPath)
+}
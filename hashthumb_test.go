@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestThumbHashIndexIsBounded(t *testing.T) {
+	var idx thumbHashIndex
+	for i := 0; i <= maxThumbHashes; i++ {
+		idx.store(fmt.Sprintf("%040x", i), "/photo.jpg")
+	}
+	if n := idx.len(); n != maxThumbHashes {
+		t.Errorf("remembered %d hashes, want %d", n, maxThumbHashes)
+	}
+	if _, ok := idx.load(fmt.Sprintf("%040x", 0)); ok {
+		t.Error("the oldest hash was kept")
+	}
+	if _, ok := idx.load(fmt.Sprintf("%040x", maxThumbHashes)); !ok {
+		t.Error("the newest hash was forgotten")
+	}
+}
+
+func TestHashedThumbnailFoundAfterRestart(t *testing.T) {
+	s := newTestServer(t)
+	fullPath := writeTestJPEG(t, s, "album/photo.jpg", 8, 8)
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := s.hashedThumbnailURL(fullPath, info)
+	hash := strings.TrimSuffix(strings.TrimPrefix(url, "/api/t/"), ".jpg")
+
+	// A restarted server has seen no listing yet
+	s.thumbHashes = thumbHashIndex{}
+	source, ok := s.findSource(t.Context(), hash)
+	if !ok || source != fullPath {
+		t.Errorf("findSource = %q, %v, want %q", source, ok, fullPath)
+	}
+	if _, ok := s.findSource(t.Context(), strings.Repeat("0", 40)); ok {
+		t.Error("found a source for an unknown hash")
+	}
+}
+
+func TestUnknownHashesAreNotRescanned(t *testing.T) {
+	s := newTestServer(t)
+	hashOf := func(fullPath string) string {
+		info, err := os.Stat(fullPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.thumbnailHash(fullPath, info)
+	}
+	first := writeTestJPEG(t, s, "album/first.jpg", 8, 8)
+	if _, ok := s.findSource(t.Context(), hashOf(first)); !ok {
+		t.Fatal("the first photo wasn't found")
+	}
+
+	// The hashes are made once per build of the index, so a lookup doesn't
+	// hash its entries again, not even one slipped in since
+	second := writeTestJPEG(t, s, "album/second.jpg", 8, 8)
+	info, err := os.Stat(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mediaIndex.mu.Lock()
+	s.mediaIndex.entries = append(s.mediaIndex.entries, mediaIndexEntry{Path: "/album/second.jpg", Size: info.Size(), ModTime: info.ModTime()})
+	s.mediaIndex.mu.Unlock()
+	if _, ok := s.findSource(t.Context(), hashOf(second)); ok {
+		t.Fatal("the media index was hashed again for an unknown hash")
+	}
+
+	s.mediaIndex.mu.Lock()
+	s.mediaIndex.built = s.mediaIndex.built.Add(-mediaIndexTTL)
+	s.mediaIndex.mu.Unlock()
+	if err := s.rebuildMediaIndex(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if source, ok := s.findSource(t.Context(), hashOf(second)); !ok || source != second {
+		t.Errorf("after a rebuild findSource = %q, %v, want %q", source, ok, second)
+	}
+}
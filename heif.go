@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// maxHEIFMeta bounds the meta box read from a HEIF file. It lists the items
+// of the file, not their data, so it stays small.
+const maxHEIFMeta = 1 << 20
+
+var errNoHEIFExif = errors.New("no EXIF item in HEIF file")
+
+// readHEIFExif returns the TIFF payload of the Exif item of a HEIC or HEIF
+// file. The top-level boxes are read up to the meta box, which says where
+// the item is; a reader that can seek goes there directly, others read
+// through to it.
+func readHEIFExif(r io.Reader) ([]byte, error) {
+	var pos int64
+	var meta []byte
+	for meta == nil {
+		size, boxType, headerSize, err := readBoxHeader(r)
+		if err != nil {
+			return nil, err
+		}
+		pos += headerSize
+		if size < headerSize {
+			// Size 0 runs to the end of the file, past where meta can be
+			return nil, errNoHEIFExif
+		}
+		body := size - headerSize
+		if boxType == "meta" {
+			if body > maxHEIFMeta || body < 4 {
+				return nil, errNoHEIFExif
+			}
+			meta = make([]byte, body)
+			if _, err := io.ReadFull(r, meta); err != nil {
+				return nil, err
+			}
+		} else if _, err := io.CopyN(io.Discard, r, body); err != nil {
+			return nil, err
+		}
+		pos += body
+	}
+
+	// meta is a full box: version and flags come before its children
+	offset, length, err := heifExifExtent(meta[4:])
+	if err != nil {
+		return nil, err
+	}
+	if length > maxTIFFHeader {
+		return nil, errNoHEIFExif
+	}
+	if seeker, ok := r.(io.Seeker); ok {
+		if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+	} else if offset < pos {
+		return nil, errNoHEIFExif
+	} else if _, err := io.CopyN(io.Discard, r, offset-pos); err != nil {
+		return nil, err
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	// The item starts with the offset of the TIFF header from its end,
+	// which skips the "Exif\0\0" most files have there
+	if len(data) < 4 {
+		return nil, errNoHEIFExif
+	}
+	start := 4 + int64(binary.BigEndian.Uint32(data))
+	if start >= int64(len(data)) {
+		return nil, errNoHEIFExif
+	}
+	return data[start:], nil
+}
+
+// readBoxHeader reads the size and type of an ISO base media box, returning
+// how many bytes the header took. A size of 0 means the box runs to the end.
+func readBoxHeader(r io.Reader) (size int64, boxType string, headerSize int64, err error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, "", 0, err
+	}
+	size, headerSize = int64(binary.BigEndian.Uint32(header[:4])), 8
+	if size == 1 {
+		var large [8]byte
+		if _, err := io.ReadFull(r, large[:]); err != nil {
+			return 0, "", 0, err
+		}
+		size, headerSize = int64(binary.BigEndian.Uint64(large[:])), 16
+	}
+	return size, string(header[4:]), headerSize, nil
+}
+
+// boxData is a cursor over the bytes of a box. Reads past the end return
+// zero and mark it bad, so a truncated box is checked for once at the end.
+type boxData struct {
+	data []byte
+	bad  bool
+}
+
+// uint reads a big-endian unsigned integer of n bytes, 0 to 8
+func (b *boxData) uint(n int) uint64 {
+	if n > len(b.data) {
+		b.bad = true
+		b.data = nil
+		return 0
+	}
+	var v uint64
+	for _, c := range b.data[:n] {
+		v = v<<8 | uint64(c)
+	}
+	b.data = b.data[n:]
+	return v
+}
+
+// children returns the boxes in data by type, the first of each type
+func children(data []byte) map[string][]byte {
+	boxes := make(map[string][]byte)
+	for len(data) >= 8 {
+		size := int64(binary.BigEndian.Uint32(data[:4]))
+		boxType, headerSize := string(data[4:8]), int64(8)
+		if size == 1 && len(data) >= 16 {
+			size, headerSize = int64(binary.BigEndian.Uint64(data[8:16])), 16
+		}
+		if size == 0 {
+			size = int64(len(data))
+		}
+		if size < headerSize || size > int64(len(data)) {
+			break
+		}
+		if _, ok := boxes[boxType]; !ok {
+			boxes[boxType] = data[headerSize:size]
+		}
+		data = data[size:]
+	}
+	return boxes
+}
+
+// heifExifExtent finds the Exif item among the children of a meta box and
+// returns where its data is in the file. Items made of several extents or
+// stored inside the meta box aren't supported; cameras write neither for
+// EXIF.
+func heifExifExtent(meta []byte) (offset, length int64, err error) {
+	boxes := children(meta)
+	id, ok := heifExifItem(boxes["iinf"])
+	if !ok {
+		return 0, 0, errNoHEIFExif
+	}
+
+	iloc := &boxData{data: boxes["iloc"]}
+	version := iloc.uint(1)
+	iloc.uint(3) // flags
+	sizes := iloc.uint(2)
+	offsetSize, lengthSize := int(sizes>>12), int(sizes>>8&0xF)
+	baseOffsetSize, indexSize := int(sizes>>4&0xF), int(sizes&0xF)
+	if version == 0 {
+		indexSize = 0
+	}
+	idSize, countSize := 2, 2
+	if version == 2 {
+		idSize, countSize = 4, 4
+	}
+	items := iloc.uint(countSize)
+	for i := uint64(0); i < items && !iloc.bad; i++ {
+		itemID := iloc.uint(idSize)
+		method := uint64(0)
+		if version == 1 || version == 2 {
+			method = iloc.uint(2) & 0xF
+		}
+		iloc.uint(2) // data reference index
+		base := iloc.uint(baseOffsetSize)
+		extents := iloc.uint(2)
+		for e := uint64(0); e < extents && !iloc.bad; e++ {
+			iloc.uint(indexSize)
+			extentOffset := iloc.uint(offsetSize)
+			extentLength := iloc.uint(lengthSize)
+			if itemID == id && !iloc.bad {
+				if method != 0 || extents != 1 {
+					return 0, 0, errNoHEIFExif
+				}
+				return int64(base + extentOffset), int64(extentLength), nil
+			}
+		}
+	}
+	return 0, 0, errNoHEIFExif
+}
+
+// heifExifItem returns the ID of the item of type Exif in an iinf box
+func heifExifItem(iinf []byte) (uint64, bool) {
+	if len(iinf) < 4 {
+		return 0, false
+	}
+	countSize := 2
+	if iinf[0] > 0 {
+		countSize = 4
+	}
+	if len(iinf) < 4+countSize {
+		return 0, false
+	}
+	data := iinf[4+countSize:]
+	for len(data) >= 8 {
+		size := int(binary.BigEndian.Uint32(data[:4]))
+		if size < 8 || size > len(data) {
+			break
+		}
+		if string(data[4:8]) == "infe" {
+			infe := &boxData{data: data[8:size]}
+			version := infe.uint(1)
+			infe.uint(3) // flags
+			idSize := 2
+			if version >= 3 {
+				idSize = 4
+			}
+			// Item types are only recorded from version 2 on
+			if version >= 2 {
+				id := infe.uint(idSize)
+				infe.uint(2) // protection index
+				if itemType := infe.uint(4); !infe.bad && itemType == 'E'<<24|'x'<<16|'i'<<8|'f' {
+					return id, true
+				}
+			}
+		}
+		data = data[size:]
+	}
+	return 0, false
+}
+
+// readHEIFExifMetadata extracts the same metadata as readExifMetadata from
+// a HEIC or HEIF file
+func readHEIFExifMetadata(r io.Reader) (exifMetadata, bool) {
+	exifData, err := readHEIFExif(r)
+	if err != nil {
+		return exifMetadata{}, false
+	}
+	tiff, err := parseTIFF(exifData)
+	if err != nil {
+		return exifMetadata{}, false
+	}
+	return tiff.metadata(), true
+}
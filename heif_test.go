@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// box returns an ISO base media box of the given type around body
+func box(boxType string, body ...[]byte) []byte {
+	data := bytes.Join(body, nil)
+	header := binary.BigEndian.AppendUint32(nil, uint32(8+len(data)))
+	return append(append(header, boxType...), data...)
+}
+
+// testHEIC returns a HEIF file whose Exif item records orientation, stored
+// in mdat after meta as phones write it
+func testHEIC(orientation int) []byte {
+	tiff := []byte{
+		'M', 'M', 0, 42, 0, 0, 0, 8, // big endian, first IFD at 8
+		0, 1, // one entry
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, byte(orientation), 0, 0, // Orientation, SHORT
+		0, 0, 0, 0, // no next IFD
+	}
+	exif := append([]byte{0, 0, 0, 6}, append([]byte("Exif\x00\x00"), tiff...)...)
+
+	ftyp := box("ftyp", []byte("heic\x00\x00\x00\x00mif1heic"))
+	infe := func(id byte, itemType string) []byte {
+		return box("infe", []byte{2, 0, 0, 0, 0, id, 0, 0}, []byte(itemType))
+	}
+	iinf := box("iinf", []byte{0, 0, 0, 0, 0, 2}, infe(1, "hvc1"), infe(2, "Exif"))
+	iloc := func(exifOffset int) []byte {
+		return box("iloc", []byte{0, 0, 0, 0, 0x44, 0x00, 0, 1}, // 4-byte offsets and lengths, one item
+			[]byte{0, 2, 0, 0, 0, 1}, // item 2, one extent
+			binary.BigEndian.AppendUint32(nil, uint32(exifOffset)),
+			binary.BigEndian.AppendUint32(nil, uint32(len(exif))))
+	}
+	meta := func(exifOffset int) []byte {
+		return box("meta", []byte{0, 0, 0, 0}, box("hdlr", make([]byte, 24)), iinf, iloc(exifOffset))
+	}
+	// The Exif item follows the image data at the start of mdat
+	mdatStart := len(ftyp) + len(meta(0)) + 8
+	return bytes.Join([][]byte{ftyp, meta(mdatStart + 16), box("mdat", make([]byte, 16), exif)}, nil)
+}
+
+func TestReadHEIFExif(t *testing.T) {
+	data := testHEIC(6)
+	// A reader that can seek and one that can't
+	for _, seekable := range []bool{true, false} {
+		var r io.Reader = bytes.NewReader(data)
+		if !seekable {
+			r = io.MultiReader(r)
+		}
+		meta, ok := readHEIFExifMetadata(r)
+		if !ok || meta.orientation != 6 {
+			t.Errorf("seekable %v: orientation %d (%v), want 6", seekable, meta.orientation, ok)
+		}
+	}
+}
+
+func TestPhotoInfoOfHEIC(t *testing.T) {
+	s := newTestServer(t)
+	photo := writeTestFile(t, s, "IMG_0042.HEIC", testHEIC(8))
+
+	meta, err := s.photoMetadataFor(t.Context(), photo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Orientation == nil || *meta.Orientation != 8 {
+		t.Errorf("orientation %v, want 8", meta.Orientation)
+	}
+	if !exifSupported("DSC_0001.NEF") {
+		t.Error("NEF files report no EXIF")
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// photoMetadataVersion is bumped when the recorded metadata changes, so
+// older sidecars are read again
+const photoMetadataVersion = 3
+
+// tiffExtensions are the RAW formats whose header is a TIFF structure, so
+// their EXIF is parsed like a JPEG's
+var tiffExtensions = map[string]bool{
+	".arw": true,
+	".dng": true,
+	".nef": true,
+}
+
+// heifExtensions are the formats whose EXIF is an item of a HEIF container
+var heifExtensions = map[string]bool{
+	".heic": true,
+	".heif": true,
+}
+
+// photoMetadata is what /api/info reports about a photo. Fields the file
+// doesn't record are null. The capture time has no time zone, EXIF doesn't
+// store one.
+type photoMetadata struct {
+	TakenAt      *string  `json:"takenAt"` // e.g. 2024-05-01T18:30:00
+	Make         *string  `json:"make"`
+	Model        *string  `json:"model"`
+	ISO          *int     `json:"iso"`
+	ExposureTime *float64 `json:"exposureTime"` // seconds
+	FNumber      *float64 `json:"fNumber"`
+	FocalLength  *float64 `json:"focalLength"` // millimetres
+	Lens         *string  `json:"lens"`
+	Orientation  *int     `json:"orientation"`
+	Latitude     *float64 `json:"latitude"`
+	Longitude    *float64 `json:"longitude"`
+}
+
+// photoMetadataRecord is the sidecar holding the metadata of one photo
+type photoMetadataRecord struct {
+	photoMetadata
+	ModTime int64 `json:"modTime"` // source mtime (UnixNano), used for invalidation
+	Version int   `json:"version"`
+}
+
+// infoResponse is the JSON body of /api/info
+type infoResponse struct {
+	Path        string `json:"path"`
+	Width       *int   `json:"width"` // as displayed, after EXIF orientation
+	Height      *int   `json:"height"`
+	Unsupported bool   `json:"unsupported,omitempty"` // EXIF of this format isn't read, e.g. PNG
+	photoMetadata
+}
+
+// getPhotoMetadataPath returns the sidecar path holding the metadata of a photo
+// e.g., photo.jpg -> .small/photo.jpg.meta.json
+func getPhotoMetadataPath(imagePath string) string {
+	dir := filepath.Dir(imagePath)
+	baseName := cacheName(filepath.Base(imagePath))
+	return filepath.Join(thumbnailDirFor(dir), baseName+".meta.json")
+}
+
+// photoMetadataFor returns the EXIF metadata of an image, reading it from
+// the sidecar when it is fresh and recording it otherwise. JPEG, HEIC and
+// TIFF-based RAW files are parsed; other formats report no metadata.
+func (s *Server) photoMetadataFor(ctx context.Context, imagePath string) (photoMetadata, error) {
+	info, err := s.store.Stat(ctx, imagePath)
+	if err != nil {
+		return photoMetadata{}, err
+	}
+	sidecarPath := getPhotoMetadataPath(imagePath)
+	var record photoMetadataRecord
+	if data, err := os.ReadFile(sidecarPath); err == nil && json.Unmarshal(data, &record) == nil &&
+		record.ModTime == info.ModTime().UnixNano() && record.Version == photoMetadataVersion {
+		return record.photoMetadata, nil
+	}
+
+	record = photoMetadataRecord{ModTime: info.ModTime().UnixNano(), Version: photoMetadataVersion}
+	if meta, ok := s.readPhotoExif(ctx, imagePath); ok {
+		record.photoMetadata = newPhotoMetadata(meta)
+	}
+	if err := os.MkdirAll(filepath.Dir(sidecarPath), 0755); err != nil {
+		return record.photoMetadata, fmt.Errorf("failed to create thumbnail directory: %w", err)
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return record.photoMetadata, err
+	}
+	return record.photoMetadata, os.WriteFile(sidecarPath, data, 0644)
+}
+
+// exifSupported reports whether the EXIF of an image is parsed: JPEG, HEIC
+// and TIFF-based RAW files are
+func exifSupported(imagePath string) bool {
+	ext := strings.ToLower(filepath.Ext(imagePath))
+	return ext == ".jpg" || ext == ".jpeg" || tiffExtensions[ext] || heifExtensions[ext]
+}
+
+// readPhotoExif parses the EXIF metadata of a JPEG, HEIC or TIFF-based RAW
+// file
+func (s *Server) readPhotoExif(ctx context.Context, imagePath string) (exifMetadata, bool) {
+	if !exifSupported(imagePath) {
+		return exifMetadata{}, false
+	}
+	read := readExifMetadata
+	switch ext := strings.ToLower(filepath.Ext(imagePath)); {
+	case tiffExtensions[ext]:
+		read = readTIFFExifMetadata
+	case heifExtensions[ext]:
+		read = readHEIFExifMetadata
+	}
+	file, err := s.store.Open(ctx, imagePath)
+	if err != nil {
+		return exifMetadata{}, false
+	}
+	defer file.Close()
+	return read(file)
+}
+
+// newPhotoMetadata converts parsed EXIF to its JSON form, leaving out what
+// wasn't recorded
+func newPhotoMetadata(meta exifMetadata) photoMetadata {
+	var out photoMetadata
+	if !meta.taken.IsZero() {
+		out.TakenAt = ptrTo(meta.taken.Format("2006-01-02T15:04:05"))
+	}
+	if meta.maker != "" {
+		out.Make = ptrTo(meta.maker)
+	}
+	if meta.model != "" {
+		out.Model = ptrTo(meta.model)
+	}
+	if meta.iso > 0 {
+		out.ISO = ptrTo(meta.iso)
+	}
+	if meta.exposure > 0 {
+		out.ExposureTime = ptrTo(meta.exposure)
+	}
+	if meta.fNumber > 0 {
+		out.FNumber = ptrTo(meta.fNumber)
+	}
+	if meta.focalLength > 0 {
+		out.FocalLength = ptrTo(meta.focalLength)
+	}
+	if meta.lens != "" {
+		out.Lens = ptrTo(meta.lens)
+	}
+	if meta.orientation > 0 {
+		out.Orientation = ptrTo(meta.orientation)
+	}
+	if meta.hasGPS {
+		out.Latitude, out.Longitude = ptrTo(meta.latitude), ptrTo(meta.longitude)
+	}
+	return out
+}
+
+// ptrTo returns a pointer to a copy of v, for the nullable JSON fields
+func ptrTo[T any](v T) *T {
+	return &v
+}
+
+// handleInfo reports the EXIF metadata and dimensions of a photo
+func (s *Server) handleInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/api/info")
+	if strings.Trim(path, "/") == "" {
+		http.Error(w, "Path required", http.StatusBadRequest)
+		return
+	}
+	fullPath, ok := s.resolvePath(path)
+	if !ok {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+	if s.isExcludedPath(s.urlPathFor(fullPath)) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if info, err := s.store.Stat(r.Context(), fullPath); err != nil || info.IsDir() {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if !isImageFile(fullPath) {
+		http.Error(w, "Not an image file", http.StatusBadRequest)
+		return
+	}
+
+	meta, err := s.photoMetadataFor(r.Context(), fullPath)
+	if err != nil {
+		log.Printf("Failed to record metadata of %s: %v", fullPath, err)
+	}
+	response := infoResponse{Path: s.urlPathFor(fullPath), Unsupported: !exifSupported(fullPath), photoMetadata: meta}
+	if dims, err := s.imageDimensionsFor(r.Context(), fullPath); err == nil {
+		response.Width, response.Height = ptrTo(dims.Width), ptrTo(dims.Height)
+	}
+	respondJSON(w, response, http.StatusOK)
+}
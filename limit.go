@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// concurrencyRetryAfter is the Retry-After hint, in seconds, sent when the
+// server is at its request limit
+const concurrencyRetryAfter = 1
+
+// concurrencyExempt are paths served even when the server is at its limit,
+// so health checks and metrics scrapes don't fail just because the gallery
+// is busy
+var concurrencyExempt = map[string]bool{
+	"/healthz": true,
+	"/metrics": true,
+}
+
+// limitConcurrency wraps a handler so that at most max requests are in flight.
+// Requests over the limit are rejected immediately with 503 instead of piling
+// up goroutines, vips processes and open files.
+func limitConcurrency(next http.Handler, max int) http.Handler {
+	sem := make(chan struct{}, max)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if concurrencyExempt[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+			next.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Retry-After", strconv.Itoa(concurrencyRetryAfter))
+			http.Error(w, "Server busy", http.StatusServiceUnavailable)
+		}
+	})
+}
+
+// acquirePreviewSlot takes one of the -max-generations slots for a preview,
+// waiting until one is free or ctx is done. Thumbnail generation can't fill
+// the slots kept by -preview-reserve, so previews only wait for each other
+// there. Without a reserve previews are not limited.
+func (s *Server) acquirePreviewSlot(ctx context.Context) (release func(), err error) {
+	if s.capacitySem == nil {
+		return func() {}, nil
+	}
+	select {
+	case s.capacitySem <- struct{}{}:
+		return func() { <-s.capacitySem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// errPreviewBusy is returned when no preview slot freed up within
+// -preview-queue-wait
+var errPreviewBusy = errors.New("too many previews in progress")
+
+// defaultMaxPreviews is how many movie previews are transcoded at once
+// unless -max-previews says otherwise
+const defaultMaxPreviews = 2
+
+// previewLimiter caps one kind of preview, movie transcodes with
+// -max-previews or image previews with -max-image-previews, and counts the
+// running ones for /api/status
+type previewLimiter struct {
+	sem    chan struct{} // nil = unlimited
+	active atomic.Int64
+}
+
+// acquire takes a slot for a preview. A busy request waits up to wait, or
+// is refused with errPreviewBusy at once when wait is 0.
+func (l *previewLimiter) acquire(ctx context.Context, wait time.Duration) (release func(), err error) {
+	if l.sem == nil {
+		l.active.Add(1)
+		return func() { l.active.Add(-1) }, nil
+	}
+	release = func() {
+		l.active.Add(-1)
+		<-l.sem
+	}
+	select {
+	case l.sem <- struct{}{}:
+		l.active.Add(1)
+		return release, nil
+	default:
+	}
+	if wait <= 0 {
+		return nil, errPreviewBusy
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case l.sem <- struct{}{}:
+		l.active.Add(1)
+		return release, nil
+	case <-timer.C:
+		return nil, errPreviewBusy
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// previewBusy responds 503 to a preview refused for want of a slot
+func previewBusy(w http.ResponseWriter) {
+	w.Header().Del("Cache-Control")
+	w.Header().Set("Retry-After", strconv.Itoa(concurrencyRetryAfter))
+	http.Error(w, "Too many previews in progress", http.StatusServiceUnavailable)
+}
+
+// handleHealthz reports that the server is up
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestListEntrySkipsRemovedFile(t *testing.T) {
+	s := newTestServer(t)
+	writeTestJPEG(t, s, "kept.jpg", 8, 8)
+	removed := writeTestJPEG(t, s, "removed.jpg", 8, 8)
+
+	entries, err := os.ReadDir(s.rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The file goes away after ReadDir, before its entry is looked at
+	if err := os.Remove(removed); err != nil {
+		t.Fatal(err)
+	}
+
+	var listed []string
+	for _, entry := range entries {
+		if info, ok := s.listEntry(t.Context(), s.rootDir, "/", entry, &listOptions{}); ok {
+			listed = append(listed, info.Name)
+		}
+	}
+	if len(listed) != 1 || listed[0] != "kept.jpg" {
+		t.Errorf("listed %v, want [kept.jpg]", listed)
+	}
+}
+
+func TestListEntryMediaKindOnlyWhenChecked(t *testing.T) {
+	s := newTestServer(t)
+	writeTestJPEG(t, s, "IMG_0042.jpg", 8, 8)
+	writeTestJPEG(t, s, "Screenshot_20240501-101500.jpg", 8, 8)
+
+	entries, err := os.ReadDir(s.rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		opts listOptions
+		want map[string]string
+	}{
+		{listOptions{}, map[string]string{"IMG_0042.jpg": "", "Screenshot_20240501-101500.jpg": kindScreenshot}},
+		{listOptions{withDimensions: true}, map[string]string{"IMG_0042.jpg": kindPhoto, "Screenshot_20240501-101500.jpg": kindScreenshot}},
+	} {
+		for _, entry := range entries {
+			info, _ := s.listEntry(t.Context(), s.rootDir, "/", entry, &tc.opts)
+			if info.MediaKind != tc.want[info.Name] {
+				t.Errorf("%s with dimensions %v: kind %q, want %q", info.Name, tc.opts.withDimensions, info.MediaKind, tc.want[info.Name])
+			}
+		}
+	}
+}
+
+func TestResolveFollowsListOrder(t *testing.T) {
+	s := newTestServer(t)
+	for _, name := range []string{"a.jpg", "b.jpg", "Screenshot_20240501-101500.jpg"} {
+		writeTestJPEG(t, s, "trip/"+name, 8, 8)
+	}
+	mux := s.newMux()
+
+	for query, want := range map[string]int{
+		"":                                   2,
+		"&order=desc":                        0,
+		"&sort=size":                         2,
+		"&kind=" + kindPhoto:                 1,
+		"&kind=" + kindPhoto + "&order=desc": 0,
+		"&kind=" + kindScreenshot:            -1,
+	} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/resolve?path=/trip/b.jpg"+query, nil))
+		if want < 0 {
+			if rec.Code != http.StatusNotFound {
+				t.Errorf("%s: status %d, want 404 for a file filtered out", query, rec.Code)
+			}
+			continue
+		}
+		var resolved resolveResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resolved); err != nil {
+			t.Fatalf("%s: %v: %s", query, err, rec.Body)
+		}
+		if resolved.Index != want {
+			t.Errorf("%s: index %d, want %d", query, resolved.Index, want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxListCacheEntries bounds the listings kept by -list-cache-ttl, the least
+// recently used one is evicted first
+const maxListCacheEntries = 512
+
+// cachedListing is a serialized /api/list response with its validators
+type cachedListing struct {
+	key         string
+	body        []byte
+	contentType string // application/json or msgpackContentType
+	etag        string
+	version     time.Time
+	expires     time.Time
+}
+
+// listCache is an in-memory LRU of serialized directory listings, keyed by
+// path and query options. Entries expire after the TTL, there is no other
+// invalidation, so changes show up at most one TTL late.
+type listCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	order   *list.List // front = most recently used
+	entries map[string]*list.Element
+}
+
+func newListCache(ttl time.Duration) *listCache {
+	return &listCache{
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns the unexpired listing for key
+func (c *listCache) get(key string) (*cachedListing, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	listing := elem.Value.(*cachedListing)
+	if time.Now().After(listing.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return listing, true
+}
+
+// put stores a listing, evicting the least recently used one when full
+func (c *listCache) put(listing *cachedListing) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	listing.expires = time.Now().Add(c.ttl)
+	if elem, ok := c.entries[listing.key]; ok {
+		elem.Value = listing
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[listing.key] = c.order.PushFront(listing)
+	if c.order.Len() > maxListCacheEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedListing).key)
+	}
+}
+
+// serve writes a listing with the same headers as a freshly built one
+func (listing *cachedListing) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("ETag", listing.etag)
+	if !listing.version.IsZero() {
+		w.Header().Set("Last-Modified", listing.version.UTC().Format(http.TimeFormat))
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	if notModified(r, listing.etag, listing.version) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", listing.contentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(listing.body)
+}
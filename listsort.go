@@ -0,0 +1,67 @@
+package main
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// listSortKeys are the keys ?sort= orders a listing by, besides manual
+var listSortKeys = map[string]bool{"name": true, "mtime": true, "size": true}
+
+// listSortFor returns the order a listing asks for with ?sort= and ?order=,
+// e.g. "mtime-desc". "" keeps the directory's order, name order unless
+// .gallery.json says otherwise. ?order=desc alone sorts by name; manual
+// order can't be reversed.
+func listSortFor(r *http.Request) (string, bool) {
+	sortOrder := r.URL.Query().Get("sort")
+	if sortOrder != "" && sortOrder != "manual" && !listSortKeys[sortOrder] {
+		return "", false
+	}
+	switch r.URL.Query().Get("order") {
+	case "", "asc":
+		return sortOrder, true
+	case "desc":
+		if sortOrder == "manual" {
+			return "", false
+		}
+		return cmp.Or(sortOrder, "name") + "-desc", true
+	}
+	return "", false
+}
+
+// sortListing puts listed files in the order from listSortFor. Keyed orders
+// list directories first, each group sorted by the key and then by name.
+func sortListing(files []FileInfo, dir, sortOrder string) {
+	key, descending := strings.CutSuffix(sortOrder, "-desc")
+	if key == "manual" {
+		sortManual(files, readManualOrder(dir))
+		return
+	}
+	if !listSortKeys[key] {
+		return
+	}
+	slices.SortStableFunc(files, func(a, b FileInfo) int {
+		if a.IsDir != b.IsDir {
+			if a.IsDir {
+				return -1
+			}
+			return 1
+		}
+		var c int
+		switch key {
+		case "mtime":
+			c = a.ModTime.Compare(b.ModTime)
+		case "size":
+			c = cmp.Compare(a.Size, b.Size)
+		}
+		if c == 0 {
+			c = strings.Compare(a.Name, b.Name)
+		}
+		if descending {
+			return -c
+		}
+		return c
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// wantsStreamedList reports whether a listing should be written as
+// newline-delimited JSON, asked for with ?stream=true or by Accept
+func wantsStreamedList(r *http.Request) bool {
+	return r.URL.Query().Get("stream") == "true" || strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+}
+
+// streamList writes a listing as one FileInfo JSON object per line, flushed
+// as soon as each entry has been built, so clients can render huge
+// directories progressively. The entries are the same as in the array form.
+// Files that pair up, such as an image and its Live Photo movie, are held
+// back until all of them are listed;
+// with ?sort=manual the order is only known at the end, so nothing is
+// written before then.
+func (s *Server) streamList(w http.ResponseWriter, r *http.Request, fullPath, path string, entries []fs.DirEntry, opts *listOptions, sortOrder string, listStarted time.Time) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	rc := http.NewResponseController(w)
+	encoder := json.NewEncoder(w)
+	var listed []FileInfo
+	emit := func(files ...FileInfo) {
+		if opts.kind != "" {
+			files = filterMediaKind(files, opts.kind)
+		}
+		for _, file := range s.rebaseFiles(files, opts.basePath) {
+			encoder.Encode(file)
+		}
+		listed = append(listed, files...)
+		rc.Flush()
+	}
+
+	if sortOrder != "" {
+		var files []FileInfo
+		for _, entry := range entries {
+			if fileInfo, ok := s.listEntry(r.Context(), fullPath, path, entry, opts); ok {
+				files = append(files, fileInfo)
+			}
+		}
+		if !opts.unpaired {
+			files = s.pairFiles(files)
+		}
+		sortListing(files, fullPath, sortOrder)
+		emit(files...)
+	} else {
+		pending := make(map[string]int)
+		if !opts.unpaired {
+			pending = pairGroups(entries)
+		}
+		held := make(map[string][]FileInfo)
+		for _, entry := range entries {
+			if r.Context().Err() != nil {
+				return
+			}
+			fileInfo, ok := s.listEntry(r.Context(), fullPath, path, entry, opts)
+			base := livePhotoBase(entry.Name())
+			if pending[base] == 0 || (!isImageFile(entry.Name()) && !isMovieFile(entry.Name())) {
+				if ok {
+					emit(fileInfo)
+				}
+				continue
+			}
+			if ok {
+				held[base] = append(held[base], fileInfo)
+			}
+			if pending[base]--; pending[base] == 0 {
+				emit(s.pairFiles(held[base])...)
+				delete(held, base)
+			}
+		}
+	}
+
+	if s.slowListings != nil {
+		s.slowListings.record(path, time.Since(listStarted), len(entries))
+	}
+	if s.settings().prefetchThumbnails {
+		go s.prefetchDirectory(fullPath, listed)
+	}
+}
+
+// livePhotoBase is the name an image and its Live Photo movie share
+func livePhotoBase(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, filepath.Ext(name)))
+}
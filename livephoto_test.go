@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestLivePhotoPairsAreListedOnce(t *testing.T) {
+	s := newTestServer(t)
+	for _, name := range []string{"IMG_0001.HEIC", "IMG_0001.MOV", "IMG_0002.jpg", "img_0002.mov", "clip.mov"} {
+		writeTestFile(t, s, "trip/"+name, []byte("data"))
+	}
+
+	rec := httptest.NewRecorder()
+	s.newMux().ServeHTTP(rec, httptest.NewRequest("GET", "/api/list?path=/trip", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var listing DirectoryResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &listing); err != nil {
+		t.Fatal(err)
+	}
+
+	movies := make(map[string]string)
+	for _, file := range listing.Files {
+		movies[file.Name] = file.CanonicalMovie
+	}
+	want := map[string]string{
+		"IMG_0001.HEIC": "/api/file.m3u8?path=" + url.QueryEscape("/trip/IMG_0001.MOV"),
+		"IMG_0002.jpg":  "/api/file.m3u8?path=" + url.QueryEscape("/trip/img_0002.mov"),
+		"clip.mov":      "",
+	}
+	if len(movies) != len(want) {
+		t.Errorf("listed %v, want the pairs as one tile each and clip.mov", movies)
+	}
+	for name, movie := range want {
+		if got, ok := movies[name]; !ok || got != movie {
+			t.Errorf("%s: canonical movie %q, want %q", name, got, movie)
+		}
+	}
+}
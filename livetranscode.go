@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// liveTranscode is a streamed movie preview shared by everyone watching the
+// same movie at the same quality from the start. ffmpeg writes to a spool
+// file and every viewer reads it at their own pace, so a slow or departing
+// viewer never holds up the others. A viewer who joins late gets what was
+// transcoded so far at once. The transcode is killed when the last viewer
+// leaves, and the spool removed once it has also ended.
+type liveTranscode struct {
+	idleWatch
+	key string
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	cancel  context.CancelFunc // stops ffmpeg
+	spool   *os.File
+	size    int64 // bytes in the spool so far
+	done    bool  // ffmpeg has exited
+	err     error // why it failed, once done
+	viewers int
+	closed  bool // the last viewer left, no one may join any more
+}
+
+// liveTranscodeKey identifies the transcodes viewers can share
+func liveTranscodeKey(moviePath string, quality movieQuality) string {
+	return fmt.Sprintf("%s?height=%d&bitrate=%s", moviePath, quality.height, quality.bitrate)
+}
+
+// joinLiveTranscode returns the transcode viewers of key share, as one of
+// its viewers, reporting true when the caller started it and has to run it
+func (s *Server) joinLiveTranscode(key string) (*liveTranscode, bool) {
+	for {
+		fresh := &liveTranscode{key: key}
+		fresh.cond = sync.NewCond(&fresh.mu)
+		actual, loaded := s.liveTranscodes.LoadOrStore(key, fresh)
+		lt := actual.(*liveTranscode)
+		lt.mu.Lock()
+		if !lt.closed {
+			lt.viewers++
+			lt.mu.Unlock()
+			return lt, !loaded
+		}
+		lt.mu.Unlock()
+		// Its last viewer just left, start over
+		s.liveTranscodes.CompareAndDelete(key, lt)
+	}
+}
+
+// leave drops a viewer. The last one out stops the transcode.
+func (s *Server) leaveLiveTranscode(lt *liveTranscode) {
+	lt.mu.Lock()
+	lt.viewers--
+	last := lt.viewers == 0
+	if last {
+		lt.closed = true
+	}
+	done, cancel := lt.done, lt.cancel
+	lt.mu.Unlock()
+	if !last {
+		return
+	}
+	s.liveTranscodes.CompareAndDelete(lt.key, lt)
+	if cancel != nil {
+		cancel()
+	}
+	if done {
+		lt.removeSpool()
+	}
+}
+
+// Write appends ffmpeg's output to the spool and wakes the viewers
+func (lt *liveTranscode) Write(p []byte) (int, error) {
+	n, err := lt.spool.Write(p)
+	lt.touch()
+	lt.mu.Lock()
+	lt.size += int64(n)
+	lt.cond.Broadcast()
+	lt.mu.Unlock()
+	return n, err
+}
+
+// wrote reports whether ffmpeg produced any output
+func (lt *liveTranscode) wrote() bool {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	return lt.size > 0
+}
+
+// finish records that the transcode ended. The spool is removed here when
+// every viewer left already.
+func (lt *liveTranscode) finish(err error) {
+	lt.mu.Lock()
+	lt.done = true
+	lt.err = err
+	closed := lt.closed
+	lt.cond.Broadcast()
+	lt.mu.Unlock()
+	if closed {
+		lt.removeSpool()
+	}
+}
+
+func (lt *liveTranscode) removeSpool() {
+	if lt.spool != nil {
+		lt.spool.Close()
+		os.Remove(lt.spool.Name())
+	}
+}
+
+// runLiveTranscode runs the transcode a viewer started. It holds the preview
+// slots taken for it until ffmpeg exits, whichever viewers remain.
+func (s *Server) runLiveTranscode(ctx context.Context, lt *liveTranscode, fullPath string, quality movieQuality, releases ...func()) {
+	defer func() {
+		for _, release := range releases {
+			release()
+		}
+	}()
+	lt.mu.Lock()
+	cancel := lt.cancel
+	lt.mu.Unlock()
+	defer cancel()
+	go lt.watchIdle(ctx, cancel)
+
+	input, err := s.store.Locate(ctx, fullPath)
+	if err != nil {
+		lt.finish(fmt.Errorf("failed to locate movie: %w", err))
+		return
+	}
+	codec := s.videoCodecFor(ctx, fullPath, input)
+	err = s.runTranscode(ctx, func(encoder videoEncoder) *exec.Cmd {
+		cmd := s.runner.command(ctx, ffmpegExecutable(), transcodeArgs(encoder, input, "pipe:1", quality, codec, transcodeOptions{})...)
+		cmd.Stderr = os.Stderr
+		cmd.Stdout = lt
+		return cmd
+	}, lt.wrote)
+	if err != nil && lt.stalled.Load() {
+		log.Printf("Stopped transcoding %s: no output for %s", fullPath, s.settings().previewIdleTimeout)
+	} else if err != nil && ctx.Err() == nil {
+		log.Printf("Failed to process movie %s: %v", fullPath, err)
+	}
+
+	// A complete transcode at the cached quality becomes the cached preview,
+	// so later plays and seeks are served from it. The spool goes away with
+	// the last viewer, so it is read through a handle of its own.
+	var spool *os.File
+	if err == nil && quality == defaultMovieQuality {
+		spool, _ = os.Open(lt.spool.Name())
+	}
+	lt.finish(err)
+	if spool != nil {
+		go func() {
+			defer spool.Close()
+			if err := keepTranscode(spool, fullPath); err != nil {
+				log.Printf("Failed to cache the preview of %s: %v", fullPath, err)
+			}
+		}()
+	}
+}
+
+// serveLiveTranscode streams a movie preview from the start, sharing the
+// transcode with everyone else watching it. Whoever comes first starts it,
+// taking the preview slots; later viewers take none.
+func (s *Server) serveLiveTranscode(w http.ResponseWriter, r *http.Request, fullPath string, quality movieQuality) {
+	ctx, cancel := s.previewContext(r)
+	defer cancel()
+
+	lt, started := s.joinLiveTranscode(liveTranscodeKey(fullPath, quality))
+	defer s.leaveLiveTranscode(lt)
+	if started {
+		// The transcode outlives the viewer who started it
+		transcodeCtx, transcodeCancel := context.WithCancel(s.baseCtx)
+		settings := s.settings()
+		if settings.previewTimeout > 0 {
+			transcodeCtx, transcodeCancel = context.WithTimeout(s.baseCtx, settings.previewTimeout)
+		}
+		lt.idle = settings.previewIdleTimeout
+		lt.touch()
+		lt.mu.Lock()
+		lt.cancel = transcodeCancel
+		lt.mu.Unlock()
+
+		releaseLimit, err := s.moviePreviews.acquire(ctx, settings.previewQueueWait)
+		if err != nil {
+			transcodeCancel()
+			lt.finish(err)
+		} else if release, err := s.acquirePreviewSlot(ctx); err != nil {
+			releaseLimit()
+			transcodeCancel()
+			lt.finish(err)
+		} else if lt.spool, err = os.CreateTemp("", "gallery-preview-*.ts"); err != nil {
+			release()
+			releaseLimit()
+			transcodeCancel()
+			lt.finish(err)
+		} else {
+			go s.runLiveTranscode(transcodeCtx, lt, fullPath, quality, release, releaseLimit)
+		}
+	}
+
+	tw := newStreamWriter(w, s.settings().previewIdleTimeout)
+	err := lt.copyTo(ctx, tw)
+	if err == nil || tw.wrote || r.Context().Err() != nil {
+		return
+	}
+	w.Header().Del("Cache-Control")
+	switch {
+	case errors.Is(err, errPreviewBusy):
+		previewBusy(w)
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled), lt.stalled.Load():
+		http.Error(w, "Preview transcoding timed out", http.StatusGatewayTimeout)
+	default:
+		http.Error(w, "Failed to transcode movie", http.StatusInternalServerError)
+	}
+}
+
+// copyTo writes the spool to w as it grows, until the transcode ends or ctx
+// is done, and returns why the transcode failed, if it did
+func (lt *liveTranscode) copyTo(ctx context.Context, w io.Writer) error {
+	// Waiting viewers are woken when their request ends
+	stop := context.AfterFunc(ctx, func() {
+		lt.mu.Lock()
+		lt.cond.Broadcast()
+		lt.mu.Unlock()
+	})
+	defer stop()
+
+	var spool *os.File
+	defer func() {
+		if spool != nil {
+			spool.Close()
+		}
+	}()
+	var offset int64
+	for {
+		lt.mu.Lock()
+		for lt.size == offset && !lt.done && ctx.Err() == nil {
+			lt.cond.Wait()
+		}
+		size, done, err := lt.size, lt.done, lt.err
+		lt.mu.Unlock()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if size == offset {
+			if done && err == nil && size == 0 {
+				return errors.New("transcode produced no output")
+			}
+			return err
+		}
+
+		// Each viewer reads through their own handle, at their own offset
+		if spool == nil {
+			var openErr error
+			if spool, openErr = os.Open(lt.spool.Name()); openErr != nil {
+				return openErr
+			}
+		}
+		n, copyErr := io.Copy(w, io.NewSectionReader(spool, offset, size-offset))
+		offset += n
+		if copyErr != nil {
+			return copyErr
+		}
+	}
+}
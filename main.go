@@ -1,31 +1,114 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
+	"image/jpeg"
+	"io"
+	"io/fs"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Server struct {
 	rootDir             string
+	store               mediaStore         // source media access, local disk or S3
+	generator           thumbnailGenerator // renders thumbnails, normally the server itself
+	runner              commandRunner      // starts vips and ffmpeg, normally execRunner
 	basePath            string
+	trustPrefixHeader   bool   // take the base path from X-Forwarded-Prefix when a proxy sends it
+	homePath            string // directory the frontend opens on load
 	indexTmpl           *template.Template
-	imageThumbnailQueue chan string
-	movieThumbnailQueue chan string
+	themes              themeSet // index templates by name, from -templates-dir (nil = the built-in index.html only)
+	defaultTheme        string   // theme used unless ?theme= or the theme cookie picks another
+	imageThumbnailQueue chan thumbnailJob
+	movieThumbnailQueue chan thumbnailJob
 	imageWorkersWg      sync.WaitGroup
 	movieWorkersWg      sync.WaitGroup
-	pendingThumbs       sync.Map // map[string]chan struct{} - tracks pending thumbnail generations
+	queueMu             sync.RWMutex             // guards sends against closeQueues
+	queuesClosed        bool                     // the queues were closed for shutdown
+	baseCtx             context.Context          // parent of requests and background work, see serve
+	stopChildren        func()                   // cancels baseCtx, killing the remaining child processes
+	live                atomic.Pointer[tunables] // the settings /api/reload can change, see settings
+	config              *configState             // -config as /api/reload last read it (nil = no -config)
+	authRequired        bool                     // -auth-user, -htpasswd or -auth-token protects every request
+	workersMu           sync.Mutex               // guards resizing the worker pools, see resizeWorkers
+	imageWorkersRunning int
+	movieWorkersRunning int
+	retireImageWorker   chan struct{}    // an image worker receiving from it exits
+	retireMovieWorker   chan struct{}    // a movie worker receiving from it exits
+	pendingThumbs       sync.Map         // map[string]*pendingThumbnail - tracks pending thumbnail generations
+	generationSem       chan struct{}    // optional global cap on concurrent generations (nil = disabled)
+	capacitySem         chan struct{}    // generations and previews together, with -preview-reserve (nil = disabled)
+	skippedFiles        sync.Map         // map[string]time.Time - source mtimes of files that exceeded maxFileTime
+	segmentSem          chan struct{}    // caps parallel segment transcodes (nil = previews are one stream)
+	pendingSegments     sync.Map         // map[string]chan struct{} - segments being transcoded
+	liveTranscodes      sync.Map         // map[string]*liveTranscode - streamed previews shared by their viewers
+	movieDurations      sync.Map         // map[string]movieDuration - probed movie lengths
+	videoCodecs         sync.Map         // map[string]probedCodec - probed video codecs
+	requireTranscoded   bool             // serve movie previews only from the pre-transcoded cache
+	thumbnailBackground string           // vips background that transparent images are flattened onto
+	colorProfile        string           // ICC profile thumbnails and previews are converted to ("" = keep the source's)
+	thumbnailMode       string           // fit, center-crop or smart-crop
+	dirConfigs          sync.Map         // map[string]cachedDirConfig - parsed .gallery.json files
+	dirCovers           sync.Map         // map[string]cachedCover - covers picked for ?covers=1
+	videoThumbStyle     string           // frame (one poster frame) or filmstrip
+	videoEncoder        videoEncoder     // encodes movie previews, see -video-encoder
+	nativeThumbnails    bool             // scale JPEG/PNG/GIF/WebP in-process instead of running vips/ffmpeg
+	vipsMissing         bool             // vipsthumbnail wasn't found, JPEG and PNG are scaled in-process
+	svgUnsupported      bool             // vips can't rasterize SVG (no librsvg), SVGs get no thumbnail
+	modernFormats       map[string]bool  // webp and avif, if vips can write them
+	placeholderVariant  thumbnailVariant // low-quality thumbnail generated alongside the default (size 0 = off)
+	hashedThumbnails    bool             // list thumbnails under content-addressable URLs
+	writable            bool             // accept uploads and deletions, see -writable
+	uploadAnyType       bool             // accept uploads that aren't images or movies
+	uploadMaxBytes      int64            // cap on one upload request or resumable upload (0 = unlimited)
+	maxStoredDimension  int              // downscale larger uploaded images to this longest side (0 = keep originals)
+	trashDir            string           // where deleted files are moved to, "" for .trash under the root
+	partialUploadLocks  sync.Map         // map[string]*sync.Mutex - resumable uploads being written
+	thumbHashes         thumbHashIndex   // sources of the hashed thumbnail URLs in listings
+	watermark           *watermark       // overlay for thumbnails and previews (nil = disabled)
+	rebuild             rebuildState     // progress of the background thumbnail rebuild
+	mediaIndex          mediaIndexCache  // cached /api/index.json listing
+	listCache           *listCache       // serialized /api/list responses (nil = disabled)
+	listIndex           *dirIndexes      // sorted listings for ?offset=&limit= windows (nil = disabled)
+	slowListings        *slowListings    // the directories slowest to list (nil = not tracked)
+	rateLimiter         *rateLimiter     // -rate-limit per client IP on thumbnails and previews (nil = off)
+	toolProbes          *toolProbes      // latest vips/ffmpeg probe results (nil = not probed)
+	pregen              *pregenProgress  // progress of -pregenerate (nil = off)
+	exclude             []string         // lowercase glob patterns of names that are never listed or served
+	favoritesMode       string           // session, global or off
+	favorites           *favoritesStore  // favorite media paths (nil = disabled)
+	sessions            *sessionManager  // signs the session cookies of session favorites
+	toolVersionsOnce    sync.Once
+	toolVersionsCache   map[string]string // vips/ffmpeg versions for /api/config
+
+	// Running previews, capped by -max-previews and -max-image-previews
+	moviePreviews previewLimiter
+	imagePreviews previewLimiter
+
+	// What /metrics reports
+	metrics serverMetrics
+
+	// Changes seen by -watch, per directory
+	generations dirGenerations
 }
 
 type FileInfo struct {
@@ -36,11 +119,255 @@ type FileInfo struct {
 	IsMovie        bool   `json:"isMovie"`
 	Thumbnail      string `json:"thumbnail,omitempty"`
 	CanonicalMovie string `json:"canonicalMovie,omitempty"`
+	RawPath        string `json:"rawPath,omitempty"` // the RAW file shot with this JPEG, which isn't listed itself
+	Width          int    `json:"width,omitempty"`
+	Height         int    `json:"height,omitempty"`
+	ThumbnailData  string `json:"thumbnailData,omitempty"` // data: URI, only with ?inline-thumbs=true
+	OwnThumbnail   bool   `json:"ownThumbnail,omitempty"`  // Thumbnail is the original itself
+	Placeholder    string `json:"placeholder,omitempty"`   // tiny low-quality thumbnail to show first
+	Cover          string `json:"cover,omitempty"`         // thumbnail of a directory's cover image
+	CoverSource    string `json:"coverSource,omitempty"`   // the cover image itself
+	MediaKind      string `json:"mediaKind,omitempty"`     // photo, screenshot or screen-recording, see mediaKindFor
+	Download       string `json:"download,omitempty"`      // the original file as an attachment
+	TakenAt        string `json:"takenAt,omitempty"`       // EXIF capture time, only with ?meta=1
+
+	// Exposure of images, only with ?exposure=true and -exposure-stats
+	Exposure *exposureStats `json:"exposure,omitempty"`
+
+	// What ?sort=size and ?sort=mtime order by; directories have no size
+	Size    int64     `json:"size,omitempty"`
+	ModTime time.Time `json:"modTime,omitzero"`
+}
+
+// Limits for thumbnails embedded in listings with ?inline-thumbs=true. Entries
+// past the count cap, or with a larger thumbnail, keep only their URL.
+const (
+	maxInlineThumbnails     = 100
+	maxInlineThumbnailBytes = 32 << 10
+)
+
+// thumbnailVariant describes one cached rendition of a thumbnail
+type thumbnailVariant struct {
+	size    int    // longest edge in pixels
+	quality int    // JPEG quality, 0 for the encoder default
+	pad     string // aspect ratio padded to, e.g. "4x3", "" for none
+	format  string // webp or avif, "" for JPEG, see negotiatedFormat
+	mode    string // center-crop or smart-crop, "" for fit, see thumbnailPathFor
+}
+
+// thumbnailCacheVersion is part of every thumbnail name. It is bumped when
+// thumbnails come out differently, so those cached before aren't found and
+// are made again when next asked for. Version 2 turns photos upright by
+// their EXIF orientation, which thumbnails of older releases could miss.
+const thumbnailCacheVersion = 2
+
+// defaultThumbnailSize is the longest edge of the default thumbnail unless
+// -thumbnail-size says otherwise. Thumbnails of this size are cached without
+// a size in their name, see getThumbnailVariantPath.
+const defaultThumbnailSize = 300
+
+// defaultVariant holds the thumbnail served when nothing else is requested.
+// -thumbnail-pad sets its pad at startup, -thumbnail-size its size at
+// startup and on /api/reload.
+var defaultVariant atomic.Pointer[thumbnailVariant]
+
+// defaultThumbnailVariant returns the thumbnail served when nothing else is requested
+func defaultThumbnailVariant() thumbnailVariant {
+	if variant := defaultVariant.Load(); variant != nil {
+		return *variant
+	}
+	return thumbnailVariant{size: defaultThumbnailSize}
+}
+
+// Bounds of -thumbnail-size
+const (
+	minThumbnailSize = 100
+	maxThumbnailSize = 3000
+)
+
+// checkThumbnailSize reports a -thumbnail-size out of bounds
+func checkThumbnailSize(size int) error {
+	if size < minThumbnailSize || size > maxThumbnailSize {
+		return fmt.Errorf("%d: must be between %d and %d", size, minThumbnailSize, maxThumbnailSize)
+	}
+	return nil
+}
+
+// thumbnailSizes are the thumbnail sizes a client may request with ?size=,
+// limited to a fixed set so URLs can't fill the cache with renditions.
+// The size of the default thumbnail is allowed as well.
+var thumbnailSizes = map[int]bool{
+	150:  true,
+	300:  true,
+	600:  true,
+	900:  true,
+	1200: true,
+}
+
+// thumbnailHintSizes are the sizes that client hints can select, so high
+// density screens don't explode the number of cached renditions
+var thumbnailHintSizes = []int{300, 600, 900}
+
+// saveDataQuality is the JPEG quality used for clients sending Save-Data: on
+const saveDataQuality = 40
+
+// thumbnailGenerator renders a thumbnail variant into the cache. The Server
+// itself is the production implementation (vips/ffmpeg); tests can swap in a
+// mock that writes fixed bytes.
+type thumbnailGenerator interface {
+	generateThumbnail(ctx context.Context, imagePath string, variant thumbnailVariant) error
+}
+
+// commandRunner starts the external tools, vips and ffmpeg, that requests
+// need. execRunner is the production implementation; tests can swap in one
+// that records what would have run.
+type commandRunner interface {
+	command(ctx context.Context, name string, args ...string) *exec.Cmd
+}
+
+// execRunner runs the tools with exec.CommandContext
+type execRunner struct{}
+
+func (execRunner) command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, name, args...)
+}
+
+// thumbnailJob is a queued thumbnail generation
+type thumbnailJob struct {
+	path    string
+	variant thumbnailVariant
+	pending *pendingThumbnail // released when the job is done
 }
 
 type DirectoryResponse struct {
-	Path  string     `json:"path"`
-	Files []FileInfo `json:"files"`
+	Path    string     `json:"path"`
+	Files   []FileInfo `json:"files"`
+	Total   int        `json:"total,omitempty"`   // all files, in ?offset=&limit= windows
+	HasMore bool       `json:"hasMore,omitempty"` // more files follow this window
+	Prev    string     `json:"prev,omitempty"`    // the neighbouring windows, when there is a limit
+	Next    string     `json:"next,omitempty"`
+	Zip     string     `json:"zip,omitempty"` // the directory's originals as one archive
+
+	// What the whole directory holds, whatever window or ?kind= is listed.
+	// Only directory listings have it, not search or random results.
+	Stats *DirectoryStats `json:"stats,omitempty"`
+}
+
+// DirectoryStats sums up a directory's listed entries. Files that are
+// paired into one entry, such as RAW+JPEG shots, are counted separately.
+type DirectoryStats struct {
+	Images int   `json:"images"`
+	Movies int   `json:"movies"`
+	Dirs   int   `json:"dirs"`
+	Bytes  int64 `json:"bytes"` // total size of the files
+}
+
+// add counts one listing entry, with the size ReadDir already reported
+func (st *DirectoryStats) add(file FileInfo) {
+	switch {
+	case file.IsDir:
+		st.Dirs++
+	case file.IsImage:
+		st.Images++
+	case file.IsMovie:
+		st.Movies++
+	}
+	st.Bytes += file.Size
+}
+
+// errThumbnailTimeout is returned when a queued thumbnail is not ready within
+// the queue wait limit
+var errThumbnailTimeout = fmt.Errorf("thumbnail generation timeout")
+
+// queueWaitTimeout is how long a request waits for a queued thumbnail before
+// giving up. A -thumbnail-timeout shorter than this takes precedence.
+const queueWaitTimeout = 30 * time.Second
+
+// defaultPreviewSize is the longest edge of a preview when no size is
+// requested. -preview-size sets it at startup.
+var defaultPreviewSize = 1600
+
+// maxPreviewSize bounds -preview-size
+const maxPreviewSize = 3200
+
+// previewSizes are the preview sizes a client may request with ?size=,
+// limited to a fixed set so the endpoint can't be used to exhaust memory.
+// -preview-size is added at startup.
+var previewSizes = map[int]bool{
+	800:  true,
+	1200: true,
+	1600: true,
+	2400: true,
+	3200: true,
+}
+
+// previewFormat is an output encoding a client may request for previews
+type previewFormat struct {
+	suffix      string // vips output suffix, selects the saver
+	contentType string
+	alpha       bool // keeps transparency instead of flattening onto the background
+}
+
+// previewFormats are the encodings allowed with ?format= on previews
+var previewFormats = map[string]previewFormat{
+	"jpeg": {".jpg", "image/jpeg", false},
+	"jpg":  {".jpg", "image/jpeg", false},
+	"webp": {".webp", "image/webp", true},
+	"avif": {".avif", "image/avif", true},
+	"png":  {".png", "image/png", true},
+}
+
+// parseBackgroundColor converts a #rrggbb color to the space-separated form
+// vips expects for its background option
+func parseBackgroundColor(color string) (string, error) {
+	hex := strings.TrimPrefix(color, "#")
+	if len(hex) != 6 {
+		return "", fmt.Errorf("invalid color %q, expected #rrggbb", color)
+	}
+	rgb, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return "", fmt.Errorf("invalid color %q, expected #rrggbb", color)
+	}
+	return fmt.Sprintf("%d %d %d", rgb>>16, rgb>>8&0xff, rgb&0xff), nil
+}
+
+// mimeTypes maps lower-case extensions to the Content-Type used when serving
+// originals. The defaults cover the formats the gallery lists, which Go's
+// mime package mostly doesn't know; -mime-types adds to or overrides them.
+var mimeTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".heic": "image/heic",
+	".heif": "image/heif",
+	".arw":  "image/x-sony-arw",
+	".raw":  "image/x-panasonic-raw",
+	".dng":  "image/x-adobe-dng",
+	".nef":  "image/x-nikon-nef",
+	".mov":  "video/quicktime",
+	".mp4":  "video/mp4",
+	".avi":  "video/x-msvideo",
+	".mkv":  "video/x-matroska",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".svg":  "image/svg+xml",
+}
+
+// parseMIMETypes applies overrides of the form ".heic=image/heic,.dng=image/dng"
+func parseMIMETypes(spec string) error {
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		ext, mimeType, ok := strings.Cut(pair, "=")
+		ext, mimeType = strings.ToLower(strings.TrimSpace(ext)), strings.TrimSpace(mimeType)
+		if !ok || mimeType == "" || !strings.HasPrefix(ext, ".") {
+			return fmt.Errorf("invalid MIME type override %q, expected .ext=type/subtype", pair)
+		}
+		mimeTypes[ext] = mimeType
+	}
+	return nil
 }
 
 var imageExtensions = map[string]bool{
@@ -57,6 +384,50 @@ var imageExtensions = map[string]bool{
 	".HEIF": true,
 	".dng":  true,
 	".DNG":  true,
+	".nef":  true,
+	".NEF":  true,
+	".gif":  true,
+	".GIF":  true,
+	".webp": true,
+	".WEBP": true,
+	".svg":  true,
+	".SVG":  true,
+}
+
+// animatedExtensions are the image formats vips can load as several frames.
+// They are always thumbnailed from the first frame, so an animation never
+// shows a blank or arbitrary frame.
+var animatedExtensions = map[string]bool{
+	".gif":  true,
+	".webp": true,
+}
+
+// browserImageExtensions are the image formats every browser can display, so
+// the original can stand in for its own thumbnail
+var browserImageExtensions = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+	".webp": true,
+}
+
+// isOwnThumbnail reports whether an image is small enough, per
+// -thumbnail-min-bytes, to be shown as is instead of generating a thumbnail
+func (s *Server) isOwnThumbnail(path string, size int64) bool {
+	minBytes := s.settings().thumbnailMinBytes
+	return minBytes > 0 && size < minBytes &&
+		browserImageExtensions[strings.ToLower(filepath.Ext(path))] && !looksLikeThumbnail(path)
+}
+
+// vipsStdinInput returns the vipsthumbnail input argument for an image piped
+// through stdin, selecting the first frame of animated formats. APNG needs no
+// option: vips only ever loads the default image of a PNG.
+func vipsStdinInput(imagePath string) string {
+	if animatedExtensions[strings.ToLower(filepath.Ext(imagePath))] {
+		return "stdin[page=0,n=1]"
+	}
+	return "stdin"
 }
 
 var movieExtensions = map[string]bool{
@@ -70,13 +441,96 @@ var movieExtensions = map[string]bool{
 	".MKV": true,
 }
 
+// isImageFile reports whether a file should be treated as a source image
+func isImageFile(path string) bool {
+	return imageExtensions[strings.ToLower(filepath.Ext(path))] && !looksLikeThumbnail(path)
+}
+
+// isMovieFile reports whether a file should be treated as a source movie
+func isMovieFile(path string) bool {
+	return movieExtensions[strings.ToLower(filepath.Ext(path))] && !looksLikeThumbnail(path)
+}
+
+// hideThumbnailCopies is set by -hide-thumbnail-copies
+var hideThumbnailCopies bool
+
+// looksLikeThumbnail reports whether a file is a generated thumbnail rather
+// than source media: anything inside a .small directory, and with
+// -hide-thumbnail-copies a .jpg whose name without the extension still ends
+// in a media extension, optionally followed by a rendition suffix
+// (photo.jpg.jpg, clip.MOV.jpg, photo.jpg.600.jpg). That is how thumbnails
+// copied out of .small look, but also e.g. a photo exported as foo.png.jpg,
+// so it is off by default. Classification otherwise goes by the last
+// extension only.
+func looksLikeThumbnail(path string) bool {
+	for _, part := range strings.Split(filepath.ToSlash(path), "/") {
+		if isCacheDirName(part) {
+			return true
+		}
+	}
+	if !hideThumbnailCopies {
+		return false
+	}
+
+	name := filepath.Base(path)
+	ext := filepath.Ext(name)
+	if strings.ToLower(ext) != ".jpg" {
+		return false
+	}
+	base := thumbnailVariantSuffix.ReplaceAllString(strings.TrimSuffix(name, ext), "")
+	inner := strings.ToLower(filepath.Ext(base))
+	return imageExtensions[inner] || movieExtensions[inner]
+}
+
+// Explicit tool locations from -vips-path and -ffmpeg-path. When empty the
+// tools are looked up on PATH.
+var (
+	vipsPath   string
+	ffmpegPath string
+)
+
+// vipsTool returns the executable for one of the vips command line tools.
+// With -vips-path the tools are taken from the directory of vipsthumbnail,
+// otherwise name.exe is preferred on PATH (Windows) over plain name.
+func vipsTool(name string) string {
+	if vipsPath != "" {
+		return filepath.Join(filepath.Dir(vipsPath), name+filepath.Ext(vipsPath))
+	}
+	if _, err := exec.LookPath(name + ".exe"); err == nil {
+		return name + ".exe"
+	}
+	return name
+}
+
+// vipsAutoRotate makes vipsthumbnail turn images upright according to their
+// EXIF orientation, which also drops the tag from the output so clients
+// don't rotate them a second time. libvips 8.5 and later always do this and
+// ignore the flag; older releases only rotate when asked.
+const vipsAutoRotate = "--rotate"
+
 // vipsExecutable returns the path to the vips executable
 // On Windows, it looks for vipsthumbnail.exe, otherwise just "vipsthumbnail"
 func vipsExecutable() string {
-	if _, err := exec.LookPath("vipsthumbnail.exe"); err == nil {
-		return "vipsthumbnail.exe"
+	if vipsPath != "" {
+		return vipsPath
 	}
-	return "vipsthumbnail"
+	return vipsTool("vipsthumbnail")
+}
+
+// ffmpegExecutable returns the path to ffmpeg, from -ffmpeg-path or PATH
+func ffmpegExecutable() string {
+	if ffmpegPath != "" {
+		return ffmpegPath
+	}
+	return "ffmpeg"
+}
+
+// ffprobeExecutable returns the path to ffprobe, next to -ffmpeg-path if set
+func ffprobeExecutable() string {
+	if ffmpegPath != "" {
+		return filepath.Join(filepath.Dir(ffmpegPath), "ffprobe"+filepath.Ext(ffmpegPath))
+	}
+	return "ffprobe"
 }
 
 // urlWithBasePath prepends the base path to a URL path
@@ -91,26 +545,305 @@ func (s *Server) urlWithBasePath(path string) string {
 	return s.basePath + path
 }
 
-// getThumbnailPath returns the thumbnail path for a given image path
+// builtinColorProfiles are the profile names vips knows without a file
+var builtinColorProfiles = map[string]bool{"srgb": true, "p3": true}
+
+// parseColorProfile validates -color-profile: a built-in profile name or the
+// path of an ICC file, returned as an absolute path
+func parseColorProfile(value string) (string, error) {
+	if value == "" || builtinColorProfiles[strings.ToLower(value)] {
+		return strings.ToLower(value), nil
+	}
+	if _, err := os.Stat(value); err != nil {
+		return "", err
+	}
+	return filepath.Abs(value)
+}
+
+// colorProfileArgs returns the vipsthumbnail arguments that convert the
+// output to -color-profile, none when the source's profile is kept. Sources
+// without an embedded profile are taken to be sRGB.
+func (s *Server) colorProfileArgs() []string {
+	if s.colorProfile == "" {
+		return nil
+	}
+	return []string{"--eprofile", s.colorProfile}
+}
+
+// thumbnailSaveOptions returns the vips save options appended to a thumbnail's
+// output path. Chroma subsampling blurs colour edges, which is fine for photos
+// but causes fringing on screenshots and text, so it can be disabled globally
+// ("off") or only for PNG sources, which are usually screenshots ("auto").
+func (s *Server) thumbnailSaveOptions(imagePath string, variant thumbnailVariant) string {
+	var options []string
+	if variant.quality > 0 {
+		options = append(options, "Q="+strconv.Itoa(variant.quality))
+	}
+	// The JPEG options below don't apply, and WebP and AVIF keep transparency
+	if variant.format != "" {
+		if len(options) == 0 {
+			return ""
+		}
+		return "[" + strings.Join(options, ",") + "]"
+	}
+
+	noSubsample := false
+	switch s.settings().thumbnailSubsample {
+	case "off":
+		noSubsample = true
+	case "auto":
+		noSubsample = strings.ToLower(filepath.Ext(imagePath)) == ".png"
+	}
+	if noSubsample {
+		options = append(options, "no_subsample=true")
+	}
+	if s.settings().progressiveJPEG {
+		options = append(options, "interlace=true")
+	}
+	// JPEG has no alpha channel, so transparent sources are flattened
+	options = append(options, "background="+s.thumbnailBackground)
+
+	if len(options) == 0 {
+		return ""
+	}
+	return "[" + strings.Join(options, ",") + "]"
+}
+
+// resolvePath converts a slash-separated path relative to the root directory
+// into a full filesystem path. It returns false if the path escapes the root
+// or is hidden, such as .small or .trash: hidden files are never listed, so
+// no handler serves them. /static/ serves thumbnails from .small itself.
+func (s *Server) resolvePath(path string) (string, bool) {
+	// Convert URL path (forward slashes) to filesystem path and clean it
+	path = filepath.Clean(filepath.FromSlash(path))
+
+	// Build full path
+	fullPath := s.rootDir
+	if path != "." && path != string(filepath.Separator) {
+		fullPath = filepath.Join(s.rootDir, path)
+	}
+
+	// Security check: ensure path is within root directory
+	relPath, err := filepath.Rel(s.rootDir, fullPath)
+	if err != nil || strings.HasPrefix(relPath, "..") || isHiddenPath(relPath) {
+		return "", false
+	}
+	return fullPath, true
+}
+
+// urlPathFor returns the URL path (forward slashes, leading /) of a file
+// under the root directory, the inverse of resolvePath
+func (s *Server) urlPathFor(fullPath string) string {
+	relPath, _ := filepath.Rel(s.rootDir, fullPath)
+	if relPath == "." {
+		return "/"
+	}
+	return "/" + filepath.ToSlash(relPath)
+}
+
+// thumbnailPathFor returns the thumbnail path of a rendition of a file, cut
+// per the thumbnail mode of its directory. Thumbnails are validated by mtime
+// only, so a mode set by .gallery.json or -thumbnail-mode gets thumbnails of
+// its own rather than the ones cut before.
+func (s *Server) thumbnailPathFor(imagePath string, variant thumbnailVariant) string {
+	if mode := s.thumbnailModeFor(imagePath); mode != "fit" {
+		variant.mode = mode
+	}
+	return getThumbnailVariantPath(imagePath, variant)
+}
+
+// getThumbnailVariantPath returns the thumbnail path for a specific rendition.
 // The thumbnail filename includes the original extension to avoid conflicts
-// between files with the same base name but different extensions
-func getThumbnailPath(imagePath string) string {
+// between files with the same base name but different extensions. Every
+// rendition ends with thumbnailCacheVersion, and renditions other than the
+// default encode their size, quality, padding and mode in the filename
+// e.g., photo.jpg -> photo.jpg.v2.jpg, photo.jpg.600.v2.jpg,
+// photo.jpg.300q40.v2.jpg, photo.jpg.pad4x3.v2.jpg, photo.jpg.center-crop.v2.jpg
+func getThumbnailVariantPath(imagePath string, variant thumbnailVariant) string {
 	dir := filepath.Dir(imagePath)
-	baseName := filepath.Base(imagePath)
+	baseName := cacheName(filepath.Base(imagePath))
 	// Include the original extension in the thumbnail filename
-	// e.g., photo.jpg -> photo.jpg.jpg, photo.png -> photo.png.jpg
-	thumbnailDir := filepath.Join(dir, ".small")
-	thumbnailPath := filepath.Join(thumbnailDir, baseName+".jpg")
+	// e.g., photo.jpg -> photo.jpg.v2.jpg, photo.png -> photo.png.v2.jpg
+	thumbnailDir := thumbnailDirFor(dir)
+	if variant.size != defaultThumbnailSize || variant.quality > 0 {
+		baseName += "." + strconv.Itoa(variant.size)
+		if variant.quality > 0 {
+			baseName += "q" + strconv.Itoa(variant.quality)
+		}
+	}
+	if variant.pad != "" {
+		baseName += ".pad" + variant.pad
+	}
+	if variant.mode != "" {
+		baseName += "." + variant.mode
+	}
+	baseName += thumbnailVersionSuffix
+	ext := ".jpg"
+	if variant.format != "" {
+		ext = "." + variant.format
+	}
+	thumbnailPath := filepath.Join(thumbnailDir, baseName+ext)
 	return thumbnailPath
 }
 
+// thumbnailVariantSuffix matches the size/quality/padding/mode and version
+// part of a thumbnail name, e.g. the ".v2" in photo.jpg.v2.jpg, the ".600.v2"
+// in photo.jpg.600.v2.jpg or the ".center-crop.v2" in
+// photo.jpg.center-crop.v2.jpg. Names from before the version lack it.
+var thumbnailVariantSuffix = regexp.MustCompile(`(\.(\d+(q\d+)?(\.pad\d+x\d+)?(\.(center|smart)-crop)?|pad\d+x\d+(\.(center|smart)-crop)?|(center|smart)-crop))?(\.v\d+)?$`)
+
+// thumbnailVersionSuffix ends the name of a thumbnail of the current
+// thumbnailCacheVersion, before its format
+var thumbnailVersionSuffix = ".v" + strconv.Itoa(thumbnailCacheVersion)
+
+// thumbnailHintHeaders are the request headers thumbnailVariantForRequest
+// reads, which responses built from its choice must list in Vary
+const thumbnailHintHeaders = "Sec-CH-DPR, Sec-CH-Width, Save-Data"
+
+// thumbnailSizeParam returns the thumbnail size asked for with ?size=. Sizes
+// outside thumbnailSizes return false, like a missing or malformed value,
+// leaving the size to the default and client hints.
+func thumbnailSizeParam(r *http.Request) (int, bool) {
+	size, err := strconv.Atoi(r.URL.Query().Get("size"))
+	if err != nil || !thumbnailSizes[size] && size != defaultThumbnailVariant().size {
+		return 0, false
+	}
+	return size, true
+}
+
+// thumbnailVariantForRequest picks the thumbnail rendition from client hints.
+// Sec-CH-Width or Sec-CH-DPR select a larger size for high density screens
+// and Save-Data: on selects a lower quality. Without hints the default is used.
+func thumbnailVariantForRequest(r *http.Request) thumbnailVariant {
+	variant := defaultThumbnailVariant()
+
+	if strings.EqualFold(r.Header.Get("Save-Data"), "on") {
+		variant.quality = saveDataQuality
+		return variant
+	}
+
+	needed := 0
+	if width, err := strconv.Atoi(r.Header.Get("Sec-CH-Width")); err == nil && width > 0 {
+		needed = width
+	} else if dpr, err := strconv.ParseFloat(r.Header.Get("Sec-CH-DPR"), 64); err == nil && dpr > 0 {
+		needed = int(float64(defaultThumbnailVariant().size) * dpr)
+	}
+	if needed <= defaultThumbnailVariant().size {
+		return variant
+	}
+
+	// Smallest allowed size that covers the need, or the largest one
+	variant.size = thumbnailHintSizes[len(thumbnailHintSizes)-1]
+	for _, size := range thumbnailHintSizes {
+		if size >= needed {
+			variant.size = size
+			break
+		}
+	}
+	return variant
+}
+
 func main() {
 	// Parse command-line arguments
+	configPath := flag.String("config", "", "Read settings from this JSON file, keyed by flag name, e.g. {\"root\": \"/srv/photos\", \"port\": 8081}; flags given on the command line take precedence")
 	rootDir := flag.String("root", ".", "Root directory to serve (default: current directory)")
 	port := flag.String("port", "8080", "Port to listen on (default: 8080)")
 	basePath := flag.String("base-path", "", "Base path for the application (e.g., /gallery)")
+	trustForwardedPrefix := flag.Bool("trust-forwarded-prefix", false, "Take the base path of each request from the X-Forwarded-Prefix header set by a reverse proxy, falling back to -base-path")
+	homePath := flag.String("home-path", "", "Directory the gallery opens in, relative to root (e.g., /2024/favorites)")
+	vipsPathFlag := flag.String("vips-path", "", "Path to vipsthumbnail; vipsheader and vips are taken from the same directory (default: look up on PATH)")
+	ffmpegPathFlag := flag.String("ffmpeg-path", "", "Path to ffmpeg (default: look up on PATH)")
+	authUser := flag.String("auth-user", "", "Require HTTP basic auth with this user name and -auth-pass (default: no authentication)")
+	authPass := flag.String("auth-pass", "", "Password for -auth-user")
+	htpasswdFlag := flag.String("htpasswd", "", "Require HTTP basic auth from the users of this htpasswd file, whose passwords must be bcrypt hashes (htpasswd -B)")
+	authToken := flag.String("auth-token", "", "Require this token as a ?token= parameter or bearer token, remembered in a cookie afterwards, e.g. for sharing links")
+	authExemptAssets := flag.Bool("auth-exempt-assets", false, "Serve the UI's own /assets/ without authentication")
+	writable := flag.Bool("writable", false, "Accept uploads with POST /api/upload or, resumable, /api/uploads and deletions with DELETE /api/file/<path>, which moves files to the trash, see -trash-dir")
+	trashDirFlag := flag.String("trash-dir", "", "With -writable, move deleted files to this directory, mirroring the tree under root. It must be on the same file system as root, and hidden if under root (default: .trash under root)")
+	uploadAnyType := flag.Bool("upload-any-type", false, "With -writable, accept uploads of any file type, not only images and movies")
+	uploadMaxBytes := flag.Int64("upload-max-bytes", defaultUploadMaxBytes, "With -writable, refuse upload requests and resumable uploads of more than this many bytes with 413, 0 for unlimited")
+	maxStoredDimension := flag.Int("max-stored-dimension", 0, "With -writable, downscale uploaded JPEG and PNG images whose longest side is larger than this many pixels before storing them, keeping their metadata (default: 0, keep originals; needs vips)")
+	readOnlyFlag := flag.Bool("read-only", false, "Refuse every request that changes something, such as prunes, rebuilds, album orders and favorites")
+	maxRequests := flag.Int("max-requests", 0, "Maximum concurrent requests before responding 503 (default: 0, unlimited)")
+	rateLimit := flag.Float64("rate-limit", 0, "Requests per second each client IP may make for thumbnails, previews and movie streams, over which it gets 429 (default: 0, unlimited)")
+	rateBurst := flag.Int("rate-burst", 50, "Requests a client IP may make at once under -rate-limit, e.g. for a page of thumbnails")
+	imageWorkers := flag.Int("image-workers", 2, "Image thumbnails generated in parallel; each runs a vips process")
+	movieWorkers := flag.Int("movie-workers", 1, "Movie thumbnails generated in parallel; each runs an ffmpeg process")
+	queueSize := flag.Int("queue-size", 250, "Thumbnails of each kind that may wait for a worker; over this a request generates its own thumbnail")
+	maxGenerations := flag.Int("max-generations", 0, "Maximum concurrent thumbnail generations across image and movie workers (default: 0, unlimited)")
+	previewReserve := flag.Int("preview-reserve", 0, "Of the -max-generations slots, keep this many for previews so a thumbnail backlog can't starve them (default: 0, previews are not limited)")
+	listIndex := flag.Bool("list-index", false, "Keep a sorted index of each directory listed with ?offset=&limit= in memory, so later windows are cut from it")
+	slowListings := flag.Int("slow-listings", 0, "Track the N directories that are slowest to list and report them at /api/status (default: 0, off)")
+	toolProbeInterval := flag.Duration("tool-probe-interval", 0, "Check that vips and ffmpeg still work this often, at least 1m, and report it at /api/status (default: 0, off)")
+	listCacheTTL := flag.Duration("list-cache-ttl", 0, "Cache directory listings in memory for this long, e.g. 30s (default: 0, off)")
+	thumbnailTimeout := flag.Duration("thumbnail-timeout", 0, "Maximum time for a thumbnail request including generation (default: 0, no limit)")
+	maxPreviews := flag.Int("max-previews", defaultMaxPreviews, "Maximum concurrent streamed movie preview transcodes, 0 for unlimited")
+	maxImagePreviews := flag.Int("max-image-previews", 0, "Maximum concurrent image previews (default: 0, unlimited)")
+	previewQueueWait := flag.Duration("preview-queue-wait", 30*time.Second, "How long a preview over -max-previews or -max-image-previews waits for a slot before getting 503; 0 refuses it at once")
+	previewTimeout := flag.Duration("preview-timeout", 0, "Maximum time for a preview request including transcoding (default: 0, no limit)")
+	logFormat := flag.String("log-format", "text", "Format of the log, including one line per request: text or json")
+	shutdownGrace := flag.Duration("shutdown-grace", defaultShutdownGrace, "On SIGINT or SIGTERM, wait this long for running requests and thumbnail generations before killing them")
+	previewIdleTimeout := flag.Duration("preview-idle-timeout", 0, "Stop a streamed movie preview when ffmpeg produces no output for this long, however long the transcode runs overall (default: 0, no limit)")
+	maxFileTime := flag.Duration("max-file-time", 0, "Give up on a file whose thumbnail or pre-transcoded preview takes longer than this, and skip it until it changes (default: 0, no limit)")
+	pregenerate := flag.Bool("pregenerate", false, "At startup, generate every thumbnail that is missing or older than its file, behind on-demand requests, and report progress at /api/pregen/status")
+	watchMode := flag.String("watch", watchOff, "Watch the root directory for changes, regenerating the thumbnails of new and edited files and dropping those of removed ones: inotify (Linux, polls when out of watches), poll (walk the tree every 30s) or off")
+	scanInterval := flag.Duration("scan-interval", 0, "Scan the whole tree for new files and generate their thumbnails this often, e.g. 24h (default: 0, off)")
+	cacheDirFlag := flag.String("cache-dir", "", "Keep thumbnails and other caches in this directory, mirroring the tree under root, instead of in .small directories next to the files (e.g., for a read-only share)")
+	zipMaxBytes := flag.Int64("zip-max-bytes", defaultZipMaxBytes, "Refuse /api/zip archives whose originals add up to more than this many bytes, 0 for unlimited")
+	cacheMaxBytes := flag.Int64("cache-max-bytes", 0, "Evict the least recently read cache files once the cache is larger than this many bytes, checked every 10 minutes (default: 0, unlimited)")
+	verifyCache := flag.Bool("verify-cache", false, "Check cached thumbnails at startup and delete truncated ones so they are regenerated")
+	segmentWorkers := flag.Int("segment-workers", 0, "Transcode movie previews as HLS segments, this many in parallel (default: 0, one continuous stream)")
+	segmentSeconds := flag.Int("segment-seconds", defaultSegmentSeconds, "Length of the HLS segments of -segment-workers in seconds, 1-30")
+	templatesDir := flag.String("templates-dir", "", "Directory of index templates, one theme per .html file, picked with ?theme=name, read at startup instead of the built-in templates/index.html (default: built in)")
+	exportDir := flag.String("export", "", "Write the gallery as static files to this directory, generating all thumbnails, and exit")
+	pretranscode := flag.Bool("pretranscode", false, "Transcode all movie previews into the cache and exit")
+	colorProfile := flag.String("color-profile", "", "Convert image thumbnails and previews to this color profile: srgb, p3, or the path of an .icc file (default: keep the source's profile; vips only)")
+	thumbnailBackground := flag.String("thumbnail-background", "#ffffff", "Background color (#rrggbb) behind transparent images in JPEG thumbnails and previews")
+	thumbnailSize := flag.Int("thumbnail-size", defaultThumbnailSize, "Longest edge of the default thumbnail in pixels, 100-3000")
+	previewSize := flag.Int("preview-size", defaultPreviewSize, "Longest edge of an image preview in pixels when the client asks for no size, up to 3200")
+	thumbnailPad := flag.String("thumbnail-pad", "", "Pad thumbnails to this aspect ratio, e.g. 4:3, with -thumbnail-background so grid tiles line up (default: keep each image's shape)")
+	placeholderSize := flag.Int("placeholder-size", 0, "Size of a low-quality placeholder thumbnail shown before the real one, e.g. 50 (default: 0, off)")
+	placeholderQuality := flag.Int("placeholder-quality", 30, "JPEG quality of placeholder thumbnails")
+	nativeThumbnails := flag.Bool("native-thumbnails", false, "Generate thumbnails and previews in-process without vips/ffmpeg (JPEG, PNG, GIF and WebP only)")
+	thumbnailMinBytes := flag.Int64("thumbnail-min-bytes", 0, "Serve JPEG, PNG, GIF and WebP images smaller than this many bytes as their own thumbnail (default: 0, off)")
+	caseInsensitive := flag.String("case-insensitive", "auto", "Treat file names as case-insensitive: auto (detect from the root directory), on, or off")
+	thumbnailMode := flag.String("thumbnail-mode", "fit", "Thumbnail shape: fit (keep aspect ratio), center-crop or smart-crop (square)")
+	videoEncoderFlag := flag.String("video-encoder", "auto", "H.264 encoder for movie previews: qsv, nvenc, vaapi, videotoolbox, software (libx264), or auto to use the first hardware encoder that works")
+	videoThumbStyle := flag.String("video-thumb-style", "frame", "Movie thumbnail style: frame (the first frame) or filmstrip (a strip of frames across the clip)")
+	thumbnailProgressive := flag.Bool("thumbnail-progressive", false, "Write image thumbnails as progressive JPEGs, which render in increasing quality while loading (vips only)")
+	thumbnailSubsample := flag.String("thumbnail-subsample", "on", "JPEG chroma subsampling for thumbnails: on, off, or auto (off for PNG sources)")
+	exposureStats := flag.Bool("exposure-stats", false, "Measure brightness, clipping and a luminance histogram of each image thumbnail and list them with ?exposure=true")
+	prefetchThumbnails := flag.Bool("prefetch-thumbnails", false, "Queue the missing thumbnails of a directory as soon as it is listed")
+	hashedThumbnails := flag.Bool("hashed-thumbnails", false, "List thumbnails under immutable content-addressable URLs (/api/t/<hash>.jpg)")
+	hideCopies := flag.Bool("hide-thumbnail-copies", false, "Don't list or thumbnail files named like generated thumbnails outside .small, such as photo.jpg.jpg or clip.MOV.jpg")
+	watermarkPath := flag.String("watermark", "", "Image to overlay on thumbnails and previews (originals are never watermarked)")
+	watermarkOpacity := flag.Float64("watermark-opacity", 0.3, "Opacity of the watermark, between 0 and 1")
+	watermarkPosition := flag.String("watermark-position", "bottom-right", "Watermark position: top-left, top-right, bottom-left, bottom-right, or center")
+	watermarkScale := flag.Float64("watermark-scale", 0.2, "Watermark width as a fraction of the image width")
+	favoritesMode := flag.String("favorites", "session", "Favorites: session (kept per visitor in a cookie-identified session), global (shared by everyone) or off")
+	sessionSecret := flag.String("session-secret", "", "Secret that signs session cookies (default: random key kept in the user's config directory, e.g. ~/.config/directory-server)")
+	excludePatterns := flag.String("exclude", defaultExcludePatterns, "Comma-separated glob patterns of files and directories to hide and never serve (case-insensitive)")
+	mimeTypeOverrides := flag.String("mime-types", "", "Comma-separated Content-Type overrides for originals (e.g., .heic=image/heic,.dng=image/x-adobe-dng)")
+	requireTranscoded := flag.Bool("require-pretranscoded", false, "Serve movie previews only from the pre-transcoded cache instead of transcoding on demand")
+	s3Bucket := flag.String("s3-bucket", "", "Serve media from this S3 bucket instead of the root directory, which then only holds thumbnails")
+	s3Prefix := flag.String("s3-prefix", "", "Key prefix within the S3 bucket to serve")
+	s3Region := flag.String("s3-region", "us-east-1", "Region of the S3 bucket")
+	s3Endpoint := flag.String("s3-endpoint", "", "S3-compatible endpoint URL (default: AWS endpoint for the region)")
 	flag.Parse()
 
+	var config *configState
+	if *configPath != "" {
+		config = newConfigState(flag.CommandLine, *configPath)
+		if err := loadConfigFile(flag.CommandLine, *configPath); err != nil {
+			log.Fatalf("Invalid -config: %v", err)
+		}
+		config.remember()
+	}
+
+	if err := setupLogging(*logFormat); err != nil {
+		log.Fatalf("Invalid -log-format: %v", err)
+	}
+
 	// On Windows, add ./bin to PATH
 	if runtime.GOOS == "windows" {
 		binPath, err := filepath.Abs("./bin")
@@ -124,24 +857,126 @@ func main() {
 		}
 	}
 
+	// Explicit tool paths are checked up front so a typo fails at startup
+	// rather than on the first thumbnail
+	if *vipsPathFlag != "" {
+		if _, err := exec.LookPath(*vipsPathFlag); err != nil {
+			log.Fatalf("Invalid -vips-path: %v", err)
+		}
+		vipsPath = *vipsPathFlag
+	}
+	if *ffmpegPathFlag != "" {
+		if _, err := exec.LookPath(*ffmpegPathFlag); err != nil {
+			log.Fatalf("Invalid -ffmpeg-path: %v", err)
+		}
+		ffmpegPath = *ffmpegPathFlag
+	}
+	hideThumbnailCopies = *hideCopies
+
+	pad, err := parseThumbnailPad(*thumbnailPad)
+	if err != nil {
+		log.Fatalf("Invalid -thumbnail-pad value: %v", err)
+	}
+	if err := checkThumbnailSize(*thumbnailSize); err != nil {
+		log.Fatalf("Invalid -thumbnail-size value: %v", err)
+	}
+	defaultVariant.Store(&thumbnailVariant{size: *thumbnailSize, pad: pad})
+	if *previewSize < 1 || *previewSize > maxPreviewSize {
+		log.Fatalf("Invalid -preview-size value %d: must be between 1 and %d", *previewSize, maxPreviewSize)
+	}
+	defaultPreviewSize = *previewSize
+	previewSizes[*previewSize] = true
+	if *placeholderSize < 0 || *placeholderQuality < 1 || *placeholderQuality > 100 {
+		log.Fatalf("Invalid placeholder settings: -placeholder-size must be >= 0 and -placeholder-quality between 1 and 100")
+	}
+
+	switch *thumbnailMode {
+	case "fit", "center-crop", "smart-crop":
+	default:
+		log.Fatalf("Invalid -thumbnail-mode value %q: must be fit, center-crop, or smart-crop", *thumbnailMode)
+	}
+
+	switch *caseInsensitive {
+	case "auto", "on", "off":
+	default:
+		log.Fatalf("Invalid -case-insensitive value %q: must be auto, on, or off", *caseInsensitive)
+	}
+
+	switch *videoThumbStyle {
+	case "frame", "filmstrip":
+	default:
+		log.Fatalf("Invalid -video-thumb-style value %q: must be frame or filmstrip", *videoThumbStyle)
+	}
+
+	switch *thumbnailSubsample {
+	case "on", "off", "auto":
+	default:
+		log.Fatalf("Invalid -thumbnail-subsample value %q: must be on, off, or auto", *thumbnailSubsample)
+	}
+
+	profile, err := parseColorProfile(*colorProfile)
+	if err != nil {
+		log.Fatalf("Invalid -color-profile value: %v", err)
+	}
+	background, err := parseBackgroundColor(*thumbnailBackground)
+	if err != nil {
+		log.Fatalf("Invalid -thumbnail-background value: %v", err)
+	}
+
+	exclude, err := parseExcludePatterns(*excludePatterns)
+	if err != nil {
+		log.Fatalf("Invalid -exclude: %v", err)
+	}
+	if err := parseMIMETypes(*mimeTypeOverrides); err != nil {
+		log.Fatalf("Invalid -mime-types value: %v", err)
+	}
+
 	// Convert to absolute path
 	absRoot, err := filepath.Abs(*rootDir)
 	if err != nil {
 		log.Fatalf("Failed to get absolute path: %v", err)
 	}
+	if *s3Bucket == "" {
+		if info, err := os.Stat(absRoot); err != nil {
+			log.Fatalf("Invalid -root: %v", err)
+		} else if !info.IsDir() {
+			log.Fatalf("Invalid -root: %s is not a directory", absRoot)
+		}
+	}
 
-	// Load template
-	tmpl, err := template.ParseFiles("templates/index.html")
+	// Source media lives on local disk unless a bucket is configured, in which
+	// case the root directory only holds the thumbnail cache
+	var store mediaStore = localStore{}
+	if *s3Bucket != "" {
+		if err := os.MkdirAll(absRoot, 0755); err != nil {
+			log.Fatalf("Failed to create cache directory: %v", err)
+		}
+		store, err = newS3Store(absRoot, *s3Endpoint, *s3Bucket, *s3Prefix, *s3Region, os.Getenv)
+		if err != nil {
+			log.Fatalf("Failed to configure S3: %v", err)
+		}
+	}
+
+	// Load template, or with -templates-dir one per theme
+	var themes themeSet
+	defaultTheme := defaultThemeName
+	tmpl, err := template.ParseFS(uiFiles, "templates/index.html")
+	if *templatesDir != "" {
+		themes, defaultTheme, err = loadThemes(*templatesDir)
+		if err == nil {
+			tmpl = themes[defaultTheme]
+			log.Printf("Loaded %d themes from %s, default %q", len(themes), *templatesDir, defaultTheme)
+		}
+	}
 	if err != nil {
 		log.Fatalf("Failed to load template: %v", err)
 	}
 
-	// Initialize thumbnail queues with buffer to prevent blocking
-	// Buffer size of 500 allows some queuing before blocking
-	queueSize := 250
-	numImageWorkers := 2 // Limit concurrent image thumbnail generations to prevent memory issues
-	numMovieWorkers := 1 // Limit concurrent movie thumbnail generations (movies are more resource-intensive)
-
+	// Worker counts bound the vips and ffmpeg processes running at once, and
+	// the queues hold what waits for them
+	if *imageWorkers < 1 || *movieWorkers < 1 || *queueSize < 1 {
+		log.Fatalf("Invalid worker settings: -image-workers, -movie-workers and -queue-size must be at least 1")
+	}
 	// Normalize base path: ensure it starts with / and ends without /
 	normalizedBasePath := *basePath
 	if normalizedBasePath != "" {
@@ -151,45 +986,337 @@ func main() {
 		normalizedBasePath = strings.TrimSuffix(normalizedBasePath, "/")
 	}
 
+	// Cache names are lowercased where Photo.JPG and photo.jpg are one file
+	switch *caseInsensitive {
+	case "on":
+		caseInsensitiveFS = true
+	case "auto":
+		caseInsensitiveFS = *s3Bucket == "" && detectCaseInsensitive(absRoot)
+	}
+	if caseInsensitiveFS {
+		caseFoldRoot = absRoot
+		log.Printf("Treating file names under %s as case-insensitive", absRoot)
+	}
+
+	// Caches go next to the files unless -cache-dir moves them out, e.g.
+	// because the root is a read-only share
+	if *cacheDirFlag != "" {
+		absCache, err := filepath.Abs(*cacheDirFlag)
+		if err != nil {
+			log.Fatalf("Failed to get absolute path: %v", err)
+		}
+		if relPath, err := filepath.Rel(absRoot, absCache); err == nil && !strings.HasPrefix(relPath, "..") {
+			log.Fatalf("Invalid -cache-dir %q: must be outside the root directory", *cacheDirFlag)
+		}
+		if err := os.MkdirAll(absCache, 0755); err != nil {
+			log.Fatalf("Failed to create cache directory: %v", err)
+		}
+		cacheDir, cacheSourceRoot = absCache, absRoot
+		log.Printf("Caching thumbnails under %s", cacheDir)
+	}
+	if (*authUser == "") != (*authPass == "") {
+		log.Fatalf("-auth-user and -auth-pass must be set together")
+	}
+	if *cacheMaxBytes < 0 {
+		log.Fatalf("Invalid -cache-max-bytes value %d: must be >= 0", *cacheMaxBytes)
+	}
+	if *zipMaxBytes < 0 {
+		log.Fatalf("Invalid -zip-max-bytes value %d: must be >= 0", *zipMaxBytes)
+	}
+	if *uploadMaxBytes < 0 {
+		log.Fatalf("Invalid -upload-max-bytes value %d: must be >= 0", *uploadMaxBytes)
+	}
+	if *maxStoredDimension < 0 {
+		log.Fatalf("Invalid -max-stored-dimension value %d: must be >= 0", *maxStoredDimension)
+	}
+	if *maxStoredDimension > 0 && !*writable {
+		log.Fatalf("-max-stored-dimension only applies to uploads and needs -writable")
+	}
+	trashDir := ""
+	if *trashDirFlag != "" {
+		if !*writable {
+			log.Fatalf("-trash-dir only applies to deletions and needs -writable")
+		}
+		if trashDir, err = filepath.Abs(*trashDirFlag); err != nil {
+			log.Fatalf("Failed to get absolute path: %v", err)
+		}
+		// A trash under the root would be listed unless it is hidden
+		if relPath, err := filepath.Rel(absRoot, trashDir); err == nil && !strings.HasPrefix(relPath, "..") && (relPath == "." || !isHiddenPath(filepath.ToSlash(relPath))) {
+			log.Fatalf("Invalid -trash-dir %q: must be outside the root directory or hidden", *trashDirFlag)
+		}
+	}
+
 	server := &Server{
 		rootDir:             absRoot,
+		store:               store,
 		basePath:            normalizedBasePath,
+		trustPrefixHeader:   *trustForwardedPrefix,
 		indexTmpl:           tmpl,
-		imageThumbnailQueue: make(chan string, queueSize),
-		movieThumbnailQueue: make(chan string, queueSize),
+		themes:              themes,
+		defaultTheme:        defaultTheme,
+		imageThumbnailQueue: make(chan thumbnailJob, *queueSize),
+		movieThumbnailQueue: make(chan thumbnailJob, *queueSize),
+		requireTranscoded:   *requireTranscoded,
+		thumbnailBackground: background,
+		colorProfile:        profile,
+		thumbnailMode:       *thumbnailMode,
+		videoThumbStyle:     *videoThumbStyle,
+		nativeThumbnails:    *nativeThumbnails,
+		placeholderVariant:  thumbnailVariant{size: *placeholderSize, quality: *placeholderQuality, pad: pad},
+		hashedThumbnails:    *hashedThumbnails,
+		writable:            *writable,
+		uploadAnyType:       *uploadAnyType,
+		uploadMaxBytes:      *uploadMaxBytes,
+		maxStoredDimension:  *maxStoredDimension,
+		trashDir:            trashDir,
+		config:              config,
+		exclude:             exclude,
+	}
+
+	server.generator = server
+	server.runner = execRunner{}
+	server.baseCtx, server.stopChildren = context.WithCancel(context.Background())
+	server.live.Store(&tunables{
+		imageWorkers:       *imageWorkers,
+		movieWorkers:       *movieWorkers,
+		thumbnailTimeout:   *thumbnailTimeout,
+		maxFileTime:        *maxFileTime,
+		previewTimeout:     *previewTimeout,
+		previewIdleTimeout: *previewIdleTimeout,
+		previewQueueWait:   *previewQueueWait,
+		thumbnailSubsample: *thumbnailSubsample,
+		progressiveJPEG:    *thumbnailProgressive,
+		thumbnailMinBytes:  *thumbnailMinBytes,
+		prefetchThumbnails: *prefetchThumbnails,
+		exposureStats:      *exposureStats,
+		cacheMaxBytes:      *cacheMaxBytes,
+		zipMaxBytes:        *zipMaxBytes,
+	})
+
+	// Without vips, JPEG and PNG still get thumbnails from the Go decoders.
+	// Only the formats that need vips (HEIC, RAW, ...) fail.
+	if !*nativeThumbnails {
+		if vips, err := exec.LookPath(vipsExecutable()); err != nil {
+			server.vipsMissing = true
+			log.Printf("vipsthumbnail not found (%v): JPEG and PNG thumbnails are generated in-process, other image formats will fail", err)
+		} else {
+			log.Printf("Generating image thumbnails with %s", vips)
+		}
+	}
+	server.svgUnsupported = server.nativeThumbnails || server.vipsMissing
+	if server.maxStoredDimension > 0 && (server.nativeThumbnails || server.vipsMissing) {
+		log.Fatalf("-max-stored-dimension needs vips and can't be combined with -native-thumbnails")
+	}
+	if !server.nativeThumbnails && !server.vipsMissing {
+		server.modernFormats = vipsSavers()
+	}
+
+	// Probing runs ffmpeg, so it's done once rather than per preview
+	if *videoEncoderFlag == "auto" {
+		if _, err := exec.LookPath(ffmpegExecutable()); err != nil {
+			*videoEncoderFlag = "software"
+		}
+	}
+	server.videoEncoder, err = selectVideoEncoder(*videoEncoderFlag)
+	if err != nil {
+		log.Fatalf("Invalid -video-encoder value: %v", err)
+	}
+	log.Printf("Transcoding movie previews with %s", server.videoEncoder.encoder)
+	if !server.svgUnsupported && !server.vipsHasSVGLoader() {
+		server.svgUnsupported = true
+		log.Printf("vips has no SVG loader (librsvg): SVG files are listed without thumbnails")
+	}
+
+	// Validate the landing directory up front rather than on every page load
+	if *homePath != "" {
+		fullHome, ok := server.resolvePath(*homePath)
+		if !ok {
+			log.Fatalf("Home path %q is outside the root directory", *homePath)
+		}
+		info, err := server.store.Stat(context.Background(), fullHome)
+		if err != nil || !info.IsDir() {
+			log.Fatalf("Home path %q is not a directory", *homePath)
+		}
+		server.homePath = "/"
+		if relHome, _ := filepath.Rel(absRoot, fullHome); relHome != "." {
+			server.homePath += filepath.ToSlash(relHome)
+		}
+	}
+
+	// Recover from partial thumbnails left behind by an unclean shutdown
+	if *verifyCache {
+		log.Printf("Verifying thumbnail cache under %s", cacheTreeFor(absRoot))
+		checked, removed := server.verifyCache(cacheTreeFor(absRoot))
+		log.Printf("Cache verification finished: %d thumbnails checked, %d corrupt removed", checked, removed)
+	}
+
+	// Batch mode: build the movie preview cache and exit
+	if *pretranscode {
+		transcoded, failed, err := server.pretranscodeMovies(context.Background())
+		if err != nil {
+			log.Fatalf("Pre-transcoding failed: %v", err)
+		}
+		log.Printf("Pre-transcoding finished: %d transcoded, %d failed", transcoded, failed)
+		return
+	}
+
+	switch *favoritesMode {
+	case favoritesOff:
+	case favoritesGlobal, favoritesSession:
+		favorites, err := loadFavorites(filepath.Join(thumbnailDirFor(absRoot), "favorites.json"))
+		if err != nil {
+			log.Fatalf("Failed to load favorites: %v", err)
+		}
+		server.favorites = favorites
+		server.favoritesMode = *favoritesMode
+	default:
+		log.Fatalf("Invalid -favorites %q: must be session, global or off", *favoritesMode)
+	}
+	if server.favoritesMode == favoritesSession {
+		key, err := loadSessionKey(*sessionSecret, sessionKeyPath(absRoot))
+		if err != nil {
+			log.Fatalf("Failed to set up sessions: %v", err)
+		}
+		server.sessions = &sessionManager{key: key}
+	}
+
+	if *watermarkPath != "" {
+		if *nativeThumbnails {
+			log.Fatalf("-watermark needs vips and can't be combined with -native-thumbnails")
+		}
+		wm, err := loadWatermark(*watermarkPath, *watermarkOpacity, *watermarkPosition, *watermarkScale)
+		if err != nil {
+			log.Fatalf("Failed to load watermark: %v", err)
+		}
+		wm.runner = server.runner
+		server.watermark = wm
+	}
+
+	if *segmentSeconds < 1 || *segmentSeconds > maxSegmentSeconds {
+		log.Fatalf("Invalid -segment-seconds value %d: must be between 1 and %d", *segmentSeconds, maxSegmentSeconds)
+	}
+	hlsSegmentSeconds = *segmentSeconds
+	if *segmentWorkers > 0 {
+		server.segmentSem = make(chan struct{}, *segmentWorkers)
 	}
 
-	// Start image worker goroutines
-	for i := 0; i < numImageWorkers; i++ {
-		server.imageWorkersWg.Add(1)
-		go server.imageThumbnailWorker(i)
+	if *rateLimit > 0 {
+		server.rateLimiter = newRateLimiter(*rateLimit, *rateBurst)
+		go server.sweepRateLimitsPeriodically()
+	}
+	if *slowListings > 0 {
+		server.slowListings = newSlowListings(*slowListings)
+	}
+
+	if *listIndex {
+		server.listIndex = newDirIndexes()
+	}
+
+	if *listCacheTTL > 0 {
+		server.listCache = newListCache(*listCacheTTL)
+	}
+
+	if *maxPreviews > 0 {
+		server.moviePreviews.sem = make(chan struct{}, *maxPreviews)
+	}
+	if *maxImagePreviews > 0 {
+		server.imagePreviews.sem = make(chan struct{}, *maxImagePreviews)
 	}
 
-	// Start movie worker goroutines
-	for i := 0; i < numMovieWorkers; i++ {
-		server.movieWorkersWg.Add(1)
-		go server.movieThumbnailWorker(i)
+	// Optional global limit shared by image and movie generation.
+	// When disabled, the image and movie worker pools run independently.
+	if *maxGenerations > 0 {
+		server.generationSem = make(chan struct{}, *maxGenerations)
 	}
 
-	http.HandleFunc("/", server.handleIndex)
-	http.HandleFunc("/api/list", server.handleList)
-	http.HandleFunc("/api/thumbnail/", server.handleThumbnail)
-	http.HandleFunc("/api/preview/", server.handlePreview)
-	http.HandleFunc("/api/file.ts", server.handleFileTS)
-	http.HandleFunc("/api/file.m3u8", server.handleM3U8)
-	http.HandleFunc("/static/", server.handleStatic)
-	http.HandleFunc("/assets/", server.handleAssets)
+	// Previews then share the limit, but thumbnails can't take all of it
+	if *previewReserve > 0 {
+		if *previewReserve >= *maxGenerations {
+			log.Fatalf("Invalid -preview-reserve %d: needs a larger -max-generations to leave slots for thumbnails", *previewReserve)
+		}
+		server.generationSem = make(chan struct{}, *maxGenerations-*previewReserve)
+		server.capacitySem = make(chan struct{}, *maxGenerations)
+	}
+
+	// Start the image and movie worker goroutines
+	server.resizeWorkers(*imageWorkers, *movieWorkers)
+
+	// Batch mode: write a static copy of the gallery and exit
+	if *exportDir != "" {
+		log.Printf("Exporting %s to %s", absRoot, *exportDir)
+		exported, failed, err := server.exportStatic(context.Background(), *exportDir)
+		if err != nil {
+			log.Fatalf("Export failed: %v", err)
+		}
+		log.Printf("Export finished: %d files exported, %d failed", exported, failed)
+		return
+	}
+
+	if *scanInterval > 0 {
+		go server.scanPeriodically(*scanInterval)
+	}
+	if *writable && (*readOnlyFlag || *s3Bucket != "") {
+		log.Fatalf("-writable needs media on local disk and can't be combined with -read-only")
+	}
+	switch *watchMode {
+	case watchOff:
+	case watchPoll, watchInotify:
+		if *s3Bucket != "" {
+			log.Fatalf("-watch needs media on local disk, not in -s3-bucket")
+		}
+		server.watchFiles(*watchMode)
+	default:
+		log.Fatalf("Invalid -watch: must be inotify, poll or off, got %q", *watchMode)
+	}
+	if *pregenerate {
+		server.pregen = &pregenProgress{started: time.Now()}
+		go server.pregenerate()
+	}
+	// Always running, as /api/reload may set -cache-max-bytes later
+	go server.evictCachePeriodically()
+	// Build the media index up front, so the first search needn't walk the tree
+	server.refreshMediaIndex()
+	if *toolProbeInterval > 0 {
+		server.toolProbes = newToolProbes()
+		go server.probeToolsPeriodically(max(*toolProbeInterval, minToolProbeInterval))
+	}
+
+	opts := handlerOptions{maxRequests: *maxRequests, readOnly: *readOnlyFlag}
+	if *authUser != "" || *authToken != "" || *htpasswdFlag != "" {
+		opts.auth = &authConfig{
+			user:         *authUser,
+			pass:         *authPass,
+			token:        *authToken,
+			exemptAssets: *authExemptAssets,
+		}
+	}
+	if *htpasswdFlag != "" {
+		users, err := loadHtpasswd(*htpasswdFlag)
+		if err != nil {
+			log.Fatalf("Failed to load -htpasswd: %v", err)
+		}
+		opts.auth.htpasswd = users
+		log.Printf("Requiring a login from the %d users of %s", len(users.users), *htpasswdFlag)
+	}
+	handler := server.newHandler(opts)
 
 	log.Printf("Server starting on port %s, serving directory: %s", *port, absRoot)
-	log.Fatal(http.ListenAndServe(":"+*port, nil))
+	if err := server.serve(":"+*port, handler, *shutdownGrace); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// Ask the browser to send client hints with thumbnail requests
+	w.Header().Set("Accept-CH", "Sec-CH-DPR, Sec-CH-Width")
+	theme, tmpl := s.themeFor(w, r)
 	templateData := map[string]string{
-		"BasePath": s.basePath,
+		"BasePath": s.requestBasePath(r),
+		"HomePath": s.homePath,
+		"Theme":    theme,
 	}
-	if err := s.indexTmpl.Execute(w, templateData); err != nil {
+	if err := tmpl.Execute(w, templateData); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -200,6 +1327,75 @@ func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
 	if path == "" {
 		path = "/"
 	}
+	withDimensions := r.URL.Query().Get("dimensions") == "true"
+	inlineThumbs := r.URL.Query().Get("inline-thumbs") == "true"
+	withExposure := s.settings().exposureStats && r.URL.Query().Get("exposure") == "true"
+	// Metadata for justified layouts: dimensions and capture time
+	withMeta := r.URL.Query().Get("meta") == "1"
+	if withMeta {
+		withDimensions = true
+	}
+	// Directories without a cover in .gallery.json get one picked
+	withCovers := r.URL.Query().Get("covers") == "1"
+	// Live Photos and RAW+JPEG shots are one entry unless ?pairs=0
+	unpaired := r.URL.Query().Get("pairs") == "0"
+	sortOrder, ok := listSortFor(r)
+	if !ok {
+		http.Error(w, "Invalid sort or order", http.StatusBadRequest)
+		return
+	}
+	kind := r.URL.Query().Get("kind")
+	if kind != "" && !validMediaKind(kind) {
+		http.Error(w, "Invalid kind", http.StatusBadRequest)
+		return
+	}
+	offset, limit, windowed, ok := listWindow(r)
+	if !ok {
+		http.Error(w, "Invalid offset or limit", http.StatusBadRequest)
+		return
+	}
+	variantTag := ""
+	if windowed {
+		variantTag = fmt.Sprintf("-%d-%d", offset, limit)
+	}
+	// Streaming clients get one entry per line as soon as it is ready
+	w.Header().Add("Vary", "Accept")
+	streamed := wantsStreamedList(r)
+	if streamed {
+		if windowed {
+			http.Error(w, "offset and limit can't be combined with streaming", http.StatusBadRequest)
+			return
+		}
+		variantTag = "-ndjson"
+	}
+	// Clients may ask for the same listing as MessagePack, which is smaller
+	packed := !streamed && wantsMsgpack(r)
+	if packed {
+		variantTag += "-msgpack"
+	}
+	if withExposure {
+		variantTag += "-exposure"
+	}
+	if withMeta {
+		variantTag += "-meta"
+	}
+	if withCovers {
+		variantTag += "-covers"
+	}
+	if unpaired {
+		variantTag += "-unpaired"
+	}
+	if kind != "" {
+		variantTag += "-" + kind
+	}
+	// Behind a proxy with -trust-forwarded-prefix the URLs depend on it
+	basePath := s.requestBasePath(r)
+	if s.trustPrefixHeader {
+		w.Header().Add("Vary", forwardedPrefixHeader)
+	}
+	if basePath != s.basePath {
+		variantTag += "-base" + basePath
+	}
 
 	// Clean the path
 	path = filepath.Clean(path)
@@ -219,9 +1415,71 @@ func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Access denied", http.StatusForbidden)
 		return
 	}
+	if s.isExcludedPath(relPath) || isHiddenPath(relPath) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	// Without ?sort= the directory's .gallery.json picks the order
+	if sortOrder == "" {
+		sortOrder = s.dirConfigFor(fullPath).Sort
+	}
+
+	// Changes seen by -watch, even those that keep the mtimes
+	if generation := s.generations.get(fullPath); generation > 0 {
+		variantTag += fmt.Sprintf("-g%d", generation)
+	}
+
+	indexKey := fmt.Sprintf("%s?dimensions=%t&inline-thumbs=%t&exposure=%t&meta=%t&covers=%t&pairs=%t&kind=%s&sort=%s", path, withDimensions, inlineThumbs, withExposure, withMeta, withCovers, !unpaired, kind, sortOrder)
+	if generation := s.generations.get(fullPath); generation > 0 {
+		indexKey += fmt.Sprintf("&generation=%d", generation)
+	}
+	cacheKey := indexKey
+	if basePath != s.basePath {
+		cacheKey += "&base=" + basePath
+	}
+	if windowed {
+		cacheKey += fmt.Sprintf("&offset=%d&limit=%d", offset, limit)
+	}
+	if packed {
+		cacheKey += "&format=msgpack"
+	}
+	if s.listCache != nil && !streamed {
+		if listing, ok := s.listCache.get(cacheKey); ok {
+			listing.serve(w, r)
+			return
+		}
+	}
+
+	// A window of an indexed directory is cut from the sorted index
+	var dirModTime time.Time
+	if windowed && s.listIndex != nil {
+		if info, err := s.store.Stat(r.Context(), fullPath); err == nil {
+			dirModTime = info.ModTime()
+			if index, ok := s.listIndex.get(indexKey, dirModTime); ok {
+				etag := listETag(index.version, index.entries, withDimensions, inlineThumbs, sortOrder, variantTag)
+				if setListValidators(w, r, etag, index.version) {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				response := DirectoryResponse{
+					Path:  path,
+					Files: s.rebaseFiles(windowOf(index.files, offset, limit), basePath),
+					Total: len(index.files),
+					Zip:   s.zipURL(path, basePath),
+					Stats: &index.stats,
+				}
+				response.HasMore = offset+len(response.Files) < response.Total
+				response.Prev, response.Next = s.pageLinks(r, offset, limit, response.Total)
+				respondNegotiated(w, r, response, http.StatusOK)
+				return
+			}
+		}
+	}
 
 	// Read directory
-	entries, err := os.ReadDir(fullPath)
+	listStarted := time.Now()
+	entries, err := s.store.ReadDir(r.Context(), fullPath)
 	if err != nil {
 		respondJSON(w, map[string]interface{}{
 			"error": err.Error(),
@@ -229,51 +1487,252 @@ func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Pollers revalidate instead of downloading an unchanged listing again.
+	// The query options change the body, so they are part of the ETag.
+	version := s.directoryVersion(r.Context(), fullPath, entries)
+	etag := listETag(version, len(entries), withDimensions, inlineThumbs, sortOrder, variantTag)
+	if setListValidators(w, r, etag, version) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	opts := &listOptions{withDimensions: withDimensions, inlineThumbs: inlineThumbs, withExposure: withExposure, withMeta: withMeta, kind: kind, basePath: basePath, unpaired: unpaired}
+	if withCovers {
+		opts.coverDeadline = listStarted.Add(coverListBudget)
+	}
+	if streamed {
+		s.streamList(w, r, fullPath, path, entries, opts, sortOrder, listStarted)
+		return
+	}
 	var files []FileInfo
+	var stats DirectoryStats
 	for _, entry := range entries {
-		// Skip hidden directories like .small
-		if strings.HasPrefix(entry.Name(), ".") {
-			continue
+		if fileInfo, ok := s.listEntry(r.Context(), fullPath, path, entry, opts); ok {
+			files = append(files, fileInfo)
+			stats.add(fileInfo)
 		}
+	}
 
-		relEntryPath := filepath.Join(path, entry.Name())
-		if path == "/" {
-			relEntryPath = "/" + entry.Name()
+	if !unpaired {
+		files = s.pairFiles(files)
+	}
+	if kind != "" {
+		files = filterMediaKind(files, kind)
+	}
+	sortListing(files, fullPath, sortOrder)
+	if s.slowListings != nil {
+		s.slowListings.record(path, time.Since(listStarted), len(entries))
+	}
+	total := len(files)
+	if windowed {
+		if s.listIndex != nil && !dirModTime.IsZero() {
+			s.listIndex.put(&dirIndex{key: indexKey, modTime: dirModTime, version: version, entries: len(entries), files: files, stats: stats})
 		}
-		// Convert to URL path format (forward slashes)
-		urlPath := strings.ReplaceAll(relEntryPath, "\\", "/")
+		files = windowOf(files, offset, limit)
+	}
+	if s.settings().prefetchThumbnails {
+		go s.prefetchDirectory(fullPath, files)
+	}
+	response := DirectoryResponse{
+		Path:  path,
+		Files: s.rebaseFiles(files, basePath),
+		Zip:   s.zipURL(path, basePath),
+		Stats: &stats,
+	}
+	if windowed {
+		response.Total = total
+		response.HasMore = offset+len(files) < total
+		response.Prev, response.Next = s.pageLinks(r, offset, limit, total)
+	}
+	if s.listCache == nil {
+		respondNegotiated(w, r, response, http.StatusOK)
+		return
+	}
+	body, contentType, err := encodeResponse(response, packed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	listing := &cachedListing{key: cacheKey, body: body, contentType: contentType, etag: etag, version: version}
+	s.listCache.put(listing)
+	listing.serve(w, r)
+}
 
-		fileInfo := FileInfo{
-			Name:  entry.Name(),
-			Path:  urlPath,
-			IsDir: entry.IsDir(),
+// listOptions are the query options of a listing that shape its entries
+type listOptions struct {
+	withDimensions bool
+	inlineThumbs   bool
+	withExposure   bool
+	withMeta       bool   // capture times, see photoMetadataFor
+	unpaired       bool   // ?pairs=0, paired files are listed separately
+	kind           string // only list files of this media kind, "" for all
+	basePath       string // the base path the client sees, see requestBasePath
+	inlined        int    // thumbnails embedded so far, up to maxInlineThumbnails
+
+	// Picking directory covers for ?covers=1 stops here, zero = no covers
+	coverDeadline time.Time
+}
+
+// listEntry builds the listing entry of one directory entry, reporting false
+// for entries that aren't listed: hidden, excluded or removed meanwhile
+func (s *Server) listEntry(ctx context.Context, dir, path string, entry fs.DirEntry, opts *listOptions) (FileInfo, bool) {
+	// Skip hidden directories like .small and excluded junk files
+	if strings.HasPrefix(entry.Name(), ".") || s.isExcluded(entry.Name()) {
+		return FileInfo{}, false
+	}
+
+	// The directory may change while we iterate: skip entries that were
+	// removed since ReadDir instead of failing or listing broken entries
+	info, err := entry.Info()
+	if errors.Is(err, fs.ErrNotExist) {
+		return FileInfo{}, false
+	}
+
+	relEntryPath := filepath.Join(path, entry.Name())
+	if path == "/" {
+		relEntryPath = "/" + entry.Name()
+	}
+	// Convert to URL path format (forward slashes)
+	urlPath := strings.ReplaceAll(relEntryPath, "\\", "/")
+
+	fileInfo := FileInfo{
+		Name:  entry.Name(),
+		Path:  urlPath,
+		IsDir: entry.IsDir(),
+	}
+	if err == nil {
+		fileInfo.ModTime = info.ModTime()
+		if !entry.IsDir() {
+			fileInfo.Size = info.Size()
+		}
+	}
+	if !entry.IsDir() {
+		fileInfo.Download = s.urlWithBasePath("/api/download" + s.urlPathFor(filepath.Join(dir, entry.Name())))
+	}
+
+	// Subdirectories can hide themselves or pick a cover in .gallery.json
+	if entry.IsDir() {
+		settings := s.ownDirConfig(filepath.Join(dir, entry.Name()))
+		if settings.Hidden {
+			return FileInfo{}, false
+		}
+		if settings.Cover != "" {
+			fileInfo.Cover = s.urlWithBasePath("/api/thumbnail" + urlPath + "/" + settings.Cover)
+			fileInfo.CoverSource = urlPath + "/" + settings.Cover
+		} else if !opts.coverDeadline.IsZero() {
+			if cover, ok := s.coverFor(ctx, filepath.Join(dir, entry.Name()), opts.coverDeadline); ok {
+				fileInfo.CoverSource = s.urlPathFor(cover)
+				fileInfo.Cover = s.urlWithBasePath("/api/thumbnail" + fileInfo.CoverSource)
+			}
 		}
+	}
 
-		// Check if it's an image
-		ext := strings.ToLower(filepath.Ext(entry.Name()))
-		if imageExtensions[ext] || movieExtensions[ext] {
-			if imageExtensions[ext] {
-				fileInfo.IsImage = true
+	// Check if it's an image
+	isImage, isMovie := isImageFile(entry.Name()), isMovieFile(entry.Name())
+	if isImage || isMovie {
+		fileInfo.IsImage = isImage
+		fileInfo.IsMovie = isMovie
+		// Generate thumbnail path - ensure it starts with / for proper URL
+		thumbPath := urlPath
+		if !strings.HasPrefix(thumbPath, "/") {
+			thumbPath = "/" + thumbPath
+		}
+		fileInfo.Thumbnail = s.urlWithBasePath("/api/thumbnail" + thumbPath)
+		if s.hashedThumbnails && err == nil {
+			fileInfo.Thumbnail = s.hashedThumbnailURL(filepath.Join(dir, entry.Name()), info)
+		}
+		if err == nil && s.isOwnThumbnail(entry.Name(), info.Size()) {
+			fileInfo.Thumbnail = s.urlWithBasePath("/static" + thumbPath)
+			fileInfo.OwnThumbnail = true
+		}
+		if s.placeholderVariant.size > 0 && !fileInfo.OwnThumbnail {
+			fileInfo.Placeholder = s.urlWithBasePath("/api/thumbnail" + thumbPath + "?placeholder=1")
+		}
+		// Thumbnail will be generated on-demand when client requests it,
+		// unless the client asked for it to be embedded in the listing
+		if opts.inlineThumbs && opts.inlined < maxInlineThumbnails && !fileInfo.OwnThumbnail {
+			if data, ok := s.inlineThumbnail(ctx, filepath.Join(dir, entry.Name())); ok {
+				fileInfo.ThumbnailData = data
+				opts.inlined++
 			}
-			if movieExtensions[ext] {
-				fileInfo.IsMovie = true
+		}
+
+		// Dimensions are cached in a sidecar, so only the first listing pays for them
+		if opts.withDimensions && fileInfo.IsImage {
+			dims, err := s.imageDimensionsFor(ctx, filepath.Join(dir, entry.Name()))
+			if errors.Is(err, fs.ErrNotExist) {
+				// Removed while we were listing
+				return FileInfo{}, false
+			} else if err != nil {
+				log.Printf("Failed to read dimensions for %s: %v", entry.Name(), err)
+			} else {
+				fileInfo.Width = dims.Width
+				fileInfo.Height = dims.Height
 			}
-			// Generate thumbnail path - ensure it starts with / for proper URL
-			thumbPath := urlPath
-			if !strings.HasPrefix(thumbPath, "/") {
-				thumbPath = "/" + thumbPath
+		}
+		if opts.withMeta && fileInfo.IsImage {
+			meta, err := s.photoMetadataFor(ctx, filepath.Join(dir, entry.Name()))
+			if err != nil {
+				log.Printf("Failed to read metadata for %s: %v", entry.Name(), err)
 			}
-			fileInfo.Thumbnail = s.urlWithBasePath("/api/thumbnail" + thumbPath)
-			// Thumbnail will be generated on-demand when client requests it
+			if meta.TakenAt != nil {
+				fileInfo.TakenAt = *meta.TakenAt
+			}
+		}
+		if opts.withExposure && fileInfo.IsImage && !fileInfo.OwnThumbnail && err == nil {
+			fileInfo.Exposure, _ = s.exposureFor(filepath.Join(dir, entry.Name()), info.ModTime())
+		}
+		fileInfo.MediaKind = s.mediaKindFor(ctx, filepath.Join(dir, entry.Name()), fileInfo, opts.withDimensions || opts.kind != "")
+	}
+
+	return fileInfo, true
+}
+
+// pairLivePhotos links each image to the movie with the same base name, like
+// the .HEIC/.MOV pairs of iOS Live Photos, by setting its CanonicalMovie to
+// the movie's stream URL. Paired movies are dropped from the listing so a
+// Live Photo is one tile. When several movies share a base name, a .mov is
+// preferred (that's what iOS writes) and the others keep their own tiles.
+func (s *Server) pairLivePhotos(files []FileInfo) []FileInfo {
+	movies := make(map[string]int)
+	for i, file := range files {
+		if !file.IsMovie {
+			continue
+		}
+		base := livePhotoBase(file.Name)
+		if j, ok := movies[base]; !ok || (!isLivePhotoMovie(files[j].Name) && isLivePhotoMovie(file.Name)) {
+			movies[base] = i
 		}
+	}
+	if len(movies) == 0 {
+		return files
+	}
 
-		files = append(files, fileInfo)
+	paired := make(map[int]bool)
+	for i, file := range files {
+		if !file.IsImage {
+			continue
+		}
+		base := livePhotoBase(file.Name)
+		if j, ok := movies[base]; ok {
+			files[i].CanonicalMovie = s.urlWithBasePath("/api/file.m3u8?path=" + url.QueryEscape(files[j].Path))
+			paired[j] = true
+		}
 	}
 
-	respondJSON(w, DirectoryResponse{
-		Path:  path,
-		Files: files,
-	}, http.StatusOK)
+	listed := files[:0]
+	for i, file := range files {
+		if !paired[i] {
+			listed = append(listed, file)
+		}
+	}
+	return listed
+}
+
+// isLivePhotoMovie reports whether a movie has the extension iOS uses for
+// the motion part of Live Photos
+func isLivePhotoMovie(name string) bool {
+	return strings.EqualFold(filepath.Ext(name), ".mov")
 }
 
 func (s *Server) handleThumbnail(w http.ResponseWriter, r *http.Request) {
@@ -286,50 +1745,356 @@ func (s *Server) handleThumbnail(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Convert URL path (forward slashes) to filesystem path
-	path := filepath.FromSlash(rawPath)
+	// Convert URL path (forward slashes) to filesystem path
+	path := filepath.FromSlash(rawPath)
+
+	// Clean the path
+	path = filepath.Clean(path)
+	if path == "." {
+		path = "/"
+	}
+
+	// Build full path
+	var fullPath string
+	if path == "/" || path == "" {
+		fullPath = s.rootDir
+	} else {
+		fullPath = filepath.Join(s.rootDir, path)
+	}
+
+	// Security check
+	relPath, err := filepath.Rel(s.rootDir, fullPath)
+	if err != nil || strings.HasPrefix(relPath, "..") {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+	if s.isExcludedPath(relPath) || isHiddenPath(relPath) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	// Check if file exists
+	info, err := s.store.Stat(r.Context(), fullPath)
+	if os.IsNotExist(err) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	// Tiny images (icons, tracking pixels) are served as their own thumbnail
+	if err == nil && s.isOwnThumbnail(fullPath, info.Size()) {
+		w.Header().Set("Content-Type", mimeTypeFor(fullPath))
+		s.store.ServeFile(w, r, fullPath)
+		return
+	}
+
+	// Low-quality placeholders don't depend on client hints
+	if r.URL.Query().Get("placeholder") == "1" && s.placeholderVariant.size > 0 {
+		s.serveThumbnail(w, r, fullPath, info, s.placeholderVariant)
+		return
+	}
+
+	// Fast path: small sizes can be served straight from the EXIF thumbnail
+	// embedded in most camera JPEGs, bypassing vips entirely
+	if s.serveEmbeddedThumbnail(w, r, fullPath, info) {
+		return
+	}
+
+	// An explicit ?size= comes from the URL, so it overrides client hints
+	// and needs no Vary either
+	if size, ok := thumbnailSizeParam(r); ok {
+		variant := defaultThumbnailVariant()
+		variant.size = size
+		s.serveThumbnail(w, r, fullPath, info, variant)
+		return
+	}
+
+	// The rendition depends on client hints, so caches must key on them.
+	// The responses above don't and leave Vary out, keeping them cacheable
+	// as one entry per URL.
+	w.Header().Set("Accept-CH", "Sec-CH-DPR, Sec-CH-Width")
+	w.Header().Add("Vary", thumbnailHintHeaders)
+
+	// Browsers that take WebP or AVIF get a smaller thumbnail, where vips
+	// renders it in one go
+	variant := thumbnailVariantForRequest(r)
+	if s.canNegotiateFormat(fullPath) {
+		w.Header().Add("Vary", "Accept")
+		variant.format = s.negotiatedFormat(r)
+	}
+
+	s.serveThumbnail(w, r, fullPath, info, variant)
+}
+
+// thumbnailCacheControl lets browsers reuse a thumbnail for an hour, like a
+// preview, before revalidating it. The URL stays the same when the file is
+// edited, so only -hashed-thumbnails URLs are cached for good.
+const thumbnailCacheControl = "public, max-age=3600"
+
+// serveThumbnail serves a thumbnail rendition of fullPath, generating it if
+// needed. Its ETag is derived from the source and the rendition, see
+// thumbnailFingerprint, so a client whose copy is current gets 304 Not
+// Modified before anything is generated, even after the cache was purged.
+// With ?nowait=1 a thumbnail that isn't cached yet is queued and answered
+// with 202 Accepted rather than waited for.
+func (s *Server) serveThumbnail(w http.ResponseWriter, r *http.Request, fullPath string, info os.FileInfo, variant thumbnailVariant) {
+	etag := ""
+	if info != nil {
+		etag = `"` + s.thumbnailFingerprint(fullPath, info, variant) + `"`
+		if notModified(r, etag, info.ModTime()) {
+			w.Header().Set("ETag", etag)
+			w.Header().Set("Cache-Control", thumbnailCacheControl)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	if r.URL.Query().Get("nowait") == "1" && (isImageFile(fullPath) || isMovieFile(fullPath)) {
+		if _, cached := s.cachedThumbnail(r.Context(), fullPath, variant); !cached {
+			s.acceptThumbnail(w, fullPath, variant)
+			return
+		}
+	}
+
+	thumbnailPath, ok := s.ensureThumbnail(w, r, fullPath, variant)
+	if !ok {
+		return
+	}
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	w.Header().Set("Cache-Control", thumbnailCacheControl)
+	serveThumbnailFile(w, r, thumbnailPath)
+}
+
+// ensureThumbnail returns the path of the thumbnail for fullPath, generating
+// it first if it doesn't exist. On failure it writes an error response and
+// returns false.
+func (s *Server) ensureThumbnail(w http.ResponseWriter, r *http.Request, fullPath string, variant thumbnailVariant) (string, bool) {
+	thumbnailPath, cached := s.cachedThumbnail(r.Context(), fullPath, variant)
+	if !cached {
+		s.metrics.thumbnailCache.inc(metricLabels("result", "miss"))
+		ctx := r.Context()
+		if timeout := s.settings().thumbnailTimeout; timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		// Queue thumbnail generation and wait for it to complete
+		if err := s.queueAndWaitForThumbnail(ctx, fullPath, variant); err != nil {
+			// A killed vips or ffmpeg reports a signal rather than the
+			// deadline, so go by the failure category
+			if thumbnailFailureCategory(err) == failureTimeout || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				http.Error(w, "Thumbnail generation timed out", http.StatusGatewayTimeout)
+				return "", false
+			}
+			http.Error(w, "Failed to generate thumbnail: "+err.Error(), http.StatusInternalServerError)
+			return "", false
+		}
+	} else {
+		s.metrics.thumbnailCache.inc(metricLabels("result", "hit"))
+	}
+	return thumbnailPath, true
+}
+
+// cachedThumbnail returns the path of the thumbnail for fullPath and whether
+// it is cached. A thumbnail older than its file, e.g. one of an edited
+// photo, is removed so that it is regenerated.
+func (s *Server) cachedThumbnail(ctx context.Context, fullPath string, variant thumbnailVariant) (string, bool) {
+	thumbnailPath := s.thumbnailPathFor(fullPath, variant)
+	thumb, err := os.Stat(thumbnailPath)
+	if err != nil {
+		return thumbnailPath, false
+	}
+	if info, err := s.store.Stat(ctx, fullPath); err == nil && thumbnailStale(thumb, info) {
+		os.Remove(thumbnailPath)
+		return thumbnailPath, false
+	}
+	return thumbnailPath, true
+}
+
+// thumbnailStale reports whether a cached thumbnail is older than its source
+// file. Files dated in the future would be regenerated on every request, so
+// their thumbnails count as fresh.
+func thumbnailStale(thumb, source fs.FileInfo) bool {
+	return thumb.ModTime().Before(source.ModTime()) && source.ModTime().Before(time.Now())
+}
+
+// directoryVersion returns the latest modification time of a directory and
+// its visible entries. The directory's own mtime covers removed entries.
+func (s *Server) directoryVersion(ctx context.Context, fullPath string, entries []fs.DirEntry) time.Time {
+	var version time.Time
+	if info, err := s.store.Stat(ctx, fullPath); err == nil {
+		version = info.ModTime()
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") || s.isExcluded(entry.Name()) {
+			continue
+		}
+		if info, err := entry.Info(); err == nil && info.ModTime().After(version) {
+			version = info.ModTime()
+		}
+	}
+	return version
+}
+
+// listETag identifies a listing. The query options change the body, so they
+// are part of it.
+func listETag(version time.Time, entries int, withDimensions, inlineThumbs bool, sortOrder, variantTag string) string {
+	return fmt.Sprintf(`W/"%x-%x-%t-%t-%s%s"`, version.UnixNano(), entries, withDimensions, inlineThumbs, sortOrder, variantTag)
+}
+
+// setListValidators sets the caching headers of a listing and reports
+// whether the client's copy is still current
+func setListValidators(w http.ResponseWriter, r *http.Request, etag string, version time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if !version.IsZero() {
+		w.Header().Set("Last-Modified", version.UTC().Format(http.TimeFormat))
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	return notModified(r, etag, version)
+}
+
+// fileETag derives a strong entity tag from a file's modification time and
+// size, with variant telling apart the responses built from the same file
+func fileETag(info fs.FileInfo, variant string) string {
+	return fmt.Sprintf(`"%x-%x%s"`, info.ModTime().UnixNano(), info.Size(), variant)
+}
+
+// serveThumbnailFile serves a cached thumbnail, with an ETag from the cache
+// file itself unless one is set already. http.ServeFile adds Last-Modified
+// and answers If-None-Match and If-Modified-Since with 304 Not Modified.
+func serveThumbnailFile(w http.ResponseWriter, r *http.Request, thumbnailPath string) {
+	if w.Header().Get("ETag") != "" {
+		http.ServeFile(w, r, thumbnailPath)
+		return
+	}
+	if info, err := os.Stat(thumbnailPath); err == nil {
+		w.Header().Set("ETag", fileETag(info, ""))
+	}
+	http.ServeFile(w, r, thumbnailPath)
+}
+
+// notModified evaluates If-None-Match, falling back to If-Modified-Since,
+// the same way http.ServeContent does
+func notModified(r *http.Request, etag string, modTime time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || modTime.IsZero() {
+		return false
+	}
+	// HTTP dates have second precision
+	return !modTime.Truncate(time.Second).After(ims)
+}
+
+// inlineThumbnail returns the default thumbnail of a file as a data: URI,
+// generating it first if needed. Thumbnails over maxInlineThumbnailBytes are
+// not inlined.
+func (s *Server) inlineThumbnail(ctx context.Context, fullPath string) (string, bool) {
+	thumbnailPath := s.thumbnailPathFor(fullPath, defaultThumbnailVariant())
+	if _, err := os.Stat(thumbnailPath); os.IsNotExist(err) {
+		if timeout := s.settings().thumbnailTimeout; timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		if err := s.queueAndWaitForThumbnail(ctx, fullPath, defaultThumbnailVariant()); err != nil {
+			log.Printf("Failed to generate inline thumbnail for %s: %v", fullPath, err)
+			return "", false
+		}
+	}
+
+	data, err := os.ReadFile(thumbnailPath)
+	if err != nil || len(data) > maxInlineThumbnailBytes {
+		return "", false
+	}
+	return "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(data), true
+}
 
-	// Clean the path
-	path = filepath.Clean(path)
-	if path == "." {
-		path = "/"
+// handleThumbnailExists reports whether a fresh thumbnail is already cached for
+// a file, without ever triggering generation. Responds 200 if it is, 404 if not.
+func (s *Server) handleThumbnailExists(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
 
-	// Build full path
-	var fullPath string
-	if path == "/" || path == "" {
-		fullPath = s.rootDir
-	} else {
-		fullPath = filepath.Join(s.rootDir, path)
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		http.Error(w, "Path query parameter required", http.StatusBadRequest)
+		return
 	}
 
-	// Security check
-	relPath, err := filepath.Rel(s.rootDir, fullPath)
-	if err != nil || strings.HasPrefix(relPath, "..") {
+	fullPath, ok := s.resolvePath(path)
+	if !ok {
 		http.Error(w, "Access denied", http.StatusForbidden)
 		return
 	}
 
-	// Check if file exists
-	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+	source, err := s.store.Stat(r.Context(), fullPath)
+	if err != nil {
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
 
-	// Generate thumbnail path
-	thumbnailPath := getThumbnailPath(fullPath)
+	thumb, err := os.Stat(s.thumbnailPathFor(fullPath, defaultThumbnailVariant()))
+	if err != nil || thumbnailStale(thumb, source) {
+		http.Error(w, "Thumbnail not cached", http.StatusNotFound)
+		return
+	}
 
-	// Check if thumbnail exists
-	if _, err := os.Stat(thumbnailPath); os.IsNotExist(err) {
-		// Queue thumbnail generation and wait for it to complete
-		if err := s.queueAndWaitForThumbnail(fullPath, thumbnailPath); err != nil {
-			http.Error(w, "Failed to generate thumbnail: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+}
+
+// serveEmbeddedThumbnail serves the EXIF thumbnail of a JPEG when it is
+// exactly the thumbnail the client asks for: a plain rendition, neither
+// padded, cropped, watermarked nor converted to another color profile, whose
+// longest edge is the requested size. It returns false when the request should fall back
+// to normal thumbnail generation.
+func (s *Server) serveEmbeddedThumbnail(w http.ResponseWriter, r *http.Request, fullPath string, info os.FileInfo) bool {
+	size, err := strconv.Atoi(r.URL.Query().Get("size"))
+	if err != nil || size <= 0 || size > maxEmbeddedThumbSize || info == nil {
+		return false
+	}
+	if variant := defaultThumbnailVariant(); variant.pad != "" || variant.quality != 0 ||
+		s.colorProfile != "" || s.watermark != nil || s.thumbnailModeFor(fullPath) != "fit" {
+		return false
 	}
 
-	// Serve thumbnail
-	http.ServeFile(w, r, thumbnailPath)
+	ext := strings.ToLower(filepath.Ext(fullPath))
+	if ext != ".jpg" && ext != ".jpeg" {
+		return false
+	}
+
+	file, err := s.store.Open(r.Context(), fullPath)
+	if err != nil {
+		return false
+	}
+	thumb, ok := readEmbeddedThumbnail(file)
+	file.Close()
+	if !ok {
+		return false
+	}
+	config, err := jpeg.DecodeConfig(bytes.NewReader(thumb))
+	if err != nil || max(config.Width, config.Height) != size {
+		return false
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeContent(w, r, "", info.ModTime(), bytes.NewReader(thumb))
+	return true
 }
 
 func (s *Server) handlePreview(w http.ResponseWriter, r *http.Request) {
@@ -365,47 +2130,160 @@ func (s *Server) handlePreview(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Access denied", http.StatusForbidden)
 		return
 	}
+	if s.isExcludedPath(relPath) || isHiddenPath(relPath) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
 
 	// Check if file exists
-	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+	info, err := s.store.Stat(r.Context(), fullPath)
+	if os.IsNotExist(err) {
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
 
 	// Check if it's an image or movie
-	ext := strings.ToLower(filepath.Ext(fullPath))
-	isImage := imageExtensions[ext]
+	isImage := isImageFile(fullPath)
+
+	// An extra turn for files with wrong orientation metadata
+	rot, ok := previewRotationFor(r)
+	if !ok {
+		http.Error(w, "Invalid rotation", http.StatusBadRequest)
+		return
+	}
+	if rot.degrees != 0 && (!isImage || isSVGFile(fullPath)) {
+		http.Error(w, "Only image previews can be rotated", http.StatusBadRequest)
+		return
+	}
 
+	if isMovieFile(fullPath) {
+		s.serveMoviePreview(w, r, "/"+filepath.ToSlash(relPath), fullPath)
+		return
+	}
 	if !isImage {
 		http.Error(w, "Not an image file", http.StatusBadRequest)
 		return
 	}
+	if isSVGFile(fullPath) {
+		s.serveSVG(w, r, fullPath)
+		return
+	}
+
+	// Optional preview size, e.g. for a high resolution zoom view
+	size := defaultPreviewSize
+	if sizeParam := r.URL.Query().Get("size"); sizeParam != "" {
+		requested, err := strconv.Atoi(sizeParam)
+		if err != nil || !previewSizes[requested] {
+			http.Error(w, "Invalid preview size", http.StatusBadRequest)
+			return
+		}
+		size = requested
+	}
+
+	// Optional output format from the URL. Without one, browsers that
+	// take WebP or AVIF get that, and the response varies on Accept.
+	format := previewFormats["jpeg"]
+	if formatParam := r.URL.Query().Get("format"); formatParam != "" {
+		requested, ok := previewFormats[strings.ToLower(formatParam)]
+		if !ok {
+			http.Error(w, "Invalid preview format", http.StatusBadRequest)
+			return
+		}
+		format = requested
+	} else if s.canNegotiateFormat(fullPath) {
+		w.Header().Add("Vary", "Accept")
+		if negotiated := s.negotiatedFormat(r); negotiated != "" {
+			format = previewFormats[negotiated]
+		}
+	}
 	w.Header().Set("Cache-Control", "public, max-age=3600")
+
+	// The preview is rendered again for every request, so a client that
+	// still has it is told so before any work is done. The tag is weak as
+	// the rendering also depends on server settings.
+	if err == nil {
+		etag := "W/" + fileETag(info, fmt.Sprintf("-%d%s%s", size, format.suffix, rot.etagSuffix()))
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+		if notModified(r, etag, info.ModTime()) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
 	// Handle image files with vips
-	// Use vips to resize and convert to JPEG, streaming directly to HTTP response
+	// Use vips to resize and convert to the requested format, streaming directly to HTTP response
 	// This avoids creating any temporary files - streams directly from vips to client
 	vipsCmd := vipsExecutable()
 
 	// Set content type and headers before writing
-	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Type", format.contentType)
 
 	// Use vips thumbnail reading input from stdin
 	// Open the file for reading
-	file, err := os.Open(fullPath)
+	file, err := s.store.Open(r.Context(), fullPath)
 	if err != nil {
 		http.Error(w, "Failed to open file", http.StatusInternalServerError)
 		return
 	}
 	defer file.Close()
 
+	ctx, cancel := s.previewContext(r)
+	defer cancel()
+
+	releaseLimit, err := s.imagePreviews.acquire(ctx, s.settings().previewQueueWait)
+	if err == errPreviewBusy {
+		previewBusy(w)
+		return
+	} else if err != nil {
+		w.Header().Del("Cache-Control")
+		http.Error(w, "Preview generation timed out", http.StatusGatewayTimeout)
+		return
+	}
+	defer releaseLimit()
+
+	release, err := s.acquirePreviewSlot(ctx)
+	if err != nil {
+		w.Header().Del("Cache-Control")
+		http.Error(w, "Preview generation timed out", http.StatusGatewayTimeout)
+		return
+	}
+	defer release()
+
+	// Formats without transparency are flattened onto the configured background
+	output := format.suffix
+	if !format.alpha {
+		output += "[background=" + s.thumbnailBackground + "]"
+	}
+
 	// Use "-" for stdin and stdout
-	cmd := exec.Command(vipsCmd, "stdin", "-s", "1600", "-o", ".jpg")
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = w   // Output to HTTP response
-	cmd.Stdin = file // Input comes from file
+	tw := &responseTracker{ResponseWriter: w}
+	var runErr error
+	if s.nativeThumbnails || (s.vipsMissing && isFallbackImage(fullPath)) {
+		if format.suffix != ".png" {
+			w.Header().Set("Content-Type", "image/jpeg")
+		}
+		runErr = s.renderNativePreview(ctx, fullPath, size, format, rot, tw)
+	} else if s.watermark != nil {
+		runErr = s.watermark.preview(ctx, file, vipsStdinInput(fullPath), size, s.colorProfileArgs(), rot, output, tw)
+	} else if rot.degrees != 0 {
+		runErr = s.rotatedPreview(ctx, file, vipsStdinInput(fullPath), size, rot, output, tw)
+	} else {
+		args := append([]string{vipsStdinInput(fullPath), vipsAutoRotate, "-s", strconv.Itoa(size), "-o", output}, s.colorProfileArgs()...)
+		cmd := s.runner.command(ctx, vipsCmd, args...)
+		cmd.Stderr = os.Stderr
+		cmd.Stdout = tw  // Output to HTTP response
+		cmd.Stdin = file // Input comes from file
+		runErr = cmd.Run()
+	}
 
 	// Execute command and stream output directly to response
-	if err := cmd.Run(); err != nil {
+	if err := runErr; err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) && !tw.wrote {
+			w.Header().Del("Cache-Control")
+			http.Error(w, "Preview generation timed out", http.StatusGatewayTimeout)
+			return
+		}
 		// If we've already started writing, we can't send an error response
 		log.Printf("Failed to process image %s: %v", fullPath, err)
 		return
@@ -443,46 +2321,151 @@ func (s *Server) handleFileTS(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Access denied", http.StatusForbidden)
 		return
 	}
+	if s.isExcludedPath(relPath) || (isHiddenPath(relPath) && !isServedThumbnailPath(relPath)) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
 
 	// Check if file exists
-	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+	if _, err := s.store.Stat(r.Context(), fullPath); os.IsNotExist(err) {
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
 
 	// Check if it's a movie file
-	ext := strings.ToLower(filepath.Ext(fullPath))
-	if !movieExtensions[ext] {
+	if !isMovieFile(fullPath) {
 		http.Error(w, "Not a movie file", http.StatusBadRequest)
 		return
 	}
 
+	quality, ok := movieQualityForRequest(r)
+	if !ok {
+		http.Error(w, "Invalid preview quality", http.StatusBadRequest)
+		return
+	}
+
+	if segmentParam := r.URL.Query().Get("segment"); segmentParam != "" {
+		index, err := strconv.Atoi(segmentParam)
+		if err != nil || !s.segmentsEnabled() {
+			http.Error(w, "Invalid segment", http.StatusBadRequest)
+			return
+		}
+		s.serveSegment(w, r, fullPath, quality, index)
+		return
+	}
+
+	// Serve the pre-transcoded preview when one is available
+	transcodePath, cached := s.freshTranscode(r.Context(), fullPath)
+	cached = cached && quality == defaultMovieQuality
+	if !cached && s.requireTranscoded {
+		// On-demand transcoding is disabled, a batch job has to build this first
+		http.Error(w, "Preview not transcoded yet", http.StatusNotFound)
+		return
+	}
+
 	// Set cache control header
 	w.Header().Set("Cache-Control", "public, max-age=3600")
 	w.Header().Set("Content-Type", "video/mp2t")
 
-	// Use ffmpeg to transcode: hevc_qsv input -> h264_qsv output, streaming to HTTP response
-	cmd := exec.Command("ffmpeg",
-		"-c:v", "hevc_qsv",
-		"-loglevel", "quiet",
-		"-i", fullPath,
-		"-c:a", "aac",
-		"-b:a", "64k",
-		"-c:v", "h264_qsv",
-		"-b:v", "500k",
-		"-f", "mpegts",
-		"pipe:1")
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = w // Output to HTTP response
+	// Cached previews are seekable through byte ranges as they are
+	if cached {
+		http.ServeFile(w, r, transcodePath)
+		return
+	}
+
+	// Live transcodes seek by starting ffmpeg later in the movie
+	start, ok := previewStart(r)
+	if !ok {
+		w.Header().Del("Cache-Control")
+		http.Error(w, "Invalid t parameter", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := s.previewContext(r)
+	defer cancel()
+
+	// Everyone watching from the start shares one transcode
+	if start == 0 {
+		cancel()
+		s.serveLiveTranscode(w, r, fullPath, quality)
+		return
+	}
+
+	releaseLimit, err := s.moviePreviews.acquire(ctx, s.settings().previewQueueWait)
+	if err == errPreviewBusy {
+		previewBusy(w)
+		return
+	} else if err != nil {
+		w.Header().Del("Cache-Control")
+		http.Error(w, "Preview transcoding timed out", http.StatusGatewayTimeout)
+		return
+	}
+	defer releaseLimit()
+
+	release, err := s.acquirePreviewSlot(ctx)
+	if err != nil {
+		w.Header().Del("Cache-Control")
+		http.Error(w, "Preview transcoding timed out", http.StatusGatewayTimeout)
+		return
+	}
+	defer release()
+
+	input, err := s.store.Locate(ctx, fullPath)
+	if err != nil {
+		http.Error(w, "Failed to locate file", http.StatusInternalServerError)
+		return
+	}
+
+	// Use ffmpeg to transcode, streaming to HTTP response
+	tw := newStreamWriter(w, s.settings().previewIdleTimeout)
+	go tw.watchIdle(ctx, cancel)
 
 	// Execute command and stream output directly to response
-	if err := cmd.Run(); err != nil {
-		// If we've already started writing, we can't send an error response
+	codec := s.videoCodecFor(ctx, fullPath, input)
+	err = s.runTranscode(ctx, func(encoder videoEncoder) *exec.Cmd {
+		cmd := s.runner.command(ctx, ffmpegExecutable(), transcodeArgs(encoder, input, "pipe:1", quality, codec, seekOptions(start))...)
+		cmd.Stderr = os.Stderr
+		cmd.Stdout = tw // Output to HTTP response
+		return cmd
+	}, func() bool { return tw.wrote })
+	if err != nil {
+		if (errors.Is(ctx.Err(), context.DeadlineExceeded) || tw.stalled.Load()) && !tw.wrote {
+			w.Header().Del("Cache-Control")
+			http.Error(w, "Preview transcoding timed out", http.StatusGatewayTimeout)
+			return
+		}
+		if tw.stalled.Load() {
+			log.Printf("Stopped transcoding %s: no output for %s", fullPath, s.settings().previewIdleTimeout)
+			return
+		}
 		log.Printf("Failed to process movie %s: %v", fullPath, err)
+		// If we've already started writing, we can't send an error response
+		if !tw.wrote && ctx.Err() == nil {
+			w.Header().Del("Cache-Control")
+			http.Error(w, "Failed to transcode movie", http.StatusInternalServerError)
+		}
 		return
 	}
 }
 
+// previewContext returns the context used to run a preview process. The
+// process is bound to the request and, if configured, the preview timeout.
+func (s *Server) previewContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if timeout := s.settings().previewTimeout; timeout > 0 {
+		return context.WithTimeout(r.Context(), timeout)
+	}
+	return context.WithCancel(r.Context())
+}
+
+// generationContext returns the context used by the workers for a single
+// thumbnail generation, bounded by the thumbnail timeout if configured
+func (s *Server) generationContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if timeout := s.settings().thumbnailTimeout; timeout > 0 {
+		return context.WithTimeout(parent, timeout)
+	}
+	return context.WithCancel(parent)
+}
+
 func (s *Server) handleM3U8(w http.ResponseWriter, r *http.Request) {
 	// Get path from query parameter
 	path := r.URL.Query().Get("path")
@@ -498,6 +2481,35 @@ func (s *Server) handleM3U8(w http.ResponseWriter, r *http.Request) {
 
 	// Build file.ts URL with base path and query parameter
 	fileTSUrl := s.urlWithBasePath("/api/file.ts") + "?path=" + url.QueryEscape(path)
+	qualityParam := r.URL.Query().Get("quality")
+	if qualityParam != "" {
+		if _, ok := movieQualities[qualityParam]; !ok {
+			http.Error(w, "Invalid preview quality", http.StatusBadRequest)
+			return
+		}
+		fileTSUrl += "&quality=" + qualityParam
+	}
+
+	// A segmented playlist, unless a complete pre-transcoded preview exists
+	if s.segmentsEnabled() && !s.requireTranscoded {
+		fullPath, ok := s.resolvePath(path)
+		if !ok {
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+		if _, cached := s.freshTranscode(r.Context(), fullPath); !cached || qualityParam != "" {
+			seconds, err := s.movieDurationFor(r.Context(), fullPath)
+			if err != nil {
+				log.Printf("Failed to segment %s: %v", fullPath, err)
+				http.Error(w, "Failed to read movie duration", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/x-mpegURL")
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+			w.Write([]byte(s.segmentedPlaylist(path, seconds, qualityParam)))
+			return
+		}
+	}
 
 	// Generate m3u8 playlist content
 	// This is a simple m3u8 that points to the file.ts endpoint
@@ -544,15 +2556,30 @@ func (s *Server) handleStatic(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Access denied", http.StatusForbidden)
 		return
 	}
+	if s.isExcludedPath(relPath) || (isHiddenPath(relPath) && !isServedThumbnailPath(relPath)) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
 
 	// Check if file exists
-	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+	if _, err := s.store.Stat(r.Context(), fullPath); os.IsNotExist(err) {
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
 
-	// Serve file
-	http.ServeFile(w, r, fullPath)
+	if isSVGFile(fullPath) {
+		s.serveSVG(w, r, fullPath)
+		return
+	}
+
+	// Serve file, with our own content type so formats like HEIC aren't
+	// sent as application/octet-stream. Anything but media, e.g. an HTML
+	// page uploaded with -upload-any-type, is only handed out to save.
+	w.Header().Set("Content-Type", mimeTypeFor(fullPath))
+	if !rendersInline(fullPath) {
+		setAttachmentHeaders(w, fullPath)
+	}
+	s.store.ServeFile(w, r, fullPath)
 }
 
 func (s *Server) handleAssets(w http.ResponseWriter, r *http.Request) {
@@ -563,34 +2590,12 @@ func (s *Server) handleAssets(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Clean the path to prevent directory traversal
-	path = filepath.Clean(path)
-	if path == "." || path == "/" {
+	// The assets are built into the binary; fs paths can't leave their root
+	if !fs.ValidPath(path) {
 		http.Error(w, "Invalid path", http.StatusBadRequest)
 		return
 	}
-
-	// Get current working directory (where the program is run from)
-	// The template is loaded from "templates/index.html" relative to CWD
-	wd, err := os.Getwd()
-	if err != nil {
-		http.Error(w, "Failed to determine working directory", http.StatusInternalServerError)
-		return
-	}
-
-	// Build full path to static assets directory
-	assetsDir := filepath.Join(wd, "static")
-	fullPath := filepath.Join(assetsDir, path)
-
-	// Security check: ensure the resolved path is within the assets directory
-	relPath, err := filepath.Rel(assetsDir, fullPath)
-	if err != nil || strings.HasPrefix(relPath, "..") {
-		http.Error(w, "Access denied", http.StatusForbidden)
-		return
-	}
-
-	// Check if file exists
-	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+	if info, err := fs.Stat(assetsFS, path); err != nil || info.IsDir() {
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
@@ -602,118 +2607,301 @@ func (s *Server) handleAssets(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Serve file
-	http.ServeFile(w, r, fullPath)
+	http.ServeFileFS(w, r, assetsFS, path)
 }
 
-func (s *Server) generateThumbnail(imagePath string) error {
+func (s *Server) generateThumbnail(ctx context.Context, imagePath string, variant thumbnailVariant) (err error) {
 	// Get thumbnail path (includes original extension)
-	thumbnailPath := getThumbnailPath(imagePath)
+	thumbnailPath := s.thumbnailPathFor(imagePath, variant)
 	thumbnailDir := filepath.Dir(thumbnailPath)
 
-	// Check if thumbnail already exists
-	if _, err := os.Stat(thumbnailPath); err == nil {
-		return nil
+	// Check if a fresh thumbnail already exists. A stale one is replaced by
+	// the rename below.
+	if thumb, err := os.Stat(thumbnailPath); err == nil {
+		if info, err := s.store.Stat(ctx, imagePath); err != nil || !thumbnailStale(thumb, info) {
+			return nil
+		}
 	}
 
 	// Create .small directory if it doesn't exist
 	if err := os.MkdirAll(thumbnailDir, 0755); err != nil {
-		return fmt.Errorf("failed to create thumbnail directory: %w", err)
+		return thumbnailFailure(failureIO, fmt.Errorf("failed to create thumbnail directory: %w", err))
 	}
 
+	// Everything is written to a temporary file that is only renamed into
+	// place once complete, so a killed process or a shutdown never leaves a
+	// truncated thumbnail behind. After the rename, the removal is a no-op.
+	tmpPath := thumbnailPath + ".tmp" + filepath.Ext(thumbnailPath)
+	defer os.Remove(tmpPath)
+
 	// Check file extension to determine if it's a movie or image
-	ext := strings.ToLower(filepath.Ext(imagePath))
+	// Acquire a slot from the global generation limit, if configured. A
+	// request that times out while waiting gives up its place.
+	if s.generationSem != nil {
+		select {
+		case s.generationSem <- struct{}{}:
+			defer func() { <-s.generationSem }()
+		case <-ctx.Done():
+			return thumbnailFailure(failureTimeout, ctx.Err())
+		}
+	}
+	if s.capacitySem != nil {
+		select {
+		case s.capacitySem <- struct{}{}:
+			defer func() { <-s.capacitySem }()
+		case <-ctx.Done():
+			return thumbnailFailure(failureTimeout, ctx.Err())
+		}
+	}
 
-	if movieExtensions[ext] {
+	// A file that can't be done within -max-file-time isn't tried again
+	if s.isSkippedFile(ctx, imagePath) {
+		return skippedFileError(imagePath)
+	}
+	fileCtx, cancel := s.fileTimeContext(ctx)
+	defer cancel()
+	defer func(parent context.Context) { s.noteFileTime(parent, fileCtx, imagePath, "thumbnail generation", err) }(ctx)
+	ctx = fileCtx
+
+	if s.nativeThumbnails || (s.vipsMissing && isFallbackImage(imagePath)) {
+		if !isImageFile(imagePath) {
+			return thumbnailFailure(failureUnsupported, fmt.Errorf("movie thumbnails need ffmpeg"))
+		}
+		if err := s.generateNativeThumbnail(ctx, imagePath, tmpPath, variant); err != nil {
+			return err
+		}
+		if _, err := s.imageDimensionsFor(ctx, imagePath); err != nil {
+			log.Printf("Failed to record dimensions for %s: %v", imagePath, err)
+		}
+	} else if isMovieFile(imagePath) {
 		// Use ffmpeg for movie files, print only errors
 		// ffmpeg -v error -i <input> -ss 1 -vf "scale=300:-2" -vframes 1 <out>
-		cmd := exec.Command("ffmpeg", "-v", "error", "-ss", "0", "-noaccurate_seek", "-i", imagePath, "-vf", "scale=300:-2", "-vframes", "1", thumbnailPath)
-		cmd.Stderr = os.Stderr
+		input, err := s.store.Locate(ctx, imagePath)
+		if err != nil {
+			return thumbnailFailure(failureIO, fmt.Errorf("failed to locate movie: %w", err))
+		}
+		filter := fmt.Sprintf("scale=%d:-2", variant.size)
+		if s.thumbnailModeFor(imagePath) != "fit" {
+			// ffmpeg has no attention-based crop, so smart-crop falls back to the centre
+			filter = fmt.Sprintf("scale=%[1]d:%[1]d:force_original_aspect_ratio=increase,crop=%[1]d:%[1]d", variant.size)
+		}
+		// -autorotate applies the display matrix of phone videos shot upright
+		args := []string{"-v", "error", "-autorotate", "-ss", "0", "-noaccurate_seek", "-i", input, "-vf", filter, "-vframes", "1"}
+		if s.videoThumbStyle == "filmstrip" {
+			// A strip of frames sampled across the whole clip, which has to be
+			// decoded; without a duration the poster frame will do
+			if strip, err := s.filmstripFilter(ctx, imagePath, variant.size); err == nil {
+				args = []string{"-v", "error", "-autorotate", "-i", input, "-vf", strip, "-vsync", "vfr", "-vframes", "1"}
+			} else {
+				log.Printf("Falling back to a single frame thumbnail for %s: %v", imagePath, err)
+			}
+		}
+		if variant.quality > 0 {
+			// Map JPEG quality (1-100) to the mjpeg qscale (31 worst - 2 best)
+			args = append(args, "-q:v", strconv.Itoa(31-variant.quality*29/100))
+		}
+		var stderr bytes.Buffer
+		cmd := s.runner.command(ctx, ffmpegExecutable(), append(append([]string{"-y"}, args...), tmpPath)...)
+		cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
 		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("failed to generate thumbnail: %w", err)
+			return classifyToolFailure(ctx, fmt.Errorf("failed to generate thumbnail: %w", err), stderr.Bytes())
+		}
+	} else if isImageFile(imagePath) {
+		if isSVGFile(imagePath) && s.svgUnsupported {
+			return thumbnailFailure(failureUnsupported, fmt.Errorf("SVG thumbnails need vips with librsvg"))
+		}
+		if s.vipsMissing {
+			// Say which tool is missing instead of failing to start it
+			return thumbnailFailure(failureMissingBinary, fmt.Errorf("%s thumbnails need vipsthumbnail, which wasn't found", strings.ToLower(filepath.Ext(imagePath))))
 		}
-	} else if imageExtensions[ext] {
 		// Use vips to read from stdin and output a .jpg, resize to 1600px
 		vipsCmd := vipsExecutable()
-		file, err := os.Open(imagePath)
+		file, err := s.store.Open(ctx, imagePath)
 		if err != nil {
-			return fmt.Errorf("failed to open image for vips stdin: %w", err)
+			return thumbnailFailure(failureIO, fmt.Errorf("failed to open image for vips stdin: %w", err))
 		}
 		defer file.Close()
 
-		cmd := exec.Command(vipsCmd, "stdin", "-s", "300", "-o", thumbnailPath)
+		args := []string{vipsStdinInput(imagePath), vipsAutoRotate, "-s", strconv.Itoa(variant.size), "-o", tmpPath + s.thumbnailSaveOptions(imagePath, variant)}
+		args = append(args, s.colorProfileArgs()...)
+		// Crop modes fill a size x size square instead of fitting inside it
+		switch s.thumbnailModeFor(imagePath) {
+		case "center-crop":
+			args = append(args, "--smartcrop", "centre")
+		case "smart-crop":
+			args = append(args, "--smartcrop", "attention")
+		}
+		var stderr bytes.Buffer
+		cmd := s.runner.command(ctx, vipsCmd, args...)
 		cmd.Stdin = file
-		cmd.Stderr = os.Stderr
+		cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
 		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("failed to generate thumbnail: %w", err)
+			return classifyToolFailure(ctx, fmt.Errorf("failed to generate thumbnail: %w", err), stderr.Bytes())
+		}
+
+		// Record the source dimensions while the file is hot in the page cache,
+		// so listings with ?dimensions=true don't need to open it again
+		if _, err := s.imageDimensionsFor(ctx, imagePath); err != nil {
+			log.Printf("Failed to record dimensions for %s: %v", imagePath, err)
 		}
 	} else {
-		return fmt.Errorf("unsupported file type for thumbnail generation")
+		return thumbnailFailure(failureUnsupported, fmt.Errorf("unsupported file type for thumbnail generation"))
 	}
 
-	return nil
-}
+	// Measured before watermarking, which would skew the result
+	if s.settings().exposureStats && variant == defaultThumbnailVariant() && isImageFile(imagePath) {
+		if info, err := s.store.Stat(ctx, imagePath); err == nil {
+			if _, err := recordExposure(imagePath, tmpPath, info.ModTime()); err != nil {
+				log.Printf("Failed to measure exposure of %s: %v", imagePath, err)
+			}
+		}
+	}
 
-func (s *Server) queueAndWaitForThumbnail(imagePath, thumbnailPath string) error {
-	// Check if thumbnail is already being generated
-	doneChan, alreadyGenerating := s.pendingThumbs.LoadOrStore(thumbnailPath, make(chan struct{}))
-	done := doneChan.(chan struct{})
+	if err := s.padThumbnail(ctx, imagePath, tmpPath, variant); err != nil {
+		return thumbnailFailure(failureIO, err)
+	}
 
-	if !alreadyGenerating {
-		// Determine file type to route to appropriate queue
-		ext := strings.ToLower(filepath.Ext(imagePath))
-		var targetQueue chan string
+	if s.watermark != nil {
+		if err := s.watermark.apply(ctx, tmpPath); err != nil {
+			return err
+		}
+	}
 
-		if movieExtensions[ext] {
-			targetQueue = s.movieThumbnailQueue
-		} else if imageExtensions[ext] {
-			targetQueue = s.imageThumbnailQueue
-		} else {
-			return fmt.Errorf("unsupported file type for thumbnail generation")
+	if err := os.Rename(tmpPath, thumbnailPath); err != nil {
+		return thumbnailFailure(failureIO, fmt.Errorf("failed to store thumbnail: %w", err))
+	}
+
+	// The placeholder is derived from the fresh thumbnail, so the two are
+	// always generated (and regenerated) together
+	if variant == defaultThumbnailVariant() && s.placeholderVariant.size > 0 {
+		if err := s.generatePlaceholder(ctx, imagePath, thumbnailPath); err != nil {
+			log.Printf("Failed to generate placeholder for %s: %v", imagePath, err)
 		}
+	}
 
-		// We're the first to request this thumbnail, queue it
-		select {
-		case targetQueue <- imagePath:
-			// Successfully queued, wait for completion
-		default:
-			// Queue is full, generate synchronously as fallback
-			err := s.generateThumbnail(imagePath)
-			close(done)
-			s.pendingThumbs.Delete(thumbnailPath)
+	return nil
+}
+
+// generatePlaceholder scales a generated thumbnail down to the placeholder
+// variant, which is much cheaper than going back to the source
+func (s *Server) generatePlaceholder(ctx context.Context, imagePath, thumbnailPath string) error {
+	placeholderPath := s.thumbnailPathFor(imagePath, s.placeholderVariant)
+	if s.nativeThumbnails || s.vipsMissing {
+		return s.generateNativePlaceholder(imagePath, thumbnailPath, placeholderPath)
+	}
+	tmpPath := placeholderPath + ".tmp.jpg"
+	cmd := s.runner.command(ctx, vipsExecutable(), thumbnailPath, "-s", strconv.Itoa(s.placeholderVariant.size),
+		"-o", tmpPath+s.thumbnailSaveOptions(imagePath, s.placeholderVariant))
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, placeholderPath)
+}
+
+// queueAndWaitForThumbnail queues a thumbnail for generation and waits until it
+// is ready. The wait ends at whichever comes first: completion, ctx being done
+// (client disconnect or -thumbnail-timeout), or the fixed queueWaitTimeout.
+// Queued generations keep running after a timeout so the thumbnail is cached
+// for the next request; they are bounded by -thumbnail-timeout on their own
+// in the workers. When every client waiting for a generation disconnects,
+// it is cancelled instead, see pendingThumbnail.
+func (s *Server) queueAndWaitForThumbnail(ctx context.Context, imagePath string, variant thumbnailVariant) error {
+	thumbnailPath := s.thumbnailPathFor(imagePath, variant)
+
+	// Determine file type to route to appropriate queue
+	var targetQueue chan thumbnailJob
+	if isMovieFile(imagePath) {
+		targetQueue = s.movieThumbnailQueue
+	} else if isImageFile(imagePath) {
+		targetQueue = s.imageThumbnailQueue
+	} else {
+		return fmt.Errorf("unsupported file type for thumbnail generation")
+	}
+
+	// Join the generation if one is already pending
+	pending, created := s.pendingFor(thumbnailPath, true)
+	if created {
+		// We're the first to request this thumbnail, queue it. When the
+		// queue is full (or closed for shutdown), generate synchronously.
+		if !s.sendThumbnailJob(targetQueue, thumbnailJob{path: imagePath, variant: variant, pending: pending}) {
+			s.metrics.thumbnailInline.inc(mediaKindLabel(imagePath))
+			err := s.timedGeneration(ctx, imagePath, variant)
+			s.leave(thumbnailPath, pending, false)
+			pending.err = err
+			s.finish(thumbnailPath, pending)
 			return err
 		}
 	}
 
 	// Wait for thumbnail generation to complete (with timeout)
+	defer s.metrics.thumbnailWait.since(mediaKindLabel(imagePath), time.Now())
 	select {
-	case <-done:
+	case <-pending.done:
+		s.leave(thumbnailPath, pending, false)
+		if pending.err != nil {
+			return pending.err
+		}
 		// Check if thumbnail was actually created
 		if _, err := os.Stat(thumbnailPath); os.IsNotExist(err) {
 			return fmt.Errorf("thumbnail generation completed but file not found")
 		}
 		return nil
-	case <-time.After(30 * time.Second):
-		return fmt.Errorf("thumbnail generation timeout")
+	case <-ctx.Done():
+		// A disconnected client abandons the generation, a timeout doesn't
+		s.leave(thumbnailPath, pending, errors.Is(ctx.Err(), context.Canceled))
+		return ctx.Err()
+	case <-time.After(queueWaitTimeout):
+		s.leave(thumbnailPath, pending, false)
+		return errThumbnailTimeout
+	}
+}
+
+// timedGeneration generates a thumbnail, recording how long it took
+func (s *Server) timedGeneration(ctx context.Context, path string, variant thumbnailVariant) error {
+	kind := mediaKindLabel(path)
+	defer s.metrics.thumbnailDuration.since(kind, time.Now())
+	err := s.generator.generateThumbnail(ctx, path, variant)
+	if err != nil {
+		s.metrics.thumbnailFailures.inc(thumbnailFailureLabels(path, err))
 	}
+	return err
 }
 
 func (s *Server) imageThumbnailWorker(workerID int) {
 	defer s.imageWorkersWg.Done()
 
-	for imagePath := range s.imageThumbnailQueue {
+	for {
+		var job thumbnailJob
+		select {
+		case next, ok := <-s.imageThumbnailQueue:
+			if !ok {
+				return
+			}
+			job = next
+		case <-s.retireImageWorker:
+			return
+		}
+		imagePath := job.path
 		// Get thumbnail path to use as key (includes original extension)
-		thumbnailPath := getThumbnailPath(imagePath)
-
-		// Generate thumbnail
-		err := s.generateThumbnail(imagePath)
+		thumbnailPath := s.thumbnailPathFor(imagePath, job.variant)
+
+		// Generate thumbnail, unless the queue is being drained for shutdown
+		// or every client that asked for it is gone
+		var err error
+		if !s.draining() && job.pending.ctx.Err() == nil {
+			ctx, cancel := s.generationContext(job.pending.ctx)
+			err = s.timedGeneration(ctx, imagePath, job.variant)
+			cancel()
+		}
 
 		// Notify waiting goroutines that generation is complete
-		if doneChan, ok := s.pendingThumbs.LoadAndDelete(thumbnailPath); ok {
-			close(doneChan.(chan struct{}))
-		}
+		job.pending.err = err
+		s.finish(thumbnailPath, job.pending)
 
 		if err != nil {
-			log.Printf("Image Worker %d: Failed to generate thumbnail for %s: %v", workerID, imagePath, err)
+			log.Printf("Image Worker %d: Failed to generate thumbnail for %s [%s]: %v", workerID, imagePath, thumbnailFailureCategory(err), err)
 		}
 	}
 }
@@ -721,24 +2909,52 @@ func (s *Server) imageThumbnailWorker(workerID int) {
 func (s *Server) movieThumbnailWorker(workerID int) {
 	defer s.movieWorkersWg.Done()
 
-	for moviePath := range s.movieThumbnailQueue {
+	for {
+		var job thumbnailJob
+		select {
+		case next, ok := <-s.movieThumbnailQueue:
+			if !ok {
+				return
+			}
+			job = next
+		case <-s.retireMovieWorker:
+			return
+		}
+		moviePath := job.path
 		// Get thumbnail path to use as key (includes original extension)
-		thumbnailPath := getThumbnailPath(moviePath)
-
-		// Generate thumbnail
-		err := s.generateThumbnail(moviePath)
+		thumbnailPath := s.thumbnailPathFor(moviePath, job.variant)
+
+		// Generate thumbnail, unless the queue is being drained for shutdown
+		// or every client that asked for it is gone
+		var err error
+		if !s.draining() && job.pending.ctx.Err() == nil {
+			ctx, cancel := s.generationContext(job.pending.ctx)
+			err = s.timedGeneration(ctx, moviePath, job.variant)
+			cancel()
+		}
 
 		// Notify waiting goroutines that generation is complete
-		if doneChan, ok := s.pendingThumbs.LoadAndDelete(thumbnailPath); ok {
-			close(doneChan.(chan struct{}))
-		}
+		job.pending.err = err
+		s.finish(thumbnailPath, job.pending)
 
 		if err != nil {
-			log.Printf("Movie Worker %d: Failed to generate thumbnail for %s: %v", workerID, moviePath, err)
+			log.Printf("Movie Worker %d: Failed to generate thumbnail for %s [%s]: %v", workerID, moviePath, thumbnailFailureCategory(err), err)
 		}
 	}
 }
 
+// responseTracker records whether any bytes have been written to the response,
+// so handlers that stream process output know if an error status can still be sent
+type responseTracker struct {
+	http.ResponseWriter
+	wrote bool
+}
+
+func (t *responseTracker) Write(p []byte) (int, error) {
+	t.wrote = true
+	return t.ResponseWriter.Write(p)
+}
+
 func respondJSON(w http.ResponseWriter, data interface{}, statusCode int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// mediaIndexTTL is how long a built index is served before the tree is
+	// walked again
+	mediaIndexTTL = 5 * time.Minute
+
+	// mediaIndexMinAge is how old an index must be before ?rebuild=1 walks
+	// the tree again, so repeated requests can't keep it walking
+	mediaIndexMinAge = 30 * time.Second
+
+	defaultMediaIndexLimit = 1000
+	maxMediaIndexLimit     = 10000
+)
+
+// mediaIndexEntry is one media file in /api/index.json
+type mediaIndexEntry struct {
+	Path      string    `json:"path"`
+	IsMovie   bool      `json:"isMovie"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"modTime"`
+	URL       string    `json:"url"`
+	Thumbnail string    `json:"thumbnail"`
+	Preview   string    `json:"preview"`
+
+	lowerName string // base name in lower case, for /api/search
+}
+
+// mediaIndexResponse is one page of the media index
+type mediaIndexResponse struct {
+	Generated time.Time         `json:"generated"`
+	Total     int               `json:"total"`
+	Offset    int               `json:"offset"`
+	Limit     int               `json:"limit"`
+	Items     []mediaIndexEntry `json:"items"`
+}
+
+// mediaIndexCache holds the last built index. Building walks the whole
+// tree, so only one build runs at a time and everyone who needs it waits
+// for that one. Requests before the first build completes wait for it;
+// later builds run in the background while the stale index is served.
+type mediaIndexCache struct {
+	mu       sync.Mutex
+	entries  []mediaIndexEntry
+	dirs     []string // URL paths of the directories, for /api/search
+	built    time.Time
+	building chan struct{} // closed when the running build finishes (nil = none runs)
+}
+
+// handleMediaIndex returns a paginated index of every media file under root
+// with the URLs of its original, thumbnail and preview, for static mirroring
+func (s *Server) handleMediaIndex(w http.ResponseWriter, r *http.Request) {
+	offset := 0
+	if v, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil && v > 0 {
+		offset = v
+	}
+	limit := defaultMediaIndexLimit
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 {
+		limit = min(v, maxMediaIndexLimit)
+	}
+
+	entries, built, err := s.mediaIndexEntries(r.Context())
+	if err != nil {
+		mediaIndexFailed(w, err)
+		return
+	}
+	page := windowOf(entries, offset, limit)
+
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(mediaIndexTTL.Seconds())))
+	respondJSON(w, mediaIndexResponse{
+		Generated: built,
+		Total:     len(entries),
+		Offset:    offset,
+		Limit:     limit,
+		Items:     page,
+	}, http.StatusOK)
+}
+
+// mediaIndexEntries returns the cached index, building it on first use and
+// refreshing it once it is older than mediaIndexTTL
+func (s *Server) mediaIndexEntries(ctx context.Context) ([]mediaIndexEntry, time.Time, error) {
+	entries, _, built, err := s.mediaIndexSnapshot(ctx)
+	return entries, built, err
+}
+
+// mediaIndexSnapshot returns the cached media and directories. A stale
+// index is returned as it is while a refresh runs in the background. The
+// error is that of ctx if it ended before the first index was complete.
+func (s *Server) mediaIndexSnapshot(ctx context.Context) ([]mediaIndexEntry, []string, time.Time, error) {
+	s.mediaIndex.mu.Lock()
+	if s.mediaIndex.entries == nil {
+		done := s.buildingMediaIndex()
+		s.mediaIndex.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, nil, time.Time{}, ctx.Err()
+		}
+		s.mediaIndex.mu.Lock()
+		if s.mediaIndex.entries == nil {
+			// The build was cut short by shutdown
+			s.mediaIndex.mu.Unlock()
+			return nil, nil, time.Time{}, context.Canceled
+		}
+	} else if time.Since(s.mediaIndex.built) > mediaIndexTTL {
+		s.buildingMediaIndex()
+	}
+	defer s.mediaIndex.mu.Unlock()
+	return s.mediaIndex.entries, s.mediaIndex.dirs, s.mediaIndex.built, nil
+}
+
+// mediaIndexFailed responds to a request whose media index wasn't ready
+func mediaIndexFailed(w http.ResponseWriter, err error) {
+	log.Printf("Media index unavailable: %v", err)
+	http.Error(w, "Media index unavailable", http.StatusServiceUnavailable)
+}
+
+// refreshMediaIndex starts walking the tree again unless a walk already
+// runs. Requests keep being answered from the old index meanwhile. It also
+// builds the index at startup.
+func (s *Server) refreshMediaIndex() {
+	s.mediaIndex.mu.Lock()
+	defer s.mediaIndex.mu.Unlock()
+	s.buildingMediaIndex()
+}
+
+// rebuildMediaIndex walks the tree again and waits for the new index, for
+// ?rebuild=1. It joins a walk that already runs, and an index younger than
+// mediaIndexMinAge is taken as it is.
+func (s *Server) rebuildMediaIndex(ctx context.Context) error {
+	s.mediaIndex.mu.Lock()
+	if s.mediaIndex.building == nil && s.mediaIndex.entries != nil && time.Since(s.mediaIndex.built) < mediaIndexMinAge {
+		s.mediaIndex.mu.Unlock()
+		return nil
+	}
+	done := s.buildingMediaIndex()
+	s.mediaIndex.mu.Unlock()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// buildingMediaIndex returns the channel of the running build, starting one
+// if none runs. The build walks with baseCtx, not the context of whoever
+// started it, so a client that goes away doesn't cut it short for the rest.
+// The caller holds mediaIndex.mu.
+func (s *Server) buildingMediaIndex() chan struct{} {
+	if s.mediaIndex.building != nil {
+		return s.mediaIndex.building
+	}
+	done := make(chan struct{})
+	s.mediaIndex.building = done
+	go func() {
+		entries, dirs := s.buildMediaIndex(s.baseCtx)
+		s.mediaIndex.mu.Lock()
+		defer s.mediaIndex.mu.Unlock()
+		// A walk cut short would pass for the whole tree until the next refresh
+		if s.baseCtx.Err() == nil {
+			s.mediaIndex.entries, s.mediaIndex.dirs = entries, dirs
+			s.mediaIndex.built = time.Now()
+		}
+		s.mediaIndex.building = nil
+		close(done)
+	}()
+	return done
+}
+
+// buildMediaIndex walks the whole tree
+func (s *Server) buildMediaIndex(ctx context.Context) ([]mediaIndexEntry, []string) {
+	entries := []mediaIndexEntry{}
+	var dirs []string
+	s.indexDir(ctx, s.rootDir, "/", &entries, &dirs)
+	return entries, dirs
+}
+
+// indexDir appends the media of one directory to entries, in listing order,
+// and its subdirectories to dirs, recursing into them but skipping hidden
+// ones like .small
+func (s *Server) indexDir(ctx context.Context, dir, urlDir string, entries *[]mediaIndexEntry, dirs *[]string) {
+	dirEntries, err := s.store.ReadDir(ctx, dir)
+	if err != nil {
+		log.Printf("Skipping %s in media index: %v", dir, err)
+		return
+	}
+	for _, entry := range dirEntries {
+		if strings.HasPrefix(entry.Name(), ".") || s.isExcluded(entry.Name()) {
+			continue
+		}
+		fullPath := filepath.Join(dir, entry.Name())
+		urlPath := path.Join(urlDir, entry.Name())
+		if entry.IsDir() {
+			// Directories hidden with .gallery.json aren't listed, so their
+			// media isn't indexed either
+			if s.ownDirConfig(fullPath).Hidden {
+				continue
+			}
+			*dirs = append(*dirs, urlPath)
+			s.indexDir(ctx, fullPath, urlPath, entries, dirs)
+			continue
+		}
+		isMovie := isMovieFile(entry.Name())
+		if !isImageFile(entry.Name()) && !isMovie {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		escaped := escapeURLPath(urlPath)
+		item := mediaIndexEntry{
+			Path:      urlPath,
+			IsMovie:   isMovie,
+			Size:      info.Size(),
+			ModTime:   info.ModTime(),
+			URL:       s.urlWithBasePath("/static" + escaped),
+			Thumbnail: s.urlWithBasePath("/api/thumbnail" + escaped),
+			Preview:   s.urlWithBasePath("/api/preview" + escaped),
+			lowerName: strings.ToLower(entry.Name()),
+		}
+		if isMovie {
+			item.Preview = s.urlWithBasePath("/api/file.m3u8?path=" + url.QueryEscape(urlPath))
+		}
+		*entries = append(*entries, item)
+	}
+}
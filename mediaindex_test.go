@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// countingStore counts the listings of the root, one per index build
+type countingStore struct {
+	localStore
+	root  string
+	walks atomic.Int32
+}
+
+func (c *countingStore) ReadDir(ctx context.Context, fullPath string) ([]fs.DirEntry, error) {
+	if fullPath == c.root {
+		c.walks.Add(1)
+	}
+	return c.localStore.ReadDir(ctx, fullPath)
+}
+
+func TestMediaIndexBuiltOnce(t *testing.T) {
+	s := newTestServer(t)
+	store := &countingStore{root: s.rootDir}
+	s.store = store
+	writeTestJPEG(t, s, "a.jpg", 40, 20)
+	writeTestJPEG(t, s, "trip/b.jpg", 40, 20)
+
+	// A request that gives up doesn't cut the build short for the others
+	gone, cancel := context.WithCancel(t.Context())
+	cancel()
+	if _, _, _, err := s.mediaIndexSnapshot(gone); err == nil {
+		t.Error("snapshot for a cancelled request succeeded")
+	}
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			entries, _, _, err := s.mediaIndexSnapshot(t.Context())
+			if err != nil || len(entries) != 2 {
+				t.Errorf("got %d entries, %v, want 2", len(entries), err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := s.rebuildMediaIndex(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if walks := store.walks.Load(); walks != 1 {
+		t.Errorf("tree walked %d times, want 1", walks)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Media kinds reported in listings and accepted by ?kind=
+const (
+	kindPhoto           = "photo"
+	kindScreenshot      = "screenshot"
+	kindScreenRecording = "screen-recording"
+)
+
+// Names that phones and desktops give screenshots and screen recordings,
+// in the languages seen most often
+var (
+	screenshotName      = regexp.MustCompile(`(?i)^(screen ?shot|scrnli_|capture d.écran|bildschirmfoto|schermafbeelding|captura de pantalla)`)
+	screenRecordingName = regexp.MustCompile(`(?i)^(screen[ _-]?recording|screenrecorder|screencast|rpreplay)`)
+)
+
+// screenResolutions are common phone, tablet and monitor resolutions, as
+// width x height in portrait or landscape, whichever is wider
+var screenResolutions = map[[2]int]bool{
+	// iPhone
+	{1136, 640}: true, {1334, 750}: true, {1920, 1080}: true, {2208, 1242}: true,
+	{1792, 828}: true, {2436, 1125}: true, {2688, 1242}: true, {2340, 1080}: true,
+	{2532, 1170}: true, {2778, 1284}: true, {2556, 1179}: true, {2796, 1290}: true,
+	{2622, 1206}: true, {2868, 1320}: true,
+	// Android
+	{1280, 720}: true, {2400, 1080}: true, {2280, 1080}: true, {2560, 1440}: true,
+	{3120, 1440}: true, {3200, 1440}: true,
+	// iPad
+	{2048, 1536}: true, {2224, 1668}: true, {2388, 1668}: true, {2732, 2048}: true,
+	{2160, 1620}: true, {2360, 1640}: true, {2266, 1488}: true,
+	// Monitors and laptops
+	{1366, 768}: true, {1440, 900}: true, {1680, 1050}: true, {1920, 1200}: true,
+	{2560, 1600}: true, {2880, 1800}: true, {3024, 1964}: true, {3456, 2234}: true,
+	{3840, 2160}: true, {5120, 2880}: true,
+}
+
+// validMediaKind reports whether kind can be filtered on with ?kind=
+func validMediaKind(kind string) bool {
+	return kind == kindPhoto || kind == kindScreenshot || kind == kindScreenRecording
+}
+
+// mediaKindFor guesses whether an image is a photo or a screenshot and a
+// movie a screen recording, with simple heuristics:
+//
+//   - the file name, e.g. "Screenshot_20240501-101500.png" or "RPReplay_Final1700000000.mp4"
+//   - with deep, an image exactly the size of a common screen and without a
+//     camera in its EXIF data. PNGs never have one; formats whose EXIF isn't
+//     read count as camera photos.
+//
+// Deep checks need the image dimensions, which come from their sidecar, so
+// they only run when the listing asks for dimensions or filters by kind.
+// Without them only a name decides, and other images have no kind rather
+// than a guess. Movies that aren't screen recordings have no kind.
+func (s *Server) mediaKindFor(ctx context.Context, fullPath string, file FileInfo, deep bool) string {
+	name := filepath.Base(fullPath)
+	if file.IsMovie {
+		if screenRecordingName.MatchString(name) {
+			return kindScreenRecording
+		}
+		return ""
+	}
+	if screenshotName.MatchString(name) {
+		return kindScreenshot
+	}
+	if !deep {
+		return ""
+	}
+
+	width, height := file.Width, file.Height
+	if width == 0 || height == 0 {
+		dims, err := s.imageDimensionsFor(ctx, fullPath)
+		if err != nil {
+			return kindPhoto
+		}
+		width, height = dims.Width, dims.Height
+	}
+	if !screenResolutions[[2]int{max(width, height), min(width, height)}] {
+		return kindPhoto
+	}
+	if s.hasCameraExif(ctx, fullPath) {
+		return kindPhoto
+	}
+	return kindScreenshot
+}
+
+// hasCameraExif reports whether an image records the camera that took it
+func (s *Server) hasCameraExif(ctx context.Context, fullPath string) bool {
+	switch strings.ToLower(filepath.Ext(fullPath)) {
+	case ".png":
+		return false
+	case ".jpg", ".jpeg":
+	default:
+		return true
+	}
+	file, err := s.store.Open(ctx, fullPath)
+	if err != nil {
+		return true
+	}
+	defer file.Close()
+	meta, ok := readExifMetadata(file)
+	return ok && meta.camera != ""
+}
+
+// filterMediaKind keeps the files of one kind. Directories are kept so the
+// filtered gallery can still be browsed.
+func filterMediaKind(files []FileInfo, kind string) []FileInfo {
+	var kept []FileInfo
+	for _, file := range files {
+		if file.IsDir || file.MediaKind == kind {
+			kept = append(kept, file)
+		}
+	}
+	return kept
+}
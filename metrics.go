@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// durationBuckets are the histogram buckets, in seconds, of every duration
+// metric: from cached thumbnails to transcodes of long movies
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// serverMetrics are the counters and histograms served at /metrics. The zero
+// value is ready to use, so a Server needs no setup to record them.
+type serverMetrics struct {
+	requests          counterVec   // by handler, method and status code
+	requestDuration   histogramVec // by handler
+	thumbnailDuration histogramVec // generation, by kind: image or movie
+	thumbnailFailures counterVec   // by kind and failure category
+	thumbnailWait     histogramVec // time spent waiting for a queued thumbnail, by kind
+	thumbnailCache    counterVec   // thumbnail requests by result: hit or miss
+	thumbnailInline   counterVec   // generated by the request itself as the queue was full, by kind
+	transcodeDuration histogramVec // ffmpeg runs for movie previews
+}
+
+// metricLabels renders label pairs, e.g. kind="image", for a series key
+func metricLabels(pairs ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(pairs[i+1]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+// labelEscaper escapes label values as the text exposition format requires
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// mediaKindLabel is the kind label of a file's thumbnail metrics
+func mediaKindLabel(path string) string {
+	return metricLabels("kind", metricMediaKind(path))
+}
+
+// thumbnailFailureLabels labels a failed generation by kind of media and
+// failure category, see thumbnailFailureCategory
+func thumbnailFailureLabels(path string, err error) string {
+	return metricLabels("kind", metricMediaKind(path), "category", thumbnailFailureCategory(err))
+}
+
+// metricMediaKind is image or movie
+func metricMediaKind(path string) string {
+	if isMovieFile(path) {
+		return "movie"
+	}
+	return "image"
+}
+
+// counterVec is a counter with a series per label set
+type counterVec struct {
+	mu     sync.Mutex
+	series map[string]uint64
+}
+
+func (c *counterVec) inc(labels string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.series == nil {
+		c.series = make(map[string]uint64)
+	}
+	c.series[labels]++
+}
+
+// get returns the count of one series
+func (c *counterVec) get(labels string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.series[labels]
+}
+
+func (c *counterVec) write(w io.Writer, name, help string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	for _, labels := range sortedKeys(c.series) {
+		fmt.Fprintf(w, "%s%s %d\n", name, braced(labels), c.series[labels])
+	}
+}
+
+// histogramVec is a histogram of durations with a series per label set
+type histogramVec struct {
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bucket of durationBuckets, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func (h *histogramVec) observe(labels string, d time.Duration) {
+	seconds := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.series == nil {
+		h.series = make(map[string]*histogram)
+	}
+	series := h.series[labels]
+	if series == nil {
+		series = &histogram{counts: make([]uint64, len(durationBuckets))}
+		h.series[labels] = series
+	}
+	if i, _ := slices.BinarySearch(durationBuckets, seconds); i < len(durationBuckets) {
+		series.counts[i]++
+	}
+	series.sum += seconds
+	series.count++
+}
+
+// since observes the time since start, for use with defer
+func (h *histogramVec) since(labels string, start time.Time) {
+	h.observe(labels, time.Since(start))
+}
+
+func (h *histogramVec) write(w io.Writer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for _, labels := range sortedKeys(h.series) {
+		series := h.series[labels]
+		prefix := labels
+		if prefix != "" {
+			prefix += ","
+		}
+		var cumulative uint64
+		for i, bound := range durationBuckets {
+			cumulative += series.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", name, prefix, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, prefix, series.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", name, braced(labels), series.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", name, braced(labels), series.count)
+	}
+}
+
+// writeGauge writes a gauge with one series per label set
+func writeGauge(w io.Writer, name, help string, series map[string]int) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	for _, labels := range sortedKeys(series) {
+		fmt.Fprintf(w, "%s%s %d\n", name, braced(labels), series[labels])
+	}
+}
+
+func braced(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// handleMetrics serves the metrics in the Prometheus text exposition format.
+// Like /healthz it needs no credentials, so scrapers work behind -auth-user
+// and -auth-token; it holds no paths or file names.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodHead {
+		return
+	}
+	m := &s.metrics
+	m.requests.write(w, "gallery_http_requests_total", "HTTP requests by handler pattern, method and status code.")
+	m.requestDuration.write(w, "gallery_http_request_duration_seconds", "Time to serve HTTP requests by handler pattern.")
+	m.thumbnailDuration.write(w, "gallery_thumbnail_generation_seconds", "Time to generate a thumbnail, by kind of media.")
+	m.thumbnailFailures.write(w, "gallery_thumbnail_failures_total", "Failed thumbnail generations, by kind of media and failure category.")
+	m.thumbnailWait.write(w, "gallery_thumbnail_queue_wait_seconds", "Time requests wait for a queued thumbnail, by kind of media.")
+	m.thumbnailCache.write(w, "gallery_thumbnail_cache_requests_total", "Thumbnail requests by whether the thumbnail was cached already.")
+	m.thumbnailInline.write(w, "gallery_thumbnail_queue_full_total", "Thumbnails generated by the request itself because the queue was full, by kind of media.")
+	m.transcodeDuration.write(w, "gallery_preview_transcode_seconds", "Time ffmpeg runs to transcode a movie preview.")
+	writeGauge(w, "gallery_thumbnail_queue_depth", "Thumbnails queued for generation, by kind of media.", map[string]int{
+		metricLabels("kind", "image"): len(s.imageThumbnailQueue),
+		metricLabels("kind", "movie"): len(s.movieThumbnailQueue),
+	})
+	writeGauge(w, "gallery_thumbnails_pending", "Thumbnail generations queued or running, joined by every request for the same thumbnail.", map[string]int{
+		"": s.pendingThumbnails(),
+	})
+	writeGauge(w, "gallery_previews_active", "Previews being rendered, by kind of media.", map[string]int{
+		metricLabels("kind", "image"): int(s.imagePreviews.active.Load()),
+		metricLabels("kind", "movie"): int(s.moviePreviews.active.Load()),
+	})
+}
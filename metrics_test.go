@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// failingGenerator fails every generation with err
+type failingGenerator struct{ err error }
+
+func (g failingGenerator) generateThumbnail(ctx context.Context, imagePath string, variant thumbnailVariant) error {
+	return g.err
+}
+
+func TestThumbnailFailuresAreCounted(t *testing.T) {
+	s := newTestServer(t)
+	s.generator = failingGenerator{thumbnailFailure(failureCorrupt, errors.New("bad data"))}
+	s.timedGeneration(t.Context(), "/photos/broken.jpg", defaultThumbnailVariant())
+	s.generator = failingGenerator{context.DeadlineExceeded}
+	s.timedGeneration(t.Context(), "/photos/clip.mov", defaultThumbnailVariant())
+
+	for labels, want := range map[string]uint64{
+		`kind="image",category="corrupt"`: 1,
+		`kind="movie",category="timeout"`: 1,
+		`kind="image",category="timeout"`: 0,
+	} {
+		if got := s.metrics.thumbnailFailures.get(labels); got != want {
+			t.Errorf("failures{%s} = %d, want %d", labels, got, want)
+		}
+	}
+}
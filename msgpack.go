@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// msgpackContentType is the media type of MessagePack responses
+const msgpackContentType = "application/msgpack"
+
+// wantsMsgpack reports whether the client asked for MessagePack instead of
+// JSON. application/x-msgpack is still common and accepted too.
+func wantsMsgpack(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, msgpackContentType) || strings.Contains(accept, "application/x-msgpack")
+}
+
+// encodeResponse serializes a response as JSON, or as MessagePack when
+// packed, and returns the body with its content type
+func encodeResponse(data any, packed bool) ([]byte, string, error) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return nil, "", err
+	}
+	if !packed {
+		return append(body, '\n'), "application/json", nil
+	}
+	body, err = jsonToMsgpack(body)
+	return body, msgpackContentType, err
+}
+
+// respondNegotiated writes data as MessagePack when the client asks for it
+// and as JSON otherwise
+func respondNegotiated(w http.ResponseWriter, r *http.Request, data any, statusCode int) {
+	if !wantsMsgpack(r) {
+		respondJSON(w, data, statusCode)
+		return
+	}
+	body, contentType, err := encodeResponse(data, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
+
+// jsonToMsgpack re-encodes a JSON document as MessagePack. Going through
+// JSON keeps field names and omitempty exactly as in the JSON responses,
+// so both formats describe the same structs. Object keys are sorted.
+func jsonToMsgpack(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := writeMsgpack(&buf, value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeMsgpack appends one decoded JSON value in MessagePack's most compact
+// encoding for it
+func writeMsgpack(buf *bytes.Buffer, value any) error {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			writeMsgpackInt(buf, n)
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+	case string:
+		writeMsgpackHeader(buf, len(v), 0xa0, 31, 0xd9, 0xda, 0xdb)
+		buf.WriteString(v)
+	case []any:
+		writeMsgpackHeader(buf, len(v), 0x90, 15, 0, 0xdc, 0xdd)
+		for _, item := range v {
+			if err := writeMsgpack(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		writeMsgpackHeader(buf, len(v), 0x80, 15, 0, 0xde, 0xdf)
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			writeMsgpack(buf, key)
+			if err := writeMsgpack(buf, v[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: unexpected %T", value)
+	}
+	return nil
+}
+
+// writeMsgpackHeader writes the type and length of a string, array or map:
+// the fix form for lengths up to fixMax, then the 8 (strings only), 16 and
+// 32-bit forms
+func writeMsgpackHeader(buf *bytes.Buffer, n int, fix byte, fixMax int, tag8, tag16, tag32 byte) {
+	switch {
+	case n <= fixMax:
+		buf.WriteByte(fix | byte(n))
+	case tag8 != 0 && n <= math.MaxUint8:
+		buf.WriteByte(tag8)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(tag16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(tag32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+// writeMsgpackInt writes an integer in the smallest form that holds it
+func writeMsgpackInt(buf *bytes.Buffer, n int64) {
+	switch {
+	case n >= 0 && n <= 127:
+		buf.WriteByte(byte(n))
+	case n < 0 && n >= -32:
+		buf.WriteByte(byte(n))
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(n))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// nativeImageExtensions are the formats the Go image packages can decode
+var nativeImageExtensions = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+	".webp": true,
+}
+
+// fallbackImageExtensions are scaled in-process when vips isn't installed
+var fallbackImageExtensions = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+}
+
+// nativeDefaultQuality matches the vips JPEG default
+const nativeDefaultQuality = 75
+
+// isNativeImage reports whether an image can be decoded without vips
+func isNativeImage(path string) bool {
+	return nativeImageExtensions[strings.ToLower(filepath.Ext(path))]
+}
+
+// isFallbackImage reports whether an image is scaled in-process when vips
+// is missing
+func isFallbackImage(path string) bool {
+	return fallbackImageExtensions[strings.ToLower(filepath.Ext(path))]
+}
+
+// generateNativeThumbnail renders a thumbnail in-process with the Go image
+// packages. Output goes to a temporary file first, like the vips path.
+func (s *Server) generateNativeThumbnail(ctx context.Context, imagePath, thumbnailPath string, variant thumbnailVariant) error {
+	if !isNativeImage(imagePath) {
+		return thumbnailFailure(failureUnsupported, fmt.Errorf("%s can't be decoded without vips", filepath.Ext(imagePath)))
+	}
+	img, err := s.decodeNativeImage(ctx, imagePath)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return thumbnailFailure(failureTimeout, err)
+	case errors.Is(err, errNativeTooLarge):
+		return thumbnailFailure(failureUnsupported, err)
+	case err != nil:
+		return thumbnailFailure(failureCorrupt, err)
+	}
+	return s.writeNativeThumbnail(img, thumbnailPath, variant, s.thumbnailModeFor(imagePath))
+}
+
+// generateNativePlaceholder scales an already generated thumbnail of
+// imagePath, which lives in the local cache rather than the media store
+func (s *Server) generateNativePlaceholder(imagePath, thumbnailPath, placeholderPath string) error {
+	file, err := os.Open(thumbnailPath)
+	if err != nil {
+		return err
+	}
+	img, err := jpeg.Decode(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	return s.writeNativeThumbnail(img, placeholderPath, s.placeholderVariant, s.thumbnailModeFor(imagePath))
+}
+
+// writeNativeThumbnail scales a decoded image per the thumbnail mode and
+// stores it as a JPEG
+func (s *Server) writeNativeThumbnail(img image.Image, thumbnailPath string, variant thumbnailVariant, mode string) error {
+	var thumb image.Image
+	if mode == "fit" {
+		thumb = scaleToFit(img, variant.size, s.backgroundColor())
+	} else {
+		// No attention detection in-process, smart-crop falls back to the centre
+		thumb = scaleToSquare(img, variant.size, s.backgroundColor())
+	}
+	return writeNativeJPEG(thumbnailPath, thumb, variant.quality)
+}
+
+// maxNativePixels bounds the images decoded in-process, which hold every
+// pixel in memory: 100 megapixels take 400 MB as RGBA
+const maxNativePixels = 100_000_000
+
+// errNativeTooLarge is returned for images beyond maxNativePixels
+var errNativeTooLarge = errors.New("image is too large to decode in-process")
+
+// decodeNativeImage decodes a source image (the first frame of animations)
+// and applies its EXIF orientation, as vips does. The header is read first,
+// so a huge or hostile image is refused before it is decoded, and the
+// decoding stops when ctx is done.
+func (s *Server) decodeNativeImage(ctx context.Context, imagePath string) (image.Image, error) {
+	file, err := s.store.Open(ctx, imagePath)
+	if err != nil {
+		return nil, err
+	}
+	config, _, err := image.DecodeConfig(file)
+	file.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	if pixels := int64(config.Width) * int64(config.Height); pixels > maxNativePixels {
+		return nil, fmt.Errorf("%dx%d pixels: %w", config.Width, config.Height, errNativeTooLarge)
+	}
+
+	file, err = s.store.Open(ctx, imagePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	img, _, err := image.Decode(contextReader{ctx, file})
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	return applyOrientation(img, s.imageOrientation(ctx, imagePath)), nil
+}
+
+// contextReader fails reads once ctx is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// renderNativePreview writes a preview of at most size pixels on its long
+// edge. PNG keeps transparency, everything else is encoded as JPEG.
+func (s *Server) renderNativePreview(ctx context.Context, imagePath string, size int, format previewFormat, rot previewRotation, w io.Writer) error {
+	img, err := s.decodeNativeImage(ctx, imagePath)
+	if err != nil {
+		return err
+	}
+	img = applyOrientation(img, rot.orientation)
+	if format.suffix == ".png" {
+		return png.Encode(w, scaleToFit(img, size, color.RGBA{}))
+	}
+	return jpeg.Encode(w, scaleToFit(img, size, s.backgroundColor()), &jpeg.Options{Quality: nativeDefaultQuality})
+}
+
+// backgroundColor parses the vips background ("r g b") for flattening
+func (s *Server) backgroundColor() color.RGBA {
+	bg := color.RGBA{255, 255, 255, 255}
+	fmt.Sscanf(s.thumbnailBackground, "%d %d %d", &bg.R, &bg.G, &bg.B)
+	return bg
+}
+
+// scaleToFit scales an image to fit a size x size box, never enlarging it,
+// onto the given background
+func scaleToFit(img image.Image, size int, bg color.RGBA) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, max(1, h*size/w)
+		} else {
+			w, h = max(1, w*size/h), size
+		}
+	}
+	return scaleRect(img, b, w, h, bg)
+}
+
+// scaleToSquare crops the centre square of an image and scales it to size
+func scaleToSquare(img image.Image, size int, bg color.RGBA) image.Image {
+	b := img.Bounds()
+	side := min(b.Dx(), b.Dy())
+	x0 := b.Min.X + (b.Dx()-side)/2
+	y0 := b.Min.Y + (b.Dy()-side)/2
+	return scaleRect(img, image.Rect(x0, y0, x0+side, y0+side), size, size, bg)
+}
+
+// scaleRect scales the src rectangle of an image to w x h over bg
+func scaleRect(img image.Image, src image.Rectangle, w, h int, bg color.RGBA) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, src, xdraw.Over, nil)
+	return dst
+}
+
+// applyOrientation transforms an image according to its EXIF orientation
+// so it is displayed upright
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored horizontally
+				dx, dy = w-1-x, y
+			case 3: // rotated 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // rotated 90 clockwise
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 90 counter-clockwise
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// writeNativeJPEG encodes a thumbnail next to its final path and renames it
+// into place, so a failure leaves no partial file
+func writeNativeJPEG(thumbnailPath string, img image.Image, quality int) error {
+	if quality <= 0 {
+		quality = nativeDefaultQuality
+	}
+	tmpPath := thumbnailPath + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return thumbnailFailure(failureIO, err)
+	}
+	if err := jpeg.Encode(file, img, &jpeg.Options{Quality: quality}); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return thumbnailFailure(failureIO, err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return thumbnailFailure(failureIO, err)
+	}
+	if err := os.Rename(tmpPath, thumbnailPath); err != nil {
+		os.Remove(tmpPath)
+		return thumbnailFailure(failureIO, err)
+	}
+	return nil
+}
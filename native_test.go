@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/gif"
+	"testing"
+)
+
+func TestNativeDecodeRefusesHugeImages(t *testing.T) {
+	s := newTestServer(t)
+	var buf bytes.Buffer
+	if err := gif.Encode(&buf, image.NewGray(image.Rect(0, 0, 4, 4)), nil); err != nil {
+		t.Fatal(err)
+	}
+	// Claim a 65535x65535 logical screen, without the pixels to go with it
+	data := buf.Bytes()
+	copy(data[6:10], []byte{0xFF, 0xFF, 0xFF, 0xFF})
+	imagePath := writeTestFile(t, s, "huge.gif", data)
+
+	if _, err := s.decodeNativeImage(t.Context(), imagePath); !errors.Is(err, errNativeTooLarge) {
+		t.Errorf("decoding a huge image: %v, want %v", err, errNativeTooLarge)
+	}
+	err := s.generateThumbnail(t.Context(), imagePath, defaultThumbnailVariant())
+	if category := thumbnailFailureCategory(err); category != failureUnsupported {
+		t.Errorf("generation failed with %v [%s], want %s", err, category, failureUnsupported)
+	}
+}
+
+func TestNativeDecodeHonoursContext(t *testing.T) {
+	s := newTestServer(t)
+	imagePath := writeTestJPEG(t, s, "photo.jpg", 64, 64)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	if _, err := s.decodeNativeImage(ctx, imagePath); !errors.Is(err, context.Canceled) {
+		t.Errorf("decoding with a cancelled context: %v, want %v", err, context.Canceled)
+	}
+	if _, err := s.decodeNativeImage(t.Context(), imagePath); err != nil {
+		t.Errorf("decoding: %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os/exec"
+	"strings"
+)
+
+// modernImageFormats are the formats thumbnails and previews are negotiated
+// to with Accept, most preferred first, with the vips saver each needs.
+// AVIF is smaller still than WebP, but slower to encode.
+var modernImageFormats = []struct{ name, saver string }{
+	{"avif", "heifsave"},
+	{"webp", "webpsave"},
+}
+
+// vipsSavers returns the modern formats the installed vips can write
+func vipsSavers() map[string]bool {
+	formats := make(map[string]bool)
+	out, err := exec.Command(vipsTool("vips"), "-l").Output()
+	if err != nil {
+		return formats
+	}
+	for _, format := range modernImageFormats {
+		if bytes.Contains(out, []byte(format.saver)) {
+			formats[format.name] = true
+		}
+	}
+	return formats
+}
+
+// canNegotiateFormat reports whether a file's thumbnail and preview may be
+// served in a modern format. Movies go through ffmpeg and SVGs aren't
+// rendered, and padding and watermarks are applied to JPEGs only.
+func (s *Server) canNegotiateFormat(fullPath string) bool {
+	return len(s.modernFormats) > 0 && isImageFile(fullPath) && !isSVGFile(fullPath) &&
+		defaultThumbnailVariant().pad == "" && s.watermark == nil
+}
+
+// negotiatedFormat returns the most preferred modern format that the client
+// accepts and vips can write, "" for JPEG
+func (s *Server) negotiatedFormat(r *http.Request) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, _ := strings.Cut(part, ";")
+		if strings.ReplaceAll(params, " ", "") == "q=0" {
+			continue
+		}
+		accepted[strings.ToLower(strings.TrimSpace(mediaType))] = true
+	}
+	for _, format := range modernImageFormats {
+		if s.modernFormats[format.name] && accepted["image/"+format.name] {
+			return format.name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// orderFileName is the sidecar in a directory that lists its file names in
+// a hand-arranged order, one per line. Being hidden, it is never listed.
+const orderFileName = ".order"
+
+// orderRequest replaces the manual order of a directory
+type orderRequest struct {
+	Files []string `json:"files"`
+}
+
+// orderResponse is the manual order of a directory
+type orderResponse struct {
+	Path  string   `json:"path"`
+	Files []string `json:"files"`
+}
+
+// readManualOrder returns the names listed in a directory's .order file,
+// nil if it has none
+func readManualOrder(dir string) []string {
+	data, err := os.ReadFile(filepath.Join(dir, orderFileName))
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if name := strings.TrimSpace(line); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// writeManualOrder stores the .order file of a directory, via a temporary
+// file so readers never see it half written
+func writeManualOrder(dir string, names []string) error {
+	path := filepath.Join(dir, orderFileName)
+	tmpPath := path + ".tmp"
+	var data []byte
+	for _, name := range names {
+		data = append(data, name+"\n"...)
+	}
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// sortManual orders files as listed in order. Files that aren't listed keep
+// their listing order and follow after the listed ones.
+func sortManual(files []FileInfo, order []string) {
+	rank := make(map[string]int, len(order))
+	for i, name := range order {
+		if _, ok := rank[name]; !ok {
+			rank[name] = i
+		}
+	}
+	rankOf := func(file FileInfo) int {
+		if i, ok := rank[file.Name]; ok {
+			return i
+		}
+		return len(order)
+	}
+	slices.SortStableFunc(files, func(a, b FileInfo) int {
+		return rankOf(a) - rankOf(b)
+	})
+}
+
+// handleOrder reads (GET) or replaces (POST) the manual order of a directory,
+// which /api/list applies with ?sort=manual
+func (s *Server) handleOrder(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		path = "/"
+	}
+	fullPath, ok := s.resolvePath(path)
+	if !ok {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+	if info, err := s.store.Stat(r.Context(), fullPath); err != nil || !info.IsDir() {
+		http.Error(w, "Directory not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		order := readManualOrder(fullPath)
+		if order == nil {
+			order = []string{}
+		}
+		respondJSON(w, orderResponse{Path: s.urlPathFor(fullPath), Files: order}, http.StatusOK)
+		return
+	}
+
+	var req orderRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		respondJSON(w, map[string]interface{}{
+			"error": "expected {\"files\": [\"name\", ...]}",
+		}, http.StatusBadRequest)
+		return
+	}
+	// Only plain names of this directory, each once
+	order := make([]string, 0, len(req.Files))
+	seen := make(map[string]bool, len(req.Files))
+	for _, name := range req.Files {
+		if name == "" || strings.ContainsAny(name, "/\\\n") || strings.HasPrefix(name, ".") {
+			respondJSON(w, map[string]interface{}{
+				"error": "invalid file name " + strconv.Quote(name),
+			}, http.StatusBadRequest)
+			return
+		}
+		if !seen[name] {
+			seen[name] = true
+			order = append(order, name)
+		}
+	}
+
+	// With S3 the directory only exists in the local cache tree
+	if err := os.MkdirAll(fullPath, 0755); err != nil {
+		log.Printf("Failed to save manual order of %s: %v", fullPath, err)
+		respondJSON(w, map[string]interface{}{
+			"error": "failed to save order",
+		}, http.StatusInternalServerError)
+		return
+	}
+	if err := writeManualOrder(fullPath, order); err != nil {
+		log.Printf("Failed to save manual order of %s: %v", fullPath, err)
+		respondJSON(w, map[string]interface{}{
+			"error": "failed to save order",
+		}, http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, orderResponse{Path: s.urlPathFor(fullPath), Files: order}, http.StatusOK)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// rawExtensions are the camera RAW formats that are paired with the JPEG
+// shot alongside them
+var rawExtensions = map[string]bool{
+	".arw": true,
+	".dng": true,
+	".nef": true,
+	".raw": true,
+}
+
+// isRawFile reports whether a file is a camera RAW image
+func isRawFile(name string) bool {
+	return rawExtensions[strings.ToLower(filepath.Ext(name))]
+}
+
+// isJPEGFile reports whether a file is a JPEG, the half of a RAW+JPEG pair
+// that is listed
+func isJPEGFile(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".jpg" || ext == ".jpeg"
+}
+
+// pairFiles folds the files that belong together into one entry: Live Photo
+// movies into their image, see pairLivePhotos, and RAW files into the JPEG
+// with the same base name, see pairRawImages
+func (s *Server) pairFiles(files []FileInfo) []FileInfo {
+	return pairRawImages(s.pairLivePhotos(files))
+}
+
+// pairRawImages links each JPEG to the RAW file with the same base name,
+// as cameras shooting RAW+JPEG write them, by setting its RawPath. Paired
+// RAW files are dropped from the listing so each shot is one tile. A RAW
+// file without a JPEG keeps its own tile.
+func pairRawImages(files []FileInfo) []FileInfo {
+	jpegs := make(map[string]int)
+	for i, file := range files {
+		if file.IsImage && isJPEGFile(file.Name) {
+			jpegs[livePhotoBase(file.Name)] = i
+		}
+	}
+	if len(jpegs) == 0 {
+		return files
+	}
+
+	paired := make(map[int]bool)
+	for i, file := range files {
+		if !file.IsImage || !isRawFile(file.Name) {
+			continue
+		}
+		if j, ok := jpegs[livePhotoBase(file.Name)]; ok && files[j].RawPath == "" {
+			files[j].RawPath = file.Path
+			paired[i] = true
+		}
+	}
+
+	listed := files[:0]
+	for i, file := range files {
+		if !paired[i] {
+			listed = append(listed, file)
+		}
+	}
+	return listed
+}
+
+// pairGroups counts, per base name shared by files that pairFiles may fold
+// together, the entries with that base name
+func pairGroups(entries []fs.DirEntry) map[string]int {
+	images := make(map[string]int)
+	movies := make(map[string]int)
+	jpegs := make(map[string]int)
+	raws := make(map[string]int)
+	for _, entry := range entries {
+		name := entry.Name()
+		base := livePhotoBase(name)
+		if isImageFile(name) {
+			images[base]++
+			if isJPEGFile(name) {
+				jpegs[base]++
+			} else if isRawFile(name) {
+				raws[base]++
+			}
+		} else if isMovieFile(name) {
+			movies[base]++
+		}
+	}
+	groups := make(map[string]int)
+	for base, count := range movies {
+		if images[base] > 0 {
+			groups[base] = images[base] + count
+		}
+	}
+	for base := range raws {
+		if jpegs[base] > 0 && groups[base] == 0 {
+			groups[base] = images[base]
+		}
+	}
+	return groups
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// decodableCodecs returns the codecs the configured ffmpeg can decode, read
+// once from "ffmpeg -codecs". Lines look like " DEV.LS h264   H.264 / ...",
+// where a D in the first flag column means decoding is supported.
+var decodableCodecs = sync.OnceValue(func() map[string]bool {
+	codecs := make(map[string]bool)
+	ctx, cancel := context.WithTimeout(context.Background(), toolProbeTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, ffmpegExecutable(), "-hide_banner", "-codecs").Output()
+	if err != nil {
+		return codecs
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || len(fields[0]) != 6 || fields[0][0] != 'D' {
+			continue
+		}
+		codecs[fields[1]] = true
+	}
+	return codecs
+})
+
+// canTranscode asks ffprobe for the codec of a movie's video stream and
+// reports whether it can be decoded, by the hardware decoder going with the
+// -video-encoder or else by ffmpeg in software. A movie ffprobe can't read
+// at all can't be transcoded either.
+func (s *Server) canTranscode(ctx context.Context, moviePath string) (bool, string) {
+	input, err := s.store.Locate(ctx, moviePath)
+	if err != nil {
+		return false, ""
+	}
+	codec := s.videoCodecFor(ctx, moviePath, input)
+	if codec == "" {
+		return false, ""
+	}
+	return s.videoEncoder.decoderFor(codec) != "" || decodableCodecs()[codec], codec
+}
+
+// serveMoviePreview answers /api/preview for a movie: movies ffmpeg can
+// transcode are redirected to their HLS playlist, or with ?format=ts to the
+// single MPEG-TS stream, the others get the original file, with range
+// support, so the browser can at least try to play it
+func (s *Server) serveMoviePreview(w http.ResponseWriter, r *http.Request, urlPath, fullPath string) {
+	endpoint := "/api/file.m3u8"
+	switch strings.ToLower(r.URL.Query().Get("format")) {
+	case "", "hls":
+	case "ts", "mpegts":
+		endpoint = "/api/file.ts"
+	default:
+		http.Error(w, "Invalid preview format", http.StatusBadRequest)
+		return
+	}
+	if ok, codec := s.canTranscode(r.Context(), fullPath); !ok {
+		log.Printf("Cannot transcode %s (codec %q), serving the original", fullPath, codec)
+		s.store.ServeFile(w, r, fullPath)
+		return
+	}
+	stream := s.urlWithBasePath(endpoint) + "?path=" + url.QueryEscape(urlPath)
+	if quality := r.URL.Query().Get("quality"); quality != "" {
+		stream += "&quality=" + url.QueryEscape(quality)
+	}
+	http.Redirect(w, r, stream, http.StatusFound)
+}
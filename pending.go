@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// pendingThumbnail is a queued or running thumbnail generation. Requests
+// wait for done; when every request that asked for it has disconnected, the
+// generation is cancelled, killing its vips or ffmpeg process, unless it
+// was also queued in the background by a prefetch or contact sheet.
+type pendingThumbnail struct {
+	done   chan struct{}
+	ctx    context.Context // parent of the generation, see abandon
+	cancel context.CancelFunc
+	err    error // why the generation failed, set before done is closed
+
+	mu       sync.Mutex
+	waiters  int  // requests waiting for done
+	detached bool // queued without a request, so nobody can abandon it
+}
+
+func newPendingThumbnail(parent context.Context) *pendingThumbnail {
+	ctx, cancel := context.WithCancel(parent)
+	return &pendingThumbnail{done: make(chan struct{}), ctx: ctx, cancel: cancel}
+}
+
+// pendingFor returns the pending generation of a thumbnail, registering a
+// new one if there is none; created reports which. With wait, the caller
+// counts as waiting until it calls leave.
+func (s *Server) pendingFor(thumbnailPath string, wait bool) (pending *pendingThumbnail, created bool) {
+	for {
+		fresh := newPendingThumbnail(s.baseCtx)
+		value, loaded := s.pendingThumbs.LoadOrStore(thumbnailPath, fresh)
+		pending = value.(*pendingThumbnail)
+		if loaded {
+			fresh.cancel()
+		}
+		pending.mu.Lock()
+		// An abandoned generation is on its way out of the map, start over
+		if pending.ctx.Err() != nil && s.baseCtx.Err() == nil {
+			pending.mu.Unlock()
+			s.pendingThumbs.CompareAndDelete(thumbnailPath, pending)
+			continue
+		}
+		if wait {
+			pending.waiters++
+		} else {
+			pending.detached = true
+		}
+		pending.mu.Unlock()
+		return pending, !loaded
+	}
+}
+
+// leave stops waiting for a generation. abandon is true when the request
+// went away; if it was the last one waiting and nothing else wants the
+// thumbnail, the generation is cancelled.
+func (s *Server) leave(thumbnailPath string, pending *pendingThumbnail, abandon bool) {
+	pending.mu.Lock()
+	defer pending.mu.Unlock()
+	pending.waiters--
+	if abandon && pending.waiters == 0 && !pending.detached {
+		pending.cancel()
+		s.pendingThumbs.CompareAndDelete(thumbnailPath, pending)
+	}
+}
+
+// pendingThumbnails counts the generations queued or running
+func (s *Server) pendingThumbnails() int {
+	n := 0
+	s.pendingThumbs.Range(func(_, _ any) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// finish releases the requests waiting for a generation and forgets it
+func (s *Server) finish(thumbnailPath string, pending *pendingThumbnail) {
+	s.pendingThumbs.CompareAndDelete(thumbnailPath, pending)
+	pending.cancel()
+	close(pending.done)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// prefetchDirectory queues the missing default thumbnails of a listed
+// directory right away, so the grid's thumbnail requests that follow the
+// listing find them generated or already in progress. Nothing waits for the
+// jobs, and once the queues are full the remaining files are left to be
+// generated on request as usual.
+func (s *Server) prefetchDirectory(dir string, files []FileInfo) {
+	for _, file := range files {
+		if (!file.IsImage && !file.IsMovie) || file.OwnThumbnail {
+			continue
+		}
+		path := filepath.Join(dir, file.Name)
+		if _, err := os.Stat(s.thumbnailPathFor(path, defaultThumbnailVariant())); err == nil {
+			continue
+		}
+		if !s.enqueueThumbnail(path, defaultThumbnailVariant()) {
+			return
+		}
+	}
+}
+
+// enqueueThumbnail queues a thumbnail for generation without waiting for it.
+// It returns false only when the queue is full; a thumbnail that is already
+// pending counts as queued.
+func (s *Server) enqueueThumbnail(imagePath string, variant thumbnailVariant) bool {
+	thumbnailPath := s.thumbnailPathFor(imagePath, variant)
+	// A background generation isn't cancelled when its requests go away
+	pending, created := s.pendingFor(thumbnailPath, false)
+	if !created {
+		return true
+	}
+
+	queue := s.imageThumbnailQueue
+	if isMovieFile(imagePath) {
+		queue = s.movieThumbnailQueue
+	}
+	if s.sendThumbnailJob(queue, thumbnailJob{path: imagePath, variant: variant, pending: pending}) {
+		return true
+	}
+	// Release anyone who started waiting in the meantime
+	s.finish(thumbnailPath, pending)
+	return false
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pregenConcurrency caps the thumbnails -pregenerate has queued at once. An
+// on-demand request never waits behind more than this many of them.
+const pregenConcurrency = 2
+
+// pregenIdlePoll is how often pregeneration checks whether the thumbnail
+// queues have emptied
+const pregenIdlePoll = 200 * time.Millisecond
+
+// pregenProgress counts the work of -pregenerate, see /api/pregen/status
+type pregenProgress struct {
+	started   time.Time
+	finished  atomic.Pointer[time.Time]
+	scanned   atomic.Int64 // media files seen
+	queued    atomic.Int64 // of those, missing or stale thumbnails
+	completed atomic.Int64
+	failed    atomic.Int64
+}
+
+// pregenStatus is the JSON body of /api/pregen/status
+type pregenStatus struct {
+	Running   bool      `json:"running"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished,omitzero"`
+	Scanned   int64     `json:"scanned"`
+	Queued    int64     `json:"queued"`
+	Completed int64     `json:"completed"`
+	Failed    int64     `json:"failed"`
+}
+
+// pregenerate generates every thumbnail of the tree that is missing or older
+// than its file, once, at startup. It runs behind on-demand requests: a
+// thumbnail is only handed to the workers while their queues are empty.
+// Nothing is recorded between runs; a restart walks the tree again and
+// skips the thumbnails that are already fresh.
+func (s *Server) pregenerate() {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, pregenConcurrency)
+	s.pregenDir(s.baseCtx, s.rootDir, &wg, sem)
+	wg.Wait()
+	finished := time.Now()
+	s.pregen.finished.Store(&finished)
+	log.Printf("Pregenerate: %d thumbnails generated (%d failed) of %d files in %s",
+		s.pregen.completed.Load(), s.pregen.failed.Load(), s.pregen.scanned.Load(),
+		finished.Sub(s.pregen.started).Round(time.Second))
+}
+
+// pregenDir queues the missing and stale thumbnails under dir. A stale
+// thumbnail is served until its replacement is renamed over it.
+func (s *Server) pregenDir(ctx context.Context, dir string, wg *sync.WaitGroup, sem chan struct{}) {
+	s.walkMedia(ctx, dir, "Pregenerate", func(path string, info fs.FileInfo) error {
+		s.pregen.scanned.Add(1)
+		if thumb, err := os.Stat(s.thumbnailPathFor(path, defaultThumbnailVariant())); err == nil && !thumbnailStale(thumb, info) {
+			return nil
+		}
+		if err := s.waitForIdleQueues(ctx); err != nil {
+			return err
+		}
+		s.pregen.queued.Add(1)
+		s.generateInBackground(ctx, path, "Pregenerate", wg, sem, func(err error) {
+			if err != nil {
+				s.pregen.failed.Add(1)
+				return
+			}
+			s.pregen.completed.Add(1)
+		})
+		return nil
+	})
+}
+
+// waitForIdleQueues blocks until both thumbnail queues are empty, so
+// on-demand jobs go first. It fails once the server shuts down.
+func (s *Server) waitForIdleQueues(ctx context.Context) error {
+	for {
+		if s.draining() {
+			return context.Canceled
+		}
+		if len(s.imageThumbnailQueue) == 0 && len(s.movieThumbnailQueue) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pregenIdlePoll):
+		}
+	}
+}
+
+// handlePregenStatus reports the progress of -pregenerate
+func (s *Server) handlePregenStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.pregen == nil {
+		http.Error(w, "Pregeneration not enabled", http.StatusNotFound)
+		return
+	}
+	status := pregenStatus{
+		Running:   true,
+		Started:   s.pregen.started,
+		Scanned:   s.pregen.scanned.Load(),
+		Queued:    s.pregen.queued.Load(),
+		Completed: s.pregen.completed.Load(),
+		Failed:    s.pregen.failed.Load(),
+	}
+	if finished := s.pregen.finished.Load(); finished != nil {
+		status.Running = false
+		status.Finished = *finished
+	}
+	respondJSON(w, status, http.StatusOK)
+}
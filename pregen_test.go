@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPregenerateReplacesStaleThumbnail(t *testing.T) {
+	s := newTestServer(t)
+	s.pregen = &pregenProgress{started: time.Now()}
+	s.resizeWorkers(1, 1)
+	t.Cleanup(func() { s.resizeWorkers(0, 0) })
+	fresh := writeTestJPEG(t, s, "fresh.jpg", 40, 20)
+	stale := writeTestJPEG(t, s, "trip/stale.jpg", 40, 20)
+	for _, photo := range []string{fresh, stale} {
+		if err := s.generateThumbnail(t.Context(), photo, defaultThumbnailVariant()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The stale photo was edited after its thumbnail was made
+	edited := time.Now().Add(-time.Minute)
+	staleThumbnail := s.thumbnailPathFor(stale, defaultThumbnailVariant())
+	if err := os.Chtimes(staleThumbnail, edited.Add(-time.Hour), edited.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(stale, edited, edited); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	s.pregenDir(t.Context(), s.rootDir, &wg, make(chan struct{}, pregenConcurrency))
+	wg.Wait()
+
+	if scanned, queued := s.pregen.scanned.Load(), s.pregen.queued.Load(); scanned != 2 || queued != 1 {
+		t.Errorf("scanned %d and queued %d, want 2 and 1", scanned, queued)
+	}
+	if s.pregen.completed.Load() != 1 {
+		t.Errorf("%d thumbnails completed, %d failed, want 1 completed", s.pregen.completed.Load(), s.pregen.failed.Load())
+	}
+	thumb, err := os.Stat(staleThumbnail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thumb.ModTime().Before(edited) {
+		t.Error("stale thumbnail wasn't replaced")
+	}
+}
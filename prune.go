@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// cacheFileSuffixes are the suffixes appended to a source file name for the
+// files stored in .small, longest first
+var cacheFileSuffixes = []string{".meta.json", ".dim.json", ".exp.json", ".ts", ".jpg", ".webp", ".avif"}
+
+type pruneResult struct {
+	Removed int      `json:"removed"`
+	Bytes   int64    `json:"bytes"`
+	DryRun  bool     `json:"dryRun,omitempty"`
+	Files   []string `json:"files,omitempty"` // with dry-run, the files that would be removed
+}
+
+// handlePrune removes cached thumbnails whose source file no longer exists,
+// and those of an older thumbnailCacheVersion.
+// An optional path parameter limits the prune to a subtree. With
+// ?dry-run=true nothing is deleted and the files that would be are listed.
+func (s *Server) handlePrune(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		path = "/"
+	}
+	fullPath, ok := s.resolvePath(path)
+	if !ok {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	dryRun := r.URL.Query().Get("dry-run") == "true"
+	result, err := s.pruneThumbnails(r.Context(), fullPath, dryRun)
+	if err != nil {
+		respondJSON(w, map[string]interface{}{
+			"error": err.Error(),
+		}, http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, result, http.StatusOK)
+}
+
+// pruneThumbnails walks the cache tree of root and deletes cache files in
+// .small directories whose source has been removed or that are outdated, or
+// only lists them with dryRun
+func (s *Server) pruneThumbnails(ctx context.Context, root string, dryRun bool) (pruneResult, error) {
+	result := pruneResult{DryRun: dryRun}
+	root = cacheTreeFor(root)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if d.Name() == ".small" {
+			s.pruneThumbnailDir(ctx, path, &result)
+			return filepath.SkipDir
+		}
+		// Other hidden directories are never listed, leave them alone
+		if strings.HasPrefix(d.Name(), ".") && path != root {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return result, err
+}
+
+// pruneThumbnailDir removes the orphaned and outdated files of a single
+// .small directory
+func (s *Server) pruneThumbnailDir(ctx context.Context, thumbnailDir string, result *pruneResult) {
+	entries, err := os.ReadDir(thumbnailDir)
+	if err != nil {
+		return
+	}
+	sourceDir := sourceDirFor(thumbnailDir)
+
+	for _, entry := range entries {
+		// Subdirectories (e.g. the hashed thumbnail store) aren't keyed by source
+		if entry.IsDir() || (s.sourceExists(ctx, sourceDir, entry.Name()) && !outdatedThumbnail(entry.Name())) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(thumbnailDir, entry.Name())
+		if result.DryRun {
+			result.Files = append(result.Files, s.cacheURLPath(path))
+		} else if err := os.Remove(path); err != nil {
+			continue
+		}
+		result.Removed++
+		result.Bytes += info.Size()
+	}
+}
+
+// outdatedThumbnail reports whether a cache file is a thumbnail of an older
+// thumbnailCacheVersion, which is never served again
+func outdatedThumbnail(cacheName string) bool {
+	ext := filepath.Ext(cacheName)
+	if ext != ".jpg" && ext != ".webp" && ext != ".avif" {
+		return false
+	}
+	return !strings.HasSuffix(strings.TrimSuffix(cacheName, ext), thumbnailVersionSuffix)
+}
+
+// sourceExists reports whether the source of a cache file is still present.
+// Files that don't look like cache files are kept.
+func (s *Server) sourceExists(ctx context.Context, sourceDir, cacheName string) bool {
+	name := strings.TrimSuffix(cacheName, ".tmp")
+
+	var base string
+	for _, suffix := range cacheFileSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			base = strings.TrimSuffix(name, suffix)
+			break
+		}
+	}
+	if base == "" {
+		return true
+	}
+
+	if _, err := s.store.Stat(ctx, filepath.Join(sourceDir, base)); err == nil {
+		return true
+	}
+	// Non-default renditions carry a size/quality suffix before the extension,
+	// movie segments a segment suffix
+	for _, suffix := range []*regexp.Regexp{thumbnailVariantSuffix, segmentSuffix} {
+		if stripped := suffix.ReplaceAllString(base, ""); stripped != base {
+			if _, err := s.store.Stat(ctx, filepath.Join(sourceDir, stripped)); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
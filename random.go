@@ -0,0 +1,81 @@
+package main
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"path"
+	"strconv"
+)
+
+const (
+	defaultRandomCount = 20
+	maxRandomCount     = 100
+)
+
+// handleRandom returns a random sample of the media under a directory, e.g.
+// for a homepage grid. Candidates come from the cached media index, which is
+// sampled in one pass, so a request never walks the tree itself.
+func (s *Server) handleRandom(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	dir := query.Get("path")
+	if dir == "" {
+		dir = "/"
+	}
+	if _, ok := s.resolvePath(dir); !ok {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+	dir = path.Clean("/" + dir)
+
+	count := defaultRandomCount
+	if v, err := strconv.Atoi(query.Get("count")); err == nil && v > 0 {
+		count = min(v, maxRandomCount)
+	}
+
+	index, _, err := s.mediaIndexEntries(r.Context())
+	if err != nil {
+		mediaIndexFailed(w, err)
+		return
+	}
+	sample := sampleMedia(index, dir, count)
+
+	files := make([]FileInfo, 0, len(sample))
+	for _, entry := range sample {
+		files = append(files, FileInfo{
+			Name:      path.Base(entry.Path),
+			Path:      entry.Path,
+			IsImage:   !entry.IsMovie,
+			IsMovie:   entry.IsMovie,
+			Thumbnail: entry.Thumbnail,
+		})
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	respondJSON(w, DirectoryResponse{
+		Path:  dir,
+		Files: files,
+	}, http.StatusOK)
+}
+
+// sampleMedia picks up to count entries under dir uniformly at random with
+// reservoir sampling, in a single pass and without collecting the subtree
+func sampleMedia(index []mediaIndexEntry, dir string, count int) []mediaIndexEntry {
+	sample := make([]mediaIndexEntry, 0, count)
+	seen := 0
+	for _, entry := range index {
+		if !inDirectory(entry.Path, dir, true) {
+			continue
+		}
+		seen++
+		if len(sample) < count {
+			sample = append(sample, entry)
+		} else if i := rand.IntN(seen); i < count {
+			sample[i] = entry
+		}
+	}
+	// The first count candidates keep their listing order, shuffle them too
+	rand.Shuffle(len(sample), func(i, j int) {
+		sample[i], sample[j] = sample[j], sample[i]
+	})
+	return sample
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitSweep is how often buckets of clients that went quiet are dropped
+const rateLimitSweep = time.Minute
+
+// rateLimiter is a token bucket per client IP for the endpoints that spawn
+// vips and ffmpeg, see -rate-limit and -rate-burst. Each bucket holds up to
+// burst requests and refills at rate per second.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	clients map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time // when tokens was last brought up to date
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(max(burst, 1)),
+		clients: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token from client's bucket. When it is empty, it returns
+// false and how long until the next token.
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bucket, ok := l.clients[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.clients[client] = bucket
+	}
+	bucket.tokens = min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// sweep drops the buckets that have refilled completely; a client coming
+// back gets a full one anyway
+func (l *rateLimiter) sweep(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for client, bucket := range l.clients {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.clients, client)
+		}
+	}
+}
+
+// sweepRateLimitsPeriodically drops the buckets of idle clients, so they
+// don't pile up until shutdown
+func (s *Server) sweepRateLimitsPeriodically() {
+	ticker := time.NewTicker(rateLimitSweep)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.baseCtx.Done():
+			return
+		case now := <-ticker.C:
+			s.rateLimiter.sweep(now)
+		}
+	}
+}
+
+// clientIP is who a request is counted against: the address of the
+// connection, so behind a reverse proxy all clients share one bucket
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimited wraps a handler so that each client IP is held to
+// -rate-limit. Requests over it get 429 with Retry-After. Without a limit
+// the handler is returned as it is.
+func (s *Server) rateLimited(next http.HandlerFunc) http.HandlerFunc {
+	if s.rateLimiter == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := s.rateLimiter.allow(clientIP(r), time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
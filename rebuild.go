@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rebuildConcurrency caps the thumbnails a rebuild has queued at once, so the
+// queues stay nearly empty and live requests are served in between
+const rebuildConcurrency = 4
+
+// rebuildProgress reports the state of the current or last thumbnail rebuild
+type rebuildProgress struct {
+	Path       string    `json:"path"`
+	Running    bool      `json:"running"`
+	Queued     int       `json:"queued"`
+	Done       int       `json:"done"`
+	Failed     int       `json:"failed"`
+	Removed    int       `json:"removed"` // thumbnails deleted before regenerating
+	Bytes      int64     `json:"bytes"`
+	Started    time.Time `json:"started"`
+	Finished   time.Time `json:"finished,omitzero"`
+	DryRun     bool      `json:"dryRun,omitempty"`
+	Files      []string  `json:"files,omitempty"`      // with dry-run, the thumbnails that would be deleted
+	Regenerate []string  `json:"regenerate,omitempty"` // with dry-run, the media that would be queued
+}
+
+// rebuildState tracks the single rebuild that may run at a time
+type rebuildState struct {
+	mu       sync.Mutex
+	progress *rebuildProgress
+}
+
+// snapshot returns a copy of the progress that is safe to encode
+func (rs *rebuildState) snapshot() (rebuildProgress, bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.progress == nil {
+		return rebuildProgress{}, false
+	}
+	return *rs.progress, true
+}
+
+// update applies a change to the progress under the lock
+func (rs *rebuildState) update(fn func(p *rebuildProgress)) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	fn(rs.progress)
+}
+
+// handleRebuild deletes and regenerates the thumbnails of a subtree.
+// POST starts a rebuild in the background, GET reports its progress.
+// POST with ?dry-run=true only reports what a rebuild would delete and queue.
+func (s *Server) handleRebuild(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		progress, ok := s.rebuild.snapshot()
+		if !ok {
+			respondJSON(w, map[string]interface{}{"running": false}, http.StatusOK)
+			return
+		}
+		respondJSON(w, progress, http.StatusOK)
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		path = "/"
+	}
+	fullPath, ok := s.resolvePath(path)
+	if !ok {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+	if info, err := s.store.Stat(r.Context(), fullPath); err != nil || !info.IsDir() {
+		http.Error(w, "Directory not found", http.StatusNotFound)
+		return
+	}
+
+	if r.URL.Query().Get("dry-run") == "true" {
+		plan := rebuildProgress{Path: path, DryRun: true, Started: time.Now()}
+		s.planRebuildDir(r.Context(), fullPath, &plan)
+		plan.Finished = time.Now()
+		respondJSON(w, plan, http.StatusOK)
+		return
+	}
+
+	s.rebuild.mu.Lock()
+	if s.rebuild.progress != nil && s.rebuild.progress.Running {
+		progress := *s.rebuild.progress
+		s.rebuild.mu.Unlock()
+		respondJSON(w, progress, http.StatusConflict)
+		return
+	}
+	s.rebuild.progress = &rebuildProgress{Path: path, Running: true, Started: time.Now()}
+	progress := *s.rebuild.progress
+	s.rebuild.mu.Unlock()
+
+	// The rebuild outlives the request that started it
+	go s.rebuildThumbnails(s.baseCtx, fullPath)
+
+	respondJSON(w, progress, http.StatusAccepted)
+}
+
+// rebuildThumbnails walks the tree under root and regenerates every default
+// thumbnail, waiting for all of them before marking the rebuild finished
+func (s *Server) rebuildThumbnails(ctx context.Context, root string) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, rebuildConcurrency)
+	s.rebuildDir(ctx, root, &wg, sem)
+	wg.Wait()
+	s.rebuild.update(func(p *rebuildProgress) {
+		p.Running = false
+		p.Finished = time.Now()
+	})
+}
+
+// rebuildDir removes the cached thumbnails of one directory, re-enqueues
+// their generation and recurses into subdirectories
+func (s *Server) rebuildDir(ctx context.Context, dir string, wg *sync.WaitGroup, sem chan struct{}) {
+	entries, err := s.store.ReadDir(ctx, dir)
+	if err != nil {
+		log.Printf("Skipping %s: %v", dir, err)
+		return
+	}
+
+	var media []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") || s.isExcluded(entry.Name()) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if entry.IsDir() {
+			s.rebuildDir(ctx, path, wg, sem)
+		} else if isImageFile(path) || isMovieFile(path) {
+			media = append(media, path)
+		}
+	}
+	if len(media) == 0 {
+		return
+	}
+	removed, bytes := removeThumbnails(dir, media, false)
+	s.rebuild.update(func(p *rebuildProgress) {
+		p.Removed += len(removed)
+		p.Bytes += bytes
+	})
+
+	for _, path := range media {
+		sem <- struct{}{}
+		s.rebuild.update(func(p *rebuildProgress) { p.Queued++ })
+		wg.Add(1)
+		go func(path string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			err := s.queueAndWaitForThumbnail(ctx, path, defaultThumbnailVariant())
+			if err != nil {
+				log.Printf("Failed to rebuild thumbnail for %s [%s]: %v", path, thumbnailFailureCategory(err), err)
+			}
+			s.rebuild.update(func(p *rebuildProgress) {
+				if err != nil {
+					p.Failed++
+				} else {
+					p.Done++
+				}
+			})
+		}(path)
+	}
+}
+
+// planRebuildDir records what rebuildDir would delete and queue for one
+// directory and its subdirectories, without touching anything
+func (s *Server) planRebuildDir(ctx context.Context, dir string, plan *rebuildProgress) {
+	entries, err := s.store.ReadDir(ctx, dir)
+	if err != nil {
+		return
+	}
+
+	var media []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") || s.isExcluded(entry.Name()) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if entry.IsDir() {
+			s.planRebuildDir(ctx, path, plan)
+		} else if isImageFile(path) || isMovieFile(path) {
+			media = append(media, path)
+		}
+	}
+	if len(media) == 0 {
+		return
+	}
+	removed, bytes := removeThumbnails(dir, media, true)
+	for _, path := range removed {
+		plan.Files = append(plan.Files, s.cacheURLPath(path))
+	}
+	for _, path := range media {
+		plan.Regenerate = append(plan.Regenerate, s.urlPathFor(path))
+	}
+	plan.Removed += len(removed)
+	plan.Bytes += bytes
+	plan.Queued += len(media)
+}
+
+// removeThumbnails deletes every cached thumbnail rendition of the given
+// media files in dir. Other cache files (dimensions, transcodes) are kept.
+// It returns the removed files and their size; with dryRun nothing is deleted.
+func removeThumbnails(dir string, media []string, dryRun bool) (removed []string, bytes int64) {
+	sources := make(map[string]bool, len(media))
+	for _, path := range media {
+		sources[cacheName(filepath.Base(path))] = true
+	}
+
+	thumbnailDir := thumbnailDirFor(dir)
+	entries, err := os.ReadDir(thumbnailDir)
+	if err != nil {
+		return nil, 0
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := filepath.Ext(name)
+		if entry.IsDir() || (ext != ".jpg" && ext != ".webp" && ext != ".avif") {
+			continue
+		}
+		base := cacheName(strings.TrimSuffix(name, ext))
+		if !sources[base] && !sources[thumbnailVariantSuffix.ReplaceAllString(base, "")] {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(thumbnailDir, name)
+		if !dryRun {
+			if err := os.Remove(path); err != nil {
+				continue
+			}
+		}
+		removed = append(removed, path)
+		bytes += info.Size()
+	}
+	return removed, bytes
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// tunables are the settings /api/reload can change while the server runs.
+// They are replaced as a whole, so a request sees one consistent set.
+type tunables struct {
+	imageWorkers       int
+	movieWorkers       int
+	thumbnailTimeout   time.Duration // per-request limit for thumbnail requests (0 = no limit)
+	maxFileTime        time.Duration // cap on generating or pre-transcoding one file (0 = no limit)
+	previewTimeout     time.Duration // per-request limit for preview requests (0 = no limit)
+	previewIdleTimeout time.Duration // kill a streamed transcode that stops producing output (0 = never)
+	previewQueueWait   time.Duration // how long a preview waits for a -max-previews slot (0 = 503 at once)
+	thumbnailSubsample string        // JPEG chroma subsampling for thumbnails: on, off or auto
+	progressiveJPEG    bool          // write progressive instead of baseline JPEG thumbnails
+	thumbnailMinBytes  int64         // smaller browser-native images are their own thumbnail (0 = off)
+	prefetchThumbnails bool          // queue a directory's missing thumbnails when it is listed
+	exposureStats      bool          // measure the exposure of image thumbnails for listings
+	cacheMaxBytes      int64         // evict least recently read cache files beyond this (0 = unlimited)
+	zipMaxBytes        int64         // cap on the originals in one /api/zip archive (0 = unlimited)
+}
+
+// settings returns the tunables in effect
+func (s *Server) settings() *tunables {
+	if live := s.live.Load(); live != nil {
+		return live
+	}
+	return &tunables{}
+}
+
+// reloadable are the flags /api/reload applies, each checking its new value
+// and setting it in the next tunables. -thumbnail-size isn't a tunable, it
+// is the size of defaultThumbnailVariant.
+var reloadable = map[string]func(next *tunables, value any) error{
+	"image-workers": func(next *tunables, value any) error {
+		next.imageWorkers = value.(int)
+		return atLeastOne(next.imageWorkers)
+	},
+	"movie-workers": func(next *tunables, value any) error {
+		next.movieWorkers = value.(int)
+		return atLeastOne(next.movieWorkers)
+	},
+	"thumbnail-timeout": func(next *tunables, value any) error {
+		next.thumbnailTimeout = value.(time.Duration)
+		return notNegative(next.thumbnailTimeout)
+	},
+	"max-file-time": func(next *tunables, value any) error {
+		next.maxFileTime = value.(time.Duration)
+		return notNegative(next.maxFileTime)
+	},
+	"preview-timeout": func(next *tunables, value any) error {
+		next.previewTimeout = value.(time.Duration)
+		return notNegative(next.previewTimeout)
+	},
+	"preview-idle-timeout": func(next *tunables, value any) error {
+		next.previewIdleTimeout = value.(time.Duration)
+		return notNegative(next.previewIdleTimeout)
+	},
+	"preview-queue-wait": func(next *tunables, value any) error {
+		next.previewQueueWait = value.(time.Duration)
+		return notNegative(next.previewQueueWait)
+	},
+	"thumbnail-subsample": func(next *tunables, value any) error {
+		next.thumbnailSubsample = value.(string)
+		switch next.thumbnailSubsample {
+		case "on", "off", "auto":
+			return nil
+		}
+		return fmt.Errorf("%q: must be on, off, or auto", next.thumbnailSubsample)
+	},
+	"thumbnail-progressive": func(next *tunables, value any) error {
+		next.progressiveJPEG = value.(bool)
+		return nil
+	},
+	"thumbnail-min-bytes": func(next *tunables, value any) error {
+		next.thumbnailMinBytes = value.(int64)
+		return notNegative(next.thumbnailMinBytes)
+	},
+	"prefetch-thumbnails": func(next *tunables, value any) error {
+		next.prefetchThumbnails = value.(bool)
+		return nil
+	},
+	"exposure-stats": func(next *tunables, value any) error {
+		next.exposureStats = value.(bool)
+		return nil
+	},
+	"cache-max-bytes": func(next *tunables, value any) error {
+		next.cacheMaxBytes = value.(int64)
+		return notNegative(next.cacheMaxBytes)
+	},
+	"zip-max-bytes": func(next *tunables, value any) error {
+		next.zipMaxBytes = value.(int64)
+		return notNegative(next.zipMaxBytes)
+	},
+	"thumbnail-size": func(next *tunables, value any) error {
+		return checkThumbnailSize(value.(int))
+	},
+}
+
+func atLeastOne(n int) error {
+	if n < 1 {
+		return fmt.Errorf("%d: must be at least 1", n)
+	}
+	return nil
+}
+
+func notNegative[T int64 | time.Duration](n T) error {
+	if n < 0 {
+		return fmt.Errorf("%v: must be >= 0", n)
+	}
+	return nil
+}
+
+// errNoConfigFile is returned by reloadConfig when there is nothing to reload
+var errNoConfigFile = errors.New("the server was started without -config")
+
+// configState is what /api/reload compares the -config file with
+type configState struct {
+	mu     sync.Mutex        // one reload at a time
+	path   string            // the -config file
+	flags  *flag.FlagSet     // the flags, for their types and defaults
+	given  map[string]bool   // flags given on the command line, which the file doesn't change
+	values map[string]string // the value of each flag in effect
+}
+
+// newConfigState notes the flags given on the command line. It is called
+// before the file is loaded, remember after.
+func newConfigState(flags *flag.FlagSet, path string) *configState {
+	c := &configState{path: path, flags: flags, given: make(map[string]bool)}
+	flags.Visit(func(f *flag.Flag) { c.given[f.Name] = true })
+	return c
+}
+
+// remember notes the value of every flag, before main adjusts any of them
+func (c *configState) remember() {
+	c.values = make(map[string]string)
+	c.flags.VisitAll(func(f *flag.Flag) { c.values[f.Name] = f.Value.String() })
+}
+
+// reloadResult reports the settings a reload changed
+type reloadResult struct {
+	Applied []string `json:"applied"` // in effect now
+	Restart []string `json:"restart"` // take effect on the next start
+}
+
+// reloadConfig reads -config again and applies the settings in reloadable
+// that changed. Flags given on the command line keep their value, and
+// settings no longer in the file go back to their default. Other changed
+// settings, such as -port or -root, are only reported. Nothing is applied
+// unless every changed setting is valid.
+func (s *Server) reloadConfig() (reloadResult, error) {
+	result := reloadResult{Applied: []string{}, Restart: []string{}}
+	c := s.config
+	if c == nil {
+		return result, errNoConfigFile
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	settings, err := readConfigFile(c.flags, c.path)
+	if err != nil {
+		return result, err
+	}
+
+	next := *s.settings()
+	changed := make(map[string]flag.Value)
+	c.flags.VisitAll(func(f *flag.Flag) {
+		if err != nil || f.Name == "config" || c.given[f.Name] {
+			return
+		}
+		setting, ok := settings[f.Name]
+		if !ok {
+			setting = f.DefValue
+		}
+		// A fresh value of the flag's own type, so "1m" and "60s" compare equal
+		value := reflect.New(reflect.TypeOf(f.Value).Elem()).Interface().(flag.Value)
+		if err = value.Set(setting); err != nil {
+			err = fmt.Errorf("%s: %s: %w", c.path, f.Name, err)
+			return
+		}
+		if value.String() == c.values[f.Name] {
+			return
+		}
+		apply, ok := reloadable[f.Name]
+		if !ok {
+			result.Restart = append(result.Restart, f.Name)
+			return
+		}
+		if err = apply(&next, value.(flag.Getter).Get()); err != nil {
+			err = fmt.Errorf("%s: %s: %w", c.path, f.Name, err)
+			return
+		}
+		result.Applied = append(result.Applied, f.Name)
+		changed[f.Name] = value
+	})
+	if err != nil {
+		return result, err
+	}
+
+	s.live.Store(&next)
+	s.resizeWorkers(next.imageWorkers, next.movieWorkers)
+	if size, ok := changed["thumbnail-size"]; ok {
+		variant := defaultThumbnailVariant()
+		variant.size = size.(flag.Getter).Get().(int)
+		defaultVariant.Store(&variant)
+	}
+	for name, value := range changed {
+		c.values[name] = value.String()
+	}
+	return result, nil
+}
+
+// handleReload applies the changes to the -config file, see reloadConfig.
+// It changes how the server runs, so it needs -auth-user, -htpasswd or
+// -auth-token.
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authRequired {
+		http.Error(w, "Reloading needs -auth-user, -htpasswd or -auth-token", http.StatusForbidden)
+		return
+	}
+
+	result, err := s.reloadConfig()
+	if errors.Is(err, errNoConfigFile) {
+		http.Error(w, "Server was started without -config", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		respondJSON(w, map[string]interface{}{
+			"error": err.Error(),
+		}, http.StatusBadRequest)
+		return
+	}
+	log.Printf("Reloaded %s: applied %v, needing a restart %v", s.config.path, result.Applied, result.Restart)
+	respondJSON(w, result, http.StatusOK)
+}
+
+// resizeWorkers starts or retires thumbnail workers until images and movies
+// of them run. A retired worker finishes its job first, so nothing queued
+// is lost.
+func (s *Server) resizeWorkers(images, movies int) {
+	s.workersMu.Lock()
+	defer s.workersMu.Unlock()
+	if s.retireImageWorker == nil {
+		s.retireImageWorker = make(chan struct{})
+		s.retireMovieWorker = make(chan struct{})
+	}
+	for ; s.imageWorkersRunning < images; s.imageWorkersRunning++ {
+		s.imageWorkersWg.Add(1)
+		go s.imageThumbnailWorker(s.imageWorkersRunning)
+	}
+	for ; s.imageWorkersRunning > images; s.imageWorkersRunning-- {
+		go s.retireWorker(s.retireImageWorker)
+	}
+	for ; s.movieWorkersRunning < movies; s.movieWorkersRunning++ {
+		s.movieWorkersWg.Add(1)
+		go s.movieThumbnailWorker(s.movieWorkersRunning)
+	}
+	for ; s.movieWorkersRunning > movies; s.movieWorkersRunning-- {
+		go s.retireWorker(s.retireMovieWorker)
+	}
+}
+
+// retireWorker stops one worker of a pool once it is between jobs
+func (s *Server) retireWorker(retire chan struct{}) {
+	select {
+	case retire <- struct{}{}:
+	case <-s.baseCtx.Done():
+	}
+}
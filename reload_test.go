@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// reloadableTestServer starts a server from a -config file holding settings
+func reloadableTestServer(t *testing.T, settings string) (*Server, string) {
+	t.Helper()
+	s := newTestServer(t)
+	s.authRequired = true
+	flags := flag.NewFlagSet("gallery", flag.ContinueOnError)
+	flags.String("config", "", "")
+	flags.String("port", "8080", "")
+	flags.Int("image-workers", 2, "")
+	flags.Duration("thumbnail-timeout", 0, "")
+	flags.Int("thumbnail-size", defaultThumbnailSize, "")
+	configPath := filepath.Join(t.TempDir(), "gallery.json")
+	if err := os.WriteFile(configPath, []byte(settings), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.config = newConfigState(flags, configPath)
+	if err := loadConfigFile(flags, configPath); err != nil {
+		t.Fatal(err)
+	}
+	s.config.remember()
+	s.live.Store(&tunables{imageWorkers: 1})
+	t.Cleanup(func() {
+		s.resizeWorkers(0, 0)
+		defaultVariant.Store(nil)
+	})
+	return s, configPath
+}
+
+func TestReloadAppliesLiveSettings(t *testing.T) {
+	s, configPath := reloadableTestServer(t, `{"image-workers": 1, "thumbnail-timeout": "1m"}`)
+	if err := os.WriteFile(configPath, []byte(`{"image-workers": 3, "thumbnail-timeout": "60s", "port": "9090", "thumbnail-size": 600}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	s.newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/reload", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var result reloadResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(result.Applied)
+	if !slices.Equal(result.Applied, []string{"image-workers", "thumbnail-size"}) {
+		t.Errorf("applied %v, want image-workers and thumbnail-size", result.Applied)
+	}
+	if !slices.Equal(result.Restart, []string{"port"}) {
+		t.Errorf("restart %v, want port", result.Restart)
+	}
+	if s.settings().imageWorkers != 3 || s.imageWorkersRunning != 3 {
+		t.Errorf("%d image workers running of %d, want 3", s.imageWorkersRunning, s.settings().imageWorkers)
+	}
+	if size := defaultThumbnailVariant().size; size != 600 {
+		t.Errorf("default thumbnail size %d, want 600", size)
+	}
+}
+
+func TestReloadRejectsInvalidSettings(t *testing.T) {
+	s, configPath := reloadableTestServer(t, `{}`)
+	if err := os.WriteFile(configPath, []byte(`{"thumbnail-timeout": "5s", "image-workers": 0}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	s.newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/reload", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400", rec.Code)
+	}
+	if timeout := s.settings().thumbnailTimeout; timeout != 0 {
+		t.Errorf("thumbnail timeout %s applied from an invalid file", timeout)
+	}
+	if s.imageWorkersRunning != 0 {
+		t.Errorf("invalid reload started %d image workers", s.imageWorkersRunning)
+	}
+}
+
+func TestReloadNeedsAuth(t *testing.T) {
+	s, _ := reloadableTestServer(t, `{}`)
+	s.authRequired = false
+
+	rec := httptest.NewRecorder()
+	s.newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/reload", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("status %d without auth, want 403", rec.Code)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// setupLogging makes every log line, the request log and the log.Printf
+// messages alike, go through slog in the -log-format: text or json
+func setupLogging(format string) error {
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, nil)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, nil)
+	default:
+		return fmt.Errorf("must be text or json, got %q", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// statusRecorder remembers the status and size of a response for the
+// request log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(p []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(p)
+	sr.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps the sendfile path of the underlying writer for served files
+func (sr *statusRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := io.Copy(sr.ResponseWriter, src)
+	sr.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the connection, for flushes
+// and write deadlines of streamed previews
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// metricMethod is the method label of a request. Clients can send any
+// method, so unknown ones share a label.
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return method
+	}
+	return "other"
+}
+
+// logRequests wraps a handler so that every request is logged when it is
+// done, and counted in the request metrics. Only the path is logged, as the
+// query may carry an auth token. Requests are labeled in the metrics by the
+// route that served them rather than by path, so file names don't end up
+// in them.
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sr, r)
+		duration := time.Since(started)
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+
+		// The mux records its pattern on the request it was given; requests
+		// turned away before it, e.g. without credentials, have none
+		route := r.Pattern
+		if route == "" {
+			route = "none"
+		}
+		s.metrics.requests.inc(metricLabels("handler", route, "method", metricMethod(r.Method), "code", fmt.Sprint(sr.status)))
+		s.metrics.requestDuration.observe(metricLabels("handler", route), duration)
+		slog.LogAttrs(r.Context(), slog.LevelInfo, "request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("client", clientIP(r)),
+			slog.Int("status", sr.status),
+			slog.Int64("bytes", sr.bytes),
+			slog.Duration("duration", duration),
+		)
+	})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// breadcrumb is one directory on the way from the root to a file
+type breadcrumb struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// resolveResponse locates a file within its directory listing
+type resolveResponse struct {
+	Path        string       `json:"path"` // the file, or the Live Photo image or JPEG it belongs to
+	Directory   string       `json:"directory"`
+	Breadcrumbs []breadcrumb `json:"breadcrumbs"`
+	Index       int          `json:"index"`      // position in /api/list of the directory
+	ImageIndex  int          `json:"imageIndex"` // position among its images, -1 if not an image
+	Total       int          `json:"total"`
+	Previous    string       `json:"previous,omitempty"` // neighbouring files, directories skipped
+	Next        string       `json:"next,omitempty"`
+}
+
+// handleResolve finds where a file appears in the gallery: its directory,
+// breadcrumbs and position in the listing (honouring ?sort=manual), so a
+// deep link can open the right folder with the lightbox on the right image.
+// ?pairs=0, ?kind=, ?sort= and ?order= resolve against the listing /api/list
+// gives for them.
+func (s *Server) handleResolve(w http.ResponseWriter, r *http.Request) {
+	filePath := r.URL.Query().Get("path")
+	if filePath == "" {
+		http.Error(w, "Path query parameter required", http.StatusBadRequest)
+		return
+	}
+	sortOrder, ok := listSortFor(r)
+	if !ok {
+		http.Error(w, "Invalid sort or order", http.StatusBadRequest)
+		return
+	}
+	kind := r.URL.Query().Get("kind")
+	if kind != "" && !validMediaKind(kind) {
+		http.Error(w, "Invalid kind", http.StatusBadRequest)
+		return
+	}
+	fullPath, ok := s.resolvePath(filePath)
+	if !ok {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+	filePath = s.urlPathFor(fullPath)
+	if filePath == "/" || s.isExcludedPath(filePath) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if info, err := s.store.Stat(r.Context(), fullPath); err != nil || info.IsDir() {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	dir := path.Dir(filePath)
+	fullDir, _ := s.resolvePath(dir)
+	entries, err := s.store.ReadDir(r.Context(), fullDir)
+	if err != nil {
+		http.Error(w, "Directory not found", http.StatusNotFound)
+		return
+	}
+
+	// The same entries, pairing, filter and order as handleList
+	opts := &listOptions{kind: kind, unpaired: r.URL.Query().Get("pairs") == "0"}
+	var files []FileInfo
+	for _, entry := range entries {
+		if fileInfo, ok := s.listEntry(r.Context(), fullDir, dir, entry, opts); ok {
+			files = append(files, fileInfo)
+		}
+	}
+	if !opts.unpaired {
+		files = s.pairFiles(files)
+	}
+	if kind != "" {
+		files = filterMediaKind(files, kind)
+	}
+	if sortOrder == "" {
+		sortOrder = s.dirConfigFor(fullDir).Sort
+	}
+	sortListing(files, fullDir, sortOrder)
+
+	// A Live Photo movie or paired RAW file isn't listed, it opens with its
+	// image
+	stream := s.urlWithBasePath("/api/file.m3u8?path=" + url.QueryEscape(filePath))
+	index, imageIndex, images := -1, -1, 0
+	for i, file := range files {
+		if file.Path == filePath || (file.CanonicalMovie != "" && file.CanonicalMovie == stream) || file.RawPath == filePath {
+			index = i
+			if file.IsImage {
+				imageIndex = images
+			}
+			break
+		}
+		if file.IsImage {
+			images++
+		}
+	}
+	if index < 0 {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	response := resolveResponse{
+		Path:        files[index].Path,
+		Directory:   dir,
+		Breadcrumbs: breadcrumbsFor(dir),
+		Index:       index,
+		ImageIndex:  imageIndex,
+		Total:       len(files),
+	}
+	for i := index - 1; i >= 0; i-- {
+		if !files[i].IsDir {
+			response.Previous = files[i].Path
+			break
+		}
+	}
+	for i := index + 1; i < len(files); i++ {
+		if !files[i].IsDir {
+			response.Next = files[i].Path
+			break
+		}
+	}
+	respondJSON(w, response, http.StatusOK)
+}
+
+// breadcrumbsFor returns the directories from the root down to dir
+func breadcrumbsFor(dir string) []breadcrumb {
+	crumbs := []breadcrumb{{Name: "/", Path: "/"}}
+	current := ""
+	for _, part := range strings.Split(strings.Trim(dir, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		current += "/" + part
+		crumbs = append(crumbs, breadcrumb{Name: part, Path: current})
+	}
+	return crumbs
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// partialUploadsDirName is the directory under the root that resumable
+// uploads collect in until they are complete. It is hidden like .trash and
+// on the same file system as the tree, so a finished upload is renamed into
+// place.
+const partialUploadsDirName = ".uploads"
+
+// partialUploadMaxAge is how long an upload may rest before it is given up
+const partialUploadMaxAge = 24 * time.Hour
+
+var (
+	errPartialUploadOffset = errors.New("offset doesn't match the bytes received")
+	errPartialUploadLength = errors.New("more bytes than the upload announced")
+	errPartialUploadBusy   = errors.New("upload is being written by another request")
+)
+
+// partialUpload is what is stored next to the bytes of a resumable upload
+// to finish it with
+type partialUpload struct {
+	Path      string `json:"path"`
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	Overwrite bool   `json:"overwrite"`
+}
+
+// partialUploadResponse reports how far a resumable upload got
+type partialUploadResponse struct {
+	ID     string `json:"id"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
+
+// handleUploads serves resumable uploads, see -writable, for large movies
+// sent over connections that drop. POST /api/uploads?path=&name=&size=
+// starts one and answers its id. PATCH /api/uploads/<id> appends the body
+// at the Upload-Offset header, which must be the number of bytes received
+// so far; HEAD or GET tell that number after an interruption. The request
+// that completes the upload moves it into place and answers like
+// /api/upload. DELETE gives an upload up.
+func (s *Server) handleUploads(w http.ResponseWriter, r *http.Request) {
+	if !s.writable {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !sameOriginRequest(r) {
+		s.uploadFailed(w, errUploadCrossSite)
+		return
+	}
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/uploads"), "/")
+	if id == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.startPartialUpload(w, r)
+		return
+	}
+	if raw, err := hex.DecodeString(id); err != nil || len(raw) != 16 {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	// Only uploads that exist get a lock, so made-up ids leave nothing behind
+	dataPath := filepath.Join(s.rootDir, partialUploadsDirName, id)
+	if _, err := os.Stat(dataPath + ".json"); err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	// One request at a time writes an upload; a client retrying while its
+	// earlier request still runs learns the offset once that one ends
+	value, _ := s.partialUploadLocks.LoadOrStore(id, new(sync.Mutex))
+	lock := value.(*sync.Mutex)
+	if !lock.TryLock() {
+		s.uploadFailed(w, errPartialUploadBusy)
+		return
+	}
+	defer lock.Unlock()
+
+	// The upload may have been finished or given up meanwhile
+	upload, err := readPartialUpload(dataPath)
+	if err != nil {
+		s.partialUploadLocks.Delete(id)
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	info, err := os.Stat(dataPath)
+	if err != nil {
+		s.partialUploadLocks.Delete(id)
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	offset := info.Size()
+
+	switch r.Method {
+	case http.MethodHead, http.MethodGet:
+		setUploadOffset(w, offset, upload.Size)
+		w.Header().Set("Cache-Control", "no-store")
+		respondJSON(w, partialUploadResponse{ID: id, Offset: offset, Size: upload.Size}, http.StatusOK)
+	case http.MethodPatch:
+		s.appendPartialUpload(w, r, id, dataPath, upload, offset)
+	case http.MethodDelete:
+		removePartialUpload(dataPath)
+		s.partialUploadLocks.Delete(id)
+		log.Printf("Gave up upload of %s to %s", upload.Name, upload.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// startPartialUpload checks where a resumable upload goes and sets aside
+// an empty file for its bytes
+func (s *Server) startPartialUpload(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	dir, err := s.uploadDir(query.Get("path"))
+	if err != nil {
+		s.uploadFailed(w, err)
+		return
+	}
+	name, err := s.uploadName(query.Get("name"))
+	if err != nil {
+		s.uploadFailed(w, err)
+		return
+	}
+	size, err := strconv.ParseInt(query.Get("size"), 10, 64)
+	if err != nil || size < 0 {
+		http.Error(w, "Invalid size parameter", http.StatusBadRequest)
+		return
+	}
+	if s.uploadMaxBytes > 0 && size > s.uploadMaxBytes {
+		s.uploadFailed(w, errUploadTooLarge)
+		return
+	}
+	overwrite := query.Get("overwrite") == "1"
+	if !overwrite {
+		if _, err := os.Lstat(filepath.Join(dir, name)); err == nil {
+			s.uploadFailed(w, errUploadExists)
+			return
+		}
+	}
+
+	partials := filepath.Join(s.rootDir, partialUploadsDirName)
+	if err := os.MkdirAll(partials, 0755); err != nil {
+		s.uploadFailed(w, err)
+		return
+	}
+	prunePartialUploads(partials)
+
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		s.uploadFailed(w, err)
+		return
+	}
+	id := hex.EncodeToString(raw)
+	dataPath := filepath.Join(partials, id)
+	upload := partialUpload{Path: s.urlPathFor(dir), Name: name, Size: size, Overwrite: overwrite}
+	meta, _ := json.Marshal(upload)
+	if err := os.WriteFile(dataPath+".json", meta, 0644); err != nil {
+		s.uploadFailed(w, err)
+		return
+	}
+	if err := os.WriteFile(dataPath, nil, 0644); err != nil {
+		removePartialUpload(dataPath)
+		s.uploadFailed(w, err)
+		return
+	}
+
+	w.Header().Set("Location", s.basePath+"/api/uploads/"+id)
+	setUploadOffset(w, 0, size)
+	respondJSON(w, partialUploadResponse{ID: id, Offset: 0, Size: size}, http.StatusCreated)
+}
+
+// appendPartialUpload writes the body of a PATCH at offset, and finishes
+// the upload once all its bytes are in. What arrived of an interrupted body
+// is kept for the next attempt to continue from. A body that can't be
+// written, e.g. to a full disk, is answered with the offset reached.
+func (s *Server) appendPartialUpload(w http.ResponseWriter, r *http.Request, id, dataPath string, upload partialUpload, offset int64) {
+	claimed, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || claimed != offset {
+		setUploadOffset(w, offset, upload.Size)
+		s.uploadFailed(w, errPartialUploadOffset)
+		return
+	}
+	file, err := os.OpenFile(dataPath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		s.uploadFailed(w, err)
+		return
+	}
+	dst := &uploadWriter{w: file}
+	written, copyErr := io.Copy(dst, io.LimitReader(r.Body, upload.Size-offset))
+	closeErr := file.Close()
+	offset += written
+	if writeErr := cmp.Or(dst.err, closeErr); writeErr != nil {
+		// A short write may have left part of a chunk behind
+		if info, err := os.Stat(dataPath); err == nil {
+			offset = info.Size()
+		}
+		setUploadOffset(w, offset, upload.Size)
+		s.uploadFailed(w, writeErr)
+		return
+	}
+	if copyErr != nil {
+		log.Printf("Upload of %s to %s interrupted at %d of %d bytes: %v", upload.Name, upload.Path, offset, upload.Size, copyErr)
+		return
+	}
+	if n, _ := r.Body.Read(make([]byte, 1)); n > 0 {
+		os.Truncate(dataPath, offset-written)
+		setUploadOffset(w, offset-written, upload.Size)
+		s.uploadFailed(w, errPartialUploadLength)
+		return
+	}
+	if offset < upload.Size {
+		setUploadOffset(w, offset, upload.Size)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// The directory may have gone, or been hidden, since the upload started
+	dir, err := s.uploadDir(upload.Path)
+	if err != nil {
+		s.uploadFailed(w, err)
+		return
+	}
+	info, err := s.finishUpload(r.Context(), dataPath, dir, upload.Name, upload.Overwrite)
+	if err != nil {
+		s.uploadFailed(w, err)
+		return
+	}
+	removePartialUpload(dataPath)
+	s.partialUploadLocks.Delete(id)
+	respondJSON(w, uploadResponse{Files: []FileInfo{info}}, http.StatusCreated)
+}
+
+// uploadWriter keeps the error of writing an upload apart from that of
+// reading the request body
+type uploadWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (uw *uploadWriter) Write(p []byte) (int, error) {
+	n, err := uw.w.Write(p)
+	if err != nil {
+		uw.err = err
+	}
+	return n, err
+}
+
+// setUploadOffset tells the client how far an upload got
+func setUploadOffset(w http.ResponseWriter, offset, size int64) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(size, 10))
+}
+
+// readPartialUpload reads what is stored about the upload at dataPath
+func readPartialUpload(dataPath string) (partialUpload, error) {
+	var upload partialUpload
+	data, err := os.ReadFile(dataPath + ".json")
+	if err != nil {
+		return upload, err
+	}
+	err = json.Unmarshal(data, &upload)
+	return upload, err
+}
+
+// removePartialUpload removes the bytes of an upload and what is stored
+// about it
+func removePartialUpload(dataPath string) {
+	os.Remove(dataPath)
+	os.Remove(dataPath + ".json")
+}
+
+// prunePartialUploads gives up the uploads in dir that haven't grown for
+// partialUploadMaxAge
+func prunePartialUploads(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < partialUploadMaxAge {
+			continue
+		}
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			removePartialUpload(filepath.Join(dir, entry.Name()))
+			log.Printf("Gave up upload %s, untouched since %s", entry.Name(), info.ModTime().Format(time.RFC3339))
+		}
+	}
+}
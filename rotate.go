@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// previewRotation is a clockwise turn asked for with ?rotate= on an image
+// preview, for files whose orientation metadata is wrong. It is applied
+// after the EXIF orientation and never reaches the cached thumbnails.
+type previewRotation struct {
+	degrees     int
+	angle       string // vips rot angle
+	orientation int    // the EXIF orientation that turns the same way, for in-process previews
+}
+
+// previewRotations are the turns allowed with ?rotate=
+var previewRotations = map[string]previewRotation{
+	"90":  {90, "d90", 6},
+	"180": {180, "d180", 3},
+	"270": {270, "d270", 8},
+}
+
+// previewRotationFor returns the turn a preview request asks for, the zero
+// value for none, reporting false for an invalid one
+func previewRotationFor(r *http.Request) (previewRotation, bool) {
+	param := r.URL.Query().Get("rotate")
+	if param == "" || param == "0" {
+		return previewRotation{}, true
+	}
+	rot, ok := previewRotations[param]
+	return rot, ok
+}
+
+// etagSuffix tells previews turned differently apart
+func (rot previewRotation) etagSuffix() string {
+	if rot.degrees == 0 {
+		return ""
+	}
+	return "-r" + strconv.Itoa(rot.degrees)
+}
+
+// rotatedPreview renders a preview of src turned by rot to out, where input
+// is the vipsthumbnail argument for stdin. vipsthumbnail can only rotate by
+// the EXIF orientation, so the resized image goes through a temporary file
+// that vips then turns.
+func (s *Server) rotatedPreview(ctx context.Context, src io.Reader, input string, size int, rot previewRotation, output string, out io.Writer) error {
+	dir, err := os.MkdirTemp("", "gallery-preview-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	basePath := filepath.Join(dir, "base.v")
+	args := append([]string{input, vipsAutoRotate, "-s", strconv.Itoa(size), "-o", basePath}, s.colorProfileArgs()...)
+	cmd := s.runner.command(ctx, vipsExecutable(), args...)
+	cmd.Stdin = src
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to resize image: %w", err)
+	}
+	return rotateVipsImage(ctx, s.runner, basePath, output, rot, out)
+}
+
+// rotateVipsImage turns the image at path by rot and saves it to output,
+// a file or a suffix for out
+func rotateVipsImage(ctx context.Context, runner commandRunner, path, output string, rot previewRotation, out io.Writer) error {
+	cmd := runner.command(ctx, vipsCLIExecutable(), "rot", path, output, rot.angle)
+	cmd.Stdout = out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to rotate image: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// handlerOptions are the flags that put middleware around the handlers
+type handlerOptions struct {
+	maxRequests int         // -max-requests, 0 for no limit
+	readOnly    bool        // -read-only
+	auth        *authConfig // -auth-user, -htpasswd or -auth-token, nil for none
+}
+
+// newHandler returns the gallery's handlers with all their middleware,
+// reachable both at their bare paths and below -base-path. It is what main
+// serves, so tests that go through it see what clients do.
+func (s *Server) newHandler(opts handlerOptions) http.Handler {
+	var handler http.Handler = s.newMux()
+	if opts.maxRequests > 0 {
+		handler = limitConcurrency(handler, opts.maxRequests)
+	}
+	if opts.readOnly {
+		handler = readOnly(handler)
+	}
+	// Outermost, so nothing is done for requests without credentials
+	if opts.auth != nil {
+		s.authRequired = true
+		handler = s.requireAuth(handler, *opts.auth)
+	}
+	// Before the rest, which then sees the same paths with and without it
+	handler = s.stripBasePath(handler)
+	// Around everything, so refused requests are logged too
+	return s.logRequests(handler)
+}
+
+// newMux registers the handlers at their bare paths, without middleware
+func (s *Server) newMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleIndex)
+	mux.HandleFunc("/api/list", s.handleList)
+	mux.HandleFunc("/api/thumbnail/", s.rateLimited(s.handleThumbnail))
+	mux.HandleFunc("/api/t/", s.rateLimited(s.handleHashedThumbnail))
+	mux.HandleFunc("/api/thumbnail-exists", s.handleThumbnailExists)
+	mux.HandleFunc("/api/thumbnails/warm", s.handleWarmThumbnails)
+	mux.HandleFunc("/api/preview/", s.rateLimited(s.handlePreview))
+	mux.HandleFunc("/api/file.ts", s.rateLimited(s.handleFileTS))
+	mux.HandleFunc("/api/file.m3u8", s.rateLimited(s.handleM3U8))
+	mux.HandleFunc("/api/feed", s.handleFeed)
+	mux.HandleFunc("/api/prune", s.handlePrune)
+	mux.HandleFunc("/api/cache", s.handleCache)
+	mux.HandleFunc("/api/rebuild", s.handleRebuild)
+	mux.HandleFunc("/api/index.json", s.handleMediaIndex)
+	mux.HandleFunc("/api/export.csv", s.handleExportCSV)
+	mux.HandleFunc("/api/slideshow", s.handleSlideshow)
+	mux.HandleFunc("/api/random", s.handleRandom)
+	mux.HandleFunc("/api/search", s.handleSearch)
+	mux.HandleFunc("/api/order", s.handleOrder)
+	mux.HandleFunc("/api/resolve", s.handleResolve)
+	mux.HandleFunc("/api/compare", s.handleCompare)
+	mux.HandleFunc("/api/contact-sheet", s.handleContactSheet)
+	mux.HandleFunc("/api/config", s.handleConfig)
+	mux.HandleFunc("/api/reload", s.handleReload)
+	mux.HandleFunc("/api/status", s.handleStatus)
+	mux.HandleFunc("/api/pregen/status", s.handlePregenStatus)
+	mux.HandleFunc("/api/favorites", s.handleFavorites)
+	mux.HandleFunc("/static/", s.handleStatic)
+	mux.HandleFunc("/api/download/", s.handleDownload)
+	mux.HandleFunc("/api/zip", s.handleZip)
+	mux.HandleFunc("/api/upload", s.handleUpload)
+	mux.HandleFunc("/api/uploads", s.handleUploads)
+	mux.HandleFunc("/api/uploads/", s.handleUploads)
+	mux.HandleFunc("/api/file/", s.handleDeleteFile)
+	mux.HandleFunc("/api/trash", s.handleTrash)
+	mux.HandleFunc("/api/trash/restore", s.handleTrashRestore)
+	mux.HandleFunc("/api/info/", s.handleInfo)
+	mux.HandleFunc("/assets/", s.handleAssets)
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	return mux
+}
+
+// stripBasePath serves requests below -base-path as if it weren't there,
+// for reverse proxies that forward the prefix instead of stripping it.
+// Requests without it are served as they are, for proxies that strip it.
+// Without a base path next is returned as it is.
+func (s *Server) stripBasePath(next http.Handler) http.Handler {
+	if s.basePath == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest, ok := strings.CutPrefix(r.URL.Path, s.basePath)
+		if !ok || (rest != "" && rest[0] != '/') {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if rest == "" {
+			rest = "/"
+		}
+		stripped := new(http.Request)
+		*stripped = *r
+		stripped.URL = new(url.URL)
+		*stripped.URL = *r.URL
+		stripped.URL.Path = rest
+		stripped.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, s.basePath)
+		next.ServeHTTP(w, stripped)
+		// The request log labels requests by the route that served them
+		r.Pattern = stripped.Pattern
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// serve sends one request through the handler main serves
+func serve(t *testing.T, handler http.Handler, method, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+	return rec
+}
+
+func TestListThroughHandler(t *testing.T) {
+	s := newTestServer(t)
+	writeTestJPEG(t, s, "trip/a.jpg", 40, 20)
+	writeTestFile(t, s, "trip/.hidden.jpg", []byte("hidden"))
+	handler := s.newHandler(handlerOptions{maxRequests: 4})
+
+	rec := serve(t, handler, http.MethodGet, "/api/list?path=/trip")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var listing struct {
+		Files []FileInfo `json:"files"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &listing); err != nil {
+		t.Fatal(err)
+	}
+	if len(listing.Files) != 1 || listing.Files[0].Name != "a.jpg" || !listing.Files[0].IsImage {
+		t.Errorf("listed %+v, want only the image a.jpg", listing.Files)
+	}
+	if rec := serve(t, handler, http.MethodGet, "/api/list?path=/trip&sort=size&order=sideways"); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid order: status %d, want 400", rec.Code)
+	}
+}
+
+func TestEncodedTraversalIsRefused(t *testing.T) {
+	s := newTestServer(t)
+	s.basePath = "/gallery"
+	writeTestJPEG(t, s, "a.jpg", 40, 20)
+	// Right next to the root, one ..%2f away
+	secret := filepath.Join(filepath.Dir(s.rootDir), "secret.jpg")
+	if err := os.WriteFile(secret, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	handler := s.newHandler(handlerOptions{})
+
+	for _, prefix := range []string{"", "/gallery"} {
+		for _, target := range []string{
+			"/static/..%2fsecret.jpg",
+			"/api/download/..%2fsecret.jpg",
+			"/api/download/%2e%2e%2fsecret.jpg",
+			"/api/thumbnail/..%2fsecret.jpg",
+			"/api/preview/..%2fsecret.jpg",
+			"/api/info/..%2fsecret.jpg",
+			"/api/list?path=..%2f",
+		} {
+			rec := serve(t, handler, http.MethodGet, prefix+target)
+			if rec.Code == http.StatusOK || strings.Contains(rec.Body.String(), "secret") {
+				t.Errorf("%s: status %d, want it refused", prefix+target, rec.Code)
+			}
+		}
+	}
+}
+
+func TestBasePathRouting(t *testing.T) {
+	s := newTestServer(t)
+	s.basePath = "/gallery"
+	s.indexTmpl = template.Must(template.New("index").Parse("index below {{.BasePath}}"))
+	writeTestJPEG(t, s, "a.jpg", 40, 20)
+	handler := s.newHandler(handlerOptions{readOnly: true, auth: &authConfig{token: "sesame"}})
+
+	for _, test := range []struct {
+		method, target string
+		want           int
+	}{
+		// Proxies that forward the prefix and proxies that strip it
+		{http.MethodGet, "/gallery/api/list?path=/&token=sesame", http.StatusOK},
+		{http.MethodGet, "/api/list?path=/&token=sesame", http.StatusOK},
+		{http.MethodGet, "/gallery/api/download/a.jpg?token=sesame", http.StatusOK},
+		// Auth and read-only apply below the base path too
+		{http.MethodGet, "/gallery/api/list?path=/", http.StatusUnauthorized},
+		{http.MethodGet, "/gallery/healthz", http.StatusOK},
+		{http.MethodPost, "/gallery/api/prune?token=sesame", http.StatusForbidden},
+	} {
+		rec := serve(t, handler, test.method, test.target)
+		if rec.Code != test.want {
+			t.Errorf("%s %s: status %d, want %d", test.method, test.target, rec.Code, test.want)
+		}
+	}
+	if body := serve(t, handler, http.MethodGet, "/gallery/?token=sesame").Body.String(); body != "index below /gallery" {
+		t.Errorf("index page %q, want it below /gallery", body)
+	}
+	// Only a whole path component is the base path, others get the page
+	if body := serve(t, handler, http.MethodGet, "/galleryapi/download/a.jpg?token=sesame").Body.String(); !strings.HasPrefix(body, "index below") {
+		t.Errorf("/galleryapi/download served %q", body)
+	}
+}
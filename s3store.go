@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3PresignExpiry is how long URLs handed to ffmpeg stay valid
+const s3PresignExpiry = time.Hour
+
+// s3Store serves media from an S3 compatible object store. Objects are
+// addressed path-style (endpoint/bucket/key) which works with AWS as well as
+// MinIO and similar servers. Requests are signed with AWS Signature V4.
+type s3Store struct {
+	root         string // local root that full paths are relative to
+	endpoint     *url.URL
+	bucket       string
+	prefix       string // key prefix, empty or ending in "/"
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	client       *http.Client
+}
+
+// s3FileInfo describes an object or a common prefix ("directory")
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+func (fi s3FileInfo) Name() string       { return fi.name }
+func (fi s3FileInfo) Size() int64        { return fi.size }
+func (fi s3FileInfo) ModTime() time.Time { return fi.modTime }
+func (fi s3FileInfo) IsDir() bool        { return fi.isDir }
+func (fi s3FileInfo) Sys() any           { return nil }
+
+func (fi s3FileInfo) Mode() fs.FileMode {
+	if fi.isDir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// newS3Store creates a store for the given bucket. Credentials are taken from
+// the standard AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+// environment variables.
+func newS3Store(root, endpoint, bucket, prefix, region string, getenv func(string) string) (*s3Store, error) {
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil || endpointURL.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+	}
+
+	prefix = strings.Trim(prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	store := &s3Store{
+		root:         root,
+		endpoint:     endpointURL,
+		bucket:       bucket,
+		prefix:       prefix,
+		region:       region,
+		accessKey:    getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: getenv("AWS_SESSION_TOKEN"),
+		client:       &http.Client{},
+	}
+	if store.accessKey == "" || store.secretKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	return store, nil
+}
+
+// key maps a full path under the local root to an object key
+func (s *s3Store) key(fullPath string) string {
+	rel, err := filepath.Rel(s.root, fullPath)
+	if err != nil || rel == "." {
+		return s.prefix
+	}
+	return s.prefix + filepath.ToSlash(rel)
+}
+
+// objectURL returns the URL of an object (or of the bucket for an empty key)
+func (s *s3Store) objectURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(s.endpoint.Path, "/") + "/" + s.bucket
+	u.RawPath = strings.TrimSuffix(s.endpoint.EscapedPath(), "/") + "/" + s3Escape(s.bucket, false)
+	if key != "" {
+		u.Path += "/" + key
+		u.RawPath += "/" + s3Escape(key, false)
+	}
+	u.RawQuery = s3CanonicalQuery(query)
+	return &u
+}
+
+func (s *s3Store) ReadDir(ctx context.Context, fullPath string) ([]fs.DirEntry, error) {
+	prefix := s.key(fullPath)
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	var entries []fs.DirEntry
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}, "delimiter": {"/"}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		result, err := s.list(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, p := range result.CommonPrefixes {
+			name := strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/")
+			if name != "" {
+				entries = append(entries, fs.FileInfoToDirEntry(s3FileInfo{name: name, isDir: true}))
+			}
+		}
+		for _, c := range result.Contents {
+			name := strings.TrimPrefix(c.Key, prefix)
+			// Skip the directory marker objects some tools create
+			if name == "" || strings.HasSuffix(name, "/") {
+				continue
+			}
+			entries = append(entries, fs.FileInfoToDirEntry(s3FileInfo{name: name, size: c.Size, modTime: c.LastModified}))
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	if len(entries) == 0 && prefix != s.prefix {
+		return nil, &fs.PathError{Op: "readdir", Path: fullPath, Err: fs.ErrNotExist}
+	}
+
+	// Match os.ReadDir, which returns entries sorted by name
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (s *s3Store) Stat(ctx context.Context, fullPath string) (fs.FileInfo, error) {
+	key := s.key(fullPath)
+	name := path.Base(key)
+	if key == s.prefix {
+		return s3FileInfo{name: "/", isDir: true}, nil
+	}
+
+	resp, err := s.do(ctx, http.MethodHead, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+		return s3FileInfo{name: name, size: resp.ContentLength, modTime: modTime}, nil
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		return nil, fmt.Errorf("S3 HEAD %s: %s", key, resp.Status)
+	}
+
+	// No such object, but it may be a "directory" holding other objects
+	result, err := s.list(ctx, url.Values{"list-type": {"2"}, "prefix": {key + "/"}, "max-keys": {"1"}})
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Contents) > 0 || len(result.CommonPrefixes) > 0 {
+		return s3FileInfo{name: name, isDir: true}, nil
+	}
+	return nil, &fs.PathError{Op: "stat", Path: fullPath, Err: fs.ErrNotExist}
+}
+
+func (s *s3Store) Open(ctx context.Context, fullPath string) (io.ReadCloser, error) {
+	key := s.key(fullPath)
+	resp, err := s.do(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, &fs.PathError{Op: "open", Path: fullPath, Err: fs.ErrNotExist}
+		}
+		return nil, fmt.Errorf("S3 GET %s: %s", key, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// ServeFile proxies the object to the client, passing range and conditional
+// headers through so S3 does the partial and 304 handling
+func (s *s3Store) ServeFile(w http.ResponseWriter, r *http.Request, fullPath string) {
+	header := http.Header{}
+	for _, h := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"} {
+		if v := r.Header.Get(h); v != "" {
+			header.Set(h, v)
+		}
+	}
+
+	resp, err := s.do(r.Context(), r.Method, s.key(fullPath), nil, header)
+	if err != nil {
+		http.Error(w, "Failed to fetch file", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, h := range []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges", "ETag", "Last-Modified"} {
+		// A content type chosen by the caller wins over the object's metadata
+		if h == "Content-Type" && w.Header().Get(h) != "" {
+			continue
+		}
+		if v := resp.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// Locate returns a presigned URL, which ffmpeg can read over HTTP(S)
+func (s *s3Store) Locate(ctx context.Context, fullPath string) (string, error) {
+	return s.presign(s.key(fullPath), time.Now().UTC(), s3PresignExpiry), nil
+}
+
+// list runs a ListObjectsV2 request on the bucket
+func (s *s3Store) list(ctx context.Context, query url.Values) (*s3ListResult, error) {
+	resp, err := s.do(ctx, http.MethodGet, "", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("S3 list %s: %s", query.Get("prefix"), resp.Status)
+	}
+
+	var result s3ListResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode S3 listing: %w", err)
+	}
+	return &result, nil
+}
+
+// do sends a signed request for an object (or the bucket for an empty key)
+func (s *s3Store) do(ctx context.Context, method, key string, query url.Values, header http.Header) (*http.Response, error) {
+	u := s.objectURL(key, query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s.sign(req, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// sign adds AWS Signature V4 authorization headers to a request. Payloads
+// are never signed since the gallery only reads from the store.
+func (s *s3Store) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if s.sessionToken != "" {
+		signed = append(signed, "x-amz-security-token")
+	}
+	var canonicalHeaders strings.Builder
+	for _, h := range signed {
+		value := req.Header.Get(h)
+		if h == "host" {
+			value = req.URL.Host
+		}
+		canonicalHeaders.WriteString(h + ":" + strings.TrimSpace(value) + "\n")
+	}
+	signedHeaders := strings.Join(signed, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	scope := s.scope(now)
+	signature := s.signature(now, amzDate, scope, canonicalRequest)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+// presign returns a GET URL for an object with the signature in the query
+func (s *s3Store) presign(key string, now time.Time, expiry time.Duration) string {
+	amzDate := now.Format("20060102T150405Z")
+	scope := s.scope(now)
+
+	query := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {s.accessKey + "/" + scope},
+		"X-Amz-Date":          {amzDate},
+		"X-Amz-Expires":       {strconv.Itoa(int(expiry.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	if s.sessionToken != "" {
+		query.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+	u := s.objectURL(key, query)
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		u.EscapedPath(),
+		u.RawQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	signature := s.signature(now, amzDate, scope, canonicalRequest)
+	u.RawQuery += "&X-Amz-Signature=" + signature
+	return u.String()
+}
+
+// scope returns the credential scope for a request made at the given time
+func (s *s3Store) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+}
+
+// signature computes the V4 signature of a canonical request
+func (s *s3Store) signature(now time.Time, amzDate, scope, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), now.Format("20060102"))
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes a string as required by Signature V4: everything
+// except unreserved characters, and optionally the slash
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3CanonicalQuery encodes query parameters sorted by key, as Signature V4
+// requires for the canonical request
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// scanResult counts the thumbnails a scan generated
+type scanResult struct {
+	generated atomic.Int64
+	failed    atomic.Int64
+}
+
+// scanPeriodically generates the missing thumbnails of the whole tree every
+// interval, so files added by an import are cached before anyone browses
+// them. A scan that is still running when the next one is due is not
+// overlapped, the next one is skipped instead.
+func (s *Server) scanPeriodically(interval time.Duration) {
+	var running atomic.Bool
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !running.CompareAndSwap(false, true) {
+			log.Printf("Scan: previous scan still running, skipping this one")
+			continue
+		}
+		go func() {
+			defer running.Store(false)
+			started := time.Now()
+			var result scanResult
+			var wg sync.WaitGroup
+			sem := make(chan struct{}, rebuildConcurrency)
+			s.scanDir(s.baseCtx, s.rootDir, &wg, sem, &result)
+			wg.Wait()
+			log.Printf("Scan: generated %d new thumbnails (%d failed) in %s",
+				result.generated.Load(), result.failed.Load(), time.Since(started).Round(time.Second))
+		}()
+	}
+}
+
+// scanDir queues the media of one directory that have no thumbnail yet, a
+// few at a time like a rebuild, and recurses into subdirectories
+func (s *Server) scanDir(ctx context.Context, dir string, wg *sync.WaitGroup, sem chan struct{}, result *scanResult) {
+	s.walkMedia(ctx, dir, "Scan", func(path string, info fs.FileInfo) error {
+		if _, err := os.Stat(s.thumbnailPathFor(path, defaultThumbnailVariant())); err == nil {
+			return nil
+		}
+		s.generateInBackground(ctx, path, "Scan", wg, sem, func(err error) {
+			if err != nil {
+				result.failed.Add(1)
+				return
+			}
+			result.generated.Add(1)
+		})
+		return nil
+	})
+}
+
+// walkMedia calls visit with each image and movie under dir that gets a
+// thumbnail, for scans and -pregenerate. Hidden entries such as .small,
+// excluded names and images that are their own thumbnail are skipped. A
+// visit that fails stops the walk with its error.
+func (s *Server) walkMedia(ctx context.Context, dir, label string, visit func(path string, info fs.FileInfo) error) error {
+	entries, err := s.store.ReadDir(ctx, dir)
+	if err != nil {
+		log.Printf("%s: skipping %s: %v", label, dir, err)
+		return nil
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") || s.isExcluded(entry.Name()) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if entry.IsDir() {
+			if err := s.walkMedia(ctx, path, label, visit); err != nil {
+				return err
+			}
+			continue
+		}
+		if !isImageFile(path) && !isMovieFile(path) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || s.isOwnThumbnail(entry.Name(), info.Size()) {
+			continue
+		}
+		if err := visit(path, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generateInBackground generates the default thumbnail of path while it
+// holds a slot of sem, replacing a stale one, and reports the outcome to
+// done. It waits for a free slot first.
+func (s *Server) generateInBackground(ctx context.Context, path, label string, wg *sync.WaitGroup, sem chan struct{}, done func(error)) {
+	select {
+	case sem <- struct{}{}:
+	case <-ctx.Done():
+		return
+	}
+	wg.Add(1)
+	go func() {
+		defer func() {
+			<-sem
+			wg.Done()
+		}()
+		err := s.queueAndWaitForThumbnail(ctx, path, defaultThumbnailVariant())
+		if err != nil {
+			log.Printf("%s: failed to generate thumbnail for %s [%s]: %v", label, path, thumbnailFailureCategory(err), err)
+		}
+		done(err)
+	}()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultSearchLimit = 100
+	maxSearchLimit     = 1000
+)
+
+// handleSearch finds files and directories anywhere below a directory by
+// name. q is a case-insensitive substring of the name, or a glob such as
+// IMG_20*.jpg when it contains *, ? or [. type narrows the results to
+// image, movie or dir. Matches come from the cached media index, so a
+// search never walks the tree itself; ?rebuild=1 walks it again first.
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := strings.ToLower(strings.TrimSpace(query.Get("q")))
+	if q == "" {
+		http.Error(w, "Query required", http.StatusBadRequest)
+		return
+	}
+	match := func(name string) bool { return strings.Contains(name, q) }
+	if strings.ContainsAny(q, "*?[") {
+		if _, err := path.Match(q, ""); err != nil {
+			http.Error(w, "Invalid pattern", http.StatusBadRequest)
+			return
+		}
+		match = func(name string) bool {
+			ok, _ := path.Match(q, name)
+			return ok
+		}
+	}
+
+	kind := query.Get("type")
+	if kind != "" && kind != "image" && kind != "movie" && kind != "dir" {
+		http.Error(w, "Invalid type", http.StatusBadRequest)
+		return
+	}
+
+	dir := query.Get("path")
+	if dir == "" {
+		dir = "/"
+	}
+	if _, ok := s.resolvePath(dir); !ok {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+	dir = path.Clean("/" + dir)
+
+	limit := defaultSearchLimit
+	if v, err := strconv.Atoi(query.Get("limit")); err == nil && v > 0 {
+		limit = min(v, maxSearchLimit)
+	}
+
+	if query.Get("rebuild") == "1" {
+		if err := s.rebuildMediaIndex(r.Context()); err != nil {
+			mediaIndexFailed(w, err)
+			return
+		}
+	}
+	index, dirs, _, err := s.mediaIndexSnapshot(r.Context())
+	if err != nil {
+		mediaIndexFailed(w, err)
+		return
+	}
+
+	// Directories come first, as in a listing
+	var matches []string
+	hasMore := false
+	if kind == "" || kind == "dir" {
+		for _, dirPath := range dirs {
+			if !inDirectory(dirPath, dir, true) || !match(strings.ToLower(path.Base(dirPath))) {
+				continue
+			}
+			if len(matches) == limit {
+				hasMore = true
+				break
+			}
+			matches = append(matches, dirPath)
+		}
+	}
+	if kind != "dir" && !hasMore {
+		for _, entry := range index {
+			if (kind == "image" && entry.IsMovie) || (kind == "movie" && !entry.IsMovie) ||
+				!inDirectory(entry.Path, dir, true) || !match(entry.lowerName) {
+				continue
+			}
+			if len(matches) == limit {
+				hasMore = true
+				break
+			}
+			matches = append(matches, entry.Path)
+		}
+	}
+
+	// Hits are built like listing entries, so the page renders them the same
+	opts := &listOptions{basePath: s.requestBasePath(r)}
+	files := make([]FileInfo, 0, len(matches))
+	for _, hit := range matches {
+		if r.Context().Err() != nil {
+			return
+		}
+		if file, ok := s.searchResult(r.Context(), hit, opts); ok {
+			files = append(files, file)
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	respondJSON(w, DirectoryResponse{
+		Path:    dir,
+		Files:   s.rebaseFiles(files, opts.basePath),
+		HasMore: hasMore,
+	}, http.StatusOK)
+}
+
+// searchResult builds the listing entry of an indexed path, reporting false
+// when it was removed or hidden since the index was built
+func (s *Server) searchResult(ctx context.Context, urlPath string, opts *listOptions) (FileInfo, bool) {
+	fullPath, ok := s.resolvePath(urlPath)
+	if !ok || s.isExcludedPath(urlPath) {
+		return FileInfo{}, false
+	}
+	info, err := s.store.Stat(ctx, fullPath)
+	if err != nil {
+		return FileInfo{}, false
+	}
+	return s.listEntry(ctx, filepath.Dir(fullPath), path.Dir(urlPath), fs.FileInfoToDirEntry(info), opts)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// previewStart returns where a live transcode of a movie should start, in
+// seconds, from ?t=. A live transcode has no length until it ends, so byte
+// ranges can't be mapped onto it: players seek with ?t= and Range headers
+// get the whole stream. ok is false for an invalid ?t=.
+func previewStart(r *http.Request) (start float64, ok bool) {
+	param := r.URL.Query().Get("t")
+	if param == "" {
+		return 0, true
+	}
+	start, err := strconv.ParseFloat(param, 64)
+	if err != nil || start < 0 || math.IsInf(start, 0) || math.IsNaN(start) {
+		return 0, false
+	}
+	return start, true
+}
+
+// seekOptions make a transcode start at start seconds. Seeking before the
+// input is fast, and shifting the timestamps back keeps the player's clock
+// at the position in the movie, as with HLS segments.
+func seekOptions(start float64) transcodeOptions {
+	if start <= 0 {
+		return transcodeOptions{}
+	}
+	offset := strconv.FormatFloat(start, 'f', 3, 64)
+	return transcodeOptions{
+		input:  []string{"-ss", offset},
+		output: []string{"-output_ts_offset", offset},
+	}
+}
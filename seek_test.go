@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeFFmpeg stands in for ffmpeg for the rest of the test, writing "ts" to
+// stdout and its arguments, one per line, to the returned log
+func fakeFFmpeg(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "args.log")
+	script := `#!/bin/sh
+printf '%s\n' "$@" >> ` + logPath + `
+printf ts
+`
+	toolPath := filepath.Join(dir, "ffmpeg")
+	if err := os.WriteFile(toolPath, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	previous := ffmpegPath
+	ffmpegPath = toolPath
+	t.Cleanup(func() { ffmpegPath = previous })
+	return logPath
+}
+
+func TestLiveTranscodeIgnoresRanges(t *testing.T) {
+	s := newTestServer(t)
+	s.videoEncoder = videoEncoders["software"]
+	logPath := fakeFFmpeg(t)
+	writeTestFile(t, s, "clip.mov", []byte("movie"))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/file.ts?path=/clip.mov&t=90", nil)
+	req.Header.Set("Range", "bytes=1000-")
+	rec := httptest.NewRecorder()
+	s.newMux().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK || rec.Body.String() != "ts" {
+		t.Fatalf("status %d, body %q, want 200 with the stream", rec.Code, rec.Body)
+	}
+	for _, header := range []string{"Accept-Ranges", "Content-Range"} {
+		if value := rec.Header().Get(header); value != "" {
+			t.Errorf("live transcode sent %s: %s", header, value)
+		}
+	}
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "-ss\n90.000\n") {
+		t.Errorf("ffmpeg wasn't asked to start at 90s:\n%s", data)
+	}
+}
+
+func TestPreviewStart(t *testing.T) {
+	for query, want := range map[string]bool{"": true, "?t=12.5": true, "?t=-1": false, "?t=NaN": false, "?t=abc": false} {
+		if _, ok := previewStart(httptest.NewRequest(http.MethodGet, "/api/file.ts"+query, nil)); ok != want {
+			t.Errorf("previewStart(%q) ok = %v, want %v", query, ok, want)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultSegmentSeconds is the length of each independently transcoded
+// segment unless -segment-seconds sets another
+const defaultSegmentSeconds = 6
+
+// maxSegmentSeconds bounds -segment-seconds; players buffer whole segments
+const maxSegmentSeconds = 30
+
+// hlsSegmentSeconds is the segment length in use, see -segment-seconds
+var hlsSegmentSeconds = defaultSegmentSeconds
+
+// segmentSuffix matches the segment part of a cached segment name, e.g. the
+// ".seg720-3" in clip.mov.seg720-3.ts or ".seg720s4-3" with 4-second
+// segments, so prune can find its source
+var segmentSuffix = regexp.MustCompile(`\.seg\d+(?:s\d+)?-\d+$`)
+
+// ffmpeg prints e.g. "  Duration: 00:01:23.45, start: 0.000000, bitrate: ..."
+var ffmpegDurationRe = regexp.MustCompile(`Duration: (\d+):(\d{2}):(\d{2}(?:\.\d+)?)`)
+
+// movieDuration is a probed duration, valid while the movie is unchanged
+type movieDuration struct {
+	modTime time.Time
+	seconds float64
+}
+
+// segmentCount returns how many segments a movie of the given length has
+func segmentCount(seconds float64) int {
+	return max(1, int(math.Ceil(seconds/float64(hlsSegmentSeconds))))
+}
+
+// getSegmentPath returns the cache path of one transcoded segment
+// e.g., clip.mov at 720p, segment 3 -> .small/clip.mov.seg720-3.ts. Segments
+// of another length than the default also carry it, .seg720s4-3.ts, since
+// the same index covers another part of the movie.
+func getSegmentPath(moviePath string, quality movieQuality, index int) string {
+	dir := filepath.Dir(moviePath)
+	baseName := cacheName(filepath.Base(moviePath))
+	length := ""
+	if hlsSegmentSeconds != defaultSegmentSeconds {
+		length = "s" + strconv.Itoa(hlsSegmentSeconds)
+	}
+	return filepath.Join(thumbnailDirFor(dir), fmt.Sprintf("%s.seg%d%s-%d.ts", baseName, quality.height, length, index))
+}
+
+// movieDurationFor returns the length of a movie in seconds. ffmpeg reports
+// it while opening the input, so no ffprobe is needed.
+func (s *Server) movieDurationFor(ctx context.Context, moviePath string) (float64, error) {
+	info, err := s.store.Stat(ctx, moviePath)
+	if err != nil {
+		return 0, err
+	}
+	if cached, ok := s.movieDurations.Load(moviePath); ok && cached.(movieDuration).modTime.Equal(info.ModTime()) {
+		return cached.(movieDuration).seconds, nil
+	}
+
+	input, err := s.store.Locate(ctx, moviePath)
+	if err != nil {
+		return 0, err
+	}
+	var stderr bytes.Buffer
+	cmd := s.runner.command(ctx, ffmpegExecutable(), "-hide_banner", "-i", input)
+	cmd.Stderr = &stderr
+	// Without an output ffmpeg always exits with an error after printing the input
+	cmd.Run()
+	match := ffmpegDurationRe.FindSubmatch(stderr.Bytes())
+	if match == nil {
+		return 0, fmt.Errorf("failed to read duration of %s", moviePath)
+	}
+	hours, _ := strconv.Atoi(string(match[1]))
+	minutes, _ := strconv.Atoi(string(match[2]))
+	secs, _ := strconv.ParseFloat(string(match[3]), 64)
+	seconds := float64(hours*3600+minutes*60) + secs
+
+	s.movieDurations.Store(moviePath, movieDuration{modTime: info.ModTime(), seconds: seconds})
+	return seconds, nil
+}
+
+// segmentedPlaylist returns an HLS playlist with one entry per segment. The
+// segments are numbered from the duration alone, so the playlist is the same
+// whichever segments happen to be transcoded already.
+func (s *Server) segmentedPlaylist(urlPath string, seconds float64, qualityParam string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n", hlsSegmentSeconds)
+	count := segmentCount(seconds)
+	for i := 0; i < count; i++ {
+		length := min(float64(hlsSegmentSeconds), seconds-float64(i*hlsSegmentSeconds))
+		segmentURL := s.urlWithBasePath("/api/file.ts") + "?path=" + url.QueryEscape(urlPath) + "&segment=" + strconv.Itoa(i)
+		if qualityParam != "" {
+			segmentURL += "&quality=" + qualityParam
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s\n", max(length, 0.001), segmentURL)
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+	return b.String()
+}
+
+// serveSegment serves one segment of a movie preview, transcoding it if it
+// isn't cached yet. The segments after it are transcoded in the background
+// in parallel, up to -segment-workers at once, so playback stays ahead.
+func (s *Server) serveSegment(w http.ResponseWriter, r *http.Request, moviePath string, quality movieQuality, index int) {
+	seconds, err := s.movieDurationFor(r.Context(), moviePath)
+	if err != nil {
+		log.Printf("Failed to segment %s: %v", moviePath, err)
+		http.Error(w, "Failed to read movie duration", http.StatusInternalServerError)
+		return
+	}
+	count := segmentCount(seconds)
+	if index < 0 || index >= count {
+		http.Error(w, "Invalid segment", http.StatusBadRequest)
+		return
+	}
+
+	// The requested segment goes first, prefetching only uses the slots
+	// left over once it is done
+	ctx, cancel := s.previewContext(r)
+	defer cancel()
+	if err := s.transcodeSegment(ctx, moviePath, quality, index, false); err != nil {
+		if ctx.Err() != nil {
+			http.Error(w, "Preview transcoding timed out", http.StatusGatewayTimeout)
+			return
+		}
+		log.Printf("Failed to transcode segment %d of %s: %v", index, moviePath, err)
+		http.Error(w, "Failed to transcode segment", http.StatusInternalServerError)
+		return
+	}
+	s.prefetchSegments(moviePath, quality, index+1, count)
+
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Header().Set("Content-Type", "video/mp2t")
+	http.ServeFile(w, r, getSegmentPath(moviePath, quality, index))
+}
+
+// prefetchSegments transcodes the segments from first on in the background,
+// one per free -segment-workers slot. The slot is taken before the goroutine
+// starts, so prefetching never piles up goroutines waiting for one; the
+// segments that find none are transcoded when they are requested.
+func (s *Server) prefetchSegments(moviePath string, quality movieQuality, first, count int) {
+	for next := first; next < min(first+cap(s.segmentSem), count); next++ {
+		if _, err := os.Stat(getSegmentPath(moviePath, quality, next)); err == nil {
+			continue
+		}
+		select {
+		case s.segmentSem <- struct{}{}:
+		default:
+			return
+		}
+		go func() {
+			if err := s.transcodeSegment(s.baseCtx, moviePath, quality, next, true); err != nil {
+				log.Printf("Failed to transcode segment %d of %s: %v", next, moviePath, err)
+			}
+		}()
+	}
+}
+
+// transcodeSegment transcodes one segment into the cache. Concurrent calls
+// for the same segment share a single ffmpeg run; ctx only bounds how long
+// the caller waits for someone else's run or a -segment-workers slot. With
+// haveSlot the caller has taken a slot already, which is released here.
+func (s *Server) transcodeSegment(ctx context.Context, moviePath string, quality movieQuality, index int, haveSlot bool) error {
+	if haveSlot {
+		defer func() { <-s.segmentSem }()
+	}
+	segmentPath := getSegmentPath(moviePath, quality, index)
+	if _, err := os.Stat(segmentPath); err == nil {
+		return nil
+	}
+
+	doneChan, running := s.pendingSegments.LoadOrStore(segmentPath, make(chan struct{}))
+	done := doneChan.(chan struct{})
+	if running {
+		// A prefetch has nothing to wait for
+		if haveSlot {
+			return nil
+		}
+		select {
+		case <-done:
+			if _, err := os.Stat(segmentPath); err != nil {
+				return fmt.Errorf("segment transcoding failed")
+			}
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	defer func() {
+		s.pendingSegments.Delete(segmentPath)
+		close(done)
+	}()
+
+	if !haveSlot {
+		select {
+		case s.segmentSem <- struct{}{}:
+			defer func() { <-s.segmentSem }()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	release, err := s.acquirePreviewSlot(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := os.MkdirAll(filepath.Dir(segmentPath), 0755); err != nil {
+		return fmt.Errorf("failed to create thumbnail directory: %w", err)
+	}
+	input, err := s.store.Locate(ctx, moviePath)
+	if err != nil {
+		return fmt.Errorf("failed to locate movie: %w", err)
+	}
+
+	// Seek before the input, then shift the timestamps back to where the
+	// segment sits in the movie so consecutive segments play seamlessly
+	start := strconv.Itoa(index * hlsSegmentSeconds)
+	codec := s.videoCodecFor(ctx, moviePath, input)
+	err = s.runTranscode(ctx, func(encoder videoEncoder) *exec.Cmd {
+		args := transcodeArgs(encoder, input, segmentPath+".tmp", quality, codec, transcodeOptions{
+			input:  []string{"-ss", start, "-t", strconv.Itoa(hlsSegmentSeconds)},
+			output: []string{"-output_ts_offset", start},
+		})
+		cmd := s.runner.command(ctx, ffmpegExecutable(), append([]string{"-y"}, args...)...)
+		cmd.Stderr = os.Stderr
+		return cmd
+	}, nil)
+	if err != nil {
+		os.Remove(segmentPath + ".tmp")
+		return fmt.Errorf("failed to transcode segment: %w", err)
+	}
+	if err := os.Rename(segmentPath+".tmp", segmentPath); err != nil {
+		os.Remove(segmentPath + ".tmp")
+		return fmt.Errorf("failed to store segment: %w", err)
+	}
+	return nil
+}
+
+// segmentsEnabled reports whether movie previews are served as parallel
+// transcoded segments
+func (s *Server) segmentsEnabled() bool {
+	return s.segmentSem != nil
+}
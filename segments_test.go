@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSegmentedPlaylist(t *testing.T) {
+	s := newTestServer(t)
+	playlist := s.segmentedPlaylist("/trip/clip one.mov", 13.5, "720")
+
+	lines := strings.Split(strings.TrimSpace(playlist), "\n")
+	if lines[0] != "#EXTM3U" || lines[len(lines)-1] != "#EXT-X-ENDLIST" {
+		t.Errorf("not a complete playlist:\n%s", playlist)
+	}
+	if !slices.Contains(lines, "#EXT-X-TARGETDURATION:6") {
+		t.Errorf("target duration isn't the segment length:\n%s", playlist)
+	}
+
+	var lengths, segments []string
+	for i, line := range lines {
+		if length, ok := strings.CutPrefix(line, "#EXTINF:"); ok {
+			lengths = append(lengths, length)
+			segments = append(segments, lines[i+1])
+		}
+	}
+	if want := []string{"6.000,", "6.000,", "1.500,"}; !slices.Equal(lengths, want) {
+		t.Errorf("segment lengths %q, want %q", lengths, want)
+	}
+	for i, segment := range segments {
+		want := "/api/file.ts?path=" + url.QueryEscape("/trip/clip one.mov") + "&segment=" + strconv.Itoa(i) + "&quality=720"
+		if segment != want {
+			t.Errorf("segment %d is %q, want %q", i, segment, want)
+		}
+	}
+}
+
+func TestTranscodeArgsOptions(t *testing.T) {
+	args := transcodeArgs(videoEncoders["software"], "in.mov", "out.ts", defaultMovieQuality, "h264", transcodeOptions{
+		input:  []string{"-ss", "12", "-t", "6"},
+		output: []string{"-output_ts_offset", "12"},
+	})
+
+	input := slices.Index(args, "-i")
+	if seek := slices.Index(args, "-ss"); seek < 0 || seek > input || args[seek+1] != "12" {
+		t.Errorf("seek isn't an input option: %q", args)
+	}
+	if offset := slices.Index(args, "-output_ts_offset"); offset < input || args[offset+1] != "12" {
+		t.Errorf("timestamp offset isn't an output option: %q", args)
+	}
+	if args[len(args)-1] != "out.ts" || args[len(args)-2] != "mpegts" {
+		t.Errorf("output isn't last: %q", args)
+	}
+}
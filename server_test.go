@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestServer returns a server on a fresh root with in-process thumbnails,
+// so tests need neither vips nor ffmpeg. No workers are started.
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	s := &Server{
+		rootDir:             t.TempDir(),
+		store:               localStore{},
+		imageThumbnailQueue: make(chan thumbnailJob, 10),
+		movieThumbnailQueue: make(chan thumbnailJob, 10),
+		nativeThumbnails:    true,
+		svgUnsupported:      true,
+		thumbnailMode:       "fit",
+		favoritesMode:       favoritesOff,
+	}
+	s.generator = s
+	s.runner = execRunner{}
+	s.baseCtx, s.stopChildren = context.WithCancel(context.Background())
+	t.Cleanup(s.stopChildren)
+	return s
+}
+
+// writeTestFile writes data to name under the server's root, creating its
+// directory, and returns the full path
+func writeTestFile(t *testing.T, s *Server, name string, data []byte) string {
+	t.Helper()
+	fullPath := filepath.Join(s.rootDir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fullPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fullPath
+}
+
+// writeTestJPEG writes a width x height JPEG to name under the server's root
+func writeTestJPEG(t *testing.T, s *Server, name string, width, height int) string {
+	t.Helper()
+	fullPath := writeTestFile(t, s, name, nil)
+	f, err := os.Create(fullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	if err := jpeg.Encode(f, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return fullPath
+}
+
+// fakeVips stands in for vipsthumbnail for the rest of the test: it appends
+// its arguments, one per line and followed by "--", to the returned log and
+// writes a small JPEG to its -o output
+func fakeVips(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	var thumb bytes.Buffer
+	if err := jpeg.Encode(&thumb, image.NewGray(image.Rect(0, 0, 4, 4)), nil); err != nil {
+		t.Fatal(err)
+	}
+	thumbPath := filepath.Join(dir, "thumb.jpg")
+	if err := os.WriteFile(thumbPath, thumb.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	logPath := filepath.Join(dir, "args.log")
+	script := `#!/bin/sh
+printf '%s\n' "$@" -- >> ` + logPath + `
+cat > /dev/null
+while [ $# -gt 0 ]; do
+	if [ "$1" = "-o" ]; then cp ` + thumbPath + ` "${2%%\[*}"; fi
+	shift
+done
+`
+	toolPath := filepath.Join(dir, "vipsthumbnail")
+	if err := os.WriteFile(toolPath, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	previous := vipsPath
+	vipsPath = toolPath
+	t.Cleanup(func() { vipsPath = previous })
+	return logPath
+}
+
+// withExifOrientation returns a JPEG with an EXIF segment holding only the
+// orientation tag, inserted right after the start of image marker
+func withExifOrientation(t *testing.T, jpegData []byte, orientation int) []byte {
+	t.Helper()
+	if len(jpegData) < 2 || jpegData[0] != 0xFF || jpegData[1] != 0xD8 {
+		t.Fatal("not a JPEG")
+	}
+	tiff := []byte{
+		'M', 'M', 0, 42, 0, 0, 0, 8, // big endian, first IFD at 8
+		0, 1, // one entry
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, byte(orientation), 0, 0, // Orientation, SHORT
+		0, 0, 0, 0, // no next IFD
+	}
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segment := []byte{0xFF, 0xE1, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}
+	out := append([]byte{0xFF, 0xD8}, segment...)
+	out = append(out, payload...)
+	return append(out, jpegData[2:]...)
+}
+
+// writeJPEGWithThumbnail writes a width x height JPEG to name under the
+// server's root whose EXIF holds the given orientation and a thumbWidth x
+// thumbHeight thumbnail, and returns that thumbnail
+func writeJPEGWithThumbnail(t *testing.T, s *Server, name string, width, height, thumbWidth, thumbHeight, orientation int) []byte {
+	t.Helper()
+	var thumb bytes.Buffer
+	if err := jpeg.Encode(&thumb, image.NewGray(image.Rect(0, 0, thumbWidth, thumbHeight)), nil); err != nil {
+		t.Fatal(err)
+	}
+	// IFD0 at 8 holds the orientation and links to IFD1 at 26, which points
+	// at the thumbnail following it at 56
+	tiff := []byte{
+		'M', 'M', 0, 42, 0, 0, 0, 8,
+		0, 1,
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, byte(orientation), 0, 0, // Orientation, SHORT
+		0, 0, 0, 26,
+		0, 2,
+		0x02, 0x01, 0, 4, 0, 0, 0, 1, 0, 0, 0, 56, // JPEGInterchangeFormat, LONG
+		0x02, 0x02, 0, 4, 0, 0, 0, 1, byte(thumb.Len() >> 24), byte(thumb.Len() >> 16), byte(thumb.Len() >> 8), byte(thumb.Len()), // JPEGInterchangeFormatLength, LONG
+		0, 0, 0, 0,
+	}
+	payload := append([]byte("Exif\x00\x00"), append(tiff, thumb.Bytes()...)...)
+
+	data, err := os.ReadFile(writeTestJPEG(t, s, name, width, height))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := append([]byte{0xFF, 0xD8, 0xFF, 0xE1, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}, payload...)
+	writeTestFile(t, s, name, append(out, data[2:]...))
+	return thumb.Bytes()
+}
+
+// writeOrientedJPEG writes a width x height JPEG with the given EXIF
+// orientation to name under the server's root
+func writeOrientedJPEG(t *testing.T, s *Server, name string, width, height, orientation int) string {
+	t.Helper()
+	fullPath := writeTestJPEG(t, s, name, width, height)
+	data, err := os.ReadFile(fullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writeTestFile(t, s, name, withExifOrientation(t, data, orientation))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// sessionCookieName identifies a visitor across requests
+	sessionCookieName = "gallery_session"
+	// sessionMaxAge is how long a browser keeps its session cookie
+	sessionMaxAge = 365 * 24 * time.Hour
+)
+
+// sessionManager issues and verifies session cookies. The cookie carries a
+// random session ID signed with an HMAC, so visitors can't pick or guess
+// someone else's ID. Nothing is stored server-side per session.
+type sessionManager struct {
+	key []byte
+}
+
+// sessionKeyPath returns where the random session key of a root is kept:
+// in the user's config directory, outside anything the gallery serves. An
+// empty path means there is no such directory.
+func sessionKeyPath(root string) string {
+	// Keys used to be kept in .small, where /static/ could serve them
+	if cacheDir == "" {
+		legacy := filepath.Join(thumbnailDirFor(root), "session.key")
+		if err := os.Remove(legacy); err == nil {
+			log.Printf("Removed the exposed session key %s, sessions start over", legacy)
+		}
+	}
+
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(root))
+	return filepath.Join(configDir, "directory-server", "session-"+hex.EncodeToString(sum[:8])+".key")
+}
+
+// loadSessionKey returns the key session cookies are signed with. An explicit
+// secret wins, otherwise a random key is created once in keyPath and reused,
+// so sessions survive restarts.
+func loadSessionKey(secret, keyPath string) ([]byte, error) {
+	if secret != "" {
+		sum := sha256.Sum256([]byte(secret))
+		return sum[:], nil
+	}
+	if keyPath == "" {
+		return nil, fmt.Errorf("no config directory to keep a session key in, set -session-secret")
+	}
+
+	if key, err := os.ReadFile(keyPath); err == nil && len(key) >= 32 {
+		return key, nil
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read session key: %w", err)
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(keyPath), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create session key directory: %w", err)
+	}
+	if err := os.WriteFile(keyPath, key, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write session key: %w", err)
+	}
+	return key, nil
+}
+
+// sign returns the cookie value for a session ID
+func (sm *sessionManager) sign(id string) string {
+	mac := hmac.New(sha256.New, sm.key)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns the session ID of a cookie value if its signature is valid
+func (sm *sessionManager) verify(value string) (string, bool) {
+	id, _, ok := strings.Cut(value, ".")
+	if !ok || id == "" {
+		return "", false
+	}
+	if !hmac.Equal([]byte(sm.sign(id)), []byte(value)) {
+		return "", false
+	}
+	return id, true
+}
+
+// sessionID returns the visitor's session ID, starting a new session and
+// setting its cookie when the request carries no valid one
+func (s *Server) sessionID(w http.ResponseWriter, r *http.Request) (string, error) {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		if id, ok := s.sessions.verify(cookie.Value); ok {
+			return id, nil
+		}
+	}
+
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(raw)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    s.sessions.sign(id),
+		Path:     s.urlWithBasePath("/"),
+		MaxAge:   int(sessionMaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return id, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// defaultShutdownGrace is how long a shutdown waits for requests and
+// running generations before child processes are killed
+const defaultShutdownGrace = 15 * time.Second
+
+// serve runs the HTTP server until SIGINT or SIGTERM and then shuts down:
+// no new connections are accepted, queued thumbnails are dropped, and
+// requests and generations already running get the grace period to finish.
+// After that the base context is cancelled, which kills the vips and ffmpeg
+// processes still running through exec.CommandContext.
+func (s *Server) serve(addr string, handler http.Handler, grace time.Duration) error {
+	srv := &http.Server{
+		Addr:        addr,
+		Handler:     handler,
+		BaseContext: func(net.Listener) context.Context { return s.baseCtx },
+	}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.ListenAndServe() }()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serveErr:
+		return err
+	case sig := <-signals:
+		log.Printf("Received %s, shutting down (grace period %s)", sig, grace)
+	}
+	// A second signal skips the grace period
+	signal.Stop(signals)
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Requests still running after %s, cancelling them: %v", grace, err)
+	}
+	s.closeQueues()
+
+	workersDone := make(chan struct{})
+	go func() {
+		s.imageWorkersWg.Wait()
+		s.movieWorkersWg.Wait()
+		close(workersDone)
+	}()
+	select {
+	case <-workersDone:
+	case <-ctx.Done():
+		log.Printf("Thumbnail generation still running after %s, killing it", grace)
+	}
+	s.stopChildren()
+	srv.Close()
+	<-workersDone
+	if s.watermark != nil {
+		s.watermark.close()
+	}
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	log.Printf("Shutdown complete")
+	return nil
+}
+
+// sendThumbnailJob queues a job without blocking. It returns false when the
+// queue is full or closed for shutdown.
+func (s *Server) sendThumbnailJob(queue chan thumbnailJob, job thumbnailJob) bool {
+	s.queueMu.RLock()
+	defer s.queueMu.RUnlock()
+	if s.queuesClosed {
+		return false
+	}
+	select {
+	case queue <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeQueues closes the thumbnail queues so the workers exit once they have
+// released the jobs still queued, which are dropped without being generated
+func (s *Server) closeQueues() {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+	if s.queuesClosed {
+		return
+	}
+	s.queuesClosed = true
+	close(s.imageThumbnailQueue)
+	close(s.movieThumbnailQueue)
+}
+
+// draining reports whether the queues were closed for shutdown
+func (s *Server) draining() bool {
+	s.queueMu.RLock()
+	defer s.queueMu.RUnlock()
+	return s.queuesClosed
+}
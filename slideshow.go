@@ -0,0 +1,95 @@
+package main
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultSlideshowLimit = 100
+	maxSlideshowLimit     = 1000
+)
+
+// slideshowResponse is one page of a slideshow. Seed is echoed (or chosen,
+// when the request had none) so the client can fetch the following pages
+// in the same order.
+type slideshowResponse struct {
+	Path   string            `json:"path"`
+	Seed   uint64            `json:"seed"`
+	Total  int               `json:"total"`
+	Offset int               `json:"offset"`
+	Limit  int               `json:"limit"`
+	Items  []mediaIndexEntry `json:"items"`
+}
+
+// handleSlideshow returns the media of a directory, optionally including
+// subdirectories, in an order that is shuffled deterministically by seed.
+// It is built from the media index, so new files show up once it refreshes.
+func (s *Server) handleSlideshow(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	dir := query.Get("path")
+	if dir == "" {
+		dir = "/"
+	}
+	if _, ok := s.resolvePath(dir); !ok {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+	dir = path.Clean("/" + dir)
+	recursive := query.Get("recursive") == "true"
+
+	offset := 0
+	if v, err := strconv.Atoi(query.Get("offset")); err == nil && v > 0 {
+		offset = v
+	}
+	limit := defaultSlideshowLimit
+	if v, err := strconv.Atoi(query.Get("limit")); err == nil && v > 0 {
+		limit = min(v, maxSlideshowLimit)
+	}
+	seed, err := strconv.ParseUint(query.Get("seed"), 10, 64)
+	if err != nil {
+		seed = rand.Uint64()
+	}
+
+	index, _, err := s.mediaIndexEntries(r.Context())
+	if err != nil {
+		mediaIndexFailed(w, err)
+		return
+	}
+	var entries []mediaIndexEntry
+	for _, entry := range index {
+		if inDirectory(entry.Path, dir, recursive) {
+			entries = append(entries, entry)
+		}
+	}
+	// The index is in listing order and never reordered in place, so the
+	// same seed shuffles the same list the same way on every page
+	if query.Get("shuffle") == "true" {
+		rand.New(rand.NewPCG(seed, 0)).Shuffle(len(entries), func(i, j int) {
+			entries[i], entries[j] = entries[j], entries[i]
+		})
+	}
+	page := windowOf(entries, offset, limit)
+
+	w.Header().Set("Cache-Control", "no-cache")
+	respondJSON(w, slideshowResponse{
+		Path:   dir,
+		Seed:   seed,
+		Total:  len(entries),
+		Offset: offset,
+		Limit:  limit,
+		Items:  page,
+	}, http.StatusOK)
+}
+
+// inDirectory reports whether an indexed media path lies in dir, or anywhere
+// below it when recursive
+func inDirectory(mediaPath, dir string, recursive bool) bool {
+	if recursive {
+		return dir == "/" || strings.HasPrefix(mediaPath, dir+"/")
+	}
+	return path.Dir(mediaPath) == dir
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestSlideshowPages(t *testing.T) {
+	s := newTestServer(t)
+	for _, name := range []string{"a.jpg", "b.jpg", "c.jpg"} {
+		writeTestJPEG(t, s, "album/"+name, 8, 8)
+	}
+
+	for _, tt := range []struct {
+		offset, limit string
+		want          int
+	}{
+		{"0", "2", 2},
+		{"2", "2", 1},
+		{"3", "2", 0},
+		{strconv.Itoa(math.MaxInt), "1000", 0},
+		{strconv.Itoa(math.MaxInt - 1), strconv.Itoa(math.MaxInt), 0},
+	} {
+		rec := httptest.NewRecorder()
+		target := "/api/slideshow?path=/album&offset=" + tt.offset + "&limit=" + tt.limit
+		s.newMux().ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", target, rec.Code)
+		}
+		var page slideshowResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		if page.Total != 3 || len(page.Items) != tt.want || page.Limit > maxSlideshowLimit {
+			t.Errorf("%s: %d of %d items with limit %d, want %d of 3", target, len(page.Items), page.Total, page.Limit, tt.want)
+		}
+	}
+}
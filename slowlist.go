@@ -0,0 +1,143 @@
+package main
+
+import (
+	"cmp"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// slowListingLogThreshold is how long a listing takes before it is logged
+// when it enters the slowest listings
+const slowListingLogThreshold = time.Second
+
+// slowListing is one directory listing and how long building it took
+type slowListing struct {
+	Path     string    `json:"path"`
+	Duration string    `json:"duration"`
+	Entries  int       `json:"entries"`
+	ListedAt time.Time `json:"listedAt"`
+
+	took time.Duration
+}
+
+// slowListings keeps the n directories that were slowest to list. Each
+// directory appears once with its latest listing, so one that got faster
+// after being split up drops out again. The slice never grows beyond n, so
+// recording stays cheap however many directories are listed.
+type slowListings struct {
+	mu       sync.Mutex
+	n        int
+	listings []slowListing
+}
+
+func newSlowListings(n int) *slowListings {
+	return &slowListings{n: n}
+}
+
+// record notes how long listing a directory took
+func (t *slowListings) record(path string, took time.Duration, entries int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	listing := slowListing{Path: path, Duration: took.String(), Entries: entries, ListedAt: time.Now(), took: took}
+
+	if i := slices.IndexFunc(t.listings, func(l slowListing) bool { return l.Path == path }); i >= 0 {
+		t.listings[i] = listing
+	} else if len(t.listings) < t.n {
+		t.listings = append(t.listings, listing)
+	} else {
+		fastest := 0
+		for i, l := range t.listings {
+			if l.took < t.listings[fastest].took {
+				fastest = i
+			}
+		}
+		if took <= t.listings[fastest].took {
+			return
+		}
+		t.listings[fastest] = listing
+	}
+	if took >= slowListingLogThreshold {
+		log.Printf("Slow listing: %s (%d entries) took %s", path, entries, took.Round(time.Millisecond))
+	}
+}
+
+// slowest returns the tracked listings, slowest first
+func (t *slowListings) slowest() []slowListing {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	listings := slices.Clone(t.listings)
+	slices.SortFunc(listings, func(a, b slowListing) int {
+		return cmp.Compare(b.took, a.took)
+	})
+	return listings
+}
+
+// statusResponse reports what the running server has observed
+type statusResponse struct {
+	SlowestListings []slowListing         `json:"slowestListings"`
+	Tools           map[string]toolHealth `json:"tools,omitempty"`
+
+	// What is being generated right now
+	Previews          map[string]previewLoad   `json:"previews"`
+	Thumbnails        map[string]thumbnailLoad `json:"thumbnails"`
+	PendingThumbnails int                      `json:"pendingThumbnails"` // queued or running, across kinds
+}
+
+// previewLoad counts the running previews of a kind
+type previewLoad struct {
+	Active int `json:"active"`
+	Limit  int `json:"limit,omitempty"` // 0 = unlimited
+}
+
+// thumbnailLoad counts the thumbnails of a kind waiting for a worker.
+// QueueFull counts the requests that found the queue full since startup and
+// generated their thumbnail themselves; a rising count calls for more
+// workers or a larger queue.
+type thumbnailLoad struct {
+	Queued    int    `json:"queued"`
+	QueueSize int    `json:"queueSize"`
+	Workers   int    `json:"workers"`
+	QueueFull uint64 `json:"queueFull"`
+}
+
+// handleStatus reports runtime statistics: the directories that were slowest
+// to list, when -slow-listings is set, and whether vips and ffmpeg passed
+// their last probe, when -tool-probe-interval is set. It also counts the
+// running previews and queued thumbnails.
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	response := statusResponse{SlowestListings: []slowListing{}}
+	if s.slowListings != nil {
+		response.SlowestListings = s.slowListings.slowest()
+	}
+	if s.toolProbes != nil {
+		response.Tools = s.toolProbes.snapshot()
+	}
+	response.Previews = map[string]previewLoad{
+		"movie": {Active: int(s.moviePreviews.active.Load()), Limit: cap(s.moviePreviews.sem)},
+		"image": {Active: int(s.imagePreviews.active.Load()), Limit: cap(s.imagePreviews.sem)},
+	}
+	response.Thumbnails = map[string]thumbnailLoad{
+		"movie": {
+			Queued:    len(s.movieThumbnailQueue),
+			QueueSize: cap(s.movieThumbnailQueue),
+			Workers:   s.settings().movieWorkers,
+			QueueFull: s.metrics.thumbnailInline.get(metricLabels("kind", "movie")),
+		},
+		"image": {
+			Queued:    len(s.imageThumbnailQueue),
+			QueueSize: cap(s.imageThumbnailQueue),
+			Workers:   s.settings().imageWorkers,
+			QueueFull: s.metrics.thumbnailInline.get(metricLabels("kind", "image")),
+		},
+	}
+	response.PendingThumbnails = s.pendingThumbnails()
+	w.Header().Set("Cache-Control", "no-store")
+	respondJSON(w, response, http.StatusOK)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// editPhoto rewrites a photo at another size, dated after its thumbnail
+func editPhoto(t *testing.T, s *Server, name, thumbnailPath string, width, height int) {
+	t.Helper()
+	made := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(thumbnailPath, made, made); err != nil {
+		t.Fatal(err)
+	}
+	photo := writeTestJPEG(t, s, name, width, height)
+	edited := time.Now().Add(-time.Minute)
+	if err := os.Chtimes(photo, edited, edited); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTouchedSourceRebuildsThumbnail(t *testing.T) {
+	s := newTestServer(t)
+	s.resizeWorkers(1, 1)
+	t.Cleanup(func() { s.resizeWorkers(0, 0) })
+	photo := writeTestJPEG(t, s, "trip/photo.jpg", 40, 20)
+	thumbnailPath := s.thumbnailPathFor(photo, defaultThumbnailVariant())
+	if err := s.generateThumbnail(t.Context(), photo, defaultThumbnailVariant()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Workers, prefetching and rebuilds go through generateThumbnail
+	editPhoto(t, s, "trip/photo.jpg", thumbnailPath, 20, 40)
+	if err := s.generateThumbnail(t.Context(), photo, defaultThumbnailVariant()); err != nil {
+		t.Fatal(err)
+	}
+	if w, h := thumbnailSize(t, thumbnailPath); w != 20 || h != 40 {
+		t.Errorf("generated thumbnail %dx%d after the edit, want 20x40", w, h)
+	}
+
+	editPhoto(t, s, "trip/photo.jpg", thumbnailPath, 40, 20)
+	rec := httptest.NewRecorder()
+	s.newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/thumbnail/trip/photo.jpg", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if w, h := thumbnailSize(t, thumbnailPath); w != 40 || h != 20 {
+		t.Errorf("served thumbnail %dx%d after the edit, want 40x20", w, h)
+	}
+}
+
+func TestOutdatedThumbnailsAreReplacedAndPruned(t *testing.T) {
+	s := newTestServer(t)
+	photo := writeTestJPEG(t, s, "trip/photo.jpg", 40, 20)
+	// A sideways thumbnail cached before thumbnailCacheVersion was in names
+	sideways := writeTestJPEG(t, s, "trip/.small/photo.jpg.jpg", 20, 40)
+
+	thumbnailPath := s.thumbnailPathFor(photo, defaultThumbnailVariant())
+	if thumbnailPath == sideways {
+		t.Fatalf("thumbnail %s is named as before versions", thumbnailPath)
+	}
+	if err := s.generateThumbnail(t.Context(), photo, defaultThumbnailVariant()); err != nil {
+		t.Fatal(err)
+	}
+	if w, h := thumbnailSize(t, thumbnailPath); w != 40 || h != 20 {
+		t.Errorf("thumbnail %dx%d, want 40x20", w, h)
+	}
+
+	result, err := s.pruneThumbnails(t.Context(), s.rootDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Removed != 1 {
+		t.Errorf("pruned %d files, want the outdated thumbnail", result.Removed)
+	}
+	if _, err := os.Stat(sideways); !os.IsNotExist(err) {
+		t.Error("outdated thumbnail was kept")
+	}
+	if _, err := os.Stat(thumbnailPath); err != nil {
+		t.Error("current thumbnail was pruned")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStaticServesNothingHiddenButThumbnails(t *testing.T) {
+	s := newTestServer(t)
+	for _, name := range []string{
+		"photo.jpg",
+		".small/photo.jpg.jpg",
+		".small/session.key",
+		".small/favorites.json",
+		".small/contact-sheets/sheet.jpg",
+		".trash/deleted.jpg",
+		".hidden/photo.jpg",
+		"album/.small/photo.jpg.webp",
+		"album/.env",
+	} {
+		writeTestFile(t, s, name, []byte("data"))
+	}
+
+	for target, want := range map[string]int{
+		"/static/photo.jpg":                       http.StatusOK,
+		"/static/.small/photo.jpg.jpg":            http.StatusOK,
+		"/static/album/.small/photo.jpg.webp":     http.StatusOK,
+		"/static/.small/session.key":              http.StatusNotFound,
+		"/static/.small/favorites.json":           http.StatusNotFound,
+		"/static/.small/contact-sheets/sheet.jpg": http.StatusNotFound,
+		"/static/.trash/deleted.jpg":              http.StatusNotFound,
+		"/static/.hidden/photo.jpg":               http.StatusNotFound,
+		"/static/album/.env":                      http.StatusNotFound,
+		"/static/album/%2e%2e/.small/session.key": http.StatusNotFound,
+	} {
+		rec := httptest.NewRecorder()
+		s.newMux().ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		if rec.Code != want {
+			t.Errorf("%s: status %d, want %d", target, rec.Code, want)
+		}
+	}
+}
+
+func TestStaticServesOnlyMediaInline(t *testing.T) {
+	s := newTestServer(t)
+	writeTestJPEG(t, s, "photo.jpg", 8, 8)
+	writeTestFile(t, s, ".small/photo.jpg.jpg", []byte("thumbnail"))
+	writeTestFile(t, s, "drawing.svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`))
+	writeTestFile(t, s, "page.html", []byte("<script>alert(1)</script>"))
+	writeTestFile(t, s, "notes.txt", []byte("notes"))
+
+	for target, inline := range map[string]bool{
+		"/static/photo.jpg":            true,
+		"/static/.small/photo.jpg.jpg": true,
+		"/static/drawing.svg":          false,
+		"/static/page.html":            false,
+		"/static/notes.txt":            false,
+		"/api/preview/drawing.svg":     false,
+	} {
+		rec := httptest.NewRecorder()
+		s.newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", target, rec.Code)
+		}
+		attachment := strings.HasPrefix(rec.Header().Get("Content-Disposition"), "attachment")
+		sandboxed := strings.Contains(rec.Header().Get("Content-Security-Policy"), "sandbox")
+		nosniff := rec.Header().Get("X-Content-Type-Options") == "nosniff"
+		if inline && attachment {
+			t.Errorf("%s: served as an attachment", target)
+		}
+		if !inline && !(attachment && sandboxed && nosniff) {
+			t.Errorf("%s: attachment %v, sandboxed %v, nosniff %v, want all", target, attachment, sandboxed, nosniff)
+		}
+	}
+}
+
+func TestSessionKeyIsKeptOutsideTheRoot(t *testing.T) {
+	s := newTestServer(t)
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	legacy := writeTestFile(t, s, ".small/session.key", make([]byte, 32))
+
+	keyPath := sessionKeyPath(s.rootDir)
+	if rel, err := filepath.Rel(s.rootDir, keyPath); keyPath == "" || err != nil || filepath.IsLocal(rel) {
+		t.Fatalf("session key kept at %q, inside the root %q", keyPath, s.rootDir)
+	}
+	if _, err := loadSessionKey("", keyPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(legacy); err == nil {
+		t.Error("the exposed session key under .small was kept")
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// staticExport is one -export run: the output directory and what has been
+// written to it so far. Media files are exported a few at a time, like a
+// rebuild, while the tree is walked.
+type staticExport struct {
+	out      string
+	exported atomic.Int64
+	failed   atomic.Int64
+	wg       sync.WaitGroup
+	sem      chan struct{}
+}
+
+// exportStatic writes the gallery under root to out as static files that any
+// web server or CDN can host: index.html and its assets, a list.json per
+// directory under lists/, and the originals, thumbnails, image previews and
+// Live Photo movies under files/, thumbnails/, previews/ and movies/. All
+// URLs carry the base path. Thumbnails and movies are generated with the
+// same logic as on request, so an existing cache is reused.
+func (s *Server) exportStatic(ctx context.Context, out string) (exported, failed int64, err error) {
+	out, err = filepath.Abs(out)
+	if err != nil {
+		return 0, 0, err
+	}
+	if relPath, err := filepath.Rel(s.rootDir, out); err == nil && !strings.HasPrefix(relPath, "..") {
+		return 0, 0, fmt.Errorf("%s is inside the root directory, it would export itself", out)
+	}
+	e := &staticExport{out: out, sem: make(chan struct{}, rebuildConcurrency)}
+	if err := os.MkdirAll(out, 0755); err != nil {
+		return 0, 0, err
+	}
+
+	index, err := os.Create(filepath.Join(out, "index.html"))
+	if err != nil {
+		return 0, 0, err
+	}
+	err = s.indexTmpl.Execute(index, map[string]string{
+		"BasePath": s.basePath,
+		"HomePath": s.homePath,
+		"Static":   "true",
+	})
+	index.Close()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to render index.html: %w", err)
+	}
+	if err := copyTree(assetsFS, filepath.Join(out, "assets")); err != nil {
+		return 0, 0, fmt.Errorf("failed to copy assets: %w", err)
+	}
+
+	err = s.exportDir(ctx, e, s.rootDir)
+	e.wg.Wait()
+	return e.exported.Load(), e.failed.Load(), err
+}
+
+// exportDir writes the list.json of one directory, queues its media and
+// recurses into its subdirectories
+func (s *Server) exportDir(ctx context.Context, e *staticExport, dir string) error {
+	entries, err := s.store.ReadDir(ctx, dir)
+	if err != nil {
+		log.Printf("Export: skipping %s: %v", dir, err)
+		return nil
+	}
+	urlDir := s.urlPathFor(dir)
+
+	var files []FileInfo
+	var subdirs []string
+	streams := make(map[string]string) // stream URL -> movie, to find paired movies again
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") || s.isExcluded(entry.Name()) {
+			continue
+		}
+		fullPath := filepath.Join(dir, entry.Name())
+		file := FileInfo{
+			Name:    entry.Name(),
+			Path:    path.Join(urlDir, entry.Name()),
+			IsDir:   entry.IsDir(),
+			IsImage: isImageFile(entry.Name()),
+			IsMovie: isMovieFile(entry.Name()),
+		}
+		if file.IsDir {
+			// Hidden directories are exported, just not listed
+			subdirs = append(subdirs, fullPath)
+			settings := s.ownDirConfig(fullPath)
+			if settings.Hidden {
+				continue
+			}
+			if settings.Cover != "" {
+				file.Cover = s.staticURL("/thumbnails", path.Join(file.Path, settings.Cover), ".jpg")
+			}
+		}
+		if !file.IsDir {
+			// Static hosting can't set Content-Disposition, the original will do
+			file.Download = s.staticURL("/files", file.Path, "")
+		}
+		if file.IsImage || file.IsMovie {
+			file.Thumbnail = s.staticURL("/thumbnails", file.Path, ".jpg")
+			if info, err := entry.Info(); err == nil && s.isOwnThumbnail(entry.Name(), info.Size()) {
+				file.Thumbnail = s.staticURL("/files", file.Path, "")
+				file.OwnThumbnail = true
+			}
+		}
+		if file.IsMovie {
+			streams[s.urlWithBasePath("/api/file.m3u8?path="+url.QueryEscape(file.Path))] = fullPath
+		}
+		files = append(files, file)
+	}
+
+	files = s.pairFiles(files)
+	for i, file := range files {
+		if moviePath, ok := streams[file.CanonicalMovie]; ok {
+			files[i].CanonicalMovie = s.staticURL("/movies", s.urlPathFor(moviePath), ".m3u8")
+			s.exportJob(e, func() error { return s.exportMovie(ctx, e, moviePath) })
+		}
+	}
+	if err := writeExportListing(e.out, urlDir, DirectoryResponse{Path: urlDir, Files: files}); err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if !file.IsDir {
+			fullPath := filepath.Join(dir, file.Name)
+			s.exportJob(e, func() error { return s.exportFile(ctx, e, fullPath, file) })
+		}
+	}
+	for _, subdir := range subdirs {
+		if err := s.exportDir(ctx, e, subdir); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// exportJob runs one export step in the background, a few at a time
+func (s *Server) exportJob(e *staticExport, job func() error) {
+	e.sem <- struct{}{}
+	e.wg.Add(1)
+	go func() {
+		defer func() {
+			<-e.sem
+			e.wg.Done()
+		}()
+		if err := job(); err != nil {
+			log.Printf("Export: %v", err)
+			e.failed.Add(1)
+			return
+		}
+		e.exported.Add(1)
+	}()
+}
+
+// exportFile copies a file's original and writes its thumbnail and, for
+// images other than SVGs, which are shown as they are, its default preview
+func (s *Server) exportFile(ctx context.Context, e *staticExport, fullPath string, file FileInfo) error {
+	if err := s.exportOriginal(ctx, fullPath, exportPath(e.out, "files", file.Path, "")); err != nil {
+		return fmt.Errorf("failed to copy %s: %w", fullPath, err)
+	}
+	if (!file.IsImage && !file.IsMovie) || file.OwnThumbnail {
+		return nil
+	}
+
+	if err := s.queueAndWaitForThumbnail(ctx, fullPath, defaultThumbnailVariant()); err != nil {
+		return fmt.Errorf("failed to generate thumbnail for %s: %w", fullPath, err)
+	}
+	if err := linkOrCopy(s.thumbnailPathFor(fullPath, defaultThumbnailVariant()), exportPath(e.out, "thumbnails", file.Path, ".jpg")); err != nil {
+		return fmt.Errorf("failed to copy thumbnail of %s: %w", fullPath, err)
+	}
+	if file.IsImage && !isSVGFile(fullPath) {
+		return s.exportPreview(ctx, fullPath, exportPath(e.out, "previews", file.Path, ".jpg"))
+	}
+	return nil
+}
+
+// exportPreview renders the default preview of an image into a file through
+// the preview handler, so watermarks, backgrounds and the in-process
+// fallback apply exactly as when it is served
+func (s *Server) exportPreview(ctx context.Context, fullPath, dst string) error {
+	previewURL := &url.URL{Path: "/api/preview" + s.urlPathFor(fullPath)}
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, previewURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	w := &exportResponse{header: make(http.Header), body: file}
+	s.handlePreview(w, r)
+	if err := file.Close(); err != nil || w.status != http.StatusOK {
+		os.Remove(dst)
+		return fmt.Errorf("failed to render preview of %s (status %d)", fullPath, w.status)
+	}
+	return nil
+}
+
+// exportMovie transcodes a Live Photo movie into the preview cache and
+// exports it with a playlist, which the lightbox plays like the live stream
+func (s *Server) exportMovie(ctx context.Context, e *staticExport, moviePath string) error {
+	if _, ok := s.freshTranscode(ctx, moviePath); !ok {
+		if err := s.transcodeToCache(ctx, moviePath); err != nil {
+			return fmt.Errorf("failed to transcode %s: %w", moviePath, err)
+		}
+	}
+	urlPath := s.urlPathFor(moviePath)
+	segment := exportPath(e.out, "movies", urlPath, ".ts")
+	if err := linkOrCopy(getTranscodePath(moviePath), segment); err != nil {
+		return fmt.Errorf("failed to copy preview of %s: %w", moviePath, err)
+	}
+	// The whole movie is one segment, whose length players check against
+	// the target duration
+	seconds, err := s.movieDurationFor(ctx, moviePath)
+	if err != nil {
+		return err
+	}
+	// The segment sits next to the playlist, so a relative URL is enough
+	playlist := fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXTINF:%.3f,\n%s\n#EXT-X-ENDLIST\n",
+		max(1, int(math.Ceil(seconds))), max(seconds, 0.001), url.PathEscape(filepath.Base(segment)))
+	return os.WriteFile(exportPath(e.out, "movies", urlPath, ".m3u8"), []byte(playlist), 0644)
+}
+
+// exportOriginal copies a source file out of the media store, hard linking
+// it instead when it is on the local disk
+func (s *Server) exportOriginal(ctx context.Context, fullPath, dst string) error {
+	if _, ok := s.store.(localStore); ok {
+		return linkOrCopy(fullPath, dst)
+	}
+	src, err := s.store.Open(ctx, fullPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return writeExportFile(dst, src)
+}
+
+// writeExportListing writes the list.json of a directory
+func writeExportListing(out, urlDir string, listing DirectoryResponse) error {
+	data, err := json.Marshal(listing)
+	if err != nil {
+		return err
+	}
+	dst := exportPath(out, "lists", urlDir, "")
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dst, "list.json"), append(data, '\n'), 0644)
+}
+
+// staticURL returns the URL of an exported file, e.g. /thumbnails/a%20b/c.jpg.jpg
+func (s *Server) staticURL(prefix, urlPath, suffix string) string {
+	return s.urlWithBasePath(prefix + (&url.URL{Path: urlPath + suffix}).EscapedPath())
+}
+
+// exportPath returns where an exported file is written, the counterpart of staticURL
+func exportPath(out, prefix, urlPath, suffix string) string {
+	return filepath.Join(out, prefix, filepath.FromSlash(urlPath)+suffix)
+}
+
+// linkOrCopy hard links a local file to dst, or copies it when that fails,
+// e.g. across filesystems. An existing dst is replaced.
+func linkOrCopy(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	os.Remove(dst)
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return writeExportFile(dst, file)
+}
+
+// writeExportFile writes src to dst
+func writeExportFile(dst string, src io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, src); err != nil {
+		file.Close()
+		os.Remove(dst)
+		return err
+	}
+	return file.Close()
+}
+
+// copyTree writes the files of a file system to a directory, e.g. the
+// built-in frontend assets
+func copyTree(src fs.FS, dst string) error {
+	return fs.WalkDir(src, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		return os.WriteFile(target, data, 0644)
+	})
+}
+
+// exportResponse is a minimal http.ResponseWriter that writes a handler's
+// body to a file, for rendering previews outside a request
+type exportResponse struct {
+	header http.Header
+	body   io.Writer
+	status int
+}
+
+func (w *exportResponse) Header() http.Header {
+	return w.header
+}
+
+func (w *exportResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *exportResponse) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
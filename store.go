@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// mediaStore abstracts access to the source media so the gallery can serve
+// files from local disk or from an object store. All methods take the full
+// path under the server's root directory, exactly as the handlers build it;
+// thumbnails and other cache files always live on local disk under that root.
+type mediaStore interface {
+	// ReadDir lists a directory
+	ReadDir(ctx context.Context, fullPath string) ([]fs.DirEntry, error)
+	// Stat returns information about a file or directory
+	Stat(ctx context.Context, fullPath string) (fs.FileInfo, error)
+	// Open opens a file for reading
+	Open(ctx context.Context, fullPath string) (io.ReadCloser, error)
+	// ServeFile writes a file to an HTTP response, honouring range and
+	// conditional request headers
+	ServeFile(w http.ResponseWriter, r *http.Request, fullPath string)
+	// Locate returns a path or URL from which external tools such as ffmpeg
+	// can read the file directly
+	Locate(ctx context.Context, fullPath string) (string, error)
+}
+
+// localStore serves media straight from the local filesystem
+type localStore struct{}
+
+func (localStore) ReadDir(ctx context.Context, fullPath string) ([]fs.DirEntry, error) {
+	return os.ReadDir(fullPath)
+}
+
+func (localStore) Stat(ctx context.Context, fullPath string) (fs.FileInfo, error) {
+	return os.Stat(fullPath)
+}
+
+func (localStore) Open(ctx context.Context, fullPath string) (io.ReadCloser, error) {
+	return os.Open(fullPath)
+}
+
+func (localStore) ServeFile(w http.ResponseWriter, r *http.Request, fullPath string) {
+	http.ServeFile(w, r, fullPath)
+}
+
+func (localStore) Locate(ctx context.Context, fullPath string) (string, error) {
+	return fullPath, nil
+}
+
+// fsStore serves media from an fs.FS rooted at the server's root directory,
+// e.g. an fstest.MapFS in tests. External tools cannot read from it, so
+// anything that hands a path to vips or ffmpeg needs a mock generator.
+type fsStore struct {
+	root string
+	fsys fs.FS
+}
+
+// name converts a full path under the root to an fs.FS name
+func (s fsStore) name(fullPath string) (string, error) {
+	rel, err := filepath.Rel(s.root, fullPath)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", &fs.PathError{Op: "open", Path: fullPath, Err: fs.ErrInvalid}
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+func (s fsStore) ReadDir(ctx context.Context, fullPath string) ([]fs.DirEntry, error) {
+	name, err := s.name(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	return fs.ReadDir(s.fsys, name)
+}
+
+func (s fsStore) Stat(ctx context.Context, fullPath string) (fs.FileInfo, error) {
+	name, err := s.name(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	return fs.Stat(s.fsys, name)
+}
+
+func (s fsStore) Open(ctx context.Context, fullPath string) (io.ReadCloser, error) {
+	name, err := s.name(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	return s.fsys.Open(name)
+}
+
+func (s fsStore) ServeFile(w http.ResponseWriter, r *http.Request, fullPath string) {
+	name, err := s.name(fullPath)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	http.ServeFileFS(w, r, s.fsys, name)
+}
+
+func (s fsStore) Locate(ctx context.Context, fullPath string) (string, error) {
+	return "", fmt.Errorf("%s: not available on disk", fullPath)
+}
+
+// mimeTypeFor returns the MIME type for a file name based on its extension,
+// preferring the configured mimeTypes over the system's mime database
+func mimeTypeFor(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if t, ok := mimeTypes[ext]; ok {
+		return t
+	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
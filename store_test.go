@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+)
+
+// mockGenerator writes fixed bytes as the thumbnail instead of running vips
+// or ffmpeg, and counts how often it was asked to
+type mockGenerator struct {
+	calls atomic.Int32
+}
+
+func (g *mockGenerator) generateThumbnail(ctx context.Context, imagePath string, variant thumbnailVariant) error {
+	g.calls.Add(1)
+	thumbnailPath := getThumbnailVariantPath(imagePath, variant)
+	if err := os.MkdirAll(filepath.Dir(thumbnailPath), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(thumbnailPath, []byte("thumbnail"), 0644)
+}
+
+// newMapFSServer returns a test server whose media comes from files, with
+// thumbnails rendered by a mock generator
+func newMapFSServer(t *testing.T, files fstest.MapFS) (*Server, *mockGenerator) {
+	t.Helper()
+	s := newTestServer(t)
+	s.store = fsStore{root: s.rootDir, fsys: files}
+	generator := &mockGenerator{}
+	s.generator = generator
+	// Without workers, an unbuffered queue makes requests generate inline
+	s.imageThumbnailQueue = make(chan thumbnailJob)
+	s.movieThumbnailQueue = make(chan thumbnailJob)
+	return s, generator
+}
+
+func TestListFromMapFS(t *testing.T) {
+	s, _ := newMapFSServer(t, fstest.MapFS{
+		"album/photo.jpg": {Data: []byte("jpeg")},
+		"album/clip.mov":  {Data: []byte("movie")},
+		"album/notes.txt": {Data: []byte("text")},
+		"album/.hidden":   {Data: []byte("hidden")},
+	})
+
+	rec := httptest.NewRecorder()
+	s.newMux().ServeHTTP(rec, httptest.NewRequest("GET", "/api/list?path=/album", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var listing struct {
+		Files []FileInfo `json:"files"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &listing); err != nil {
+		t.Fatal(err)
+	}
+	kinds := make(map[string]string)
+	for _, f := range listing.Files {
+		switch {
+		case f.IsImage:
+			kinds[f.Name] = "image"
+		case f.IsMovie:
+			kinds[f.Name] = "movie"
+		default:
+			kinds[f.Name] = "other"
+		}
+	}
+	want := map[string]string{"photo.jpg": "image", "clip.mov": "movie", "notes.txt": "other"}
+	if len(kinds) != len(want) {
+		t.Errorf("listed %v, want %v", kinds, want)
+	}
+	for name, kind := range want {
+		if kinds[name] != kind {
+			t.Errorf("%s listed as %q, want %q", name, kinds[name], kind)
+		}
+	}
+}
+
+func TestThumbnailWithMockGenerator(t *testing.T) {
+	s, generator := newMapFSServer(t, fstest.MapFS{
+		"album/photo.jpg": {Data: []byte("jpeg")},
+	})
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		s.newMux().ServeHTTP(rec, httptest.NewRequest("GET", "/api/thumbnail/album/photo.jpg", nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != "thumbnail" {
+			t.Fatalf("request %d: status %d, body %q", i+1, rec.Code, rec.Body)
+		}
+	}
+	// The second request is served from the cache
+	if n := generator.calls.Load(); n != 1 {
+		t.Errorf("generated %d times, want 1", n)
+	}
+}
+
+func TestPathsOutsideRootAreRefused(t *testing.T) {
+	s, generator := newMapFSServer(t, fstest.MapFS{
+		"album/photo.jpg": {Data: []byte("jpeg")},
+	})
+
+	for _, target := range []string{
+		"/api/list?path=/../etc",
+		"/api/list?path=../../etc",
+		"/api/thumbnail/..%2f..%2fetc%2fpasswd.jpg",
+		"/api/download/..%2fsecret.jpg",
+	} {
+		rec := httptest.NewRecorder()
+		s.newMux().ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		if rec.Code == http.StatusOK {
+			t.Errorf("%s: status %d, want it refused", target, rec.Code)
+		}
+	}
+	if n := generator.calls.Load(); n != 0 {
+		t.Errorf("generated %d thumbnails for paths outside the root", n)
+	}
+}
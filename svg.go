@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// isSVGFile reports whether an image is an SVG drawing
+func isSVGFile(path string) bool {
+	return strings.ToLower(filepath.Ext(path)) == ".svg"
+}
+
+// vipsHasSVGLoader reports whether vips was built with librsvg, by looking
+// for the svgload operation in vips -l
+func (s *Server) vipsHasSVGLoader() bool {
+	out, err := s.runner.command(context.Background(), vipsTool("vips"), "-l").Output()
+	return err == nil && bytes.Contains(out, []byte("svgload"))
+}
+
+// serveSVG serves an SVG drawing as is, since browsers render it natively
+// in an <img>. Drawings can carry scripts, so they are sandboxed from the
+// gallery's origin and opening one on its own downloads it.
+func (s *Server) serveSVG(w http.ResponseWriter, r *http.Request, fullPath string) {
+	w.Header().Set("Content-Type", "image/svg+xml")
+	setAttachmentHeaders(w, fullPath)
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+	s.store.ServeFile(w, r, fullPath)
+}
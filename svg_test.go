@@ -0,0 +1,13 @@
+package main
+
+import "testing"
+
+func TestSVGLoaderProbeUsesRunner(t *testing.T) {
+	s := newTestServer(t)
+	runner := &recordingRunner{dir: t.TempDir()}
+	s.runner = runner
+	s.vipsHasSVGLoader()
+	if n := runner.calls.Load(); n != 1 {
+		t.Errorf("probing for the SVG loader started %d processes through the runner, want 1", n)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"maps"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// themeCookieName remembers the theme a visitor picked with ?theme=
+	themeCookieName = "gallery_theme"
+	// defaultThemeName is the theme used unless another one is picked
+	defaultThemeName = "index"
+	// themeCookieMaxAge is how long a browser keeps its theme choice
+	themeCookieMaxAge = 365 * 24 * time.Hour
+)
+
+// themeSet holds the index templates by theme name
+type themeSet map[string]*template.Template
+
+// loadThemes parses every .html file in dir as an index template, named
+// after the file: dark.html is the theme "dark". index.html is the default;
+// without it the first theme in alphabetical order is.
+func loadThemes(dir string) (themeSet, string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(paths) == 0 {
+		return nil, "", fmt.Errorf("no .html templates in %s", dir)
+	}
+	themes := make(themeSet)
+	for _, path := range paths {
+		tmpl, err := template.ParseFiles(path)
+		if err != nil {
+			return nil, "", err
+		}
+		themes[strings.TrimSuffix(filepath.Base(path), ".html")] = tmpl
+	}
+	defaultTheme := defaultThemeName
+	if themes[defaultTheme] == nil {
+		defaultTheme = slices.Sorted(maps.Keys(themes))[0]
+	}
+	return themes, defaultTheme, nil
+}
+
+// themeFor picks the index template for a request: ?theme= if it names a
+// known theme, which is then remembered in a cookie, else the remembered
+// theme, else the default. Unknown names fall back silently.
+func (s *Server) themeFor(w http.ResponseWriter, r *http.Request) (string, *template.Template) {
+	if len(s.themes) == 0 {
+		return defaultThemeName, s.indexTmpl
+	}
+	// The page depends on the cookie, so shared caches must not mix themes
+	w.Header().Add("Vary", "Cookie")
+
+	if name := r.URL.Query().Get("theme"); name != "" {
+		if tmpl, ok := s.themes[name]; ok {
+			http.SetCookie(w, &http.Cookie{
+				Name:     themeCookieName,
+				Value:    name,
+				Path:     s.urlWithBasePath("/"),
+				MaxAge:   int(themeCookieMaxAge.Seconds()),
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+			return name, tmpl
+		}
+	}
+	if cookie, err := r.Cookie(themeCookieName); err == nil {
+		if tmpl, ok := s.themes[cookie.Value]; ok {
+			return cookie.Value, tmpl
+		}
+	}
+	return s.defaultTheme, s.indexTmpl
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"os/exec"
+)
+
+// Categories of thumbnail generation failures. A few corrupt or unsupported
+// files are expected in any library, a missing binary or repeated timeouts
+// mean the server itself needs attention.
+const (
+	failureUnsupported   = "unsupported"    // the tool doesn't understand the format
+	failureCorrupt       = "corrupt"        // the tool failed on a supported format
+	failureMissingBinary = "missing-binary" // vips or ffmpeg could not be started
+	failureTimeout       = "timeout"        // generation exceeded its deadline
+	failureIO            = "io"             // reading the source or writing the cache failed
+	failureOther         = "other"
+)
+
+// unsupportedFormatMessages are stderr fragments from vips and ffmpeg that
+// mean the input format, rather than the file, is the problem
+var unsupportedFormatMessages = [][]byte{
+	[]byte("is not a known file format"),
+	[]byte("not a known image format"),
+	[]byte("Decoder not found"),
+	[]byte("Unsupported codec"),
+}
+
+// thumbnailError is a generation failure tagged with its category
+type thumbnailError struct {
+	category string
+	err      error
+}
+
+func (e *thumbnailError) Error() string { return e.err.Error() }
+func (e *thumbnailError) Unwrap() error { return e.err }
+
+// thumbnailFailure tags err with a category
+func thumbnailFailure(category string, err error) error {
+	return &thumbnailError{category: category, err: err}
+}
+
+// thumbnailFailureCategory returns the category of a generation error
+func thumbnailFailureCategory(err error) string {
+	var te *thumbnailError
+	switch {
+	case errors.As(err, &te):
+		return te.category
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, errThumbnailTimeout):
+		return failureTimeout
+	}
+	return failureOther
+}
+
+// classifyToolFailure categorizes the failure of a vips or ffmpeg run from
+// the run error, the generation context and what the tool printed on stderr
+func classifyToolFailure(ctx context.Context, err error, stderr []byte) error {
+	switch {
+	case errors.Is(err, exec.ErrNotFound), errors.Is(err, fs.ErrNotExist), errors.Is(err, fs.ErrPermission):
+		return thumbnailFailure(failureMissingBinary, err)
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return thumbnailFailure(failureTimeout, err)
+	}
+	for _, msg := range unsupportedFormatMessages {
+		if bytes.Contains(stderr, msg) {
+			return thumbnailFailure(failureUnsupported, err)
+		}
+	}
+	return thumbnailFailure(failureCorrupt, err)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// parseThumbnailPad validates -thumbnail-pad, an aspect ratio such as 4:3,
+// and returns it in the form used in cache names, e.g. 4x3
+func parseThumbnailPad(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	w, h, ok := strings.Cut(value, ":")
+	width, errW := strconv.Atoi(w)
+	height, errH := strconv.Atoi(h)
+	if !ok || errW != nil || errH != nil || width <= 0 || height <= 0 {
+		return "", fmt.Errorf("invalid aspect ratio %q, expected e.g. 4:3", value)
+	}
+	return fmt.Sprintf("%dx%d", width, height), nil
+}
+
+// padAspect returns the aspect ratio a variant is padded to, as width and
+// height; ok is false for unpadded variants
+func (v thumbnailVariant) padAspect() (width, height int, ok bool) {
+	w, h, found := strings.Cut(v.pad, "x")
+	width, errW := strconv.Atoi(w)
+	height, errH := strconv.Atoi(h)
+	return width, height, found && errW == nil && errH == nil && width > 0 && height > 0
+}
+
+// padThumbnail pads a generated thumbnail of imagePath in place to the
+// aspect ratio of its variant, centred on the thumbnail background, so tiles
+// of mixed shapes line up in a grid without cropping anything. vips extends
+// the canvas with gravity, keeping the format and save options of the
+// thumbnail; the result is written next to it and renamed over it.
+func (s *Server) padThumbnail(ctx context.Context, imagePath, thumbnailPath string, variant thumbnailVariant) error {
+	aspectW, aspectH, ok := variant.padAspect()
+	if !ok {
+		return nil
+	}
+	thumbW, thumbH, err := readImageDimensions(ctx, s.runner, thumbnailPath)
+	if err != nil {
+		return fmt.Errorf("failed to read thumbnail size: %w", err)
+	}
+
+	// Grow the short side only, the image itself is never scaled
+	width, height := thumbW, thumbH
+	if width*aspectH > height*aspectW {
+		height = (width*aspectH + aspectW/2) / aspectW
+	} else {
+		width = (height*aspectW + aspectH/2) / aspectH
+	}
+	if width == thumbW && height == thumbH {
+		return nil
+	}
+	if s.nativeThumbnails || s.vipsMissing {
+		return s.padNativeThumbnail(thumbnailPath, variant, width, height)
+	}
+
+	tmpPath := thumbnailPath + ".tmp" + filepath.Ext(thumbnailPath)
+	cmd := s.runner.command(ctx, vipsTool("vips"), "gravity", thumbnailPath, tmpPath+s.thumbnailSaveOptions(imagePath, variant),
+		"centre", strconv.Itoa(width), strconv.Itoa(height), "--extend", "background", "--background", s.thumbnailBackground)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to pad thumbnail: %w: %s", err, bytes.TrimSpace(out))
+	}
+	return os.Rename(tmpPath, thumbnailPath)
+}
+
+// padNativeThumbnail pads a thumbnail to width x height like padThumbnail,
+// without vips, for -native-thumbnails
+func (s *Server) padNativeThumbnail(thumbnailPath string, variant thumbnailVariant, width, height int) error {
+	file, err := os.Open(thumbnailPath)
+	if err != nil {
+		return err
+	}
+	img, err := jpeg.Decode(file)
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to decode thumbnail: %w", err)
+	}
+
+	b := img.Bounds()
+	canvas := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(s.backgroundColor()), image.Point{}, draw.Src)
+	offset := image.Pt((width-b.Dx())/2, (height-b.Dy())/2)
+	draw.Draw(canvas, image.Rectangle{Min: offset, Max: offset.Add(b.Size())}, img, b.Min, draw.Src)
+
+	tmpPath := thumbnailPath + ".tmp.jpg"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	err = jpeg.Encode(out, canvas, &jpeg.Options{Quality: cmp.Or(variant.quality, nativeDefaultQuality)})
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write padded thumbnail: %w", err)
+	}
+	return os.Rename(tmpPath, thumbnailPath)
+}
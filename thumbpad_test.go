@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPadThumbnailExtendsWithVips(t *testing.T) {
+	s := newTestServer(t)
+	s.nativeThumbnails = false
+	s.thumbnailBackground = "255 255 255"
+	fakeVips(t)
+	// vips stands next to vipsthumbnail, logging its arguments and copying
+	// its input to its output
+	logPath := filepath.Join(filepath.Dir(vipsPath), "vips.log")
+	script := `#!/bin/sh
+printf '%s\n' "$@" > ` + logPath + `
+cp "$2" "${3%%\[*}"
+`
+	if err := os.WriteFile(filepath.Join(filepath.Dir(vipsPath), "vips"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	thumbnailPath := writeTestJPEG(t, s, "thumb.jpg", 40, 40)
+
+	if err := s.padThumbnail(t.Context(), thumbnailPath, thumbnailPath, thumbnailVariant{size: 40, pad: "4x3"}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := strings.Split(strings.TrimSpace(string(data)), "\n")
+	want := []string{"gravity", thumbnailPath, "centre", "53", "40", "--extend", "background", "--background", "255 255 255"}
+	if len(args) != 10 || args[0] != want[0] || args[1] != want[1] || !strings.HasPrefix(args[2], thumbnailPath+".tmp.jpg") ||
+		strings.Join(args[3:], "|") != strings.Join(want[2:], "|") {
+		t.Errorf("vips %q, want %q with the output after the input", args, want)
+	}
+}
+
+func TestPadThumbnailNative(t *testing.T) {
+	s := newTestServer(t)
+	thumbnailPath := writeTestJPEG(t, s, "thumb.jpg", 40, 40)
+
+	if err := s.padThumbnail(t.Context(), thumbnailPath, thumbnailPath, thumbnailVariant{size: 40, pad: "4x3"}); err != nil {
+		t.Fatal(err)
+	}
+	if w, h := thumbnailSize(t, thumbnailPath); w != 53 || h != 40 {
+		t.Errorf("padded thumbnail is %dx%d, want 53x40", w, h)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"log"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// minToolProbeInterval keeps -tool-probe-interval from spawning processes
+// more often than monitoring needs
+const minToolProbeInterval = time.Minute
+
+// toolProbeTimeout bounds one probe, so a hanging tool counts as failing
+const toolProbeTimeout = 10 * time.Second
+
+// toolHealth is the outcome of the probes of one external tool
+type toolHealth struct {
+	Healthy     bool       `json:"healthy"`
+	CheckedAt   time.Time  `json:"checkedAt"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+	LastErrorAt *time.Time `json:"lastErrorAt,omitempty"`
+}
+
+// toolProbes holds the latest health of each probed tool
+type toolProbes struct {
+	mu     sync.Mutex
+	health map[string]toolHealth
+}
+
+func newToolProbes() *toolProbes {
+	return &toolProbes{health: make(map[string]toolHealth)}
+}
+
+// record notes the outcome of one probe, logging when a tool starts
+// failing or recovers
+func (p *toolProbes) record(tool string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	health, seen := p.health[tool]
+	wasHealthy := health.Healthy
+	health.CheckedAt = now
+	health.Healthy = err == nil
+	if err == nil {
+		health.LastSuccess = &now
+		if seen && !wasHealthy {
+			log.Printf("Tool probe: %s works again", tool)
+		}
+	} else {
+		health.LastError = err.Error()
+		health.LastErrorAt = &now
+		if !seen || wasHealthy {
+			log.Printf("Tool probe: %s is failing: %v", tool, err)
+		}
+	}
+	p.health[tool] = health
+}
+
+// snapshot returns the health of every probed tool
+func (p *toolProbes) snapshot() map[string]toolHealth {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return maps.Clone(p.health)
+}
+
+// probeToolsPeriodically checks right away and then every interval that
+// vips and ffmpeg still convert a tiny image. Tools the server doesn't use,
+// like vips when it wasn't found at startup, are not probed.
+func (s *Server) probeToolsPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if !s.nativeThumbnails && !s.vipsMissing {
+			s.toolProbes.record("vips", probeVips())
+		}
+		if !s.nativeThumbnails {
+			s.toolProbes.record("ffmpeg", probeFFmpeg())
+		}
+		<-ticker.C
+	}
+}
+
+// probeVips thumbnails an 8x8 PNG with vipsthumbnail
+func probeVips() error {
+	ctx, cancel := context.WithTimeout(context.Background(), toolProbeTimeout)
+	defer cancel()
+	dir, err := os.MkdirTemp("", "tool-probe")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "probe.png")
+	file, err := os.Create(input)
+	if err != nil {
+		return err
+	}
+	err = png.Encode(file, image.NewGray(image.Rect(0, 0, 8, 8)))
+	file.Close()
+	if err != nil {
+		return err
+	}
+	return runProbe(exec.CommandContext(ctx, vipsExecutable(), input, "-s", "4", "-o", filepath.Join(dir, "probe.jpg")))
+}
+
+// probeFFmpeg encodes one frame of a generated test source to JPEG,
+// discarding the output
+func probeFFmpeg() error {
+	ctx, cancel := context.WithTimeout(context.Background(), toolProbeTimeout)
+	defer cancel()
+	return runProbe(exec.CommandContext(ctx, ffmpegExecutable(), "-v", "error", "-f", "lavfi", "-i", "color=c=black:s=16x16",
+		"-frames:v", "1", "-c:v", "mjpeg", "-f", "null", "-"))
+}
+
+// runProbe runs a probe command, reporting its stderr on failure
+func runProbe(cmd *exec.Cmd) error {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := bytes.TrimSpace(stderr.Bytes()); len(msg) > 0 {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// getTranscodePath returns the path of the pre-transcoded preview for a movie
+// e.g., clip.mov -> .small/clip.mov.ts
+func getTranscodePath(moviePath string) string {
+	dir := filepath.Dir(moviePath)
+	baseName := cacheName(filepath.Base(moviePath))
+	return filepath.Join(thumbnailDirFor(dir), baseName+".ts")
+}
+
+// movieQuality is a rung of the movie preview resolution ladder
+type movieQuality struct {
+	height  int    // maximum output height, smaller movies aren't upscaled
+	bitrate string // video bitrate
+}
+
+// movieQualities are the preview resolutions a client can pick with ?quality=
+var movieQualities = map[string]movieQuality{
+	"360":  {height: 360, bitrate: "800k"},
+	"720":  {height: 720, bitrate: "2500k"},
+	"1080": {height: 1080, bitrate: "5000k"},
+}
+
+// defaultMovieQuality keeps the source resolution at a low bitrate. It is
+// the only quality that is pre-transcoded into the cache.
+var defaultMovieQuality = movieQuality{bitrate: "500k"}
+
+// movieQualityForRequest returns the quality a preview request asks for
+func movieQualityForRequest(r *http.Request) (movieQuality, bool) {
+	param := r.URL.Query().Get("quality")
+	if param == "" {
+		return defaultMovieQuality, true
+	}
+	quality, ok := movieQualities[param]
+	return quality, ok
+}
+
+// transcodeOptions select part of a movie to transcode
+type transcodeOptions struct {
+	input  []string // go before the input, e.g. a seek
+	output []string // go before the output, e.g. a timestamp offset
+}
+
+// transcodeArgs returns the ffmpeg arguments used to transcode a movie preview
+// to MPEG-TS at the given quality, written to output (a file path or "pipe:1").
+// codec is the movie's video codec, from videoCodec, which picks the hardware
+// decoder going with the encoder.
+func transcodeArgs(encoder videoEncoder, inputPath, output string, quality movieQuality, codec string, opts transcodeOptions) []string {
+	args := slices.Clone(encoder.inputArgs)
+	if decoder := encoder.decoderFor(codec); decoder != "" {
+		args = append(args, "-c:v", decoder)
+	}
+	args = append(args, opts.input...)
+	args = append(args,
+		"-loglevel", "quiet",
+		"-autorotate",
+		"-i", inputPath,
+		"-c:a", "aac",
+		"-b:a", "64k",
+		"-c:v", encoder.encoder,
+		"-b:v", quality.bitrate,
+	)
+	args = append(args, encoder.outputArgs...)
+	var filters []string
+	if quality.height > 0 {
+		filters = append(filters, fmt.Sprintf("scale=-2:'min(%d,ih)'", quality.height))
+	}
+	if encoder.filter != "" {
+		filters = append(filters, encoder.filter)
+	}
+	if len(filters) > 0 {
+		args = append(args, "-vf", strings.Join(filters, ","))
+	}
+	args = append(args, opts.output...)
+	// Write packets out as soon as they are muxed, so a streamed preview
+	// starts arriving right away instead of after the first buffer fills
+	return append(args, "-flush_packets", "1", "-f", "mpegts", output)
+}
+
+// freshTranscode returns the cached preview for a movie if it exists and is
+// not older than the movie itself
+func (s *Server) freshTranscode(ctx context.Context, moviePath string) (string, bool) {
+	transcodePath := getTranscodePath(moviePath)
+	cached, err := os.Stat(transcodePath)
+	if err != nil {
+		return "", false
+	}
+	source, err := s.store.Stat(ctx, moviePath)
+	if err != nil || cached.ModTime().Before(source.ModTime()) {
+		return "", false
+	}
+	return transcodePath, true
+}
+
+// transcodeToCache transcodes a movie into the preview cache. Output goes to a
+// temporary file first so an interrupted transcode never leaves a partial preview.
+func (s *Server) transcodeToCache(ctx context.Context, moviePath string) (err error) {
+	if s.isSkippedFile(ctx, moviePath) {
+		return skippedFileError(moviePath)
+	}
+	fileCtx, cancel := s.fileTimeContext(ctx)
+	defer cancel()
+	defer func(parent context.Context) { s.noteFileTime(parent, fileCtx, moviePath, "transcoding", err) }(ctx)
+	ctx = fileCtx
+
+	transcodePath := getTranscodePath(moviePath)
+	if err := os.MkdirAll(filepath.Dir(transcodePath), 0755); err != nil {
+		return fmt.Errorf("failed to create thumbnail directory: %w", err)
+	}
+	input, err := s.store.Locate(ctx, moviePath)
+	if err != nil {
+		return fmt.Errorf("failed to locate movie: %w", err)
+	}
+
+	tmpPath := transcodePath + ".tmp"
+	codec := s.videoCodecFor(ctx, moviePath, input)
+	err = s.runTranscode(ctx, func(encoder videoEncoder) *exec.Cmd {
+		cmd := s.runner.command(ctx, ffmpegExecutable(), append([]string{"-y"}, transcodeArgs(encoder, input, tmpPath, defaultMovieQuality, codec, transcodeOptions{})...)...)
+		cmd.Stderr = os.Stderr
+		return cmd
+	}, nil)
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to transcode movie: %w", err)
+	}
+	if err := os.Rename(tmpPath, transcodePath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to store transcoded movie: %w", err)
+	}
+	return nil
+}
+
+// keepTranscode copies a complete live transcode of a movie into the preview
+// cache. The spool may be on another file system, so it is copied to a
+// temporary file next to the cached preview and renamed into place.
+func keepTranscode(spool *os.File, moviePath string) error {
+	transcodePath := getTranscodePath(moviePath)
+	if err := os.MkdirAll(filepath.Dir(transcodePath), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(transcodePath), filepath.Base(transcodePath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, io.NewSectionReader(spool, 0, math.MaxInt64))
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), transcodePath)
+}
+
+// pretranscodeMovies walks the root directory and transcodes every movie that
+// has no fresh cached preview. Movies are processed one at a time since each
+// transcode already saturates the encoder.
+func (s *Server) pretranscodeMovies(ctx context.Context) (transcoded, failed int, err error) {
+	err = s.pretranscodeDir(ctx, s.rootDir, &transcoded, &failed)
+	return transcoded, failed, err
+}
+
+// pretranscodeDir transcodes the movies in one directory and recurses into
+// its subdirectories, skipping hidden ones like .small
+func (s *Server) pretranscodeDir(ctx context.Context, dir string, transcoded, failed *int) error {
+	entries, err := s.store.ReadDir(ctx, dir)
+	if err != nil {
+		// Skip unreadable directories but keep walking
+		log.Printf("Skipping %s: %v", dir, err)
+		return nil
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") || s.isExcluded(entry.Name()) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if entry.IsDir() {
+			if err := s.pretranscodeDir(ctx, path, transcoded, failed); err != nil {
+				return err
+			}
+			continue
+		}
+		if !isMovieFile(path) {
+			continue
+		}
+		if _, ok := s.freshTranscode(ctx, path); ok {
+			continue
+		}
+
+		log.Printf("Transcoding %s", path)
+		if err := s.transcodeToCache(ctx, path); err != nil {
+			log.Printf("Failed to transcode %s: %v", path, err)
+			*failed++
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			continue
+		}
+		*transcoded++
+	}
+	return nil
+}
+
+// idleWatch notices a process that stops producing output
+type idleWatch struct {
+	idle       time.Duration
+	lastOutput atomic.Int64 // unix nanoseconds
+	stalled    atomic.Bool
+}
+
+// touch records output
+func (iw *idleWatch) touch() {
+	iw.lastOutput.Store(time.Now().UnixNano())
+}
+
+// watchIdle cancels the stream once its process has produced nothing for the
+// idle timeout. A slow transcode keeps writing and runs as long as it needs,
+// a stuck one is killed. It returns when ctx is done.
+func (iw *idleWatch) watchIdle(ctx context.Context, cancel context.CancelFunc) {
+	if iw.idle <= 0 {
+		return
+	}
+	ticker := time.NewTicker(min(iw.idle/4, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if time.Since(time.Unix(0, iw.lastOutput.Load())) > iw.idle {
+				iw.stalled.Store(true)
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// streamWriter passes streamed process output straight to the client. Every
+// write is flushed, so proxies in between see bytes as soon as ffmpeg
+// produces them, and with an idle timeout each write gets a fresh deadline
+// instead of one for the whole, possibly very long, response.
+type streamWriter struct {
+	*responseTracker
+	idleWatch
+	rc *http.ResponseController
+}
+
+func newStreamWriter(w http.ResponseWriter, idle time.Duration) *streamWriter {
+	sw := &streamWriter{
+		responseTracker: &responseTracker{ResponseWriter: w},
+		rc:              http.NewResponseController(w),
+	}
+	sw.idle = idle
+	sw.touch()
+	return sw
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	if sw.idle > 0 {
+		sw.rc.SetWriteDeadline(time.Now().Add(sw.idle))
+	}
+	n, err := sw.responseTracker.Write(p)
+	sw.touch()
+	if err == nil {
+		sw.rc.Flush()
+	}
+	return n, err
+}
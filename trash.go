@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// trashDirName is the directory under the root that deleted files are moved
+// to by default, mirroring the tree, see -trash-dir. It is hidden like
+// .small, so it is never listed.
+const trashDirName = ".trash"
+
+// trashStampFormat is appended to a file moved to the trash when its name is
+// taken there already
+const trashStampFormat = "20060102-150405.000"
+
+// trashStamp matches what trashStampFormat appends, before the extension
+var trashStamp = regexp.MustCompile(`\.\d{8}-\d{6}\.\d{3}$`)
+
+var errRestoreExists = errors.New("file exists, restore with ?overwrite=1 to replace it")
+
+// trashedFile is a file in the trash as GET /api/trash lists it
+type trashedFile struct {
+	Path     string `json:"path"`     // in the trash, for restoring
+	Original string `json:"original"` // where it is restored to
+	Size     int64  `json:"size"`
+}
+
+// trashRoot returns the directory deleted files are moved to
+func (s *Server) trashRoot() string {
+	if s.trashDir != "" {
+		return s.trashDir
+	}
+	return filepath.Join(s.rootDir, trashDirName)
+}
+
+// trashPathFor resolves a slash-separated path in the trash, false if it
+// escapes the trash
+func (s *Server) trashPathFor(path string) (string, bool) {
+	trash := s.trashRoot()
+	fullPath := filepath.Join(trash, filepath.Clean(filepath.FromSlash("/"+path)))
+	if fullPath == trash {
+		return "", false
+	}
+	return fullPath, true
+}
+
+// originalPathFor returns the URL path a file in the trash was deleted from
+func originalPathFor(trashURLPath string) string {
+	ext := filepath.Ext(trashURLPath)
+	return trashStamp.ReplaceAllString(strings.TrimSuffix(trashURLPath, ext), "") + ext
+}
+
+// handleDeleteFile moves a file to the trash, see -writable and -trash-dir.
+// The trash keeps the file's place in the tree; a name already taken there
+// gets the time of deletion appended. The thumbnails go along, so a restored
+// file doesn't need them made again. ?permanent=1 deletes the file for good
+// instead. DELETE /api/trash empties the trash.
+func (s *Server) handleDeleteFile(w http.ResponseWriter, r *http.Request) {
+	if !s.writable || r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fullPath, ok := s.resolvePath(strings.TrimPrefix(r.URL.Path, "/api/file"))
+	if !ok || fullPath == s.rootDir {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+	urlPath := s.urlPathFor(fullPath)
+	if s.isExcludedPath(urlPath) || strings.Contains(urlPath, "/.") {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+	info, err := os.Lstat(fullPath)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if info.IsDir() {
+		http.Error(w, "Only files can be deleted", http.StatusBadRequest)
+		return
+	}
+
+	if r.URL.Query().Get("permanent") == "1" {
+		if err := os.Remove(fullPath); err != nil {
+			s.uploadFailed(w, err)
+			return
+		}
+		log.Printf("Deleted %s for good", fullPath)
+		dropCaches(fullPath)
+		s.generations.bump(filepath.Dir(fullPath))
+		respondJSON(w, map[string]string{"deleted": urlPath}, http.StatusOK)
+		return
+	}
+
+	trashPath := filepath.Join(s.trashRoot(), filepath.FromSlash(urlPath))
+	if err := os.MkdirAll(filepath.Dir(trashPath), 0755); err != nil {
+		s.uploadFailed(w, err)
+		return
+	}
+	if _, err := os.Lstat(trashPath); err == nil {
+		ext := filepath.Ext(trashPath)
+		trashPath = fmt.Sprintf("%s.%s%s", strings.TrimSuffix(trashPath, ext), time.Now().Format(trashStampFormat), ext)
+	}
+	if err := os.Rename(fullPath, trashPath); err != nil {
+		s.uploadFailed(w, err)
+		return
+	}
+	log.Printf("Moved %s to the trash", fullPath)
+
+	moveThumbnails(fullPath, trashPath)
+	s.generations.bump(filepath.Dir(fullPath))
+	relPath, _ := filepath.Rel(s.trashRoot(), trashPath)
+	respondJSON(w, map[string]string{
+		"trashed": "/" + filepath.ToSlash(relPath),
+	}, http.StatusOK)
+}
+
+// handleTrash lists the trash with GET and empties it for good with DELETE,
+// or with ?path= removes one file from it, see handleDeleteFile
+func (s *Server) handleTrash(w http.ResponseWriter, r *http.Request) {
+	if !s.writable {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	trash := s.trashRoot()
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		files := []trashedFile{}
+		filepath.WalkDir(trash, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if entry.IsDir() {
+				if path != trash && isCacheDirName(entry.Name()) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return nil
+			}
+			relPath, _ := filepath.Rel(trash, path)
+			urlPath := "/" + filepath.ToSlash(relPath)
+			files = append(files, trashedFile{Path: urlPath, Original: originalPathFor(urlPath), Size: info.Size()})
+			return nil
+		})
+		w.Header().Set("Cache-Control", "no-store")
+		respondJSON(w, map[string][]trashedFile{"files": files}, http.StatusOK)
+	case http.MethodDelete:
+		if path := r.URL.Query().Get("path"); path != "" {
+			trashPath, ok := s.trashPathFor(path)
+			if !ok {
+				http.Error(w, "Access denied", http.StatusForbidden)
+				return
+			}
+			if err := os.Remove(trashPath); err != nil {
+				s.uploadFailed(w, err)
+				return
+			}
+			removeThumbnails(filepath.Dir(trashPath), []string{trashPath}, false)
+			os.Remove(getDimensionsPath(trashPath))
+			log.Printf("Deleted %s from the trash", trashPath)
+			respondJSON(w, map[string]int{"removed": 1}, http.StatusOK)
+			return
+		}
+		s.emptyTrash(w, trash)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// emptyTrash removes everything in the trash, thumbnails included
+func (s *Server) emptyTrash(w http.ResponseWriter, trash string) {
+	removed := 0
+	filepath.WalkDir(trash, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if entry.IsDir() && isCacheDirName(entry.Name()) {
+			return filepath.SkipDir
+		}
+		if !entry.IsDir() {
+			removed++
+		}
+		return nil
+	})
+	if err := os.RemoveAll(trash); err != nil {
+		log.Printf("Failed to empty the trash: %v", err)
+		http.Error(w, "Failed to empty the trash", http.StatusInternalServerError)
+		return
+	}
+	// Under -cache-dir the thumbnails of the trash are kept elsewhere
+	if cached := filepath.Dir(thumbnailDirFor(trash)); cached != trash {
+		os.RemoveAll(cached)
+	}
+	log.Printf("Emptied the trash, %d files removed", removed)
+	respondJSON(w, map[string]int{"removed": removed}, http.StatusOK)
+}
+
+// handleTrashRestore moves the file at ?path= in the trash, as
+// handleDeleteFile answered it, back to where it was deleted from, along
+// with its thumbnails. A file that has taken its place is only replaced
+// with ?overwrite=1.
+func (s *Server) handleTrashRestore(w http.ResponseWriter, r *http.Request) {
+	if !s.writable || r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := r.URL.Query().Get("path")
+	trashPath, ok := s.trashPathFor(path)
+	if !ok {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+	info, err := os.Lstat(trashPath)
+	if err != nil || info.IsDir() {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	relPath, _ := filepath.Rel(s.trashRoot(), trashPath)
+	dest, ok := s.resolvePath(originalPathFor("/" + filepath.ToSlash(relPath)))
+	if !ok {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+	urlPath := s.urlPathFor(dest)
+	if s.isExcludedPath(urlPath) || strings.Contains(urlPath, "/.") {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+	overwrite := r.URL.Query().Get("overwrite") == "1"
+	if _, err := os.Lstat(dest); err == nil && !overwrite {
+		s.uploadFailed(w, errRestoreExists)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		s.uploadFailed(w, err)
+		return
+	}
+	if err := os.Rename(trashPath, dest); err != nil {
+		s.uploadFailed(w, err)
+		return
+	}
+	log.Printf("Restored %s from the trash", dest)
+
+	// Renditions of a file the restored one replaced don't show it
+	dropCaches(dest)
+	moveThumbnails(trashPath, dest)
+	s.generations.bump(filepath.Dir(dest))
+	respondJSON(w, map[string]string{"restored": urlPath}, http.StatusOK)
+}
+
+// moveThumbnails moves the cached thumbnails and dimensions of a file that
+// was moved from one path to another along with it. They are validated by
+// the file's mtime, which a move keeps. Those that can't be moved are made
+// again when asked for.
+func moveThumbnails(from, to string) {
+	fromDir, toDir := thumbnailDirFor(filepath.Dir(from)), thumbnailDirFor(filepath.Dir(to))
+	thumbnails, _ := removeThumbnails(filepath.Dir(from), []string{from}, true)
+	if len(thumbnails) > 0 {
+		if err := os.MkdirAll(toDir, 0755); err != nil {
+			dropCaches(from)
+			return
+		}
+	}
+	fromBase, toBase := cacheName(filepath.Base(from)), cacheName(filepath.Base(to))
+	for _, path := range thumbnails {
+		// Past the name of the file come the rendition and the format
+		rendition := strings.TrimPrefix(path, filepath.Join(fromDir, fromBase))
+		if err := os.Rename(path, filepath.Join(toDir, toBase+rendition)); err != nil {
+			os.Remove(path)
+		}
+	}
+	if os.Rename(getDimensionsPath(from), getDimensionsPath(to)) != nil {
+		os.Remove(getDimensionsPath(from))
+	}
+}
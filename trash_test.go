@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTrashKeepsThumbnailsAndRestores(t *testing.T) {
+	s := newTestServer(t)
+	s.writable = true
+	mux := s.newMux()
+	photo := writeTestJPEG(t, s, "trip/photo.jpg", 40, 30)
+	thumbnail := s.thumbnailPathFor(photo, defaultThumbnailVariant())
+	if err := os.MkdirAll(filepath.Dir(thumbnail), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(thumbnail, []byte("thumbnail"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/api/file/trip/photo.jpg", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("delete: status %d: %s", rec.Code, rec.Body)
+	}
+	var deleted map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &deleted); err != nil {
+		t.Fatal(err)
+	}
+	if deleted["trashed"] != "/trip/photo.jpg" {
+		t.Fatalf("trashed = %q, want /trip/photo.jpg", deleted["trashed"])
+	}
+	trashed := filepath.Join(s.rootDir, trashDirName, "trip", "photo.jpg")
+	if _, err := os.Stat(s.thumbnailPathFor(trashed, defaultThumbnailVariant())); err != nil {
+		t.Errorf("thumbnail didn't move to the trash: %v", err)
+	}
+	if _, err := os.Stat(thumbnail); err == nil {
+		t.Error("thumbnail left behind")
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/trash/restore?path=/trip/photo.jpg", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("restore: status %d: %s", rec.Code, rec.Body)
+	}
+	if _, err := os.Stat(photo); err != nil {
+		t.Errorf("photo not restored: %v", err)
+	}
+	if data, err := os.ReadFile(thumbnail); err != nil || string(data) != "thumbnail" {
+		t.Errorf("thumbnail not restored: %v", err)
+	}
+}
+
+func TestOriginalPathFor(t *testing.T) {
+	if got := originalPathFor("/trip/photo.20240102-030405.678.jpg"); got != "/trip/photo.jpg" {
+		t.Errorf("originalPathFor = %q, want /trip/photo.jpg", got)
+	}
+	if got := originalPathFor("/trip/photo.jpg"); got != "/trip/photo.jpg" {
+		t.Errorf("originalPathFor = %q, want /trip/photo.jpg", got)
+	}
+}
+
+func TestPermanentDelete(t *testing.T) {
+	s := newTestServer(t)
+	s.writable = true
+	photo := writeTestJPEG(t, s, "photo.jpg", 40, 30)
+
+	rec := httptest.NewRecorder()
+	s.newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/api/file/photo.jpg?permanent=1", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if _, err := os.Stat(photo); err == nil {
+		t.Error("photo still there")
+	}
+	if _, err := os.Stat(filepath.Join(s.rootDir, trashDirName)); err == nil {
+		t.Error("permanent delete used the trash")
+	}
+}
+
+func TestTrashRestoreEscape(t *testing.T) {
+	s := newTestServer(t)
+	s.writable = true
+	writeTestJPEG(t, s, "photo.jpg", 40, 30)
+
+	rec := httptest.NewRecorder()
+	s.newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/trash/restore?path=/../photo.jpg", nil))
+	if rec.Code == http.StatusOK {
+		t.Fatal("restored a file from outside the trash")
+	}
+}
+
+func TestTrashIsNotServed(t *testing.T) {
+	s := newTestServer(t)
+	s.resizeWorkers(1, 1)
+	t.Cleanup(func() { s.resizeWorkers(0, 0) })
+	writeTestJPEG(t, s, trashDirName+"/trip/photo.jpg", 40, 30)
+	handler := s.newHandler(handlerOptions{})
+
+	for _, target := range []string{
+		"/static/.trash/trip/photo.jpg",
+		"/api/download/.trash/trip/photo.jpg",
+		"/api/info/.trash/trip/photo.jpg",
+		"/api/preview/.trash/trip/photo.jpg",
+		"/api/thumbnail/.trash/trip/photo.jpg",
+		"/api/list?path=/.trash/trip",
+		"/api/zip?path=/.trash/trip",
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code < 400 {
+			t.Errorf("%s: status %d, want an error", target, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// defaultUploadMaxBytes caps one upload request, or one resumable upload,
+// unless -upload-max-bytes says otherwise
+const defaultUploadMaxBytes = 4 << 30
+
+var (
+	errUploadName      = errors.New("invalid file name")
+	errUploadType      = errors.New("only images and movies can be uploaded")
+	errUploadExists    = errors.New("file exists, upload with ?overwrite=1 to replace it")
+	errUploadTooLarge  = errors.New("upload exceeds -upload-max-bytes")
+	errUploadCrossSite = errors.New("uploads are only taken from the gallery's own pages")
+)
+
+// uploadResponse lists the files saved by an upload, as they would be listed
+type uploadResponse struct {
+	Files []FileInfo `json:"files"`
+}
+
+// handleUpload saves the files of a multipart form into the directory given
+// by its path field, or ?path=, see -writable. The form is streamed, so the
+// path field must come before the files. Each file is written to a hidden
+// temporary file next to its destination and renamed into place once
+// complete, so listings never show half an upload. Existing files are only
+// replaced with ?overwrite=1. A request body over -upload-max-bytes is cut
+// off with 413.
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	if !s.writable || r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !sameOriginRequest(r) {
+		s.uploadFailed(w, errUploadCrossSite)
+		return
+	}
+	if s.uploadMaxBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, s.uploadMaxBytes)
+	}
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Expected multipart form data", http.StatusBadRequest)
+		return
+	}
+	overwrite := r.URL.Query().Get("overwrite") == "1"
+
+	dir := ""
+	if path := r.URL.Query().Get("path"); path != "" {
+		if dir, err = s.uploadDir(path); err != nil {
+			s.uploadFailed(w, err)
+			return
+		}
+	}
+	var saved []FileInfo
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if tooLarge := new(http.MaxBytesError); errors.As(err, &tooLarge) {
+				s.uploadFailed(w, err)
+				return
+			}
+			http.Error(w, "Invalid multipart form data", http.StatusBadRequest)
+			return
+		}
+		if part.FileName() == "" {
+			if part.FormName() == "path" {
+				value, _ := io.ReadAll(io.LimitReader(part, 4096))
+				if dir, err = s.uploadDir(string(value)); err != nil {
+					part.Close()
+					s.uploadFailed(w, err)
+					return
+				}
+			}
+			part.Close()
+			continue
+		}
+		if dir == "" {
+			part.Close()
+			http.Error(w, "The path field must come before the files", http.StatusBadRequest)
+			return
+		}
+		info, err := s.saveUpload(r, dir, part, overwrite)
+		part.Close()
+		if err != nil {
+			s.uploadFailed(w, err)
+			return
+		}
+		saved = append(saved, info)
+	}
+	if len(saved) == 0 {
+		http.Error(w, "No files uploaded", http.StatusBadRequest)
+		return
+	}
+	respondJSON(w, uploadResponse{Files: saved}, http.StatusCreated)
+}
+
+// sameOriginRequest reports whether a request comes from the gallery's own
+// pages or from outside a browser. Otherwise a form on another site could
+// have a visitor's browser upload files with its credentials. Browsers say
+// where a request comes from in Sec-Fetch-Site, older ones in Origin;
+// clients such as curl send neither.
+func sameOriginRequest(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		return true
+	case "":
+	default:
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	return u.Host == r.Host || u.Host == r.Header.Get("X-Forwarded-Host")
+}
+
+// uploadDir resolves the directory an upload goes to. Hidden and excluded
+// directories, .small and .trash among them, can't be written to.
+func (s *Server) uploadDir(path string) (string, error) {
+	fullPath, ok := s.resolvePath(path)
+	if !ok {
+		return "", fs.ErrPermission
+	}
+	urlPath := s.urlPathFor(fullPath)
+	if s.isExcludedPath(urlPath) || strings.Contains(urlPath, "/.") {
+		return "", fs.ErrPermission
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil || !info.IsDir() {
+		return "", fs.ErrNotExist
+	}
+	return fullPath, nil
+}
+
+// saveUpload streams one uploaded file into dir and queues its thumbnail
+func (s *Server) saveUpload(r *http.Request, dir string, part *multipart.Part, overwrite bool) (FileInfo, error) {
+	name, err := s.uploadName(part.FileName())
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if !overwrite {
+		if _, err := os.Lstat(filepath.Join(dir, name)); err == nil {
+			return FileInfo{}, errUploadExists
+		}
+	}
+
+	tmp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, part)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return s.finishUpload(r.Context(), tmp.Name(), dir, name, overwrite)
+}
+
+// uploadName checks the name an upload is stored under and returns its base
+func (s *Server) uploadName(fileName string) (string, error) {
+	name := filepath.Base(filepath.FromSlash(fileName))
+	if name == "." || name == string(filepath.Separator) || strings.HasPrefix(name, ".") || s.isExcluded(name) {
+		return "", errUploadName
+	}
+	if !s.uploadAnyType && !isImageFile(name) && !isMovieFile(name) {
+		return "", errUploadType
+	}
+	return name, nil
+}
+
+// finishUpload moves the complete upload at tmpPath into dir as name,
+// shrinking it first, see -max-stored-dimension, and queues its thumbnail.
+// It returns the file as a listing would show it.
+func (s *Server) finishUpload(ctx context.Context, tmpPath, dir, name string, overwrite bool) (FileInfo, error) {
+	dest := filepath.Join(dir, name)
+	if err := s.shrinkUpload(ctx, tmpPath, name); err != nil {
+		// Better the original than nothing
+		log.Printf("Storing %s at full size: %v", dest, err)
+	}
+	if err := placeUpload(tmpPath, dest, overwrite); err != nil {
+		return FileInfo{}, err
+	}
+	log.Printf("Uploaded %s", dest)
+
+	// The cached thumbnails of a replaced file are validated by mtime, which
+	// the upload may have kept
+	dropCaches(dest)
+	s.generations.bump(dir)
+	if isImageFile(dest) || isMovieFile(dest) {
+		s.enqueueThumbnail(dest, defaultThumbnailVariant())
+	}
+
+	info, err := os.Stat(dest)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	fileInfo, _ := s.listEntry(ctx, dir, s.urlPathFor(dir), fs.FileInfoToDirEntry(info), &listOptions{})
+	return fileInfo, nil
+}
+
+// resizableUploadExtensions are the formats -max-stored-dimension shrinks.
+// vips may not be able to write the others, and shrinking would keep only
+// the first frame of an animation.
+var resizableUploadExtensions = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+}
+
+// shrinkUpload downscales the uploaded image at tmpPath in place so that its
+// longest side is at most -max-stored-dimension. vipsthumbnail keeps the
+// metadata, with the orientation applied to the pixels and reset.
+func (s *Server) shrinkUpload(ctx context.Context, tmpPath, name string) error {
+	ext := strings.ToLower(filepath.Ext(name))
+	if s.maxStoredDimension <= 0 || !resizableUploadExtensions[ext] {
+		return nil
+	}
+	width, height, err := readImageDimensions(ctx, s.runner, tmpPath)
+	if err != nil {
+		return err
+	}
+	if max(width, height) <= s.maxStoredDimension {
+		return nil
+	}
+
+	// The extension picks the format vips writes
+	resizedPath := tmpPath + ext
+	defer os.Remove(resizedPath)
+	size := strconv.Itoa(s.maxStoredDimension)
+	cmd := s.runner.command(ctx, vipsExecutable(), tmpPath, "-s", size+"x"+size+">", "-o", resizedPath)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to resize: %w: %s", err, bytes.TrimSpace(out))
+	}
+	if err := os.Chmod(resizedPath, 0644); err != nil {
+		return err
+	}
+	return os.Rename(resizedPath, tmpPath)
+}
+
+// placeUpload moves a complete upload to dest. Without overwrite a hard link
+// claims dest only if it is still free; file systems without links fall
+// back to a rename after the earlier check.
+func placeUpload(tmpPath, dest string, overwrite bool) error {
+	if !overwrite {
+		err := os.Link(tmpPath, dest)
+		if errors.Is(err, fs.ErrExist) {
+			return errUploadExists
+		}
+		if err == nil {
+			return nil
+		}
+	}
+	return os.Rename(tmpPath, dest)
+}
+
+// uploadFailed responds to a failed upload or delete
+func (s *Server) uploadFailed(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, fs.ErrPermission):
+		http.Error(w, "Access denied", http.StatusForbidden)
+	case errors.Is(err, errUploadCrossSite):
+		http.Error(w, "Rejected: "+err.Error(), http.StatusForbidden)
+	case errors.Is(err, fs.ErrNotExist):
+		http.Error(w, "Not found", http.StatusNotFound)
+	case errors.Is(err, errUploadName), errors.Is(err, errUploadType):
+		http.Error(w, "Rejected: "+err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errUploadExists), errors.Is(err, errRestoreExists), errors.Is(err, errPartialUploadOffset), errors.Is(err, errPartialUploadBusy):
+		http.Error(w, "Rejected: "+err.Error(), http.StatusConflict)
+	case errors.Is(err, errPartialUploadLength), errors.Is(err, errUploadTooLarge):
+		http.Error(w, "Rejected: "+err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.As(err, new(*http.MaxBytesError)):
+		http.Error(w, "Rejected: "+errUploadTooLarge.Error(), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, syscall.ENOSPC):
+		log.Printf("Failed to save upload: %v", err)
+		http.Error(w, "Failed to save file: no space left", http.StatusInsufficientStorage)
+	default:
+		log.Printf("Failed to save upload: %v", err)
+		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+	}
+}
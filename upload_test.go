@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestResumableUpload(t *testing.T) {
+	s := newTestServer(t)
+	s.writable = true
+	if err := os.Mkdir(filepath.Join(s.rootDir, "trip"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	mux := s.newMux()
+	body := bytes.Repeat([]byte("movie"), 1000)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/uploads?path=/trip&name=clip.mp4&size="+strconv.Itoa(len(body)), nil))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("start: status %d: %s", rec.Code, rec.Body)
+	}
+	var started partialUploadResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &started); err != nil {
+		t.Fatal(err)
+	}
+	uploadURL := "/api/uploads/" + started.ID
+
+	patch := func(offset int, chunk []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, uploadURL, bytes.NewReader(chunk))
+		req.Header.Set("Upload-Offset", strconv.Itoa(offset))
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := patch(0, body[:2000]); rec.Code != http.StatusNoContent || rec.Header().Get("Upload-Offset") != "2000" {
+		t.Fatalf("first chunk: status %d, offset %q", rec.Code, rec.Header().Get("Upload-Offset"))
+	}
+	// A client that lost track resends from the wrong place
+	if rec := patch(1000, body[1000:]); rec.Code != http.StatusConflict || rec.Header().Get("Upload-Offset") != "2000" {
+		t.Fatalf("stale offset: status %d, offset %q", rec.Code, rec.Header().Get("Upload-Offset"))
+	}
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, uploadURL, nil))
+	if got := rec.Header().Get("Upload-Offset"); got != "2000" {
+		t.Fatalf("HEAD offset = %q, want 2000", got)
+	}
+	if _, err := os.Stat(filepath.Join(s.rootDir, "trip", "clip.mp4")); err == nil {
+		t.Fatal("unfinished upload is in the tree")
+	}
+
+	if rec := patch(2000, body[2000:]); rec.Code != http.StatusCreated {
+		t.Fatalf("last chunk: status %d: %s", rec.Code, rec.Body)
+	}
+	data, err := os.ReadFile(filepath.Join(s.rootDir, "trip", "clip.mp4"))
+	if err != nil || !bytes.Equal(data, body) {
+		t.Fatalf("stored upload differs: %v", err)
+	}
+	if len(s.movieThumbnailQueue) != 1 {
+		t.Errorf("%d thumbnails queued, want 1", len(s.movieThumbnailQueue))
+	}
+	if entries, _ := os.ReadDir(filepath.Join(s.rootDir, partialUploadsDirName)); len(entries) != 0 {
+		t.Errorf("%d partial upload files left", len(entries))
+	}
+}
+
+func TestResumableUploadRejectsExtraBytes(t *testing.T) {
+	s := newTestServer(t)
+	s.writable = true
+	mux := s.newMux()
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/uploads?path=/&name=a.jpg&size=4", nil))
+	var started partialUploadResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &started); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPatch, "/api/uploads/"+started.ID, bytes.NewReader([]byte("too long")))
+	req.Header.Set("Upload-Offset", "0")
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge || rec.Header().Get("Upload-Offset") != "0" {
+		t.Fatalf("status %d, offset %q", rec.Code, rec.Header().Get("Upload-Offset"))
+	}
+}
+
+func TestResumableUploadReportsWriteErrors(t *testing.T) {
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("no /dev/full to run out of space on")
+	}
+	s := newTestServer(t)
+	s.writable = true
+	mux := s.newMux()
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/uploads?path=/&name=clip.mp4&size=5", nil))
+	var started partialUploadResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &started); err != nil {
+		t.Fatal(err)
+	}
+	// Every write to /dev/full fails with ENOSPC
+	dataPath := filepath.Join(s.rootDir, partialUploadsDirName, started.ID)
+	if err := os.Remove(dataPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/dev/full", dataPath); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPatch, "/api/uploads/"+started.ID, bytes.NewReader([]byte("movie")))
+	req.Header.Set("Upload-Offset", "0")
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusInsufficientStorage || rec.Header().Get("Upload-Offset") != "0" {
+		t.Errorf("disk full: status %d, offset %q, want 507 at 0", rec.Code, rec.Header().Get("Upload-Offset"))
+	}
+}
+
+func TestUnknownUploadLeavesNoLock(t *testing.T) {
+	s := newTestServer(t)
+	s.writable = true
+	mux := s.newMux()
+
+	for _, method := range []string{http.MethodHead, http.MethodPatch, http.MethodDelete} {
+		req := httptest.NewRequest(method, "/api/uploads/0123456789abcdef0123456789abcdef", nil)
+		req.Header.Set("Upload-Offset", "0")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s: status %d, want 404", method, rec.Code)
+		}
+	}
+	s.partialUploadLocks.Range(func(id, _ any) bool {
+		t.Errorf("lock kept for unknown upload %v", id)
+		return true
+	})
+}
+
+// uploadRequest builds a multipart upload of files, by name, into dir
+func uploadRequest(t *testing.T, dir string, files map[string][]byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("path", dir)
+	for name, data := range files {
+		part, err := form.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(data)
+	}
+	form.Close()
+	req := httptest.NewRequest(http.MethodPost, "/api/upload", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req
+}
+
+func TestUploadMaxBytes(t *testing.T) {
+	s := newTestServer(t)
+	s.writable = true
+	s.uploadMaxBytes = 4096
+	if err := os.Mkdir(filepath.Join(s.rootDir, "trip"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	mux := s.newMux()
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, uploadRequest(t, "/trip", map[string][]byte{"clip.mp4": bytes.Repeat([]byte("movie"), 1000)}))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status %d, want 413", rec.Code)
+	}
+	entries, _ := os.ReadDir(filepath.Join(s.rootDir, "trip"))
+	if len(entries) != 0 {
+		t.Errorf("%d files left behind by a refused upload", len(entries))
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, uploadRequest(t, "/trip", map[string][]byte{"clip.mp4": []byte("movie")}))
+	if rec.Code != http.StatusCreated {
+		t.Errorf("small upload: status %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/uploads?path=/trip&name=big.mp4&size=4097", nil))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("resumable upload over the limit: status %d, want 413", rec.Code)
+	}
+}
+
+func TestUploadRefusesOtherSites(t *testing.T) {
+	s := newTestServer(t)
+	s.writable = true
+	if err := os.Mkdir(filepath.Join(s.rootDir, "trip"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	mux := s.newMux()
+
+	for i, test := range []struct {
+		header, value string
+		want          int
+	}{
+		{"Sec-Fetch-Site", "cross-site", http.StatusForbidden},
+		{"Sec-Fetch-Site", "same-site", http.StatusForbidden},
+		{"Origin", "https://evil.example", http.StatusForbidden},
+		{"Origin", "null", http.StatusForbidden},
+		{"Sec-Fetch-Site", "same-origin", http.StatusCreated},
+		{"Origin", "http://example.com", http.StatusCreated},
+		{"", "", http.StatusCreated},
+	} {
+		name := "photo" + strconv.Itoa(i) + ".jpg"
+		req := uploadRequest(t, "/trip", map[string][]byte{name: []byte("jpeg")})
+		if test.header != "" {
+			req.Header.Set(test.header, test.value)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != test.want {
+			t.Errorf("%s: %s: status %d, want %d", test.header, test.value, rec.Code, test.want)
+		}
+		_, err := os.Stat(filepath.Join(s.rootDir, "trip", name))
+		if saved := err == nil; saved != (test.want == http.StatusCreated) {
+			t.Errorf("%s: %s: saved %v", test.header, test.value, saved)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/uploads?path=/trip&name=clip.mp4&size=5", nil)
+	req.Header.Set("Sec-Fetch-Site", "cross-site")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("cross-site resumable upload: status %d, want 403", rec.Code)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// JPEG start and end of image markers
+var (
+	jpegSOI = []byte{0xFF, 0xD8}
+	jpegEOI = []byte{0xFF, 0xD9}
+)
+
+// verifyCache walks every .small directory under root, including the hashed
+// store, and deletes JPEG thumbnails that are truncated or otherwise not a
+// JPEG, so they are regenerated on the next request
+func (s *Server) verifyCache(root string) (checked, removed int) {
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			// Hidden directories other than the caches are never listed
+			if strings.HasPrefix(d.Name(), ".") && d.Name() != ".small" && path != root {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(d.Name(), ".jpg") || !isInCache(root, path) {
+			return nil
+		}
+		checked++
+		if jpegComplete(path) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			log.Printf("Failed to remove corrupt thumbnail %s: %v", path, err)
+			return nil
+		}
+		log.Printf("Removed corrupt thumbnail %s", path)
+		removed++
+		return nil
+	})
+	return checked, removed
+}
+
+// isInCache reports whether a path lies inside a .small directory
+func isInCache(root, path string) bool {
+	relPath, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	for _, part := range strings.Split(filepath.ToSlash(relPath), "/") {
+		if part == ".small" {
+			return true
+		}
+	}
+	return false
+}
+
+// jpegComplete does a quick structural check of a JPEG: it must start with
+// the SOI marker and end with the EOI marker, which a truncated write lacks
+func jpegComplete(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(file, head); err != nil || !bytes.Equal(head, jpegSOI) {
+		return false
+	}
+	tail := make([]byte, 2)
+	if _, err := file.Seek(-2, io.SeekEnd); err != nil {
+		return false
+	}
+	if _, err := io.ReadFull(file, tail); err != nil {
+		return false
+	}
+	return bytes.Equal(tail, jpegEOI)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// videoEncoder is an H.264 encoder that movie previews can be transcoded
+// with, together with what it needs around it
+type videoEncoder struct {
+	name       string   // the -video-encoder value, e.g. "qsv"
+	encoder    string   // ffmpeg encoder, e.g. h264_qsv
+	decoder    string   // suffix of the matching hardware decoders, e.g. "_qsv"; "" decodes in software
+	inputArgs  []string // before -i, e.g. the VA-API device
+	filter     string   // appended to the video filters, e.g. to upload frames
+	outputArgs []string // encoder options
+}
+
+// videoEncoders are the encoders -video-encoder can pick
+var videoEncoders = map[string]videoEncoder{
+	"qsv":          {name: "qsv", encoder: "h264_qsv", decoder: "_qsv"},
+	"nvenc":        {name: "nvenc", encoder: "h264_nvenc", decoder: "_cuvid"},
+	"vaapi":        {name: "vaapi", encoder: "h264_vaapi", inputArgs: []string{"-vaapi_device", "/dev/dri/renderD128"}, filter: "format=nv12,hwupload"},
+	"videotoolbox": {name: "videotoolbox", encoder: "h264_videotoolbox"},
+	"software":     {name: "software", encoder: "libx264", outputArgs: []string{"-preset", "veryfast"}},
+}
+
+// hardwareEncoderOrder is the order -video-encoder auto tries the hardware
+// encoders in before settling for software
+var hardwareEncoderOrder = []string{"qsv", "nvenc", "vaapi", "videotoolbox"}
+
+// ffmpegList returns the names from an ffmpeg listing such as "-encoders",
+// whose lines look like " V....D h264_qsv   H.264 (Intel Quick Sync ...)"
+func ffmpegList(option string) map[string]bool {
+	names := make(map[string]bool)
+	ctx, cancel := context.WithTimeout(context.Background(), toolProbeTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, ffmpegExecutable(), "-hide_banner", option).Output()
+	if err != nil {
+		return names
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || len(fields[0]) != 6 || fields[0] == "------" {
+			continue
+		}
+		names[fields[1]] = true
+	}
+	return names
+}
+
+// availableDecoders returns the decoders the configured ffmpeg has, read once
+var availableDecoders = sync.OnceValue(func() map[string]bool {
+	return ffmpegList("-decoders")
+})
+
+// selectVideoEncoder resolves -video-encoder. "auto" picks the first
+// hardware encoder that ffmpeg lists and that encodes a test frame, since
+// builds often list encoders for hardware the machine doesn't have, and
+// falls back to software.
+func selectVideoEncoder(name string) (videoEncoder, error) {
+	if name != "auto" {
+		encoder, ok := videoEncoders[name]
+		if !ok {
+			return videoEncoder{}, fmt.Errorf("unknown video encoder %q", name)
+		}
+		return encoder, nil
+	}
+	listed := ffmpegList("-encoders")
+	for _, candidate := range hardwareEncoderOrder {
+		encoder := videoEncoders[candidate]
+		if listed[encoder.encoder] && encoder.works() {
+			return encoder, nil
+		}
+	}
+	return videoEncoders["software"], nil
+}
+
+// works encodes a single black frame to check that the encoder's hardware
+// is really there
+func (e videoEncoder) works() bool {
+	args := append(slices.Clone(e.inputArgs), "-v", "error", "-f", "lavfi", "-i", "color=black:s=256x256:d=0.1", "-frames:v", "1")
+	if e.filter != "" {
+		args = append(args, "-vf", e.filter)
+	}
+	args = append(args, "-c:v", e.encoder, "-f", "null", "-")
+	ctx, cancel := context.WithTimeout(context.Background(), toolProbeTimeout)
+	defer cancel()
+	return exec.CommandContext(ctx, ffmpegExecutable(), args...).Run() == nil
+}
+
+// decoderFor returns the hardware decoder matching the encoder for a video
+// codec, "" to let ffmpeg decode it in software
+func (e videoEncoder) decoderFor(codec string) string {
+	if e.decoder == "" || codec == "" || !availableDecoders()[codec+e.decoder] {
+		return ""
+	}
+	return codec + e.decoder
+}
+
+// probedCodec is a probed video codec, valid while the movie is unchanged
+type probedCodec struct {
+	modTime time.Time
+	codec   string
+}
+
+// videoCodecFor returns the codec of a movie's first video stream, read
+// from input, see videoCodec. It is probed once per version of the movie,
+// so previews and their segments don't each run ffprobe.
+func (s *Server) videoCodecFor(ctx context.Context, moviePath, input string) string {
+	info, err := s.store.Stat(ctx, moviePath)
+	if err == nil {
+		if cached, ok := s.videoCodecs.Load(moviePath); ok && cached.(probedCodec).modTime.Equal(info.ModTime()) {
+			return cached.(probedCodec).codec
+		}
+	}
+	probeCtx, cancel := context.WithTimeout(ctx, toolProbeTimeout)
+	defer cancel()
+	codec := videoCodec(probeCtx, s.runner, input)
+	// A probe cut short says nothing about the movie
+	if err == nil && probeCtx.Err() == nil {
+		s.videoCodecs.Store(moviePath, probedCodec{modTime: info.ModTime(), codec: codec})
+	}
+	return codec
+}
+
+// videoCodec asks ffprobe for the codec of a movie's first video stream,
+// "" if it can't tell
+func videoCodec(ctx context.Context, runner commandRunner, input string) string {
+	out, err := runner.command(ctx, ffprobeExecutable(), "-v", "error", "-select_streams", "v:0",
+		"-show_entries", "stream=codec_name", "-of", "csv=p=0", input).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// runTranscode runs the ffmpeg command newCmd builds for the -video-encoder.
+// When a hardware encoder fails before any output was written, e.g. because
+// the device is busy or the codec profile unsupported, the transcode is run
+// once more with libx264. wrote reports whether output was written; nil
+// means output goes to a file that is simply rewritten.
+func (s *Server) runTranscode(ctx context.Context, newCmd func(videoEncoder) *exec.Cmd, wrote func() bool) error {
+	defer s.metrics.transcodeDuration.since("", time.Now())
+	err := newCmd(s.videoEncoder).Run()
+	if err == nil || s.videoEncoder.name == "software" || ctx.Err() != nil || (wrote != nil && wrote()) {
+		return err
+	}
+	log.Printf("Transcoding with %s failed (%v), retrying with libx264", s.videoEncoder.encoder, err)
+	return newCmd(videoEncoders["software"]).Run()
+}
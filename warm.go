@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxWarmPaths bounds the paths of one /api/thumbnails/warm request, about
+// a few screens of grid tiles
+const maxWarmPaths = 200
+
+// States of a path in a warm response
+const (
+	warmReady       = "ready"       // cached, a thumbnail request won't wait
+	warmQueued      = "queued"      // queued or already being generated
+	warmBusy        = "busy"        // the queue is full, request it as usual
+	warmLimited     = "limited"     // over -rate-limit, request it later
+	warmUnsupported = "unsupported" // missing, or not an image or movie
+	warmDenied      = "denied"      // outside the root or excluded
+)
+
+// handleWarmThumbnails queues the missing default thumbnails of the posted
+// paths, e.g. the tiles in the viewport, and answers at once with the state
+// of each. Thumbnails already pending, from a thumbnail request or a
+// prefetch, are joined rather than generated twice. Under -rate-limit each
+// thumbnail queued costs a token, as its own thumbnail request would.
+func (s *Server) handleWarmThumbnails(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var paths []string
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&paths); err != nil {
+		http.Error(w, "Invalid request body, expected an array of paths", http.StatusBadRequest)
+		return
+	}
+	if len(paths) > maxWarmPaths {
+		http.Error(w, "At most "+strconv.Itoa(maxWarmPaths)+" paths per request", http.StatusBadRequest)
+		return
+	}
+
+	states := make(map[string]string, len(paths))
+	for _, path := range paths {
+		states[path] = s.warmThumbnail(r, path)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	respondJSON(w, states, http.StatusOK)
+}
+
+// warmThumbnail queues the default thumbnail of path unless it is cached,
+// and returns its state
+func (s *Server) warmThumbnail(r *http.Request, path string) string {
+	fullPath, ok := s.resolvePath(path)
+	if !ok || s.isExcludedPath(s.urlPathFor(fullPath)) {
+		return warmDenied
+	}
+	if !isImageFile(fullPath) && !isMovieFile(fullPath) {
+		return warmUnsupported
+	}
+	info, err := s.store.Stat(r.Context(), fullPath)
+	if err != nil || !info.Mode().IsRegular() {
+		return warmUnsupported
+	}
+	// Tiny images are served as their own thumbnail
+	if s.isOwnThumbnail(fullPath, info.Size()) {
+		return warmReady
+	}
+	if _, cached := s.cachedThumbnail(r.Context(), fullPath, defaultThumbnailVariant()); cached {
+		return warmReady
+	}
+	if s.rateLimiter != nil {
+		if ok, _ := s.rateLimiter.allow(clientIP(r), time.Now()); !ok {
+			return warmLimited
+		}
+	}
+	if !s.enqueueThumbnail(fullPath, defaultThumbnailVariant()) {
+		return warmBusy
+	}
+	return warmQueued
+}
+
+// acceptThumbnail queues a thumbnail for a ?nowait=1 request and answers 202
+// Accepted, so the client retries later instead of holding a connection
+// while it is generated. With the queue full it answers 503 instead.
+func (s *Server) acceptThumbnail(w http.ResponseWriter, fullPath string, variant thumbnailVariant) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", strconv.Itoa(concurrencyRetryAfter))
+	if !s.enqueueThumbnail(fullPath, variant) {
+		http.Error(w, "Thumbnail queue is full", http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, "Thumbnail is being generated", http.StatusAccepted)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWarmChargesEachQueuedThumbnail(t *testing.T) {
+	s := newTestServer(t)
+	s.rateLimiter = newRateLimiter(0.001, 2)
+	for _, name := range []string{"a.jpg", "b.jpg", "c.jpg"} {
+		writeTestJPEG(t, s, name, 40, 20)
+	}
+	cached := writeTestJPEG(t, s, "cached.jpg", 40, 20)
+	if err := s.generateThumbnail(t.Context(), cached, defaultThumbnailVariant()); err != nil {
+		t.Fatal(err)
+	}
+	handler := s.newHandler(handlerOptions{})
+
+	body := `["cached.jpg", "a.jpg", "b.jpg", "c.jpg", "cached.jpg"]`
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/thumbnails/warm", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var states map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &states); err != nil {
+		t.Fatal(err)
+	}
+	// The burst of 2 covers two thumbnails; cached ones cost nothing
+	want := map[string]string{"cached.jpg": warmReady, "a.jpg": warmQueued, "b.jpg": warmQueued, "c.jpg": warmLimited}
+	for path, state := range want {
+		if states[path] != state {
+			t.Errorf("%s is %q, want %q", path, states[path], state)
+		}
+	}
+}
+
+func TestWarmIsRefusedWhenReadOnly(t *testing.T) {
+	s := newTestServer(t)
+	writeTestJPEG(t, s, "a.jpg", 40, 20)
+	handler := s.newHandler(handlerOptions{readOnly: true})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/thumbnails/warm", strings.NewReader(`["a.jpg"]`)))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("status %d, want 403", rec.Code)
+	}
+	if n := len(s.imageThumbnailQueue); n != 0 {
+		t.Errorf("%d thumbnails queued on a read-only server", n)
+	}
+}
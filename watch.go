@@ -0,0 +1,187 @@
+package main
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Modes of -watch
+const (
+	watchOff     = "off"
+	watchPoll    = "poll"
+	watchInotify = "inotify"
+)
+
+// watchPollInterval is how often -watch poll walks the tree for changes,
+// and -watch inotify once it had to fall back to polling
+const watchPollInterval = 30 * time.Second
+
+// dirGenerations counts the changes the watcher saw in each directory. They
+// are part of the listing ETags and cache keys, so a listing changes with
+// every add, edit or removal, even one that keeps the mtimes, like rsync -t.
+type dirGenerations struct {
+	dirs sync.Map      // map[string]*atomic.Uint64
+	all  atomic.Uint64 // bumped when events were lost, for every directory
+}
+
+// bump records a change in dir
+func (g *dirGenerations) bump(dir string) {
+	counter, _ := g.dirs.LoadOrStore(dir, new(atomic.Uint64))
+	counter.(*atomic.Uint64).Add(1)
+}
+
+// get returns the generation of dir, 0 while nothing changed or nothing is
+// watched
+func (g *dirGenerations) get(dir string) uint64 {
+	generation := g.all.Load()
+	if counter, ok := g.dirs.Load(dir); ok {
+		generation += counter.(*atomic.Uint64).Load()
+	}
+	return generation
+}
+
+// fileWatcher keeps the caches in step with the files under the root, see
+// -watch. Files written or moved in get their thumbnails regenerated, and
+// removed ones lose them. Hidden entries, .small included, and excluded
+// names are ignored, so the watcher never reacts to its own thumbnails.
+type fileWatcher struct {
+	s   *Server
+	sem chan struct{} // caps the thumbnails queued at once, like a rebuild
+}
+
+// watchFiles starts watching the root directory in mode. inotify falls back
+// to polling where it isn't available, e.g. when the watch limit is reached.
+func (s *Server) watchFiles(mode string) {
+	fw := &fileWatcher{s: s, sem: make(chan struct{}, rebuildConcurrency)}
+	if mode == watchInotify {
+		err := fw.inotify()
+		if err == nil {
+			log.Printf("Watching %s for changes", s.rootDir)
+			return
+		}
+		log.Printf("Watch: can't use inotify (%v), polling every %s instead", err, watchPollInterval)
+	} else {
+		log.Printf("Polling %s for changes every %s", s.rootDir, watchPollInterval)
+	}
+	go fw.poll()
+}
+
+// watched reports whether changes to the entry at path matter
+func (fw *fileWatcher) watched(path string) bool {
+	name := filepath.Base(path)
+	return !strings.HasPrefix(name, ".") && !fw.s.isExcluded(name) && path != cacheDir
+}
+
+// written handles a file that was written or moved into the tree. Its old
+// thumbnails and dimensions are dropped, and for media a new thumbnail is
+// queued.
+func (fw *fileWatcher) written(path string) {
+	s := fw.s
+	s.generations.bump(filepath.Dir(path))
+	if !isImageFile(path) && !isMovieFile(path) {
+		return
+	}
+	dropCaches(path)
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() || s.isOwnThumbnail(filepath.Base(path), info.Size()) {
+		return
+	}
+	go func() {
+		fw.sem <- struct{}{}
+		defer func() { <-fw.sem }()
+		if err := s.queueAndWaitForThumbnail(s.baseCtx, path, defaultThumbnailVariant()); err != nil && s.baseCtx.Err() == nil {
+			log.Printf("Watch: failed to generate thumbnail for %s [%s]: %v", path, thumbnailFailureCategory(err), err)
+		}
+	}()
+}
+
+// removed handles a file that was deleted or moved away
+func (fw *fileWatcher) removed(path string) {
+	fw.s.generations.bump(filepath.Dir(path))
+	if isImageFile(path) || isMovieFile(path) {
+		dropCaches(path)
+	}
+}
+
+// dropCaches deletes the thumbnails and dimensions cached for a file. Those
+// are validated by mtime, which a replacement may keep.
+func dropCaches(path string) {
+	removeThumbnails(filepath.Dir(path), []string{path}, false)
+	os.Remove(getDimensionsPath(path))
+}
+
+// watchedState is what polling compares between two walks
+type watchedState struct {
+	isDir   bool
+	size    int64
+	modTime time.Time
+}
+
+// poll walks the tree every watchPollInterval and handles what changed
+// since the walk before
+func (fw *fileWatcher) poll() {
+	known := fw.walk()
+	ticker := time.NewTicker(watchPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-fw.s.baseCtx.Done():
+			return
+		case <-ticker.C:
+		}
+		current := fw.walk()
+		for path, state := range current {
+			if old, ok := known[path]; ok && old == state {
+				continue
+			}
+			if state.isDir {
+				fw.s.generations.bump(filepath.Dir(path))
+			} else {
+				fw.written(path)
+			}
+		}
+		for path, old := range known {
+			if _, ok := current[path]; ok {
+				continue
+			}
+			if old.isDir {
+				fw.s.generations.bump(filepath.Dir(path))
+			} else {
+				fw.removed(path)
+			}
+		}
+		known = current
+	}
+}
+
+// walk records the watched entries of the tree. Directories are recorded
+// without their mtime, which changes with every file added to them.
+func (fw *fileWatcher) walk() map[string]watchedState {
+	states := make(map[string]watchedState)
+	filepath.WalkDir(fw.s.rootDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || path == fw.s.rootDir {
+			return nil
+		}
+		if !fw.watched(path) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			states[path] = watchedState{isDir: true}
+			return nil
+		}
+		if info, err := entry.Info(); err == nil {
+			states[path] = watchedState{size: info.Size(), modTime: info.ModTime()}
+		}
+		return nil
+	})
+	return states
+}
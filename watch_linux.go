@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// inotifyMask are the events watched in every directory. Files count as
+// written once closed, so half-copied files aren't thumbnailed.
+const inotifyMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ONLYDIR
+
+// inotify watches every directory of the tree with inotify. Directories
+// created later are added as they appear. Without enough watches, see
+// fs.inotify.max_user_watches, it fails; when they run out later the
+// watcher switches to polling.
+func (fw *fileWatcher) inotify() error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	dirs := make(map[int32]string)
+	if err := fw.addWatches(fd, fw.s.rootDir, dirs, false); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+	go fw.readInotify(fd, dirs)
+	return nil
+}
+
+// addWatches watches dir and the directories below it. With added, the
+// files found are handled as written, for directories that appeared with
+// their files already in them.
+func (fw *fileWatcher) addWatches(fd int, dir string, dirs map[int32]string, added bool) error {
+	wd, err := syscall.InotifyAddWatch(fd, dir, inotifyMask)
+	if errors.Is(err, syscall.ENOSPC) {
+		return fmt.Errorf("out of inotify watches, see fs.inotify.max_user_watches: %w", err)
+	} else if err != nil {
+		// Gone already, or not readable
+		return nil
+	}
+	dirs[int32(wd)] = dir
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if !fw.watched(path) {
+			continue
+		}
+		if entry.IsDir() {
+			if err := fw.addWatches(fd, path, dirs, added); err != nil {
+				return err
+			}
+		} else if added {
+			fw.written(path)
+		}
+	}
+	return nil
+}
+
+// removeWatches stops watching dir and the directories below it, once it
+// was moved away. A move within the tree watches it again at its new path.
+func removeWatches(fd int, dir string, dirs map[int32]string) {
+	for wd, path := range dirs {
+		if path == dir || strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			syscall.InotifyRmWatch(fd, uint32(wd))
+			delete(dirs, wd)
+		}
+	}
+}
+
+// readInotify handles the events of fd until it fails
+func (fw *fileWatcher) readInotify(fd int, dirs map[int32]string) {
+	defer syscall.Close(fd)
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := syscall.Read(fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || n <= 0 {
+			log.Printf("Watch: reading inotify events failed (%v), polling every %s instead", err, watchPollInterval)
+			go fw.poll()
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[nameStart:nameStart+int(event.Len)]), "\x00")
+			offset = nameStart + int(event.Len)
+
+			if err := fw.handleInotify(fd, dirs, event.Wd, event.Mask, name); err != nil {
+				log.Printf("Watch: %v, polling every %s instead", err, watchPollInterval)
+				go fw.poll()
+				return
+			}
+		}
+	}
+}
+
+// handleInotify handles one event on the directory watched as wd
+func (fw *fileWatcher) handleInotify(fd int, dirs map[int32]string, wd int32, mask uint32, name string) error {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		// Events were lost, so every listing may have changed
+		fw.s.generations.all.Add(1)
+		log.Printf("Watch: inotify queue overflowed, some changes were missed")
+		return nil
+	}
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(dirs, wd)
+		return nil
+	}
+	dir, ok := dirs[wd]
+	if !ok || name == "" {
+		return nil
+	}
+	path := filepath.Join(dir, name)
+	if !fw.watched(path) {
+		return nil
+	}
+
+	if mask&syscall.IN_ISDIR != 0 {
+		fw.s.generations.bump(dir)
+		switch {
+		case mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+			return fw.addWatches(fd, path, dirs, true)
+		case mask&syscall.IN_MOVED_FROM != 0:
+			removeWatches(fd, path, dirs)
+		}
+		return nil
+	}
+	switch {
+	case mask&(syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO) != 0:
+		fw.written(path)
+	case mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+		fw.removed(path)
+	case mask&syscall.IN_CREATE != 0:
+		// Links are complete when created, files once closed
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			fw.written(path)
+		} else {
+			fw.s.generations.bump(dir)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// inotify is Linux only, elsewhere -watch inotify polls
+func (fw *fileWatcher) inotify() error {
+	return errors.New("inotify is only available on Linux")
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// watermarkMargin is the distance in pixels between the watermark and the
+// image edge for corner positions
+const watermarkMargin = 8
+
+// watermark is an overlay composited onto thumbnails and previews
+type watermark struct {
+	source   string // watermark image as configured
+	opacity  float64
+	path     string // prepared PNG with the opacity already applied
+	width    int    // dimensions of the prepared PNG
+	height   int
+	position string  // top-left, top-right, bottom-left, bottom-right or center
+	scale    float64 // watermark width as a fraction of the image width
+	dir      string  // scratch directory for the prepared and scaled overlays
+	runner   commandRunner
+
+	mu     sync.Mutex
+	scaled map[int]string // target width -> scaled overlay path
+}
+
+// vipsCLIExecutable returns the path to the vips command line tool
+// On Windows, it looks for vips.exe, otherwise just "vips"
+func vipsCLIExecutable() string {
+	return vipsTool("vips")
+}
+
+// loadWatermark decodes the watermark image, bakes the opacity into its alpha
+// channel and stores the result as a PNG in a scratch directory
+func loadWatermark(path string, opacity float64, position string, scale float64) (*watermark, error) {
+	switch position {
+	case "top-left", "top-right", "bottom-left", "bottom-right", "center":
+	default:
+		return nil, fmt.Errorf("invalid watermark position %q", position)
+	}
+	if opacity <= 0 || opacity > 1 {
+		return nil, fmt.Errorf("watermark opacity must be in (0, 1]")
+	}
+	if scale <= 0 || scale > 1 {
+		return nil, fmt.Errorf("watermark scale must be in (0, 1]")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	src, _, err := image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode watermark: %w", err)
+	}
+
+	// Draw through a uniform alpha mask to scale every pixel's alpha
+	bounds := src.Bounds()
+	img := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	mask := image.NewUniform(color.Alpha{A: uint8(opacity * 255)})
+	draw.DrawMask(img, img.Bounds(), src, bounds.Min, mask, image.Point{}, draw.Src)
+
+	dir, err := os.MkdirTemp("", "gallery-watermark-")
+	if err != nil {
+		return nil, err
+	}
+	preparedPath := filepath.Join(dir, "watermark.png")
+	if err := writePNG(preparedPath, img); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	return &watermark{
+		source:   path,
+		opacity:  opacity,
+		path:     preparedPath,
+		width:    bounds.Dx(),
+		height:   bounds.Dy(),
+		position: position,
+		scale:    scale,
+		dir:      dir,
+		scaled:   make(map[int]string),
+	}, nil
+}
+
+// writePNG encodes img to a new file at path
+func writePNG(path string, img image.Image) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(out, img); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// close removes the scratch directory with the prepared overlays
+func (wm *watermark) close() {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	os.RemoveAll(wm.dir)
+}
+
+// overlayFor returns the overlay scaled for an image of the given width,
+// along with the overlay's dimensions. Scaled overlays are cached.
+func (wm *watermark) overlayFor(ctx context.Context, imageWidth int) (string, int, int, error) {
+	width := max(1, int(float64(imageWidth)*wm.scale))
+	height := max(1, wm.height*width/wm.width)
+
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+
+	if path, ok := wm.scaled[width]; ok {
+		return path, width, height, nil
+	}
+
+	path := filepath.Join(wm.dir, "watermark-"+strconv.Itoa(width)+".png")
+	cmd := wm.runner.command(ctx, vipsExecutable(), wm.path, "-s", strconv.Itoa(width)+"x", "-o", path)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", 0, 0, fmt.Errorf("failed to scale watermark: %w", err)
+	}
+	wm.scaled[width] = path
+	return path, width, height, nil
+}
+
+// offset returns where to place an overlay on the base image
+func (wm *watermark) offset(baseW, baseH, overlayW, overlayH int) (int, int) {
+	switch wm.position {
+	case "top-left":
+		return watermarkMargin, watermarkMargin
+	case "top-right":
+		return baseW - overlayW - watermarkMargin, watermarkMargin
+	case "bottom-left":
+		return watermarkMargin, baseH - overlayH - watermarkMargin
+	case "center":
+		return (baseW - overlayW) / 2, (baseH - overlayH) / 2
+	}
+	return baseW - overlayW - watermarkMargin, baseH - overlayH - watermarkMargin
+}
+
+// composite overlays the watermark on basePath and writes the result to
+// output, which may be a suffix such as ".jpg" to write to out instead
+func (wm *watermark) composite(ctx context.Context, basePath, output string, out io.Writer) error {
+	baseW, baseH, err := readImageDimensions(ctx, wm.runner, basePath)
+	if err != nil {
+		return err
+	}
+	overlay, overlayW, overlayH, err := wm.overlayFor(ctx, baseW)
+	if err != nil {
+		return err
+	}
+	x, y := wm.offset(baseW, baseH, overlayW, overlayH)
+
+	cmd := wm.runner.command(ctx, vipsCLIExecutable(), "composite2", basePath, overlay, output, "over",
+		"--x", strconv.Itoa(x), "--y", strconv.Itoa(y))
+	cmd.Stdout = out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to apply watermark: %w", err)
+	}
+	return nil
+}
+
+// apply watermarks a generated thumbnail in place. The result is written
+// next to it and renamed over it, so a failure leaves no partial file.
+func (wm *watermark) apply(ctx context.Context, thumbnailPath string) error {
+	tmpPath := thumbnailPath + ".tmp.jpg"
+	if err := wm.composite(ctx, thumbnailPath, tmpPath, nil); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, thumbnailPath)
+}
+
+// preview renders a watermarked preview of src to out, where input is the
+// vipsthumbnail argument for stdin and profileArgs convert its colors.
+// vipsthumbnail can't composite, so the resized image goes through a
+// temporary file first, where it is also turned by rot before the
+// watermark goes on.
+func (wm *watermark) preview(ctx context.Context, src io.Reader, input string, size int, profileArgs []string, rot previewRotation, suffix string, out io.Writer) error {
+	dir, err := os.MkdirTemp("", "gallery-preview-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	// The uncompressed vips format is the cheapest intermediate
+	basePath := filepath.Join(dir, "base.v")
+	args := append([]string{input, vipsAutoRotate, "-s", strconv.Itoa(size), "-o", basePath}, profileArgs...)
+	cmd := wm.runner.command(ctx, vipsExecutable(), args...)
+	cmd.Stdin = src
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to resize image: %w", err)
+	}
+	if rot.degrees != 0 {
+		rotatedPath := filepath.Join(dir, "rotated.v")
+		if err := rotateVipsImage(ctx, wm.runner, basePath, rotatedPath, rot, nil); err != nil {
+			return err
+		}
+		basePath = rotatedPath
+	}
+
+	return wm.composite(ctx, basePath, suffix, out)
+}
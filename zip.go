@@ -0,0 +1,256 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// defaultZipMaxBytes caps the originals in one archive unless
+	// -zip-max-bytes says otherwise
+	defaultZipMaxBytes = 4 << 30
+	// maxZipFiles caps the files in one archive
+	maxZipFiles = 10000
+)
+
+// errZipTooLarge is returned when an archive would exceed its caps
+var errZipTooLarge = errors.New("too large")
+
+// zipRequest is the JSON body of POST /api/zip: either the files and
+// directories to archive, or one directory. Directories are archived with
+// their subdirectories unless Recursive is false.
+type zipRequest struct {
+	Paths     []string `json:"paths"`
+	Dir       string   `json:"dir"`
+	Recursive *bool    `json:"recursive"`
+}
+
+// zipEntry is one original to be archived under name
+type zipEntry struct {
+	fullPath string
+	name     string
+	info     fs.FileInfo
+}
+
+// zipContents are the entries of an archive being collected. A file asked
+// for twice, e.g. on its own and with its directory, is archived once.
+type zipContents struct {
+	entries []zipEntry
+	total   int64
+	names   map[string]bool
+}
+
+// zipURL returns the URL of a directory's archive, for DirectoryResponse
+func (s *Server) zipURL(dir, basePath string) string {
+	return s.rebaseURL(s.urlWithBasePath("/api/zip?dir="+url.QueryEscape(dir)), basePath)
+}
+
+// handleZip streams a ZIP archive of originals, straight to the response
+// without a temporary file. GET /api/zip?dir= (or ?path=) archives a
+// directory with its subdirectories, or with ?recursive=false only the files
+// directly in it; POST takes a zipRequest, e.g. for a selection. Hidden and
+// excluded files are left out, as in listings, and nothing in a directory
+// hidden by .gallery.json is archived, not even when asked for by path. Archives over -zip-max-bytes
+// or maxZipFiles are refused with 413 before anything is written.
+func (s *Server) handleZip(w http.ResponseWriter, r *http.Request) {
+	var req zipRequest
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		req.Dir = r.URL.Query().Get("dir")
+		if req.Dir == "" {
+			req.Dir = r.URL.Query().Get("path")
+		}
+		if req.Dir == "" {
+			http.Error(w, "dir query parameter required", http.StatusBadRequest)
+			return
+		}
+		if recursive, err := strconv.ParseBool(r.URL.Query().Get("recursive")); err == nil {
+			req.Recursive = &recursive
+		}
+	case http.MethodPost:
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if (req.Dir == "") == (len(req.Paths) == 0) {
+			http.Error(w, "Either dir or paths required", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	recursive := req.Recursive == nil || *req.Recursive
+	contents := &zipContents{names: make(map[string]bool)}
+	filename := "selection.zip"
+	if req.Dir != "" {
+		fullDir, ok := s.resolvePath(req.Dir)
+		if !ok {
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+		if info, err := s.store.Stat(ctx, fullDir); err != nil || !info.IsDir() || s.isExcludedPath(s.urlPathFor(fullDir)) || s.hiddenByDirConfig(fullDir) {
+			http.Error(w, "Directory not found", http.StatusNotFound)
+			return
+		}
+		filename = "gallery.zip"
+		if fullDir != s.rootDir {
+			filename = filepath.Base(fullDir) + ".zip"
+		}
+		if err := s.collectZipDir(ctx, fullDir, "", recursive, contents); err != nil {
+			s.zipCollectFailed(w, err)
+			return
+		}
+	}
+	for _, p := range req.Paths {
+		fullPath, ok := s.resolvePath(p)
+		if !ok {
+			http.Error(w, "Access denied: "+p, http.StatusForbidden)
+			return
+		}
+		urlPath := s.urlPathFor(fullPath)
+		info, err := s.store.Stat(ctx, fullPath)
+		if err != nil || urlPath == "/" || s.isExcludedPath(urlPath) || s.hiddenByDirConfig(fullPath) {
+			http.Error(w, "File not found: "+p, http.StatusNotFound)
+			return
+		}
+		// Named by their path below the root, so files from different
+		// directories can't clash
+		name := strings.TrimPrefix(urlPath, "/")
+		if info.IsDir() {
+			err = s.collectZipDir(ctx, fullPath, name+"/", recursive, contents)
+		} else {
+			err = s.addZipEntry(zipEntry{fullPath: fullPath, name: name, info: info}, contents)
+		}
+		if err != nil {
+			s.zipCollectFailed(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	// Photos and movies are compressed already, so they are stored as they
+	// are. A failure past this point can only cut the archive short.
+	zw := zip.NewWriter(w)
+	for _, entry := range contents.entries {
+		if err := s.writeZipEntry(ctx, zw, entry); err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Failed to archive %s: %v", entry.fullPath, err)
+			}
+			return
+		}
+	}
+	if err := zw.Close(); err != nil && ctx.Err() == nil {
+		log.Printf("Failed to finish archive: %v", err)
+	}
+}
+
+// collectZipDir adds the files under fullDir to entries, named with prefix
+// and their path below fullDir, and with recursive those of its
+// subdirectories. Hidden entries, excluded names and directories hidden by
+// .gallery.json are skipped, as in listings.
+func (s *Server) collectZipDir(ctx context.Context, fullDir, prefix string, recursive bool, contents *zipContents) error {
+	dirEntries, err := s.store.ReadDir(ctx, fullDir)
+	if err != nil {
+		return err
+	}
+	for _, dirEntry := range dirEntries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name := dirEntry.Name()
+		if strings.HasPrefix(name, ".") || s.isExcluded(name) {
+			continue
+		}
+		fullPath := filepath.Join(fullDir, name)
+		if dirEntry.IsDir() {
+			if !recursive || s.ownDirConfig(fullPath).Hidden {
+				continue
+			}
+			if err := s.collectZipDir(ctx, fullPath, prefix+name+"/", recursive, contents); err != nil {
+				return err
+			}
+			continue
+		}
+		// Symlinks are followed to files, never to directories, so an
+		// archive can't loop
+		info, err := s.store.Stat(ctx, fullPath)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if err := s.addZipEntry(zipEntry{fullPath: fullPath, name: prefix + name, info: info}, contents); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addZipEntry appends an entry unless one of the same name was added,
+// failing once the archive exceeds its caps
+func (s *Server) addZipEntry(entry zipEntry, contents *zipContents) error {
+	entry.name = path.Clean(entry.name)
+	if contents.names[entry.name] {
+		return nil
+	}
+	contents.names[entry.name] = true
+	contents.total += entry.info.Size()
+	contents.entries = append(contents.entries, entry)
+	if len(contents.entries) > maxZipFiles {
+		return fmt.Errorf("%w: more than %d files", errZipTooLarge, maxZipFiles)
+	}
+	if limit := s.settings().zipMaxBytes; limit > 0 && contents.total > limit {
+		return fmt.Errorf("%w: more than %d bytes", errZipTooLarge, limit)
+	}
+	return nil
+}
+
+// zipCollectFailed responds to an archive that can't be built
+func (s *Server) zipCollectFailed(w http.ResponseWriter, err error) {
+	if errors.Is(err, errZipTooLarge) {
+		http.Error(w, "Archive "+err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, "Failed to read directory", http.StatusInternalServerError)
+}
+
+// writeZipEntry copies one original into the archive
+func (s *Server) writeZipEntry(ctx context.Context, zw *zip.Writer, entry zipEntry) error {
+	header, err := zip.FileInfoHeader(entry.info)
+	if err != nil {
+		return err
+	}
+	header.Name = entry.name
+	header.Method = zip.Store
+	dst, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	src, err := s.store.Open(ctx, entry.fullPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	_, err = io.Copy(dst, src)
+	return err
+}
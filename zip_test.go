@@ -0,0 +1,85 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestZipRefusesHiddenPaths(t *testing.T) {
+	s := newTestServer(t)
+	writeTestJPEG(t, s, "trip/a.jpg", 40, 20)
+	writeTestJPEG(t, s, ".trash/trip/b.jpg", 40, 20)
+	writeTestFile(t, s, "trip/.small/a.jpg.jpg", []byte("thumbnail"))
+
+	for _, body := range []string{
+		`{"paths": ["/.trash/trip/b.jpg"]}`,
+		`{"paths": ["/trip/a.jpg", "/.trash"]}`,
+		`{"paths": ["/trip/.small/a.jpg.jpg"]}`,
+		`{"dir": "/.trash"}`,
+	} {
+		rec := httptest.NewRecorder()
+		s.newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/zip", strings.NewReader(body)))
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s: status %d, want 403", body, rec.Code)
+		}
+	}
+}
+
+func TestZipArchivesEachFileOnce(t *testing.T) {
+	s := newTestServer(t)
+	writeTestJPEG(t, s, "trip/a.jpg", 40, 20)
+	writeTestJPEG(t, s, "trip/day2/b.jpg", 40, 20)
+
+	body := `{"paths": ["/trip/a.jpg", "/trip", "/trip/day2/b.jpg", "/trip/a.jpg"]}`
+	rec := httptest.NewRecorder()
+	s.newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/zip", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range archive.File {
+		names = append(names, file.Name)
+	}
+	if want := []string{"trip/a.jpg", "trip/day2/b.jpg"}; !slices.Equal(names, want) {
+		t.Errorf("archived %v, want %v", names, want)
+	}
+}
+
+func TestZipLeavesOutHiddenDirectories(t *testing.T) {
+	s := newTestServer(t)
+	writeTestJPEG(t, s, "trip/a.jpg", 40, 20)
+	writeTestJPEG(t, s, "trip/private/b.jpg", 40, 20)
+	writeTestJPEG(t, s, "trip/private/day2/c.jpg", 40, 20)
+	writeTestFile(t, s, "trip/private/"+dirConfigName, []byte(`{"hidden": true}`))
+
+	for _, body := range []string{
+		`{"dir": "/trip/private"}`,
+		`{"dir": "/trip/private/day2"}`,
+		`{"paths": ["/trip/private/b.jpg"]}`,
+		`{"paths": ["/trip/a.jpg", "/trip/private/day2/c.jpg"]}`,
+	} {
+		rec := httptest.NewRecorder()
+		s.newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/zip", strings.NewReader(body)))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s: status %d, want 404", body, rec.Code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	s.newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/zip?dir=/trip", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if strings.Contains(rec.Body.String(), "private/") {
+		t.Error("the archive of /trip holds its hidden directory")
+	}
+}